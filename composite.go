@@ -0,0 +1,385 @@
+package satch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const ReportKeySinks = "satch.sinks"
+
+// InputProvider provides inputs to a Composite, e.g. any DataSource
+type InputProvider interface {
+	Inputs(context.Context) (interface{}, error)
+}
+
+// Sink commits outputs of a Composite, e.g. any DataSource
+type Sink interface {
+	Commit(ctx context.Context, data interface{}) error
+}
+
+// LockProvider locks a Composite, e.g. any DataSource.
+// If it is also an Unlocker, it is unlocked when Start returns.
+type LockProvider interface {
+	LockWrite(context.Context) error
+	LockRead(context.Context) error
+}
+
+// Preparer is implemented by sinks that can check data before anything is committed.
+// In FanOutStopOnError, all sinks are prepared before any sink commits.
+type Preparer interface {
+	Prepare(ctx context.Context, data interface{}) error
+}
+
+// Compensator is implemented by sinks that can undo a commit.
+// In FanOutStopOnError, committed sinks are compensated if a later sink fails.
+type Compensator interface {
+	Compensate(ctx context.Context, data interface{}) error
+}
+
+// FanOut decides how a Composite commits to several sinks
+type FanOut int
+
+const (
+	// FanOutStopOnError commits sinks in order, and stops at the first failure.
+	// Sinks already committed are compensated in reverse order if they are Compensators.
+	//
+	// Other sinks are NOT rolled back, and stay committed. Check SinkResult.Compensated
+	// of the failed commit to find sinks that need fixing by hand.
+	//
+	// The smem, sfile and ssql data sources are Preparers and Compensators.
+	// An ssql sink only compensates with statements from its config, so put it last:
+	// it commits atomically, and nothing after it can fail.
+	FanOutStopOnError FanOut = iota
+
+	// FanOutBestEffort commits to every sink regardless of failures.
+	// Commit only fails if a Required sink fails, or if all sinks fail.
+	FanOutBestEffort
+)
+
+// NamedSink is a sink of a Composite
+type NamedSink struct {
+	Name string
+	Sink Sink
+
+	// Map converts job outputs into data for this sink, e.g. rows for a SQL sink.
+	// If nil, the outputs are committed as-is.
+	Map func(outputs interface{}) (interface{}, error)
+
+	// Required sinks fail the commit in FanOutBestEffort
+	Required bool
+}
+
+// SinkResult is the outcome of a commit to one sink
+type SinkResult struct {
+	Name        string
+	Committed   bool
+	Compensated bool
+	Skipped     bool // Not attempted because an earlier sink failed
+	Err         error
+	Duration    time.Duration
+}
+
+// SinkReport is the outcome of a Composite commit,
+// recorded in the satch report as ReportKeySinks
+type SinkReport struct {
+	Mode    FanOut
+	Results []SinkResult
+}
+
+func (r *SinkReport) Failed() []SinkResult {
+	failed := []SinkResult{}
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+
+	return failed
+}
+
+// SinkError is returned by Composite.Commit when the commit fails
+type SinkError struct {
+	Report *SinkReport
+}
+
+func (e *SinkError) Error() string {
+	msgs := []string{}
+	for _, result := range e.Report.Failed() {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", result.Name, result.Err.Error()))
+	}
+
+	return fmt.Sprintf("%d sink(s) failed: %s", len(msgs), strings.Join(msgs, "; "))
+}
+
+type CompositeConfig struct {
+	Inputs InputProvider
+	Sinks  []NamedSink
+	Locks  LockProvider // Locking is a no-op if nil
+	FanOut FanOut
+}
+
+// Composite is a DataSource made of a separate input provider,
+// commit sinks and lock provider, e.g. reading from MongoDB and committing to files.
+type Composite struct {
+	conf CompositeConfig
+
+	mut  sync.Mutex
+	last *SinkReport
+}
+
+var (
+	_ DataSource = &Composite{}
+	_ Unlocker   = &Composite{}
+)
+
+func NewComposite(conf CompositeConfig) (*Composite, error) {
+	if conf.Inputs == nil {
+		return nil, errors.New("composite requires an input provider")
+	}
+
+	if len(conf.Sinks) == 0 {
+		return nil, errors.New("composite requires at least one sink")
+	}
+
+	names := make(map[string]bool)
+	for i := range conf.Sinks {
+		s := &conf.Sinks[i]
+		switch {
+		case s.Sink == nil:
+			return nil, fmt.Errorf("sink %d is nil", i)
+
+		case s.Name == "":
+			s.Name = fmt.Sprintf("sink-%d", i)
+		}
+
+		if names[s.Name] {
+			return nil, fmt.Errorf("duplicate sink name '%s'", s.Name)
+		}
+
+		names[s.Name] = true
+	}
+
+	return &Composite{conf: conf}, nil
+}
+
+// LastReport returns the report of the last commit, or nil if there was none
+func (c *Composite) LastReport() *SinkReport {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	return c.last
+}
+
+func (c *Composite) LockWrite(ctx context.Context) error {
+	if c.conf.Locks == nil {
+		return nil
+	}
+
+	return c.conf.Locks.LockWrite(ctx)
+}
+
+func (c *Composite) LockRead(ctx context.Context) error {
+	if c.conf.Locks == nil {
+		return nil
+	}
+
+	return c.conf.Locks.LockRead(ctx)
+}
+
+func (c *Composite) Unlock(ctx context.Context) error {
+	unlocker, ok := c.conf.Locks.(Unlocker)
+	if !ok {
+		return nil
+	}
+
+	return unlocker.Unlock(ctx)
+}
+
+func (c *Composite) Inputs(ctx context.Context) (interface{}, error) {
+	return c.conf.Inputs.Inputs(ctx)
+}
+
+func (c *Composite) Commit(ctx context.Context, outputs interface{}) error {
+	report := &SinkReport{Mode: c.conf.FanOut, Results: make([]SinkResult, len(c.conf.Sinks))}
+	for i := range c.conf.Sinks {
+		report.Results[i].Name = c.conf.Sinks[i].Name
+	}
+
+	var err error
+	switch c.conf.FanOut {
+	case FanOutStopOnError:
+		err = c.commitStopOnError(ctx, outputs, report)
+
+	case FanOutBestEffort:
+		err = c.commitBestEffort(ctx, outputs, report)
+
+	default:
+		err = fmt.Errorf("unexpected fan-out mode %d", c.conf.FanOut)
+	}
+
+	c.mut.Lock()
+	c.last = report
+	c.mut.Unlock()
+
+	Record(ctx, ReportKeySinks, report)
+
+	return err
+}
+
+func (c *Composite) commitStopOnError(ctx context.Context, outputs interface{}, report *SinkReport) error {
+	data := make([]interface{}, len(c.conf.Sinks))
+	for i := range c.conf.Sinks {
+		s := &c.conf.Sinks[i]
+		result := &report.Results[i]
+
+		var err error
+		data[i], err = s.data(outputs)
+		if err == nil {
+			err = s.prepare(ctx, data[i])
+		}
+
+		if err != nil {
+			// Nothing is committed
+			skip(report, 0)
+			result.Skipped = false
+			result.Err = err
+
+			return &SinkError{Report: report}
+		}
+	}
+
+	for i := range c.conf.Sinks {
+		err := c.conf.Sinks[i].commit(ctx, data[i], &report.Results[i])
+		if err == nil {
+			continue
+		}
+
+		skip(report, i+1)
+
+		for j := i - 1; j >= 0; j-- {
+			c.conf.Sinks[j].compensate(ctx, data[j], &report.Results[j])
+		}
+
+		return &SinkError{Report: report}
+	}
+
+	return nil
+}
+
+func (c *Composite) commitBestEffort(ctx context.Context, outputs interface{}, report *SinkReport) error {
+	failed := 0
+	failedRequired := false
+
+	for i := range c.conf.Sinks {
+		s := &c.conf.Sinks[i]
+		result := &report.Results[i]
+
+		data, err := s.data(outputs)
+		if err != nil {
+			result.Err = err
+		} else {
+			err = s.commit(ctx, data, result)
+		}
+
+		if err != nil {
+			logrus.Errorf("sink %s failed: %s", s.Name, err.Error())
+
+			failed++
+			failedRequired = failedRequired || s.Required
+		}
+	}
+
+	if failedRequired || failed == len(c.conf.Sinks) {
+		return &SinkError{Report: report}
+	}
+
+	return nil
+}
+
+func (s *NamedSink) data(outputs interface{}) (interface{}, error) {
+	if s.Map == nil {
+		return outputs, nil
+	}
+
+	data, err := s.Map(outputs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to map outputs")
+	}
+
+	return data, nil
+}
+
+func (s *NamedSink) prepare(ctx context.Context, data interface{}) error {
+	preparer, ok := s.Sink.(Preparer)
+	if !ok {
+		return nil
+	}
+
+	err := preparer.Prepare(ctx, data)
+	if err != nil {
+		return errors.Wrap(err, "failed to prepare")
+	}
+
+	return nil
+}
+
+func (s *NamedSink) commit(ctx context.Context, data interface{}, result *SinkResult) error {
+	start := time.Now()
+	err := s.Sink.Commit(ctx, data)
+	result.Duration = time.Since(start)
+
+	if err != nil {
+		result.Err = err
+		return err
+	}
+
+	result.Committed = true
+	return nil
+}
+
+func (s *NamedSink) compensate(ctx context.Context, data interface{}, result *SinkResult) {
+	compensator, ok := s.Sink.(Compensator)
+	if !ok {
+		logrus.Errorf("sink %s was committed, but cannot be compensated", s.Name)
+		return
+	}
+
+	err := compensator.Compensate(ctx, data)
+	if err != nil {
+		logrus.Errorf("failed to compensate sink %s: %s", s.Name, err.Error())
+		result.Err = errors.Wrap(err, "failed to compensate")
+
+		return
+	}
+
+	result.Compensated = true
+}
+
+func skip(report *SinkReport, from int) {
+	for i := from; i < len(report.Results); i++ {
+		report.Results[i].Skipped = true
+	}
+}
+
+// LocksFrom adapts a Locker into a LockProvider for CompositeConfig.Locks
+func LocksFrom(l Locker) LockProvider {
+	return modeLocks{l}
+}
+
+type modeLocks struct {
+	Locker
+}
+
+func (l modeLocks) LockWrite(ctx context.Context) error {
+	return l.Lock(ctx, "write")
+}
+
+func (l modeLocks) LockRead(ctx context.Context) error {
+	return l.Lock(ctx, "read")
+}
@@ -0,0 +1,261 @@
+package satch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testSink records committed data, and fails with err if set
+type testSink struct {
+	err       error
+	committed []interface{}
+}
+
+func (s *testSink) Commit(_ context.Context, data interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.committed = append(s.committed, data)
+	return nil
+}
+
+// undoSink is a testSink that can be prepared and compensated
+type undoSink struct {
+	testSink
+	prepareErr  error
+	compensated []interface{}
+}
+
+func (s *undoSink) Prepare(_ context.Context, _ interface{}) error {
+	return s.prepareErr
+}
+
+func (s *undoSink) Compensate(_ context.Context, data interface{}) error {
+	s.compensated = append(s.compensated, data)
+	return nil
+}
+
+type testInputs struct{}
+
+func (testInputs) Inputs(context.Context) (interface{}, error) {
+	return "inputs", nil
+}
+
+func sinkResults(report *SinkReport) string {
+	results := ""
+	for _, r := range report.Results {
+		results += fmt.Sprintf("%s:committed=%v,compensated=%v,skipped=%v,failed=%v ", r.Name, r.Committed, r.Compensated, r.Skipped, r.Err != nil)
+	}
+
+	return results
+}
+
+func TestCompositeStopOnError(t *testing.T) {
+	ctx := context.Background()
+	undo := &undoSink{}
+	plain := &testSink{}
+	failing := &testSink{err: errors.New("unavailable")}
+	last := &testSink{}
+
+	c, err := NewComposite(CompositeConfig{
+		Inputs: testInputs{},
+		Sinks: []NamedSink{
+			{Name: "undo", Sink: undo, Map: func(outputs interface{}) (interface{}, error) { return outputs.(string) + "-mapped", nil }},
+			{Name: "plain", Sink: plain},
+			{Name: "failing", Sink: failing},
+			{Name: "last", Sink: last},
+		},
+		FanOut: FanOutStopOnError,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Commit(ctx, "outputs")
+
+	var sinkErr *SinkError
+	if !errors.As(err, &sinkErr) {
+		t.Fatalf("expecting SinkError, got %v", err)
+	}
+
+	// Sinks that are not Compensators stay committed
+	expect := "undo:committed=true,compensated=true,skipped=false,failed=false " +
+		"plain:committed=true,compensated=false,skipped=false,failed=false " +
+		"failing:committed=false,compensated=false,skipped=false,failed=true " +
+		"last:committed=false,compensated=false,skipped=true,failed=false "
+
+	if actual := sinkResults(sinkErr.Report); actual != expect {
+		t.Fatalf("unexpected results\nexpect %s\nactual %s", expect, actual)
+	}
+
+	if !reflect.DeepEqual(undo.compensated, []interface{}{"outputs-mapped"}) || len(plain.committed) != 1 || len(last.committed) != 0 {
+		t.Fatalf("unexpected sink states: %v, %v, %v", undo.compensated, plain.committed, last.committed)
+	}
+
+	if c.LastReport() != sinkErr.Report {
+		t.Fatal("expecting last report to be the failed commit")
+	}
+}
+
+func TestCompositeStopOnErrorPrepare(t *testing.T) {
+	ctx := context.Background()
+	plain := &testSink{}
+	unprepared := &undoSink{prepareErr: errors.New("bad data")}
+
+	c, err := NewComposite(CompositeConfig{
+		Inputs: testInputs{},
+		Sinks:  []NamedSink{{Name: "plain", Sink: plain}, {Name: "unprepared", Sink: unprepared}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Commit(ctx, "outputs")
+	if err == nil {
+		t.Fatal("expecting prepare failure")
+	}
+
+	// Nothing is committed if any sink fails to prepare
+	expect := "plain:committed=false,compensated=false,skipped=true,failed=false " +
+		"unprepared:committed=false,compensated=false,skipped=false,failed=true "
+
+	if actual := sinkResults(c.LastReport()); actual != expect || len(plain.committed) != 0 {
+		t.Fatalf("unexpected results\nexpect %s\nactual %s", expect, actual)
+	}
+}
+
+func TestCompositeBestEffort(t *testing.T) {
+	ctx := context.Background()
+	unavailable := errors.New("unavailable")
+
+	tests := []struct {
+		name     string
+		sinks    []NamedSink
+		expectOK bool
+	}{
+		{
+			name:     "optional sink fails",
+			sinks:    []NamedSink{{Sink: &testSink{err: unavailable}}, {Sink: &testSink{}}},
+			expectOK: true,
+		},
+		{
+			name:  "required sink fails",
+			sinks: []NamedSink{{Sink: &testSink{err: unavailable}, Required: true}, {Sink: &testSink{}}},
+		},
+		{
+			name:  "all sinks fail",
+			sinks: []NamedSink{{Sink: &testSink{err: unavailable}}, {Sink: &testSink{err: unavailable}}},
+		},
+		{
+			name: "map fails",
+			sinks: []NamedSink{
+				{Sink: &testSink{}, Required: true, Map: func(interface{}) (interface{}, error) { return nil, unavailable }},
+				{Sink: &testSink{}},
+			},
+		},
+	}
+
+	for i := range tests {
+		tc := &tests[i]
+
+		c, err := NewComposite(CompositeConfig{Inputs: testInputs{}, Sinks: tc.sinks, FanOut: FanOutBestEffort})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Commit(ctx, "outputs")
+		if (err == nil) != tc.expectOK {
+			t.Fatalf("[%s] unexpected error %v", tc.name, err)
+		}
+
+		// Every sink is attempted regardless of failures
+		for j, s := range tc.sinks {
+			sink := s.Sink.(*testSink)
+			if sink.err == nil && s.Map == nil && len(sink.committed) != 1 {
+				t.Fatalf("[%s] sink %d was not committed", tc.name, j)
+			}
+		}
+
+		if len(c.LastReport().Failed()) != 1 && tc.name != "all sinks fail" {
+			t.Fatalf("[%s] unexpected failed sinks %v", tc.name, c.LastReport().Failed())
+		}
+	}
+}
+
+// testLocker is a Locker held by at most one owner
+type testLocker struct {
+	held  bool
+	modes []string
+}
+
+func (l *testLocker) Lock(_ context.Context, mode string) error {
+	if l.held {
+		return ErrLocked
+	}
+
+	l.held = true
+	l.modes = append(l.modes, mode)
+	return nil
+}
+
+func (l *testLocker) Unlock(context.Context) error {
+	l.held = false
+	return nil
+}
+
+type identityJob struct{}
+
+func (identityJob) ID() string { return "identity" }
+
+func (identityJob) Run(_ context.Context, inputs interface{}, _ time.Time) (interface{}, error) {
+	return inputs, nil
+}
+
+func TestCompositeStart(t *testing.T) {
+	ctx := context.Background()
+	sink := &testSink{}
+	locker := &testLocker{}
+
+	c, err := NewComposite(CompositeConfig{
+		Inputs: testInputs{},
+		Sinks:  []NamedSink{{Sink: sink}},
+		Locks:  LocksFrom(locker),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := StartReport(ctx, identityJob{}, c, Config{LockWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(sink.committed, []interface{}{"inputs"}) {
+		t.Fatalf("unexpected commits %v", sink.committed)
+	}
+
+	if locker.held || !reflect.DeepEqual(locker.modes, []string{"write"}) {
+		t.Fatalf("expecting write lock to be taken and released, got %v", locker.modes)
+	}
+
+	sinks, ok := report.Get(ReportKeySinks)
+	if !ok || sinks.(*SinkReport).Results[0].Name != "sink-0" {
+		t.Fatalf("unexpected sink report %v", sinks)
+	}
+
+	locker.held = true
+	err = Start(ctx, identityJob{}, c, Config{LockWrite: true})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expecting ErrLocked, got %v", err)
+	}
+
+	_, err = NewComposite(CompositeConfig{Inputs: testInputs{}, Sinks: []NamedSink{{Name: "a", Sink: sink}, {Name: "a", Sink: sink}}})
+	if err == nil {
+		t.Fatal("expecting duplicate sink names to be rejected")
+	}
+}
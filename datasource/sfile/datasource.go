@@ -0,0 +1,417 @@
+package sfile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/soyart/satch"
+)
+
+// Input declares an input file of DataSource
+type Input struct {
+	Name   string // Key in Inputs
+	Path   string
+	Format Format // FormatAuto detects the format from Path
+
+	// Decode decodes records into a typed slice, e.g. sfile.Decoder[Payout]().
+	// If nil, records are decoded into []map[string]interface{}.
+	Decode func(r io.Reader, f Format) (interface{}, error)
+
+	// Optional inputs are empty if the file does not exist
+	Optional bool
+}
+
+// Output is a file to be written by DataSource.Commit
+type Output struct {
+	Path    string
+	Format  Format // FormatAuto detects the format from Path
+	Records interface{}
+}
+
+// Inputs maps input names to decoded records
+type Inputs map[string]interface{}
+
+// InputsOf returns the records of input name as []T
+func InputsOf[T any](inputs Inputs, name string) ([]T, error) {
+	records, ok := inputs[name]
+	if !ok {
+		return nil, fmt.Errorf("no inputs for '%s'", name)
+	}
+
+	typed, ok := records.([]T)
+	if !ok {
+		return nil, fmt.Errorf("unexpected inputs type for '%s': %s", name, reflect.TypeOf(records))
+	}
+
+	return typed, nil
+}
+
+// Decoder adapts Decode for Input.Decode
+func Decoder[T any]() func(r io.Reader, f Format) (interface{}, error) {
+	return func(r io.Reader, f Format) (interface{}, error) {
+		return Decode[T](r, f)
+	}
+}
+
+type DataSourceConfig struct {
+	// Dir is where relative paths of inputs, outputs and LockFile are resolved.
+	// Defaults to the working directory.
+	Dir string
+
+	Inputs []Input
+	Perm   os.FileMode // Of output files, defaults to DefaultPerm
+
+	// LockFile is taken as a FileLock by LockRead and LockWrite if Locker is nil.
+	// Both are no-ops if neither is set.
+	LockFile string
+	Locker   satch.Locker
+}
+
+// DataSource is a satch.DataSource driven by DataSourceConfig.
+//
+// Inputs reads the configured files and returns Inputs.
+// Commit accepts Output or []Output. Every file is written to a temp file first,
+// and the temp files are only renamed once all of them are written,
+// so a failed commit leaves all outputs unchanged.
+// A crash between the renames can still leave only some outputs replaced.
+//
+// As a sink of satch.Composite, Prepare encodes the outputs without writing them,
+// and Compensate restores the files replaced by the last Commit.
+// For this, Commit keeps the replaced files in memory until the next Commit.
+type DataSource struct {
+	conf   DataSourceConfig
+	locker satch.Locker
+
+	mut      sync.Mutex
+	replaced map[string]*replacedFile // By output path, of the last Commit
+}
+
+// replacedFile is an output file before it was replaced by Commit
+type replacedFile struct {
+	existed bool
+	content []byte
+	perm    os.FileMode
+}
+
+var (
+	_ satch.DataSource  = &DataSource{}
+	_ satch.Unlocker    = &DataSource{}
+	_ satch.Preparer    = &DataSource{}
+	_ satch.Compensator = &DataSource{}
+)
+
+func NewDataSource(conf DataSourceConfig) (*DataSource, error) {
+	names := make(map[string]bool)
+	for i := range conf.Inputs {
+		in := &conf.Inputs[i]
+		switch {
+		case in.Name == "" || in.Path == "":
+			return nil, fmt.Errorf("input %d requires a name and a path", i)
+
+		case names[in.Name]:
+			return nil, fmt.Errorf("duplicate input name '%s'", in.Name)
+		}
+
+		_, err := in.Format.resolve(in.Path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "input '%s'", in.Name)
+		}
+
+		names[in.Name] = true
+	}
+
+	ds := &DataSource{conf: conf, locker: conf.Locker}
+	if ds.locker == nil && conf.LockFile != "" {
+		ds.locker = NewFileLock(ds.path(conf.LockFile))
+	}
+
+	return ds, nil
+}
+
+func (d *DataSource) LockRead(ctx context.Context) error {
+	if d.locker == nil {
+		return nil
+	}
+
+	return d.locker.Lock(ctx, "read")
+}
+
+func (d *DataSource) LockWrite(ctx context.Context) error {
+	if d.locker == nil {
+		return nil
+	}
+
+	return d.locker.Lock(ctx, "write")
+}
+
+func (d *DataSource) Unlock(ctx context.Context) error {
+	if d.locker == nil {
+		return nil
+	}
+
+	return d.locker.Unlock(ctx)
+}
+
+func (d *DataSource) Inputs(ctx context.Context) (interface{}, error) {
+	inputs := make(Inputs, len(d.conf.Inputs))
+	for i := range d.conf.Inputs {
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		in := &d.conf.Inputs[i]
+		records, err := d.read(in)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read input '%s'", in.Name)
+		}
+
+		inputs[in.Name] = records
+	}
+
+	return inputs, nil
+}
+
+func (d *DataSource) read(in *Input) (interface{}, error) {
+	path := d.path(in.Path)
+
+	f, err := in.Format.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decode := in.Decode
+	if decode == nil {
+		decode = Decoder[map[string]interface{}]()
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) && in.Optional {
+		logrus.Infof("sfile: optional input '%s' does not exist", path)
+		return decode(empty(f), f)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open '%s'", path)
+	}
+
+	defer file.Close()
+
+	return decode(file, f)
+}
+
+func (d *DataSource) Commit(ctx context.Context, data interface{}) error {
+	outputs, err := toOutputs(data)
+	if err != nil {
+		return err
+	}
+
+	files := make([]*staged, 0, len(outputs))
+	discard := func() {
+		for _, s := range files {
+			s.discard()
+		}
+	}
+
+	for i := range outputs {
+		err := ctx.Err()
+		if err != nil {
+			discard()
+			return err
+		}
+
+		out := &outputs[i]
+		s, err := stage(d.path(out.Path), out.Format, out.Records, d.conf.Perm)
+		if err != nil {
+			discard()
+			return err
+		}
+
+		files = append(files, s)
+	}
+
+	replaced := make(map[string]*replacedFile, len(files))
+	for _, s := range files {
+		r, err := readReplaced(s.path)
+		if err != nil {
+			discard()
+			return err
+		}
+
+		replaced[s.path] = r
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	d.replaced = replaced
+
+	for i, s := range files {
+		err := s.commit()
+		if err != nil {
+			for _, rest := range files[i+1:] {
+				rest.discard()
+			}
+
+			return err
+		}
+
+		logrus.Infof("sfile: wrote '%s'", s.path)
+	}
+
+	return nil
+}
+
+// Prepare checks that data can be encoded into the output files
+func (d *DataSource) Prepare(ctx context.Context, data interface{}) error {
+	outputs, err := toOutputs(data)
+	if err != nil {
+		return err
+	}
+
+	for i := range outputs {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		out := &outputs[i]
+		path := d.path(out.Path)
+
+		f, err := out.Format.resolve(path)
+		if err != nil {
+			return err
+		}
+
+		err = Encode(io.Discard, f, out.Records)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode '%s'", path)
+		}
+	}
+
+	return nil
+}
+
+// Compensate restores the output files of data to what they were before the last Commit.
+// Files that did not exist are removed.
+func (d *DataSource) Compensate(_ context.Context, data interface{}) error {
+	outputs, err := toOutputs(data)
+	if err != nil {
+		return err
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	for i := range outputs {
+		path := d.path(outputs[i].Path)
+
+		r, ok := d.replaced[path]
+		if !ok {
+			return fmt.Errorf("no commit of '%s' to compensate", path)
+		}
+
+		err := r.restore(path)
+		if err != nil {
+			return err
+		}
+
+		delete(d.replaced, path)
+		logrus.Infof("sfile: restored '%s'", path)
+	}
+
+	return nil
+}
+
+func toOutputs(data interface{}) ([]Output, error) {
+	switch data := data.(type) {
+	case Output:
+		return []Output{data}, nil
+
+	case []Output:
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("unexpected data type: '%s'", reflect.TypeOf(data))
+}
+
+func readReplaced(path string) (*replacedFile, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return &replacedFile{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to stat '%s'", path)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read '%s'", path)
+	}
+
+	return &replacedFile{existed: true, content: content, perm: info.Mode().Perm()}, nil
+}
+
+// restore atomically puts r back at path, or removes path if r did not exist
+func (r *replacedFile) restore(path string) error {
+	if !r.existed {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to remove '%s'", path)
+		}
+
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temp file for '%s'", path)
+	}
+
+	s := &staged{path: path, tmp: tmp.Name()}
+
+	_, err = tmp.Write(r.content)
+	if err == nil {
+		err = tmp.Chmod(r.perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	errClose := tmp.Close()
+	if err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		s.discard()
+		return errors.Wrapf(err, "failed to write '%s'", tmp.Name())
+	}
+
+	return s.commit()
+}
+
+func (d *DataSource) path(p string) string {
+	if d.conf.Dir == "" || filepath.IsAbs(p) {
+		return p
+	}
+
+	return filepath.Join(d.conf.Dir, p)
+}
+
+// empty returns a reader of no records in format f, for missing optional inputs
+func empty(f Format) io.Reader {
+	if f == FormatJSON {
+		return strings.NewReader("[]")
+	}
+
+	return strings.NewReader("")
+}
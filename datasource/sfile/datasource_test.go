@@ -0,0 +1,255 @@
+package sfile
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soyart/satch"
+)
+
+// doubleJob doubles the amount of every record
+type doubleJob struct{}
+
+func (doubleJob) ID() string { return "double" }
+
+func (doubleJob) Run(_ context.Context, inputs interface{}, _ time.Time) (interface{}, error) {
+	records, err := InputsOf[record](inputs.(Inputs), "records")
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range records {
+		records[i].Amount *= 2
+	}
+
+	return []Output{
+		{Path: "doubled.ndjson", Records: records},
+		{Path: "count.json", Records: []int{len(records)}},
+	}, nil
+}
+
+func TestDataSource(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	err := WriteFile(filepath.Join(dir, "records.csv"), FormatAuto, []record{{ID: "r1", Amount: 1}, {ID: "r2", Amount: 2}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err := NewDataSource(DataSourceConfig{
+		Dir: dir,
+		Inputs: []Input{
+			{Name: "records", Path: "records.csv", Decode: Decoder[record]()},
+			{Name: "missing", Path: "missing.json", Optional: true},
+		},
+		LockFile: "job.lock",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = satch.Start(ctx, doubleJob{}, ds, satch.Config{LockWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doubled, err := ReadFile[record](filepath.Join(dir, "doubled.ndjson"), FormatAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(doubled, []record{{ID: "r1", Amount: 2}, {ID: "r2", Amount: 4}}) {
+		t.Fatalf("unexpected outputs %+v", doubled)
+	}
+
+	// Required inputs must exist
+	ds, err = NewDataSource(DataSourceConfig{Dir: dir, Inputs: []Input{{Name: "missing", Path: "missing.json"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ds.Inputs(ctx)
+	if err == nil {
+		t.Fatal("expecting missing input to fail")
+	}
+}
+
+func TestDataSourceCommitAtomic(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	ds, err := NewDataSource(DataSourceConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.Commit(ctx, Output{Path: "a.json", Records: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The unencodable second output fails the commit before the first is replaced
+	err = ds.Commit(ctx, []Output{
+		{Path: "a.json", Records: []int{2}},
+		{Path: "b.csv", Records: []int{3}},
+	})
+	if err == nil {
+		t.Fatal("expecting csv of ints to fail")
+	}
+
+	a, err := ReadFile[int](filepath.Join(dir, "a.json"), FormatAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(a, []int{1}) {
+		t.Fatalf("failed commit changed outputs: %v", a)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "b.csv"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("failed commit wrote outputs: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("expecting temp files to be removed, got %v", entries)
+	}
+
+	err = ds.Commit(ctx, "a.json")
+	if err == nil {
+		t.Fatal("expecting unexpected data type to be rejected")
+	}
+}
+
+// failSink fails every commit
+type failSink struct{}
+
+func (failSink) Commit(context.Context, interface{}) error {
+	return errors.New("sink down")
+}
+
+func TestDataSourceCompensate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	err := WriteFile(filepath.Join(dir, "records.csv"), FormatAuto, []record{{ID: "r1", Amount: 1}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaced by the job, and restored when the next sink fails
+	doubledPath := filepath.Join(dir, "doubled.ndjson")
+	err = os.WriteFile(doubledPath, []byte("old\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err := NewDataSource(DataSourceConfig{
+		Dir:    dir,
+		Inputs: []Input{{Name: "records", Path: "records.csv", Decode: Decoder[record]()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	composite, err := satch.NewComposite(satch.CompositeConfig{
+		Inputs: ds,
+		Sinks: []satch.NamedSink{
+			{Name: "files", Sink: ds},
+			{Name: "fail", Sink: failSink{}},
+		},
+		FanOut: satch.FanOutStopOnError,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = satch.Start(ctx, doubleJob{}, composite, satch.Config{})
+	if err == nil {
+		t.Fatal("expecting failing sink to fail the commit")
+	}
+
+	if result := composite.LastReport().Results[0]; !result.Committed || !result.Compensated {
+		t.Fatalf("unexpected result of files %+v", result)
+	}
+
+	content, err := os.ReadFile(doubledPath)
+	if err != nil || string(content) != "old\n" {
+		t.Fatalf("expecting replaced file restored, got %q, %v", content, err)
+	}
+
+	info, err := os.Stat(doubledPath)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expecting permissions restored, got %v, %v", info.Mode(), err)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "count.json"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expecting new file removed, got %v", err)
+	}
+
+	// Nothing was committed since
+	err = ds.Compensate(ctx, Output{Path: "count.json"})
+	if err == nil {
+		t.Fatal("expecting compensation without a commit to fail")
+	}
+
+	err = ds.Prepare(ctx, []Output{{Path: "a.json", Records: []int{1}}, {Path: "b.csv", Records: []int{2}}})
+	if err == nil {
+		t.Fatal("expecting csv of ints to fail")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expecting prepare to write nothing, got %v, %v", entries, err)
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "job.lock")
+
+	first := NewFileLock(path)
+	second := NewFileLock(path)
+
+	err := first.Lock(ctx, "write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = first.Lock(ctx, "write")
+	if !errors.Is(err, satch.ErrLocked) {
+		t.Fatalf("expecting ErrLocked when locking twice, got %v", err)
+	}
+
+	err = second.Lock(ctx, "read")
+	if !errors.Is(err, satch.ErrLocked) {
+		t.Fatalf("expecting ErrLocked, got %v", err)
+	}
+
+	err = first.Unlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = second.Lock(ctx, "read")
+	if err != nil {
+		t.Fatalf("expecting released lock to be taken, got %v", err)
+	}
+
+	err = second.Unlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
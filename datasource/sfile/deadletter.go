@@ -0,0 +1,159 @@
+package sfile
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/soyart/satch"
+)
+
+// DeadLetterFile is a satch.DeadLetterStore in a JSON file,
+// rewritten atomically on every change
+type DeadLetterFile struct {
+	path string
+	mut  sync.Mutex
+}
+
+var _ satch.DeadLetterStore = &DeadLetterFile{}
+
+type deadLetterRecord struct {
+	Key    string          `json:"key"`
+	JobID  string          `json:"jobID"`
+	Reason string          `json:"reason"`
+	Input  json.RawMessage `json:"input"`
+	At     time.Time       `json:"at"`
+}
+
+func NewDeadLetterFile(path string) *DeadLetterFile {
+	return &DeadLetterFile{path: path}
+}
+
+func (s *DeadLetterFile) Put(_ context.Context, letters ...satch.DeadLetter) error {
+	if len(letters) == 0 {
+		return nil
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	for i := range letters {
+		letter := &letters[i]
+
+		input, err := json.Marshal(letter.Input)
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal input of dead letter '%s'", letter.Key)
+		}
+
+		records[letter.Key] = deadLetterRecord{
+			Key:    letter.Key,
+			JobID:  letter.JobID,
+			Reason: letter.Reason,
+			Input:  input,
+			At:     letter.At,
+		}
+	}
+
+	return s.save(records)
+}
+
+// List returns all letters, oldest first.
+// Inputs are loaded as JSON values, so DecodeInput uses json tags.
+func (s *DeadLetterFile) List(_ context.Context) ([]satch.DeadLetter, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := sortRecords(records)
+	letters := make([]satch.DeadLetter, len(sorted))
+	for i := range sorted {
+		record := sorted[i]
+
+		var input interface{}
+		err := json.Unmarshal(record.Input, &input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode input of dead letter '%s'", record.Key)
+		}
+
+		letters[i] = satch.DeadLetter{
+			Key:    record.Key,
+			JobID:  record.JobID,
+			Reason: record.Reason,
+			Input:  input,
+			At:     record.At,
+		}.WithInputDecoder(func(v interface{}) error {
+			return json.Unmarshal(record.Input, v)
+		})
+	}
+
+	return letters, nil
+}
+
+func (s *DeadLetterFile) Delete(_ context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		delete(records, key)
+	}
+
+	return s.save(records)
+}
+
+func (s *DeadLetterFile) load() (map[string]deadLetterRecord, error) {
+	list, err := ReadFile[deadLetterRecord](s.path, FormatJSON)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+
+	records := make(map[string]deadLetterRecord, len(list))
+	for _, record := range list {
+		records[record.Key] = record
+	}
+
+	return records, nil
+}
+
+func (s *DeadLetterFile) save(records map[string]deadLetterRecord) error {
+	return WriteFile(s.path, FormatJSON, sortRecords(records), 0)
+}
+
+func sortRecords(records map[string]deadLetterRecord) []deadLetterRecord {
+	sorted := make([]deadLetterRecord, 0, len(records))
+	for _, record := range records {
+		sorted = append(sorted, record)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if !sorted[i].At.Equal(sorted[j].At) {
+			return sorted[i].At.Before(sorted[j].At)
+		}
+
+		return sorted[i].Key < sorted[j].Key
+	})
+
+	return sorted
+}
@@ -0,0 +1,73 @@
+package sfile
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/soyart/satch"
+)
+
+func TestDeadLetterFile(t *testing.T) {
+	ctx := context.Background()
+	store := NewDeadLetterFile(filepath.Join(t.TempDir(), "dead_letters.json"))
+
+	letters, err := store.List(ctx)
+	if err != nil || len(letters) != 0 {
+		t.Fatalf("expecting empty store, got %v, %v", letters, err)
+	}
+
+	at := time.Date(2024, 6, 18, 0, 0, 0, 0, time.UTC)
+	err = store.Put(ctx,
+		satch.DeadLetter{Key: "r2", JobID: "job", Reason: "bad", Input: record{ID: "r2", Amount: 2}, At: at.Add(time.Second)},
+		satch.DeadLetter{Key: "r1", JobID: "job", Reason: "bad", Input: record{ID: "r1", Amount: 1}, At: at},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Letters with the same key are replaced
+	err = store.Put(ctx, satch.DeadLetter{Key: "r2", JobID: "job", Reason: "worse", Input: record{ID: "r2", Amount: 3}, At: at.Add(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	letters, err = store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(letters) != 2 || letters[0].Key != "r1" || letters[1].Key != "r2" || letters[1].Reason != "worse" {
+		t.Fatalf("unexpected letters %+v", letters)
+	}
+
+	var input record
+	err = letters[1].DecodeInput(&input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if input.ID != "r2" || input.Amount != 3 {
+		t.Fatalf("unexpected input %+v", input)
+	}
+
+	err = store.Delete(ctx, "r1", "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	letters, err = store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(letters) != 1 || letters[0].Key != "r2" {
+		t.Fatalf("unexpected letters after delete %+v", letters)
+	}
+
+	err = store.Put(ctx, satch.DeadLetter{Key: "bad", Input: func() {}})
+	if err == nil {
+		t.Fatal("expecting unmarshalable input to fail")
+	}
+}
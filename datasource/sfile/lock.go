@@ -0,0 +1,98 @@
+package sfile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/soyart/satch"
+)
+
+// FileLock is an exclusive flock(2) lock on a lock file.
+//
+// The lock is released by the OS if the process dies, so there are no stale locks.
+// The lock file is not removed on Unlock, because removing it would let
+// another process lock a new file while a third still holds the old one.
+// While locked, the file contains the owner's pid, host and mode for debugging.
+type FileLock struct {
+	path string
+
+	mut  sync.Mutex
+	file *os.File
+}
+
+var _ satch.Locker = &FileLock{}
+
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+func (l *FileLock) Path() string {
+	return l.path
+}
+
+func (l *FileLock) Lock(_ context.Context, mode string) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.file != nil {
+		return errors.Wrapf(satch.ErrLocked, "lock file '%s' is already held by this locker", l.path)
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open lock file '%s'", l.path)
+	}
+
+	ok, err := tryLock(file)
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "failed to lock '%s'", l.path)
+	}
+
+	if !ok {
+		file.Close()
+		return errors.Wrapf(satch.ErrLocked, "lock file '%s'", l.path)
+	}
+
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("pid=%d host=%s mode=%s at=%s\n", os.Getpid(), hostname, mode, time.Now().Format(time.RFC3339))
+
+	// The owner info is only informational
+	if file.Truncate(0) == nil {
+		file.WriteAt([]byte(owner), 0)
+	}
+
+	l.file = file
+	logrus.Debugf("sfile: took lock file '%s'", l.path)
+
+	return nil
+}
+
+func (l *FileLock) Unlock(_ context.Context) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	defer func() {
+		l.file.Close()
+		l.file = nil
+	}()
+
+	l.file.Truncate(0)
+
+	err := unlockFile(l.file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to release lock file '%s'", l.path)
+	}
+
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package sfile
+
+import (
+	"errors"
+	"os"
+)
+
+var errUnsupported = errors.New("file locks are not supported on this platform")
+
+func tryLock(_ *os.File) (bool, error) {
+	return false, errUnsupported
+}
+
+func unlockFile(_ *os.File) error {
+	return errUnsupported
+}
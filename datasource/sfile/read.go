@@ -0,0 +1,313 @@
+package sfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxLine is the longest NDJSON line accepted by Decode
+const maxLine = 16 << 20
+
+var (
+	typeTime            = reflect.TypeOf(time.Time{})
+	typeDuration        = reflect.TypeOf(time.Duration(0))
+	typeTextUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// ReadFile reads the records in path as []T.
+// If f is FormatAuto, the format is detected from the extension of path.
+func ReadFile[T any](path string, f Format) ([]T, error) {
+	f, err := f.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open '%s'", path)
+	}
+
+	defer file.Close()
+
+	records, err := Decode[T](file, f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read '%s'", path)
+	}
+
+	return records, nil
+}
+
+// Decode decodes the records in r as []T.
+//
+// JSON and NDJSON records are decoded with encoding/json.
+// CSV records must have a header row. If T is a struct, columns are mapped to fields
+// by their `csv` tags, then `json` tags, then field names, all case-insensitive.
+// Columns without fields are discarded. T may also be map[string]string or map[string]interface{},
+// in which case all values are strings.
+func Decode[T any](r io.Reader, f Format) ([]T, error) {
+	switch f {
+	case FormatJSON:
+		records := []T{}
+		err := json.NewDecoder(r).Decode(&records)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode json array")
+		}
+
+		return records, nil
+
+	case FormatNDJSON:
+		return decodeNDJSON[T](r)
+
+	case FormatCSV:
+		return decodeCSV[T](r)
+	}
+
+	return nil, fmt.Errorf("cannot decode format %s", f)
+}
+
+func decodeNDJSON[T any](r io.Reader) ([]T, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+
+	records := []T{}
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var record T
+		err := json.Unmarshal(line, &record)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode line %d", n)
+		}
+
+		records = append(records, record)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to scan ndjson")
+	}
+
+	return records, nil
+}
+
+func decodeCSV[T any](r io.Reader) ([]T, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []T{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read csv header")
+	}
+
+	// header is reused by reader
+	header = append([]string{}, header...)
+
+	var zero T
+	typ := reflect.TypeOf(&zero).Elem()
+
+	var set func(v reflect.Value, row []string) error
+	switch {
+	case typ.Kind() == reflect.Struct:
+		fields := csvFieldsByName(typ)
+		indexes := make([][]int, len(header))
+		for i, col := range header {
+			indexes[i] = fields[strings.ToLower(strings.TrimSpace(col))]
+		}
+
+		set = func(v reflect.Value, row []string) error {
+			for i, index := range indexes {
+				if index == nil {
+					continue
+				}
+
+				err := setField(v.FieldByIndex(index), row[i])
+				if err != nil {
+					return errors.Wrapf(err, "column '%s'", header[i])
+				}
+			}
+
+			return nil
+		}
+
+	case typ.Kind() == reflect.Map && typ.Key().Kind() == reflect.String && typ.Elem().Kind() == reflect.String,
+		typ.Kind() == reflect.Map && typ.Key().Kind() == reflect.String && typ.Elem().Kind() == reflect.Interface:
+
+		set = func(v reflect.Value, row []string) error {
+			v.Set(reflect.MakeMapWithSize(typ, len(header)))
+			for i, col := range header {
+				v.SetMapIndex(reflect.ValueOf(col), reflect.ValueOf(row[i]).Convert(typ.Elem()))
+			}
+
+			return nil
+		}
+
+	default:
+		return nil, fmt.Errorf("cannot decode csv into %s", typ)
+	}
+
+	records := []T{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read csv")
+		}
+
+		var record T
+		err = set(reflect.ValueOf(&record).Elem(), row)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, errors.Wrapf(err, "failed to decode csv line %d", line)
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// setField parses s into v. Empty strings leave v as zero value.
+func setField(v reflect.Value, s string) error {
+	if s == "" {
+		return nil
+	}
+
+	if v.Kind() == reflect.Pointer {
+		elem := reflect.New(v.Type().Elem())
+		err := setField(elem.Elem(), s)
+		if err != nil {
+			return err
+		}
+
+		v.Set(elem)
+		return nil
+	}
+
+	if reflect.PointerTo(v.Type()).Implements(typeTextUnmarshaler) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+
+	switch v.Type() {
+	case typeDuration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		v.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		v.SetUint(u)
+
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		v.SetFloat(f)
+
+	case reflect.Interface:
+		v.Set(reflect.ValueOf(s))
+
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+
+	return nil
+}
+
+// csvField is a struct field mapped to a CSV column
+type csvField struct {
+	name  string
+	index []int
+}
+
+// csvFields returns the CSV columns of struct typ in field order
+func csvFields(typ reflect.Type) []csvField {
+	fields := []csvField{}
+
+	for _, f := range reflect.VisibleFields(typ) {
+		if !f.IsExported() || (f.Anonymous && f.Type.Kind() == reflect.Struct && f.Type != typeTime) {
+			continue
+		}
+
+		name := tagName(f.Tag.Get("csv"))
+		if name == "" {
+			name = tagName(f.Tag.Get("json"))
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		fields = append(fields, csvField{name: name, index: f.Index})
+	}
+
+	return fields
+}
+
+// csvFieldsByName maps lower-cased column names to field indexes of struct typ
+func csvFieldsByName(typ reflect.Type) map[string][]int {
+	fields := make(map[string][]int)
+	for _, f := range csvFields(typ) {
+		fields[strings.ToLower(f.name)] = f.index
+	}
+
+	return fields
+}
+
+// tagName returns the name part of a struct tag value, e.g. "id" of "id,omitempty"
+func tagName(tag string) string {
+	name, _, _ := strings.Cut(tag, ",")
+	return name
+}
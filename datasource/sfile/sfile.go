@@ -0,0 +1,61 @@
+// sfile provides satch data sources backed by local files,
+// for local runs, replays and offline reconciliation.
+//
+// Inputs are read from JSON arrays, NDJSON or CSV files, and outputs are
+// written atomically via a temp file and a rename. Locks are flock-style lock files.
+
+package sfile
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Format is the encoding of a file
+type Format int
+
+const (
+	FormatAuto   Format = iota // Detected from the file extension
+	FormatJSON                 // A single JSON array
+	FormatNDJSON               // One JSON value per line
+	FormatCSV                  // CSV with a header row
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatAuto:
+		return "auto"
+	case FormatJSON:
+		return "json"
+	case FormatNDJSON:
+		return "ndjson"
+	case FormatCSV:
+		return "csv"
+	}
+
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// FormatOf returns the format of path from its extension
+func FormatOf(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON, nil
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON, nil
+	case ".csv":
+		return FormatCSV, nil
+	}
+
+	return FormatAuto, fmt.Errorf("unknown file format of '%s'", path)
+}
+
+// resolve returns f, or the format of path if f is FormatAuto
+func (f Format) resolve(path string) (Format, error) {
+	if f != FormatAuto {
+		return f, nil
+	}
+
+	return FormatOf(path)
+}
@@ -0,0 +1,91 @@
+package sfile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type record struct {
+	ID     string    `json:"id"`
+	Amount float64   `json:"amount"`
+	Count  int       `json:"count,omitempty"`
+	Done   bool      `json:"done"`
+	At     time.Time `json:"at"`
+	Note   string    `json:"-"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	at := time.Date(2024, 6, 18, 12, 0, 0, 0, time.UTC)
+	records := []record{
+		{ID: "r1", Amount: 1.5, Count: 2, Done: true, At: at},
+		{ID: "r,2", Amount: -3, At: at.Add(time.Hour)},
+	}
+
+	for _, f := range []Format{FormatJSON, FormatNDJSON, FormatCSV} {
+		var buf bytes.Buffer
+		err := Encode(&buf, f, records)
+		if err != nil {
+			t.Fatalf("[%s] failed to encode: %v", f, err)
+		}
+
+		decoded, err := Decode[record](&buf, f)
+		if err != nil {
+			t.Fatalf("[%s] failed to decode: %v", f, err)
+		}
+
+		if !reflect.DeepEqual(decoded, records) {
+			t.Fatalf("[%s] unexpected records\nexpect %+v\nactual %+v", f, records, decoded)
+		}
+	}
+}
+
+func TestWriteReadFile(t *testing.T) {
+	dir := t.TempDir()
+	records := []record{{ID: "r1", Amount: 1}}
+
+	for _, name := range []string{"out.json", "out.ndjson", "out.csv"} {
+		path := filepath.Join(dir, name)
+
+		err := WriteFile(path, FormatAuto, records, 0)
+		if err != nil {
+			t.Fatalf("[%s] %v", name, err)
+		}
+
+		read, err := ReadFile[record](path, FormatAuto)
+		if err != nil {
+			t.Fatalf("[%s] %v", name, err)
+		}
+
+		if !reflect.DeepEqual(read, records) {
+			t.Fatalf("[%s] unexpected records %+v", name, read)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode().Perm() != DefaultPerm {
+			t.Fatalf("[%s] unexpected permission %v", name, info.Mode().Perm())
+		}
+	}
+
+	// No temp files are left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("unexpected files in dir: %v", entries)
+	}
+
+	_, err = FormatOf("out.txt")
+	if err == nil {
+		t.Fatal("expecting unknown extension to be rejected")
+	}
+}
@@ -0,0 +1,323 @@
+package sfile
+
+import (
+	"bufio"
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultPerm os.FileMode = 0o644
+
+var typeTextMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// WriteFile atomically replaces path with records encoded in format f.
+// Readers of path see either the old or the new file, never a partial one.
+//
+// If f is FormatAuto, the format is detected from the extension of path.
+// If perm is 0, DefaultPerm is used.
+func WriteFile(path string, f Format, records interface{}, perm os.FileMode) error {
+	staged, err := stage(path, f, records, perm)
+	if err != nil {
+		return err
+	}
+
+	return staged.commit()
+}
+
+// Encode encodes records, which must be a slice, to w in format f.
+//
+// For CSV, a header row is written first. If records are structs, columns are named
+// as in Decode, in field order. If records are maps with string keys, columns are
+// the sorted union of keys. Records of [][]string are written as-is.
+func Encode(w io.Writer, f Format, records interface{}) error {
+	v := reflect.ValueOf(records)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return fmt.Errorf("unexpected records type: %s", reflect.TypeOf(records))
+	}
+
+	switch f {
+	case FormatJSON:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			// Writes [] instead of null
+			records = []interface{}{}
+		}
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "    ")
+
+		return encoder.Encode(records)
+
+	case FormatNDJSON:
+		encoder := json.NewEncoder(w)
+		for i := 0; i < v.Len(); i++ {
+			err := encoder.Encode(v.Index(i).Interface())
+			if err != nil {
+				return errors.Wrapf(err, "failed to encode record %d", i)
+			}
+		}
+
+		return nil
+
+	case FormatCSV:
+		return encodeCSV(w, v)
+	}
+
+	return fmt.Errorf("cannot encode format %s", f)
+}
+
+func encodeCSV(w io.Writer, v reflect.Value) error {
+	writer := csv.NewWriter(w)
+
+	typ := v.Type().Elem()
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	var header []string
+	var row func(record reflect.Value) ([]string, error)
+
+	switch {
+	case typ.Kind() == reflect.Struct:
+		fields := csvFields(typ)
+		for _, f := range fields {
+			header = append(header, f.name)
+		}
+
+		row = func(record reflect.Value) ([]string, error) {
+			out := make([]string, len(fields))
+			for i, f := range fields {
+				field, err := record.FieldByIndexErr(f.index)
+				if err != nil {
+					// Nil embedded pointer
+					continue
+				}
+
+				out[i], err = formatField(field)
+				if err != nil {
+					return nil, errors.Wrapf(err, "column '%s'", f.name)
+				}
+			}
+
+			return out, nil
+		}
+
+	case typ.Kind() == reflect.Map && typ.Key().Kind() == reflect.String:
+		keys := make(map[string]bool)
+		for i := 0; i < v.Len(); i++ {
+			iter := indirect(v.Index(i)).MapRange()
+			for iter.Next() {
+				keys[iter.Key().String()] = true
+			}
+		}
+
+		for k := range keys {
+			header = append(header, k)
+		}
+
+		sort.Strings(header)
+
+		row = func(record reflect.Value) ([]string, error) {
+			out := make([]string, len(header))
+			for i, k := range header {
+				value := record.MapIndex(reflect.ValueOf(k).Convert(typ.Key()))
+				if !value.IsValid() {
+					continue
+				}
+
+				var err error
+				out[i], err = formatField(value)
+				if err != nil {
+					return nil, errors.Wrapf(err, "column '%s'", k)
+				}
+			}
+
+			return out, nil
+		}
+
+	case typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.String:
+		row = func(record reflect.Value) ([]string, error) {
+			return record.Interface().([]string), nil
+		}
+
+	default:
+		return fmt.Errorf("cannot encode %s as csv", typ)
+	}
+
+	if header != nil {
+		err := writer.Write(header)
+		if err != nil {
+			return errors.Wrap(err, "failed to write csv header")
+		}
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		record := indirect(v.Index(i))
+		if !record.IsValid() {
+			return fmt.Errorf("record %d is nil", i)
+		}
+
+		out, err := row(record)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode record %d", i)
+		}
+
+		err = writer.Write(out)
+		if err != nil {
+			return errors.Wrapf(err, "failed to write record %d", i)
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// formatField formats v as a CSV value, reversing setField
+func formatField(v reflect.Value) (string, error) {
+	v = indirect(v)
+	if !v.IsValid() {
+		return "", nil
+	}
+
+	switch v.Type() {
+	case typeTime:
+		return v.Interface().(time.Time).Format(time.RFC3339Nano), nil
+
+	case typeDuration:
+		return v.Interface().(time.Duration).String(), nil
+	}
+
+	if v.Type().Implements(typeTextMarshaler) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		b, err := json.Marshal(v.Interface())
+		return string(b), err
+	}
+
+	return fmt.Sprint(v.Interface()), nil
+}
+
+// indirect dereferences pointers and interfaces, returning an invalid value on nil
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+
+		v = v.Elem()
+	}
+
+	return v
+}
+
+// staged is a fully written temp file waiting to be renamed to path
+type staged struct {
+	path string
+	tmp  string
+}
+
+// stage writes records to a temp file in the directory of path
+func stage(path string, f Format, records interface{}, perm os.FileMode) (*staged, error) {
+	f, err := f.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if perm == 0 {
+		perm = DefaultPerm
+	}
+
+	// The temp file must be on the same filesystem for rename to be atomic
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create temp file for '%s'", path)
+	}
+
+	ok := false
+	defer func() {
+		if !ok {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	buf := bufio.NewWriter(tmp)
+	err = Encode(buf, f, records)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode '%s'", path)
+	}
+
+	err = buf.Flush()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to write '%s'", tmp.Name())
+	}
+
+	err = tmp.Chmod(perm)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to chmod '%s'", tmp.Name())
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to sync '%s'", tmp.Name())
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to close '%s'", tmp.Name())
+	}
+
+	ok = true
+	return &staged{path: path, tmp: tmp.Name()}, nil
+}
+
+// commit renames the temp file to path
+func (s *staged) commit() error {
+	err := os.Rename(s.tmp, s.path)
+	if err != nil {
+		os.Remove(s.tmp)
+		return errors.Wrapf(err, "failed to rename '%s' to '%s'", s.tmp, s.path)
+	}
+
+	syncDir(filepath.Dir(s.path))
+	return nil
+}
+
+// discard removes the temp file
+func (s *staged) discard() {
+	err := os.Remove(s.tmp)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("sfile: failed to remove temp file '%s': %s", s.tmp, err.Error())
+	}
+}
+
+// syncDir persists renames in dir. Errors are only logged,
+// because some platforms cannot sync directories.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		logrus.Debugf("sfile: failed to open dir '%s': %s", dir, err.Error())
+		return
+	}
+
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		logrus.Debugf("sfile: failed to sync dir '%s': %s", dir, err.Error())
+	}
+}
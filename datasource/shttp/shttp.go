@@ -0,0 +1,401 @@
+// shttp provides a satch commit sink that POSTs job outputs
+// to HTTP endpoints as JSON batches, e.g. internal REST APIs or webhooks.
+//
+// Use Sink as a satch.Sink of satch.Composite.
+
+package shttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/soyart/satch"
+)
+
+const (
+	ReportKeyBatches = "shttp.batches"
+
+	DefaultBatchSize  = 100
+	DefaultMaxRetries = 5
+	DefaultBackoff    = 500 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+
+	DefaultMaxRetryAfter = 5 * time.Minute
+	DefaultStatusTTL     = 24 * time.Hour
+)
+
+type SinkConfig struct {
+	URL     string
+	Method  string // Defaults to POST
+	Headers map[string]string
+	Client  *http.Client // http.DefaultClient if nil
+
+	BatchSize int // Records per request, defaults to DefaultBatchSize
+
+	// MaxRetries is how many times a batch is retried after
+	// network errors, 5xx and 429 responses. Other responses are not retried.
+	MaxRetries int
+	Backoff    time.Duration // First retry delay, doubled on every retry
+	MaxBackoff time.Duration
+
+	// MaxRetryAfter caps the Retry-After delay of 429 responses,
+	// which is honoured even if it is longer than MaxBackoff
+	MaxRetryAfter time.Duration
+
+	// KeyPrefix is prepended to the status key and the Idempotency-Key of every batch.
+	// Statuses are keyed by a hash of the batch body, and the Idempotency-Key
+	// adds the time of the first attempt, so it is stable across retries and resumes.
+	KeyPrefix string
+
+	// Statuses records per-batch status. Batches already sent are skipped,
+	// so committing the same outputs again resumes a partially failed commit.
+	// Defaults to a new MemStatusStore.
+	Statuses StatusStore
+
+	// StatusTTL is how long statuses are kept. An identical batch committed
+	// after the status of the earlier one expired is sent again, with a new Idempotency-Key.
+	// Stores that are Pruners drop expired statuses on every commit.
+	// Defaults to DefaultStatusTTL.
+	StatusTTL time.Duration
+
+	// ContinueOnError keeps sending later batches after a batch fails
+	ContinueOnError bool
+}
+
+// Sink commits slices of records as JSON arrays, BatchSize records per request.
+// Each request carries header Idempotency-Key, which the receiver should use to drop duplicates.
+type Sink struct {
+	conf SinkConfig
+
+	mut  sync.Mutex
+	last *Report
+}
+
+var _ satch.Sink = &Sink{}
+
+// Report is the outcome of a Sink commit,
+// recorded in the satch report as ReportKeyBatches
+type Report struct {
+	Batches []BatchStatus
+	Sent    int // Sent by this commit
+	Skipped int // Already sent by an earlier commit
+	Failed  int
+}
+
+// BatchError is returned by Sink.Commit when a batch fails
+type BatchError struct {
+	Report *Report
+}
+
+func (e *BatchError) Error() string {
+	msgs := []string{}
+	for _, b := range e.Report.Batches {
+		if b.State == StateFailed {
+			msgs = append(msgs, fmt.Sprintf("batch %d (%s): %s", b.Index, b.Key, b.Err))
+		}
+	}
+
+	return fmt.Sprintf("%d batch(es) failed: %s", e.Report.Failed, strings.Join(msgs, "; "))
+}
+
+func NewSink(conf SinkConfig) (*Sink, error) {
+	if conf.URL == "" {
+		return nil, errors.New("sink requires a url")
+	}
+
+	if conf.Method == "" {
+		conf.Method = http.MethodPost
+	}
+
+	if conf.Client == nil {
+		conf.Client = http.DefaultClient
+	}
+
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = DefaultBatchSize
+	}
+
+	if conf.MaxRetries < 0 {
+		conf.MaxRetries = 0
+	} else if conf.MaxRetries == 0 {
+		conf.MaxRetries = DefaultMaxRetries
+	}
+
+	if conf.Backoff <= 0 {
+		conf.Backoff = DefaultBackoff
+	}
+
+	if conf.MaxBackoff <= 0 {
+		conf.MaxBackoff = DefaultMaxBackoff
+	}
+
+	if conf.MaxRetryAfter <= 0 {
+		conf.MaxRetryAfter = DefaultMaxRetryAfter
+	}
+
+	if conf.Statuses == nil {
+		conf.Statuses = NewMemStatusStore()
+	}
+
+	if conf.StatusTTL <= 0 {
+		conf.StatusTTL = DefaultStatusTTL
+	}
+
+	return &Sink{conf: conf}, nil
+}
+
+// LastReport returns the report of the last commit, or nil if there was none
+func (s *Sink) LastReport() *Report {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return s.last
+}
+
+// Commit sends data, which must be a slice, in batches
+func (s *Sink) Commit(ctx context.Context, data interface{}) error {
+	v := reflect.ValueOf(data)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return fmt.Errorf("unexpected data type: '%s'", reflect.TypeOf(data))
+	}
+
+	report := &Report{}
+	defer func() {
+		s.mut.Lock()
+		s.last = report
+		s.mut.Unlock()
+
+		satch.Record(ctx, ReportKeyBatches, report)
+	}()
+
+	if pruner, ok := s.conf.Statuses.(Pruner); ok {
+		err := pruner.Prune(ctx, time.Now().Add(-s.conf.StatusTTL))
+		if err != nil {
+			return errors.Wrap(err, "failed to prune batch statuses")
+		}
+	}
+
+	for i, start := 0, 0; start < v.Len(); i, start = i+1, start+s.conf.BatchSize {
+		end := start + s.conf.BatchSize
+		if end > v.Len() {
+			end = v.Len()
+		}
+
+		body, err := json.Marshal(v.Slice(start, end).Interface())
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal batch %d", i)
+		}
+
+		status, err := s.send(ctx, i, end-start, body)
+		if err != nil {
+			return err
+		}
+
+		report.Batches = append(report.Batches, *status)
+
+		switch status.State {
+		case StateSent:
+			if status.Resumed {
+				report.Skipped++
+			} else {
+				report.Sent++
+			}
+
+		case StateFailed:
+			report.Failed++
+			if !s.conf.ContinueOnError {
+				return &BatchError{Report: report}
+			}
+		}
+	}
+
+	if report.Failed > 0 {
+		return &BatchError{Report: report}
+	}
+
+	return nil
+}
+
+// send sends a batch unless it was already sent, and saves its status.
+// Errors are only returned for failures of the status store or ctx.
+func (s *Sink) send(ctx context.Context, index, records int, body []byte) (*BatchStatus, error) {
+	sum := sha256.Sum256(body)
+	key := s.conf.KeyPrefix + hex.EncodeToString(sum[:])
+
+	status, err := s.conf.Statuses.Load(ctx, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load status of batch %d", index)
+	}
+
+	if status != nil && status.expired(s.conf.StatusTTL) {
+		status = nil
+	}
+
+	if status != nil && status.State == StateSent {
+		logrus.Infof("shttp: skipping batch %d already sent as %s", index, status.idempotencyKey())
+
+		status.Index = index
+		status.Resumed = true
+
+		return status, nil
+	}
+
+	if status == nil {
+		status = &BatchStatus{
+			Key:            key,
+			IdempotencyKey: key + "-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+		}
+	}
+
+	status.Index = index
+	status.Records = records
+
+	// status.Attempts also counts attempts of earlier commits
+	attempts := 0
+	backoff := s.conf.Backoff
+	for {
+		attempts++
+		status.Attempts++
+
+		code, retryAfter, err := s.post(ctx, status.idempotencyKey(), body)
+		status.StatusCode = code
+		status.UpdatedAt = time.Now()
+
+		if err == nil {
+			status.State = StateSent
+			status.Err = ""
+
+			break
+		}
+
+		status.State = StateFailed
+		status.Err = err.Error()
+
+		if ctx.Err() != nil {
+			s.save(ctx, status)
+			return nil, ctx.Err()
+		}
+
+		retryable := code == 0 || code == http.StatusTooManyRequests || code >= 500
+		if !retryable || attempts > s.conf.MaxRetries {
+			logrus.Errorf("shttp: batch %d failed after %d attempt(s): %s", index, attempts, status.Err)
+			break
+		}
+
+		wait := backoff
+		if wait > s.conf.MaxBackoff {
+			wait = s.conf.MaxBackoff
+		}
+
+		if code == http.StatusTooManyRequests && retryAfter > 0 {
+			wait = retryAfter
+			if wait > s.conf.MaxRetryAfter {
+				wait = s.conf.MaxRetryAfter
+			}
+		}
+
+		logrus.Warnf("shttp: retrying batch %d in %s: %s", index, wait, status.Err)
+
+		err = sleep(ctx, wait)
+		if err != nil {
+			s.save(ctx, status)
+			return nil, err
+		}
+
+		backoff *= 2
+	}
+
+	err = s.conf.Statuses.Save(ctx, *status)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to save status of batch %d", index)
+	}
+
+	return status, nil
+}
+
+// save saves status on a best-effort basis when ctx is done
+func (s *Sink) save(ctx context.Context, status *BatchStatus) {
+	err := s.conf.Statuses.Save(context.WithoutCancel(ctx), *status)
+	if err != nil {
+		logrus.Errorf("shttp: failed to save status of batch %d: %s", status.Index, err.Error())
+	}
+}
+
+// post sends body once, and returns the status code (0 on network errors)
+// and the Retry-After delay of the response
+func (s *Sink) post(ctx context.Context, key string, body []byte) (int, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, s.conf.Method, s.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to create request")
+	}
+
+	for k, v := range s.conf.Headers {
+		req.Header.Set(k, v)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+
+	resp, err := s.conf.Client.Do(req)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to send request")
+	}
+
+	defer resp.Body.Close()
+
+	// Keeps some of the body for error messages
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return resp.StatusCode, 0, nil
+	}
+
+	err = fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	return resp.StatusCode, retryAfter(resp.Header.Get("Retry-After")), err
+}
+
+// retryAfter parses a Retry-After value in seconds or as an HTTP date
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0
+	}
+
+	return time.Until(t)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,386 @@
+package shttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type request struct {
+	Records []int
+	Key     string
+	Header  http.Header
+}
+
+// testServer records requests, and responds with respond
+type testServer struct {
+	*httptest.Server
+
+	mut      sync.Mutex
+	requests []request
+	respond  func(w http.ResponseWriter, records []int, n int) // n counts requests of the same batch
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		var records []int
+		err := json.Unmarshal(body, &records)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.mut.Lock()
+		key := r.Header.Get("Idempotency-Key")
+		n := 0
+		for _, req := range s.requests {
+			if req.Key == key {
+				n++
+			}
+		}
+
+		s.requests = append(s.requests, request{Records: records, Key: key, Header: r.Header})
+		respond := s.respond
+		s.mut.Unlock()
+
+		if respond == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		respond(w, records, n)
+	}))
+
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) batches() [][]int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	batches := [][]int{}
+	for _, req := range s.requests {
+		batches = append(batches, req.Records)
+	}
+
+	return batches
+}
+
+func (s *testServer) keys() []string {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	keys := []string{}
+	for _, req := range s.requests {
+		keys = append(keys, req.Key)
+	}
+
+	return keys
+}
+
+func (s *testServer) sink(t *testing.T, conf SinkConfig) *Sink {
+	t.Helper()
+
+	conf.URL = s.URL
+	conf.Backoff = time.Millisecond
+
+	sink, err := NewSink(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sink
+}
+
+func failing(batch int, code int) func(w http.ResponseWriter, records []int, n int) {
+	return func(w http.ResponseWriter, records []int, _ int) {
+		for _, r := range records {
+			if r == batch {
+				http.Error(w, "unavailable", code)
+				return
+			}
+		}
+	}
+}
+
+func TestSinkBatches(t *testing.T) {
+	server := newTestServer(t)
+	sink := server.sink(t, SinkConfig{
+		BatchSize: 2,
+		Headers:   map[string]string{"Authorization": "Bearer token"},
+		KeyPrefix: "payout-",
+	})
+
+	err := sink.Commit(context.Background(), []int{1, 2, 3, 4, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if batches := server.batches(); !reflect.DeepEqual(batches, [][]int{{1, 2}, {3, 4}, {5}}) {
+		t.Fatalf("unexpected batches %v", batches)
+	}
+
+	keys := map[string]bool{}
+	for _, req := range server.requests {
+		switch {
+		case req.Header.Get("Authorization") != "Bearer token":
+			t.Fatal("expecting configured headers")
+
+		case req.Header.Get("Content-Type") != "application/json":
+			t.Fatal("expecting json content type")
+
+		case !strings.HasPrefix(req.Key, "payout-"):
+			t.Fatalf("expecting key prefix, got %s", req.Key)
+		}
+
+		keys[req.Key] = true
+	}
+
+	if len(keys) != 3 {
+		t.Fatalf("expecting a key per batch, got %v", keys)
+	}
+
+	report := sink.LastReport()
+	if report.Sent != 3 || report.Failed != 0 || report.Skipped != 0 || report.Batches[2].Records != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	err = sink.Commit(context.Background(), "not a slice")
+	if err == nil {
+		t.Fatal("expecting non-slice data to be rejected")
+	}
+}
+
+func TestSinkRetries(t *testing.T) {
+	server := newTestServer(t)
+	server.respond = func(w http.ResponseWriter, _ []int, n int) {
+		switch n {
+		case 0:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		}
+	}
+
+	sink := server.sink(t, SinkConfig{})
+	err := sink.Commit(context.Background(), []int{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := sink.LastReport().Batches[0]; status.Attempts != 3 || status.State != StateSent || status.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	// Other errors are not retried
+	server.requests = nil
+	server.respond = failing(2, http.StatusBadRequest)
+
+	err = sink.Commit(context.Background(), []int{2})
+
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expecting BatchError, got %v", err)
+	}
+
+	if status := batchErr.Report.Batches[0]; status.Attempts != 1 || status.StatusCode != http.StatusBadRequest || !strings.Contains(status.Err, "unavailable") {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	// Retries give up after MaxRetries
+	server.requests = nil
+	server.respond = failing(3, http.StatusBadGateway)
+
+	sink = server.sink(t, SinkConfig{MaxRetries: 2})
+	err = sink.Commit(context.Background(), []int{3})
+	if err == nil || len(server.batches()) != 3 {
+		t.Fatalf("expecting 3 attempts, got %d: %v", len(server.batches()), err)
+	}
+}
+
+func TestSinkRetryAfter(t *testing.T) {
+	server := newTestServer(t)
+	retryAfter := "1"
+	server.respond = func(w http.ResponseWriter, _ []int, n int) {
+		if n == 0 {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		}
+	}
+
+	// Retry-After is honoured beyond MaxBackoff
+	sink := server.sink(t, SinkConfig{MaxBackoff: time.Millisecond})
+
+	start := time.Now()
+	err := sink.Commit(context.Background(), []int{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("expecting to wait for Retry-After, took %v", elapsed)
+	}
+
+	// ... up to MaxRetryAfter
+	retryAfter = "3600"
+	sink = server.sink(t, SinkConfig{MaxRetryAfter: 10 * time.Millisecond})
+
+	start = time.Now()
+	err = sink.Commit(context.Background(), []int{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expecting Retry-After to be capped by MaxRetryAfter, took %v", elapsed)
+	}
+
+	// A canceled ctx stops waiting for retries
+	server.respond = failing(3, http.StatusServiceUnavailable)
+	sink = server.sink(t, SinkConfig{MaxBackoff: time.Hour})
+	sink.conf.Backoff = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = sink.Commit(ctx, []int{3})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expecting deadline exceeded, got %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if d := retryAfter("2"); d != 2*time.Second {
+		t.Fatalf("unexpected delay %v", d)
+	}
+
+	if d := retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); d <= 50*time.Second || d > time.Minute {
+		t.Fatalf("unexpected delay %v", d)
+	}
+
+	if d := retryAfter("soon"); d != 0 {
+		t.Fatalf("unexpected delay %v", d)
+	}
+}
+
+func TestSinkResume(t *testing.T) {
+	server := newTestServer(t)
+	server.respond = failing(3, http.StatusBadRequest)
+
+	sink := server.sink(t, SinkConfig{BatchSize: 2})
+	records := []int{1, 2, 3, 4, 5}
+
+	err := sink.Commit(context.Background(), records)
+	if err == nil {
+		t.Fatal("expecting second batch to fail")
+	}
+
+	// Later batches are not sent after a failure
+	if batches := server.batches(); !reflect.DeepEqual(batches, [][]int{{1, 2}, {3, 4}}) {
+		t.Fatalf("unexpected batches %v", batches)
+	}
+
+	// Committing again skips the batch already sent
+	server.respond = nil
+	err = sink.Commit(context.Background(), records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if batches := server.batches(); !reflect.DeepEqual(batches, [][]int{{1, 2}, {3, 4}, {3, 4}, {5}}) {
+		t.Fatalf("unexpected batches %v", batches)
+	}
+
+	report := sink.LastReport()
+	if report.Sent != 2 || report.Skipped != 1 || !report.Batches[0].Resumed || report.Batches[1].Attempts != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestSinkStatusTTL(t *testing.T) {
+	server := newTestServer(t)
+	statuses := NewMemStatusStore()
+
+	sink := server.sink(t, SinkConfig{Statuses: statuses, StatusTTL: time.Hour})
+	for i := 0; i < 2; i++ {
+		err := sink.Commit(context.Background(), []int{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The identical batch is skipped while its status is kept
+	if report := sink.LastReport(); report.Skipped != 1 || len(server.batches()) != 1 {
+		t.Fatalf("expecting batch to be skipped, got %+v", report)
+	}
+
+	// After the status expires, the batch is sent again with a new key
+	sink = server.sink(t, SinkConfig{Statuses: statuses, StatusTTL: time.Millisecond})
+	time.Sleep(5 * time.Millisecond)
+
+	err := sink.Commit(context.Background(), []int{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report := sink.LastReport(); report.Sent != 1 || len(server.batches()) != 2 {
+		t.Fatalf("expecting batch to be sent again, got %+v", report)
+	}
+
+	if keys := server.keys(); keys[0] == keys[1] {
+		t.Fatalf("expecting a new idempotency key, got %s twice", keys[0])
+	}
+
+	// Expired statuses are pruned by the next commit
+	time.Sleep(5 * time.Millisecond)
+
+	err = sink.Commit(context.Background(), []int{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses.mut.Lock()
+	n := len(statuses.statuses)
+	statuses.mut.Unlock()
+
+	if n != 1 {
+		t.Fatalf("expecting expired statuses to be pruned, got %d statuses", n)
+	}
+}
+
+func TestSinkContinueOnError(t *testing.T) {
+	server := newTestServer(t)
+	server.respond = failing(3, http.StatusBadRequest)
+
+	sink := server.sink(t, SinkConfig{BatchSize: 2, ContinueOnError: true})
+	err := sink.Commit(context.Background(), []int{1, 2, 3, 4, 5})
+
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expecting BatchError, got %v", err)
+	}
+
+	if batches := server.batches(); !reflect.DeepEqual(batches, [][]int{{1, 2}, {3, 4}, {5}}) {
+		t.Fatalf("expecting all batches to be sent, got %v", batches)
+	}
+
+	report := batchErr.Report
+	if report.Sent != 2 || report.Failed != 1 || report.Batches[1].State != StateFailed {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
@@ -0,0 +1,207 @@
+package shttp
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/soyart/satch/datasource/sfile"
+)
+
+// BatchState is the delivery state of a batch
+type BatchState string
+
+const (
+	StateSent   BatchState = "sent"
+	StateFailed BatchState = "failed"
+)
+
+// BatchStatus is the delivery status of a batch, keyed by a hash of its body
+type BatchStatus struct {
+	Key            string     `json:"key"`
+	IdempotencyKey string     `json:"idempotencyKey,omitempty"` // Key if empty
+	Index          int        `json:"index"`                    // Position in the last commit
+	Records        int        `json:"records"`
+	State          BatchState `json:"state"`
+	Attempts       int        `json:"attempts"`
+	StatusCode     int        `json:"statusCode,omitempty"`
+	Err            string     `json:"err,omitempty"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+
+	// Resumed is true if the batch was sent by an earlier commit, and skipped
+	Resumed bool `json:"-"`
+}
+
+func (s *BatchStatus) idempotencyKey() string {
+	if s.IdempotencyKey == "" {
+		return s.Key
+	}
+
+	return s.IdempotencyKey
+}
+
+func (s *BatchStatus) expired(ttl time.Duration) bool {
+	return time.Since(s.UpdatedAt) >= ttl
+}
+
+// StatusStore persists batch statuses, so that failed commits can be resumed
+type StatusStore interface {
+	Load(ctx context.Context, key string) (*BatchStatus, error) // Returns nil if there's no status yet
+	Save(ctx context.Context, status BatchStatus) error
+}
+
+// Pruner is implemented by stores that can drop expired statuses
+type Pruner interface {
+	Prune(ctx context.Context, before time.Time) error // Drops statuses last updated before before
+}
+
+// MemStatusStore keeps batch statuses in memory,
+// so commits can only be resumed within the same process
+type MemStatusStore struct {
+	mut      sync.Mutex
+	statuses map[string]BatchStatus
+}
+
+var (
+	_ Pruner = &MemStatusStore{}
+	_ Pruner = &FileStatusStore{}
+)
+
+func NewMemStatusStore() *MemStatusStore {
+	return &MemStatusStore{statuses: make(map[string]BatchStatus)}
+}
+
+func (s *MemStatusStore) Load(_ context.Context, key string) (*BatchStatus, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	status, ok := s.statuses[key]
+	if !ok {
+		return nil, nil
+	}
+
+	return &status, nil
+}
+
+func (s *MemStatusStore) Save(_ context.Context, status BatchStatus) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.statuses[status.Key] = status
+	return nil
+}
+
+func (s *MemStatusStore) Prune(_ context.Context, before time.Time) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for key, status := range s.statuses {
+		if status.UpdatedAt.Before(before) {
+			delete(s.statuses, key)
+		}
+	}
+
+	return nil
+}
+
+// FileStatusStore keeps batch statuses in a JSON file, rewritten atomically on every Save
+type FileStatusStore struct {
+	path string
+
+	mut      sync.Mutex
+	statuses map[string]BatchStatus // Loaded lazily
+}
+
+func NewFileStatusStore(path string) *FileStatusStore {
+	return &FileStatusStore{path: path}
+}
+
+func (s *FileStatusStore) Load(_ context.Context, key string) (*BatchStatus, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	status, ok := s.statuses[key]
+	if !ok {
+		return nil, nil
+	}
+
+	return &status, nil
+}
+
+func (s *FileStatusStore) Save(_ context.Context, status BatchStatus) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	err := s.load()
+	if err != nil {
+		return err
+	}
+
+	s.statuses[status.Key] = status
+	return s.write()
+}
+
+// Prune rewrites the file only if statuses were dropped
+func (s *FileStatusStore) Prune(_ context.Context, before time.Time) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	err := s.load()
+	if err != nil {
+		return err
+	}
+
+	pruned := false
+	for key, status := range s.statuses {
+		if status.UpdatedAt.Before(before) {
+			delete(s.statuses, key)
+			pruned = true
+		}
+	}
+
+	if !pruned {
+		return nil
+	}
+
+	return s.write()
+}
+
+func (s *FileStatusStore) write() error {
+	statuses := make([]BatchStatus, 0, len(s.statuses))
+	for _, st := range s.statuses {
+		statuses = append(statuses, st)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Key < statuses[j].Key
+	})
+
+	return sfile.WriteFile(s.path, sfile.FormatJSON, statuses, 0)
+}
+
+func (s *FileStatusStore) load() error {
+	if s.statuses != nil {
+		return nil
+	}
+
+	statuses, err := sfile.ReadFile[BatchStatus](s.path, sfile.FormatJSON)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+
+	s.statuses = make(map[string]BatchStatus, len(statuses))
+	for _, status := range statuses {
+		s.statuses[status.Key] = status
+	}
+
+	return nil
+}
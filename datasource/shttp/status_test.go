@@ -0,0 +1,65 @@
+package shttp
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStatusStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "statuses.json")
+
+	store := NewFileStatusStore(path)
+	status, err := store.Load(ctx, "k1")
+	if err != nil || status != nil {
+		t.Fatalf("expecting no status, got %v, %v", status, err)
+	}
+
+	err = store.Save(ctx, BatchStatus{Key: "k1", State: StateSent, Attempts: 2, UpdatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Statuses survive a restart
+	status, err = NewFileStatusStore(path).Load(ctx, "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status == nil || status.State != StateSent || status.Attempts != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestFileStatusStorePrune(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "statuses.json")
+	now := time.Now()
+
+	store := NewFileStatusStore(path)
+	for _, status := range []BatchStatus{
+		{Key: "old", State: StateSent, UpdatedAt: now.Add(-2 * time.Hour)},
+		{Key: "new", State: StateSent, UpdatedAt: now},
+	} {
+		err := store.Save(ctx, status)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := store.Prune(ctx, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pruning is persisted
+	restarted := NewFileStatusStore(path)
+	for key, kept := range map[string]bool{"old": false, "new": true} {
+		status, err := restarted.Load(ctx, key)
+		if err != nil || (status != nil) != kept {
+			t.Fatalf("unexpected status %s: %+v, %v", key, status, err)
+		}
+	}
+}
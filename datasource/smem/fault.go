@@ -0,0 +1,95 @@
+package smem
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInjected is the default error of Fail and FailOn
+var ErrInjected = errors.New("injected fault")
+
+// ErrTransient is matched by errors returned from Transient
+var ErrTransient = errors.New("transient error")
+
+// Fault makes calls of Op slow, failing or both.
+//
+// A fault applies from the Call-th call of Op (1-based, 0 means the first),
+// for Times calls (0 means all later calls).
+// If several faults apply, their latencies add up and the first error is returned.
+type Fault struct {
+	Op      Op
+	Call    int
+	Times   int
+	Latency time.Duration
+	Err     error
+}
+
+// FailOn fails the nth call of op with err, or ErrInjected if err is nil
+func FailOn(op Op, n int, err error) Fault {
+	if err == nil {
+		err = ErrInjected
+	}
+
+	return Fault{Op: op, Call: n, Times: 1, Err: err}
+}
+
+// Fail fails every call of op with err, or ErrInjected if err is nil
+func Fail(op Op, err error) Fault {
+	if err == nil {
+		err = ErrInjected
+	}
+
+	return Fault{Op: op, Err: err}
+}
+
+// Latency delays every call of op by d
+func Latency(op Op, d time.Duration) Fault {
+	return Fault{Op: op, Latency: d}
+}
+
+// FailTransient fails the first times calls of op with a transient error,
+// and lets later calls succeed
+func FailTransient(op Op, times int) Fault {
+	return Fault{Op: op, Call: 1, Times: times, Err: Transient(fmt.Errorf("%s unavailable", op))}
+}
+
+// Transient marks err as transient, so that errors.Is(err, ErrTransient) is true
+func Transient(err error) error {
+	return &transientError{err: err}
+}
+
+// IsTransient reports whether err or any error it wraps is transient
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrTransient)
+}
+
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return "transient: " + e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+func (e *transientError) Is(target error) bool {
+	return target == ErrTransient
+}
+
+func (f *Fault) matches(n int) bool {
+	start := f.Call
+	if start <= 0 {
+		start = 1
+	}
+
+	if n < start {
+		return false
+	}
+
+	return f.Times <= 0 || n < start+f.Times
+}
@@ -0,0 +1,75 @@
+package smem
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/soyart/satch"
+)
+
+// Lock is an in-memory exclusive lock.
+// Share a Lock between data sources via Config.Lock to make them contend.
+type Lock struct {
+	mut   sync.Mutex
+	owner *DataSource
+	mode  Op
+
+	// released is closed and replaced whenever the lock is released
+	released chan struct{}
+}
+
+func NewLock() *Lock {
+	return &Lock{released: make(chan struct{})}
+}
+
+// Owner returns the data source holding the lock, or nil
+func (l *Lock) Owner() *DataSource {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	return l.owner
+}
+
+func (l *Lock) lock(ctx context.Context, owner *DataSource, mode Op, wait bool) error {
+	for {
+		l.mut.Lock()
+		if l.owner == nil {
+			l.owner = owner
+			l.mode = mode
+			l.mut.Unlock()
+
+			return nil
+		}
+
+		current := l.mode
+		released := l.released
+		l.mut.Unlock()
+
+		if !wait {
+			return errors.Wrapf(satch.ErrLocked, "smem: lock is held for %s", current)
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "smem: waiting for lock held for %s", current)
+		case <-released:
+		}
+	}
+}
+
+func (l *Lock) unlock(owner *DataSource) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.owner != owner {
+		return
+	}
+
+	l.owner = nil
+	l.mode = ""
+
+	close(l.released)
+	l.released = make(chan struct{})
+}
@@ -0,0 +1,96 @@
+package smem
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/soyart/satch"
+)
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	lock := NewLock()
+	first := New(Config{Lock: lock})
+	second := New(Config{Lock: lock})
+
+	err := first.LockWrite(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = second.LockRead(ctx)
+	if !errors.Is(err, satch.ErrLocked) {
+		t.Fatalf("expecting ErrLocked, got %v", err)
+	}
+
+	// Unlock by non-owners leaves the lock held
+	err = second.Unlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lock.Owner() != first {
+		t.Fatal("expecting lock to be held by first")
+	}
+
+	err = first.Unlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = second.LockRead(ctx)
+	if err != nil {
+		t.Fatalf("expecting released lock to be taken, got %v", err)
+	}
+
+	if !second.Locked() || first.Locked() {
+		t.Fatal("expecting lock to be held by second")
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	ctx := context.Background()
+	lock := NewLock()
+	holder := New(Config{Lock: lock})
+	waiter := New(Config{Lock: lock, WaitLock: true})
+
+	err := holder.LockWrite(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	err = waiter.LockWrite(timeout)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expecting wait to time out, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- waiter.LockWrite(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	err = holder.Unlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("waiter did not take the released lock")
+	}
+
+	if lock.Owner() != waiter {
+		t.Fatal("expecting lock to be held by waiter")
+	}
+}
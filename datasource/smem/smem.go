@@ -0,0 +1,267 @@
+// smem provides an in-memory satch.DataSource for tests and for embedding satch
+// in programs that already hold their data in memory.
+//
+// DataSource returns configured inputs, captures commits, and has real locks,
+// so concurrent satch.Start calls contend. Faults can be injected per operation.
+
+package smem
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/soyart/satch"
+)
+
+// Op is a DataSource operation
+type Op string
+
+const (
+	OpLockRead  Op = "lockRead"
+	OpLockWrite Op = "lockWrite"
+	OpUnlock    Op = "unlock"
+	OpInputs    Op = "inputs"
+	OpCommit    Op = "commit"
+
+	// Used when DataSource is a sink of satch.Composite
+	OpPrepare    Op = "prepare"
+	OpCompensate Op = "compensate"
+)
+
+type Config struct {
+	// Inputs is returned by DataSource.Inputs, unless InputsFunc is set
+	Inputs     interface{}
+	InputsFunc func(ctx context.Context) (interface{}, error)
+
+	// CommitFunc, if set, is called by Commit. Data is only captured if it returns nil.
+	CommitFunc func(ctx context.Context, data interface{}) error
+
+	// Lock is shared by data sources that should contend with each other.
+	// Defaults to a new Lock.
+	Lock *Lock
+
+	// WaitLock makes LockRead and LockWrite wait for the lock until ctx is done,
+	// instead of failing with satch.ErrLocked
+	WaitLock bool
+
+	Faults []Fault
+}
+
+// DataSource is an in-memory satch.DataSource. It is safe for concurrent use.
+type DataSource struct {
+	conf Config
+	lock *Lock
+
+	mut     sync.Mutex
+	calls   map[Op]int
+	faults  []Fault
+	commits []interface{}
+}
+
+var (
+	_ satch.DataSource  = &DataSource{}
+	_ satch.Unlocker    = &DataSource{}
+	_ satch.Preparer    = &DataSource{}
+	_ satch.Compensator = &DataSource{}
+)
+
+func New(conf Config) *DataSource {
+	lock := conf.Lock
+	if lock == nil {
+		lock = NewLock()
+	}
+
+	return &DataSource{
+		conf:   conf,
+		lock:   lock,
+		calls:  make(map[Op]int),
+		faults: append([]Fault{}, conf.Faults...),
+	}
+}
+
+// WithInputs returns a DataSource whose Inputs returns inputs
+func WithInputs(inputs interface{}) *DataSource {
+	return New(Config{Inputs: inputs})
+}
+
+func (d *DataSource) LockRead(ctx context.Context) error {
+	err := d.call(ctx, OpLockRead)
+	if err != nil {
+		return err
+	}
+
+	return d.lock.lock(ctx, d, OpLockRead, d.conf.WaitLock)
+}
+
+func (d *DataSource) LockWrite(ctx context.Context) error {
+	err := d.call(ctx, OpLockWrite)
+	if err != nil {
+		return err
+	}
+
+	return d.lock.lock(ctx, d, OpLockWrite, d.conf.WaitLock)
+}
+
+// Unlock releases the lock if it is held by d
+func (d *DataSource) Unlock(ctx context.Context) error {
+	err := d.call(ctx, OpUnlock)
+	if err != nil {
+		return err
+	}
+
+	d.lock.unlock(d)
+	return nil
+}
+
+func (d *DataSource) Inputs(ctx context.Context) (interface{}, error) {
+	err := d.call(ctx, OpInputs)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.conf.InputsFunc != nil {
+		return d.conf.InputsFunc(ctx)
+	}
+
+	return d.conf.Inputs, nil
+}
+
+func (d *DataSource) Commit(ctx context.Context, data interface{}) error {
+	err := d.call(ctx, OpCommit)
+	if err != nil {
+		return err
+	}
+
+	if d.conf.CommitFunc != nil {
+		err := d.conf.CommitFunc(ctx, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	d.commits = append(d.commits, data)
+	return nil
+}
+
+// Prepare only counts the call and applies its faults
+func (d *DataSource) Prepare(ctx context.Context, _ interface{}) error {
+	return d.call(ctx, OpPrepare)
+}
+
+// Compensate removes the latest commit of data, as compared with reflect.DeepEqual
+func (d *DataSource) Compensate(ctx context.Context, data interface{}) error {
+	err := d.call(ctx, OpCompensate)
+	if err != nil {
+		return err
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	for i := len(d.commits) - 1; i >= 0; i-- {
+		if reflect.DeepEqual(d.commits[i], data) {
+			d.commits = append(d.commits[:i], d.commits[i+1:]...)
+			return nil
+		}
+	}
+
+	return errors.New("smem: no commit to compensate")
+}
+
+// Commits returns data of successful commits that were not compensated, oldest first
+func (d *DataSource) Commits() []interface{} {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	return append([]interface{}{}, d.commits...)
+}
+
+// LastCommit returns data of the last successful commit, or false if there is none
+func (d *DataSource) LastCommit() (interface{}, bool) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if len(d.commits) == 0 {
+		return nil, false
+	}
+
+	return d.commits[len(d.commits)-1], true
+}
+
+// Calls returns how many times op was called, including failed calls
+func (d *DataSource) Calls(op Op) int {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	return d.calls[op]
+}
+
+// Inject adds faults to d
+func (d *DataSource) Inject(faults ...Fault) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	d.faults = append(d.faults, faults...)
+}
+
+// Reset clears calls, commits and faults, and releases the lock if held by d
+func (d *DataSource) Reset() {
+	d.mut.Lock()
+	d.calls = make(map[Op]int)
+	d.faults = nil
+	d.commits = nil
+	d.mut.Unlock()
+
+	d.lock.unlock(d)
+}
+
+// Locked reports whether d holds its lock
+func (d *DataSource) Locked() bool {
+	return d.lock.Owner() == d
+}
+
+// call counts a call to op, and applies its faults
+func (d *DataSource) call(ctx context.Context, op Op) error {
+	d.mut.Lock()
+	d.calls[op]++
+	n := d.calls[op]
+
+	var latency time.Duration
+	var err error
+	for i := range d.faults {
+		f := &d.faults[i]
+		if f.Op != op || !f.matches(n) {
+			continue
+		}
+
+		latency += f.Latency
+		if err == nil && f.Err != nil {
+			err = f.Err
+		}
+	}
+	d.mut.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if err != nil {
+		return errors.WithMessagef(err, "smem: injected fault on %s call %d", op, n)
+	}
+
+	return ctx.Err()
+}
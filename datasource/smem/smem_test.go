@@ -0,0 +1,211 @@
+package smem
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soyart/satch"
+)
+
+// sumJob outputs the sum of its []int inputs
+type sumJob struct{}
+
+func (sumJob) ID() string { return "sum" }
+
+func (sumJob) Run(_ context.Context, inputs interface{}, _ time.Time) (interface{}, error) {
+	sum := 0
+	for _, n := range inputs.([]int) {
+		sum += n
+	}
+
+	return sum, nil
+}
+
+func TestDataSource(t *testing.T) {
+	ctx := context.Background()
+	ds := WithInputs([]int{1, 2, 3})
+
+	err := satch.Start(ctx, sumJob{}, ds, satch.Config{LockWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last, ok := ds.LastCommit()
+	if !ok || last != 6 {
+		t.Fatalf("unexpected last commit %v, %v", last, ok)
+	}
+
+	if ds.Locked() {
+		t.Fatal("expecting lock to be released by Start")
+	}
+
+	for op, expect := range map[Op]int{OpLockWrite: 1, OpLockRead: 0, OpInputs: 1, OpCommit: 1, OpUnlock: 1} {
+		if n := ds.Calls(op); n != expect {
+			t.Fatalf("expecting %d calls of %s, got %d", expect, op, n)
+		}
+	}
+
+	ds.Reset()
+	if len(ds.Commits()) != 0 || ds.Calls(OpCommit) != 0 {
+		t.Fatal("expecting reset to clear commits and calls")
+	}
+}
+
+func TestDataSourceFuncs(t *testing.T) {
+	ctx := context.Background()
+	reject := errors.New("rejected")
+
+	calls := 0
+	ds := New(Config{
+		InputsFunc: func(context.Context) (interface{}, error) {
+			calls++
+			return []int{calls}, nil
+		},
+		CommitFunc: func(_ context.Context, data interface{}) error {
+			if data == 2 {
+				return reject
+			}
+
+			return nil
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		err := satch.Start(ctx, sumJob{}, ds, satch.Config{})
+		if i == 1 {
+			if !errors.Is(err, reject) {
+				t.Fatalf("expecting CommitFunc error, got %v", err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Data is only captured if CommitFunc succeeds
+	if commits := ds.Commits(); !reflect.DeepEqual(commits, []interface{}{1, 3}) {
+		t.Fatalf("unexpected commits %v", commits)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+	ds := New(Config{
+		Inputs: []int{1},
+		Faults: []Fault{FailOn(OpCommit, 2, nil), FailTransient(OpInputs, 1)},
+	})
+
+	err := satch.Start(ctx, sumJob{}, ds, satch.Config{})
+	if !IsTransient(err) {
+		t.Fatalf("expecting transient error on first inputs, got %v", err)
+	}
+
+	err = satch.Start(ctx, sumJob{}, ds, satch.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = satch.Start(ctx, sumJob{}, ds, satch.Config{})
+	if !errors.Is(err, ErrInjected) || IsTransient(err) {
+		t.Fatalf("expecting injected error on second commit, got %v", err)
+	}
+
+	err = satch.Start(ctx, sumJob{}, ds, satch.Config{})
+	if err != nil {
+		t.Fatalf("expecting faults to apply to their calls only, got %v", err)
+	}
+
+	if n := len(ds.Commits()); n != 2 {
+		t.Fatalf("expecting 2 commits, got %d", n)
+	}
+
+	// Latency is cut short by ctx
+	ds.Inject(Latency(OpInputs, time.Minute))
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	_, err = ds.Inputs(timeout)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expecting deadline exceeded, got %v", err)
+	}
+
+	ds.Inject(Fail(OpUnlock, nil))
+	if err := ds.Unlock(ctx); !errors.Is(err, ErrInjected) {
+		t.Fatalf("expecting injected error on unlock, got %v", err)
+	}
+}
+
+func TestCompositeRollback(t *testing.T) {
+	ctx := context.Background()
+	first := New(Config{})
+	second := New(Config{})
+	last := New(Config{Faults: []Fault{FailOn(OpCommit, 1, nil)}})
+
+	composite, err := satch.NewComposite(satch.CompositeConfig{
+		Inputs: WithInputs([]int{1, 2}),
+		Sinks: []satch.NamedSink{
+			{Name: "first", Sink: first},
+			{Name: "second", Sink: second},
+			{Name: "last", Sink: last},
+		},
+		FanOut: satch.FanOutStopOnError,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = satch.Start(ctx, sumJob{}, composite, satch.Config{})
+
+	sinkErr := &satch.SinkError{}
+	if !errors.As(err, &sinkErr) || !errors.Is(sinkErr.Report.Failed()[0].Err, ErrInjected) {
+		t.Fatalf("expecting sink error, got %v", err)
+	}
+
+	// Sinks committed before the failure are compensated
+	for _, ds := range []*DataSource{first, second, last} {
+		if commits := ds.Commits(); len(commits) != 0 {
+			t.Fatalf("expecting no commits, got %v", commits)
+		}
+	}
+
+	for i, result := range composite.LastReport().Results[:2] {
+		if !result.Committed || !result.Compensated || result.Err != nil {
+			t.Fatalf("unexpected result %d: %+v", i, result)
+		}
+	}
+
+	// A failed prepare commits nothing
+	second.Inject(FailOn(OpPrepare, 2, nil))
+
+	err = satch.Start(ctx, sumJob{}, composite, satch.Config{})
+	if err == nil {
+		t.Fatal("expecting prepare to fail")
+	}
+
+	if first.Calls(OpCommit) != 1 || len(first.Commits()) != 0 {
+		t.Fatalf("expecting no commits after failed prepare, got %d calls", first.Calls(OpCommit))
+	}
+
+	err = satch.Start(ctx, sumJob{}, composite, satch.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ds := range []*DataSource{first, second, last} {
+		if commits := ds.Commits(); !reflect.DeepEqual(commits, []interface{}{3}) {
+			t.Fatalf("unexpected commits %v", commits)
+		}
+	}
+
+	err = first.Compensate(ctx, 4)
+	if err == nil {
+		t.Fatal("expecting compensating an unknown commit to fail")
+	}
+}
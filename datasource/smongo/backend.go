@@ -0,0 +1,153 @@
+package smongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Backend is the storage used by data sources built on smongo.
+// MongoBackend talks to MongoDB, while MemBackend keeps documents in memory for tests.
+type Backend interface {
+	// Find decodes documents in coll matching filter into results, a pointer to a slice
+	Find(ctx context.Context, coll string, filter interface{}, results interface{}, opts ...*options.FindOptions) error
+
+	// FindSnapshot runs queries against a single point in time, and returns that time.
+	// If at is nil, the current time is used.
+	FindSnapshot(ctx context.Context, at *primitive.Timestamp, queries ...SnapshotQuery) (primitive.Timestamp, error)
+
+	// BulkWrite executes plan in a single transaction.
+	// Versioned writes are planned with WritePlan.ThenVersioned.
+	BulkWrite(ctx context.Context, plan WritePlan, opts ...*options.BulkWriteOptions) (*BulkWriteCollsResult, error)
+
+	// FindOneAndUpdate updates the first document in coll matching filter and decodes it into result.
+	// It returns mongo.ErrNoDocuments if no document matches and none is upserted.
+	FindOneAndUpdate(ctx context.Context, coll string, filter interface{}, update interface{}, result interface{}, opts ...*options.FindOneAndUpdateOptions) error
+
+	// Aggregate runs pipeline on coll and decodes the output into results, a pointer to a slice
+	Aggregate(ctx context.Context, coll string, pipeline interface{}, results interface{}, opts ...*options.AggregateOptions) error
+
+	// WithTx runs tx in a transaction. Backend calls made with the context
+	// passed to tx are part of the transaction, and so are Backend calls
+	// made in tx with a context from an enclosing WithTx.
+	WithTx(ctx context.Context, tx TxFunc) (interface{}, error)
+}
+
+// MongoBackend is Backend for a MongoDB database
+type MongoBackend struct {
+	db *mongo.Database
+}
+
+var (
+	_ Backend = &MongoBackend{}
+	_ Backend = &MemBackend{}
+)
+
+func NewMongoBackend(db *mongo.Database) *MongoBackend {
+	return &MongoBackend{db: db}
+}
+
+func (b *MongoBackend) Unwrap() *mongo.Database {
+	return b.db
+}
+
+func (b *MongoBackend) Find(
+	ctx context.Context,
+	coll string,
+	filter interface{},
+	results interface{},
+	opts ...*options.FindOptions,
+) error {
+	if mongo.SessionFromContext(ctx) == nil {
+		return NewCollection(b.db.Client(), b.db.Name(), coll).Find(ctx, filter, results, opts...)
+	}
+
+	cursor, err := b.db.Collection(coll).Find(ctx, filter, opts...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to find in collection '%s'", coll)
+	}
+
+	return cursor.All(ctx, results)
+}
+
+func (b *MongoBackend) FindSnapshot(
+	ctx context.Context,
+	at *primitive.Timestamp,
+	queries ...SnapshotQuery,
+) (
+	primitive.Timestamp,
+	error,
+) {
+	return FindSnapshot(ctx, b.db, at, queries...)
+}
+
+func (b *MongoBackend) BulkWrite(
+	ctx context.Context,
+	plan WritePlan,
+	opts ...*options.BulkWriteOptions,
+) (
+	*BulkWriteCollsResult,
+	error,
+) {
+	resultTx, err := b.WithTx(ctx, TxBulkWritePlan(b.db, plan, opts...))
+	if err != nil {
+		return nil, err
+	}
+
+	results, ok := resultTx.(*BulkWriteCollsResult)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type: %s", reflect.TypeOf(resultTx).String())
+	}
+
+	return results, nil
+}
+
+func (b *MongoBackend) FindOneAndUpdate(
+	ctx context.Context,
+	coll string,
+	filter interface{},
+	update interface{},
+	result interface{},
+	opts ...*options.FindOneAndUpdateOptions,
+) error {
+	_, err := b.WithTx(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		return nil, b.db.Collection(coll).FindOneAndUpdate(ctx, filter, update, opts...).Decode(result)
+	})
+
+	return err
+}
+
+func (b *MongoBackend) Aggregate(
+	ctx context.Context,
+	coll string,
+	pipeline interface{},
+	results interface{},
+	opts ...*options.AggregateOptions,
+) error {
+	_, err := b.WithTx(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		cursor, err := b.db.Collection(coll).Aggregate(ctx, pipeline, opts...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to aggregate in collection '%s'", coll)
+		}
+
+		return nil, cursor.All(ctx, results)
+	})
+
+	return err
+}
+
+// WithTx joins the session of ctx if it has one,
+// or runs tx in a new DB-level transaction
+func (b *MongoBackend) WithTx(ctx context.Context, tx TxFunc) (interface{}, error) {
+	sess := mongo.SessionFromContext(ctx)
+	if sess == nil {
+		return WithTxDb(ctx, b.db, tx)
+	}
+
+	return tx(mongo.NewSessionContext(ctx, sess))
+}
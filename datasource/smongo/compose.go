@@ -0,0 +1,243 @@
+package smongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrTxAssertion is wrapped by errors from failed Assert steps
+var ErrTxAssertion = errors.New("tx assertion failed")
+
+// TxStepFunc is like TxFunc, but can read the results of previous steps
+type TxStepFunc func(ctx mongo.SessionContext, results *TxResults) (interface{}, error)
+
+// TxCond decides which branch of If and IfElse to run
+type TxCond func(ctx mongo.SessionContext, results *TxResults) (bool, error)
+
+// TxStep is a named step of a composed transaction.
+// Its result is recorded in TxResults under Name.
+type TxStep struct {
+	Name string
+	Fn   TxStepFunc
+}
+
+// TxResults collects the results of the steps of a composed transaction
+type TxResults struct {
+	names   []string
+	results map[string]interface{}
+}
+
+func newTxResults() *TxResults {
+	return &TxResults{results: make(map[string]interface{})}
+}
+
+// Get returns the result of step name
+func (r *TxResults) Get(name string) (interface{}, bool) {
+	result, ok := r.results[name]
+	return result, ok
+}
+
+// Names returns the names of steps that have run, in order
+func (r *TxResults) Names() []string {
+	return r.names
+}
+
+func (r *TxResults) set(name string, result interface{}) {
+	if _, ok := r.results[name]; !ok {
+		r.names = append(r.names, name)
+	}
+
+	r.results[name] = result
+}
+
+// TxResult returns the result of step name as T
+func TxResult[T any](results *TxResults, name string) (T, error) {
+	var zero T
+
+	result, ok := results.Get(name)
+	if !ok {
+		return zero, fmt.Errorf("no result for tx step '%s'", name)
+	}
+
+	typed, ok := result.(T)
+	if !ok {
+		return zero, fmt.Errorf("unexpected result type for tx step '%s': %s", name, reflect.TypeOf(result))
+	}
+
+	return typed, nil
+}
+
+// Step wraps a TxFunc, e.g. from TxFind or TxBulkWrite, as a named step
+func Step(name string, tx TxFunc) TxStep {
+	return TxStep{
+		Name: name,
+		Fn: func(ctx mongo.SessionContext, _ *TxResults) (interface{}, error) {
+			return tx(ctx)
+		},
+	}
+}
+
+// StepWith creates a named step that reads the results of previous steps
+func StepWith(name string, fn TxStepFunc) TxStep {
+	return TxStep{Name: name, Fn: fn}
+}
+
+// StepFrom creates a named step that receives the result of step from as T.
+// The step fails if from has not run or its result is not a T.
+func StepFrom[T any](
+	name string,
+	from string,
+	fn func(ctx mongo.SessionContext, prev T) (interface{}, error),
+) TxStep {
+	return TxStep{
+		Name: name,
+		Fn: func(ctx mongo.SessionContext, results *TxResults) (interface{}, error) {
+			prev, err := TxResult[T](results, from)
+			if err != nil {
+				return nil, err
+			}
+
+			return fn(ctx, prev)
+		},
+	}
+}
+
+// Assert creates a step that aborts the transaction if check returns an error.
+// The error matches both ErrTxAssertion and the error of check with errors.Is.
+func Assert(name string, check func(results *TxResults) error) TxStep {
+	return TxStep{
+		Name: name,
+		Fn: func(_ mongo.SessionContext, results *TxResults) (interface{}, error) {
+			err := check(results)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w: %w", name, ErrTxAssertion, err)
+			}
+
+			return true, nil
+		},
+	}
+}
+
+// If runs then only if cond is true
+func If(cond TxCond, then TxStep) TxStep {
+	return IfElse(cond, then, TxStep{})
+}
+
+// IfElse runs then if cond is true, or otherwise if cond is false.
+// Only the branch that runs has its result recorded.
+// A zero TxStep branch does nothing.
+func IfElse(cond TxCond, then TxStep, otherwise TxStep) TxStep {
+	return TxStep{
+		Fn: func(ctx mongo.SessionContext, results *TxResults) (interface{}, error) {
+			ok, err := cond(ctx, results)
+			if err != nil {
+				return nil, errors.Wrap(err, "tx condition failed")
+			}
+
+			branch := otherwise
+			if ok {
+				branch = then
+			}
+
+			return nil, runStep(ctx, results, branch)
+		},
+	}
+}
+
+// Group creates a step that runs steps in order.
+// The steps' results are recorded individually.
+func Group(steps ...TxStep) TxStep {
+	return TxStep{
+		Fn: func(ctx mongo.SessionContext, results *TxResults) (interface{}, error) {
+			for i := range steps {
+				err := runStep(ctx, results, steps[i])
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			return nil, nil
+		},
+	}
+}
+
+// TxSeq sequences steps into a TxFunc that returns *TxResults.
+// The first failing step aborts the sequence and the transaction.
+//
+// The MongoDB driver may retry the callback, so every call starts with fresh results.
+func TxSeq(steps ...TxStep) TxFunc {
+	return func(ctx mongo.SessionContext) (interface{}, error) {
+		results := newTxResults()
+
+		for i := range steps {
+			err := runStep(ctx, results, steps[i])
+			if err != nil {
+				return results, err
+			}
+		}
+
+		return results, nil
+	}
+}
+
+// Seq runs steps in a DB-level transaction
+func Seq(
+	ctx context.Context,
+	db *mongo.Database,
+	steps ...TxStep,
+) (
+	*TxResults,
+	error,
+) {
+	return BackendSeq(ctx, NewMongoBackend(db), steps...)
+}
+
+// BackendSeq runs steps in a transaction of backend.
+// Steps should make their Backend calls with the ctx they receive,
+// so that the calls join the transaction.
+func BackendSeq(
+	ctx context.Context,
+	backend Backend,
+	steps ...TxStep,
+) (
+	*TxResults,
+	error,
+) {
+	resultTx, err := backend.WithTx(ctx, TxSeq(steps...))
+	if err != nil {
+		return nil, err
+	}
+
+	result, ok := resultTx.(*TxResults)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type: %s", reflect.TypeOf(resultTx).String())
+	}
+
+	return result, nil
+}
+
+// runStep runs step and records its result if the step is named
+func runStep(ctx mongo.SessionContext, results *TxResults, step TxStep) error {
+	if step.Fn == nil {
+		return nil
+	}
+
+	result, err := step.Fn(ctx, results)
+	if err != nil {
+		if step.Name == "" {
+			return err
+		}
+
+		return errors.Wrapf(err, "tx step '%s' failed", step.Name)
+	}
+
+	if step.Name != "" {
+		results.set(step.Name, result)
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package smongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// value is a step returning v
+func value(name string, v interface{}) TxStep {
+	return Step(name, func(mongo.SessionContext) (interface{}, error) { return v, nil })
+}
+
+// runSeq runs steps without a session, so steps must not use ctx
+func runSeq(steps ...TxStep) (*TxResults, error) {
+	results, err := TxSeq(steps...)(nil)
+	return results.(*TxResults), err
+}
+
+func TestTxSeq(t *testing.T) {
+	results, err := runSeq(
+		value("count", 2),
+		StepFrom("double", "count", func(_ mongo.SessionContext, count int) (interface{}, error) {
+			return count * 2, nil
+		}),
+		StepWith("sum", func(_ mongo.SessionContext, results *TxResults) (interface{}, error) {
+			count, _ := TxResult[int](results, "count")
+			double, _ := TxResult[int](results, "double")
+			return count + double, nil
+		}),
+		Assert("positive", func(results *TxResults) error { return nil }),
+		Group(value("a", "a"), value("b", "b")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := results.Names(); !reflect.DeepEqual(names, []string{"count", "double", "sum", "positive", "a", "b"}) {
+		t.Fatalf("unexpected step names %v", names)
+	}
+
+	sum, err := TxResult[int](results, "sum")
+	if err != nil || sum != 6 {
+		t.Fatalf("unexpected sum %d, %v", sum, err)
+	}
+
+	_, err = TxResult[string](results, "sum")
+	if err == nil {
+		t.Fatal("expecting result type mismatch to fail")
+	}
+
+	_, err = TxResult[int](results, "missing")
+	if err == nil {
+		t.Fatal("expecting missing result to fail")
+	}
+}
+
+func TestTxSeqErrors(t *testing.T) {
+	errCheck := errors.New("balance is negative")
+	ran := false
+	after := StepWith("after", func(mongo.SessionContext, *TxResults) (interface{}, error) {
+		ran = true
+		return nil, nil
+	})
+
+	results, err := runSeq(value("count", 1), Assert("balance", func(*TxResults) error { return errCheck }), after)
+	switch {
+	case !errors.Is(err, ErrTxAssertion) || !errors.Is(err, errCheck):
+		t.Fatalf("expecting assertion error wrapping the check error, got %v", err)
+
+	case ran:
+		t.Fatal("expecting steps after the failure to be skipped")
+
+	case !reflect.DeepEqual(results.Names(), []string{"count"}):
+		t.Fatalf("unexpected step names %v", results.Names())
+	}
+
+	// StepFrom fails if the step it reads is missing or of another type
+	_, err = runSeq(StepFrom("double", "count", func(_ mongo.SessionContext, count int) (interface{}, error) { return count, nil }))
+	if err == nil {
+		t.Fatal("expecting missing step to fail")
+	}
+
+	_, err = runSeq(value("count", "2"), StepFrom("double", "count", func(_ mongo.SessionContext, count int) (interface{}, error) { return count, nil }))
+	if err == nil {
+		t.Fatal("expecting step of another type to fail")
+	}
+}
+
+func TestTxSeqIf(t *testing.T) {
+	isBig := func(_ mongo.SessionContext, results *TxResults) (bool, error) {
+		count, err := TxResult[int](results, "count")
+		return count > 10, err
+	}
+
+	for count, expected := range map[int][]string{
+		1:  {"count", "small"},
+		20: {"count", "big", "bigOnly"},
+	} {
+		results, err := runSeq(
+			value("count", count),
+			IfElse(isBig, value("big", true), value("small", true)),
+			If(isBig, value("bigOnly", true)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(results.Names(), expected) {
+			t.Fatalf("expecting steps %v for count %d, got %v", expected, count, results.Names())
+		}
+	}
+
+	errCond := errors.New("cannot decide")
+	_, err := runSeq(If(func(mongo.SessionContext, *TxResults) (bool, error) { return false, errCond }, value("then", true)))
+	if !errors.Is(err, errCond) {
+		t.Fatalf("expecting condition error, got %v", err)
+	}
+}
+
+func TestSeqRollback(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t, true)
+	coll := db.Collection("compose")
+
+	errCheck := fmt.Errorf("too many documents")
+	_, err := Seq(ctx, db,
+		Step("insert", func(ctx mongo.SessionContext) (interface{}, error) {
+			return coll.InsertOne(ctx, bson.M{"_id": "a"})
+		}),
+		Assert("none", func(*TxResults) error { return errCheck }),
+	)
+	if !errors.Is(err, ErrTxAssertion) || !errors.Is(err, errCheck) {
+		t.Fatalf("expecting assertion error, got %v", err)
+	}
+
+	n, err := coll.CountDocuments(ctx, bson.M{})
+	if err != nil || n != 0 {
+		t.Fatalf("expecting insert rolled back, got %d, %v", n, err)
+	}
+}
+
+func TestBackendSeq(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemBackend()
+
+	err := mem.Insert("accounts", bson.M{"_id": "a1", "balance": int32(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	debit := func(amount int32) TxStep {
+		return StepWith("debit", func(ctx mongo.SessionContext, _ *TxResults) (interface{}, error) {
+			var account bson.M
+			err := mem.FindOneAndUpdate(ctx, "accounts", bson.M{"_id": "a1"}, bson.M{"$inc": bson.M{"balance": -amount}}, &account,
+				options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+			return account["balance"], err
+		})
+	}
+
+	nonNegative := Assert("non-negative", func(results *TxResults) error {
+		balance, err := TxResult[int32](results, "debit")
+		if err != nil {
+			return err
+		}
+
+		if balance < 0 {
+			return fmt.Errorf("negative balance %d", balance)
+		}
+
+		return nil
+	})
+
+	results, err := BackendSeq(ctx, mem, debit(4), nonNegative)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if balance, _ := TxResult[int32](results, "debit"); balance != 6 {
+		t.Fatalf("unexpected balance %d", balance)
+	}
+
+	_, err = BackendSeq(ctx, mem, debit(7), nonNegative)
+	if !errors.Is(err, ErrTxAssertion) {
+		t.Fatalf("expecting assertion error, got %v", err)
+	}
+
+	if docs := mem.Docs("accounts"); docs[0]["balance"] != int32(6) {
+		t.Fatalf("expecting debit rolled back, got %v", docs[0])
+	}
+}
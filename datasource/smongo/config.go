@@ -0,0 +1,380 @@
+package smongo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Default prefix for environment variables read by ConfigFromEnv
+const EnvPrefix = "SMONGO_"
+
+type MongoDBConfig struct {
+	// URI is a MongoDB connection string (mongodb:// or mongodb+srv://).
+	// Other non-zero fields override the values from URI.
+	URI string `json:"uri" yaml:"uri"`
+
+	// Hosts is a comma-separated list of host:port, used when URI is empty
+	Hosts string `json:"hosts" yaml:"hosts"`
+
+	// Deprecated: use AuthSource. Admin is used as AuthSource if AuthSource is empty.
+	Admin string `json:"admin" yaml:"admin"`
+
+	Username      string `json:"username" yaml:"username"`
+	Password      string `json:"password" yaml:"password"`
+	AuthSource    string `json:"authSource" yaml:"authSource"`
+	AuthMechanism string `json:"authMechanism" yaml:"authMechanism"`
+
+	ReplicaSet string `json:"replicaSet" yaml:"replicaSet"`
+	AppName    string `json:"appName" yaml:"appName"`
+
+	TLS         bool   `json:"tls" yaml:"tls"`
+	TLSCAFile   string `json:"tlsCAFile" yaml:"tlsCAFile"`
+	TLSCertFile string `json:"tlsCertFile" yaml:"tlsCertFile"` // PEM certificate, may also contain the key
+	TLSKeyFile  string `json:"tlsKeyFile" yaml:"tlsKeyFile"`   // PEM key, if not in TLSCertFile
+	TLSInsecure bool   `json:"tlsInsecure" yaml:"tlsInsecure"`
+
+	ConnectTimeout         Duration `json:"connectTimeout" yaml:"connectTimeout"`
+	ServerSelectionTimeout Duration `json:"serverSelectionTimeout" yaml:"serverSelectionTimeout"`
+	SocketTimeout          Duration `json:"socketTimeout" yaml:"socketTimeout"`
+
+	MaxPoolSize uint64 `json:"maxPoolSize" yaml:"maxPoolSize"`
+	MinPoolSize uint64 `json:"minPoolSize" yaml:"minPoolSize"`
+
+	// Compressors is a list of wire compressors, e.g. snappy, zlib and zstd
+	Compressors []string `json:"compressors" yaml:"compressors"`
+
+	// SkipReadyCheck makes NewClient connect without checking that the deployment
+	// is reachable and supports transactions, e.g. for a standalone mongod
+	// only used by Queue
+	SkipReadyCheck bool `json:"skipReadyCheck" yaml:"skipReadyCheck"`
+}
+
+// Duration is time.Duration that can be unmarshaled from strings like "10s"
+type Duration time.Duration
+
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	parsed, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// ConfigFromYAML reads MongoDBConfig from YAML file at path
+func ConfigFromYAML(path string) (MongoDBConfig, error) {
+	var conf MongoDBConfig
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return conf, errors.Wrapf(err, "failed to read mongodb config file '%s'", path)
+	}
+
+	err = yaml.Unmarshal(b, &conf)
+	if err != nil {
+		return conf, errors.Wrapf(err, "failed to unmarshal mongodb config from '%s'", path)
+	}
+
+	return conf, nil
+}
+
+// ConfigFromEnv reads MongoDBConfig from environment variables.
+// The variable names are prefix followed by the upper snake-case field name,
+// e.g. SMONGO_URI, SMONGO_AUTH_SOURCE and SMONGO_MAX_POOL_SIZE.
+// Compressors are comma-separated.
+//
+// If prefix is empty, EnvPrefix is used.
+func ConfigFromEnv(prefix string) (MongoDBConfig, error) {
+	if prefix == "" {
+		prefix = EnvPrefix
+	}
+
+	var conf MongoDBConfig
+	return conf, conf.ApplyEnv(prefix)
+}
+
+// ApplyEnv overrides conf with the environment variables that are set.
+// See ConfigFromEnv for the variable names.
+func (conf *MongoDBConfig) ApplyEnv(prefix string) error {
+	strs := map[string]*string{
+		"URI":            &conf.URI,
+		"HOSTS":          &conf.Hosts,
+		"USERNAME":       &conf.Username,
+		"PASSWORD":       &conf.Password,
+		"AUTH_SOURCE":    &conf.AuthSource,
+		"AUTH_MECHANISM": &conf.AuthMechanism,
+		"REPLICA_SET":    &conf.ReplicaSet,
+		"APP_NAME":       &conf.AppName,
+		"TLS_CA_FILE":    &conf.TLSCAFile,
+		"TLS_CERT_FILE":  &conf.TLSCertFile,
+		"TLS_KEY_FILE":   &conf.TLSKeyFile,
+	}
+
+	bools := map[string]*bool{
+		"TLS":              &conf.TLS,
+		"TLS_INSECURE":     &conf.TLSInsecure,
+		"SKIP_READY_CHECK": &conf.SkipReadyCheck,
+	}
+
+	durations := map[string]*Duration{
+		"CONNECT_TIMEOUT":          &conf.ConnectTimeout,
+		"SERVER_SELECTION_TIMEOUT": &conf.ServerSelectionTimeout,
+		"SOCKET_TIMEOUT":           &conf.SocketTimeout,
+	}
+
+	uints := map[string]*uint64{
+		"MAX_POOL_SIZE": &conf.MaxPoolSize,
+		"MIN_POOL_SIZE": &conf.MinPoolSize,
+	}
+
+	for key, field := range strs {
+		if v, ok := os.LookupEnv(prefix + key); ok {
+			*field = v
+		}
+	}
+
+	for key, field := range bools {
+		v, ok := os.LookupEnv(prefix + key)
+		if !ok {
+			continue
+		}
+
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.Wrapf(err, "bad bool value for %s%s", prefix, key)
+		}
+
+		*field = b
+	}
+
+	for key, field := range durations {
+		v, ok := os.LookupEnv(prefix + key)
+		if !ok {
+			continue
+		}
+
+		err := field.UnmarshalText([]byte(v))
+		if err != nil {
+			return errors.Wrapf(err, "bad duration value for %s%s", prefix, key)
+		}
+	}
+
+	for key, field := range uints {
+		v, ok := os.LookupEnv(prefix + key)
+		if !ok {
+			continue
+		}
+
+		u, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "bad integer value for %s%s", prefix, key)
+		}
+
+		*field = u
+	}
+
+	if v, ok := os.LookupEnv(prefix + "COMPRESSORS"); ok {
+		conf.Compressors = splitList(v)
+	}
+
+	return nil
+}
+
+// Validate checks conf for missing or conflicting values
+func (conf MongoDBConfig) Validate() error {
+	switch {
+	case conf.URI == "" && conf.Hosts == "":
+		return errors.New("either uri or hosts is required")
+
+	case conf.URI != "" && conf.Hosts != "":
+		return errors.New("uri and hosts are mutually exclusive")
+
+	case conf.URI != "" && !strings.HasPrefix(conf.URI, "mongodb://") && !strings.HasPrefix(conf.URI, "mongodb+srv://"):
+		return errors.New("uri must start with mongodb:// or mongodb+srv://")
+
+	case conf.Password != "" && conf.Username == "":
+		return errors.New("password is set but username is empty")
+
+	case conf.MinPoolSize > 0 && conf.MaxPoolSize > 0 && conf.MinPoolSize > conf.MaxPoolSize:
+		return fmt.Errorf("minPoolSize %d is greater than maxPoolSize %d", conf.MinPoolSize, conf.MaxPoolSize)
+
+	case conf.ConnectTimeout < 0 || conf.ServerSelectionTimeout < 0 || conf.SocketTimeout < 0:
+		return errors.New("timeouts must not be negative")
+
+	case !conf.TLS && (conf.TLSCAFile != "" || conf.TLSCertFile != "" || conf.TLSKeyFile != "" || conf.TLSInsecure):
+		return errors.New("tls files or tlsInsecure are set but tls is disabled")
+
+	case conf.TLSKeyFile != "" && conf.TLSCertFile == "":
+		return errors.New("tlsKeyFile is set but tlsCertFile is empty")
+	}
+
+	for _, c := range conf.Compressors {
+		switch c {
+		case "snappy", "zlib", "zstd":
+		default:
+			return fmt.Errorf("unknown compressor '%s'", c)
+		}
+	}
+
+	return nil
+}
+
+// ClientOptions validates conf and converts it to *options.ClientOptions
+func (conf MongoDBConfig) ClientOptions() (*options.ClientOptions, error) {
+	err := conf.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.Client()
+
+	if conf.URI != "" {
+		opts.ApplyURI(conf.URI)
+	} else {
+		opts.SetHosts(splitList(conf.Hosts))
+	}
+
+	authSource := conf.AuthSource
+	if authSource == "" {
+		authSource = conf.Admin
+	}
+
+	if conf.Username != "" || conf.AuthMechanism != "" || authSource != "" {
+		cred := options.Credential{}
+		if opts.Auth != nil {
+			cred = *opts.Auth
+		}
+
+		if conf.Username != "" {
+			cred.Username = conf.Username
+			cred.Password = conf.Password
+			cred.PasswordSet = conf.Password != ""
+		}
+
+		if authSource != "" {
+			cred.AuthSource = authSource
+		}
+
+		if conf.AuthMechanism != "" {
+			cred.AuthMechanism = conf.AuthMechanism
+		}
+
+		opts.SetAuth(cred)
+	}
+
+	if conf.ReplicaSet != "" {
+		opts.SetReplicaSet(conf.ReplicaSet)
+	}
+
+	if conf.AppName != "" {
+		opts.SetAppName(conf.AppName)
+	}
+
+	if conf.TLS {
+		tlsConf, err := conf.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		opts.SetTLSConfig(tlsConf)
+	}
+
+	if conf.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(conf.ConnectTimeout.Std())
+	}
+
+	if conf.ServerSelectionTimeout > 0 {
+		opts.SetServerSelectionTimeout(conf.ServerSelectionTimeout.Std())
+	}
+
+	if conf.SocketTimeout > 0 {
+		opts.SetSocketTimeout(conf.SocketTimeout.Std())
+	}
+
+	if conf.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(conf.MaxPoolSize)
+	}
+
+	if conf.MinPoolSize > 0 {
+		opts.SetMinPoolSize(conf.MinPoolSize)
+	}
+
+	if len(conf.Compressors) > 0 {
+		opts.SetCompressors(conf.Compressors)
+	}
+
+	err = opts.Validate()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid client options")
+	}
+
+	return opts, nil
+}
+
+func (conf MongoDBConfig) tlsConfig() (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: conf.TLSInsecure,
+	}
+
+	if conf.TLSCAFile != "" {
+		pem, err := os.ReadFile(conf.TLSCAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read tls ca file '%s'", conf.TLSCAFile)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in tls ca file '%s'", conf.TLSCAFile)
+		}
+
+		tlsConf.RootCAs = pool
+	}
+
+	if conf.TLSCertFile != "" {
+		keyFile := conf.TLSKeyFile
+		if keyFile == "" {
+			keyFile = conf.TLSCertFile
+		}
+
+		cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load tls certificate '%s'", conf.TLSCertFile)
+		}
+
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConf, nil
+}
+
+func splitList(s string) []string {
+	parts := strings.Split(s, ",")
+	list := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			list = append(list, p)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,182 @@
+package smongo
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientOptionsAuthSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		conf   MongoDBConfig
+		expect string
+	}{
+		{name: "auth source", conf: MongoDBConfig{Hosts: "localhost:27017", Username: "u", AuthSource: "admin"}, expect: "admin"},
+		{name: "deprecated admin", conf: MongoDBConfig{Hosts: "localhost:27017", Username: "u", Admin: "legacy"}, expect: "legacy"},
+		{name: "auth source over admin", conf: MongoDBConfig{Hosts: "localhost:27017", Username: "u", Admin: "legacy", AuthSource: "admin"}, expect: "admin"},
+		{name: "none", conf: MongoDBConfig{Hosts: "localhost:27017", Username: "u"}, expect: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := tt.conf.ClientOptions()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if opts.Auth == nil || opts.Auth.AuthSource != tt.expect {
+				t.Fatalf("expecting auth source '%s', got %+v", tt.expect, opts.Auth)
+			}
+		})
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	for key, value := range map[string]string{
+		"TEST_SMONGO_HOSTS":           "h1:27017,h2:27017",
+		"TEST_SMONGO_USERNAME":        "user",
+		"TEST_SMONGO_PASSWORD":        "pass",
+		"TEST_SMONGO_AUTH_SOURCE":     "admin",
+		"TEST_SMONGO_TLS":             "true",
+		"TEST_SMONGO_CONNECT_TIMEOUT": "5s",
+		"TEST_SMONGO_MAX_POOL_SIZE":   "20",
+		"TEST_SMONGO_COMPRESSORS":     "zstd, snappy,",
+	} {
+		t.Setenv(key, value)
+	}
+
+	conf, err := ConfigFromEnv("TEST_SMONGO_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := MongoDBConfig{
+		Hosts:          "h1:27017,h2:27017",
+		Username:       "user",
+		Password:       "pass",
+		AuthSource:     "admin",
+		TLS:            true,
+		ConnectTimeout: Duration(5 * time.Second),
+		MaxPoolSize:    20,
+		Compressors:    []string{"zstd", "snappy"},
+	}
+
+	if !reflect.DeepEqual(conf, expected) {
+		t.Fatalf("unexpected config %+v", conf)
+	}
+
+	// Unset variables keep existing values
+	conf = MongoDBConfig{URI: "mongodb://localhost", AppName: "app"}
+	err = conf.ApplyEnv("TEST_SMONGO_")
+	if err != nil || conf.AppName != "app" || conf.URI != "mongodb://localhost" || conf.Username != "user" {
+		t.Fatalf("unexpected config %+v, %v", conf, err)
+	}
+}
+
+func TestConfigFromEnvErrors(t *testing.T) {
+	for key, value := range map[string]string{
+		"TLS":             "maybe",
+		"CONNECT_TIMEOUT": "5",
+		"MAX_POOL_SIZE":   "-1",
+	} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv("TEST_SMONGO_"+key, value)
+
+			_, err := ConfigFromEnv("TEST_SMONGO_")
+			if err == nil || !strings.Contains(err.Error(), "TEST_SMONGO_"+key) {
+				t.Fatalf("expecting error for %s, got %v", key, err)
+			}
+		})
+	}
+}
+
+func TestConfigFromYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mongodb.yaml")
+	err := os.WriteFile(path, []byte(`
+uri: mongodb://localhost:27017
+authSource: admin
+replicaSet: rs0
+connectTimeout: 5s
+serverSelectionTimeout: 1m30s
+socketTimeout: 250ms
+minPoolSize: 2
+maxPoolSize: 10
+compressors: [zstd]
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := ConfigFromYAML(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := MongoDBConfig{
+		URI:                    "mongodb://localhost:27017",
+		AuthSource:             "admin",
+		ReplicaSet:             "rs0",
+		ConnectTimeout:         Duration(5 * time.Second),
+		ServerSelectionTimeout: Duration(90 * time.Second),
+		SocketTimeout:          Duration(250 * time.Millisecond),
+		MinPoolSize:            2,
+		MaxPoolSize:            10,
+		Compressors:            []string{"zstd"},
+	}
+
+	if !reflect.DeepEqual(conf, expected) {
+		t.Fatalf("unexpected config %+v", conf)
+	}
+
+	err = os.WriteFile(path, []byte("connectTimeout: soon\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ConfigFromYAML(path)
+	if err == nil {
+		t.Fatal("expecting bad duration to fail")
+	}
+
+	_, err = ConfigFromYAML(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err == nil {
+		t.Fatal("expecting missing file to fail")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		conf   MongoDBConfig
+		expect string
+	}{
+		{name: "valid uri", conf: MongoDBConfig{URI: "mongodb+srv://cluster.example.com"}},
+		{name: "valid hosts", conf: MongoDBConfig{Hosts: "localhost:27017", Username: "u", Password: "p", TLS: true, TLSInsecure: true}},
+		{name: "no uri or hosts", conf: MongoDBConfig{}, expect: "either uri or hosts"},
+		{name: "uri and hosts", conf: MongoDBConfig{URI: "mongodb://a", Hosts: "b"}, expect: "mutually exclusive"},
+		{name: "bad scheme", conf: MongoDBConfig{URI: "http://localhost"}, expect: "must start with"},
+		{name: "password only", conf: MongoDBConfig{Hosts: "h", Password: "p"}, expect: "username is empty"},
+		{name: "pool sizes", conf: MongoDBConfig{Hosts: "h", MinPoolSize: 5, MaxPoolSize: 2}, expect: "greater than maxPoolSize"},
+		{name: "negative timeout", conf: MongoDBConfig{Hosts: "h", SocketTimeout: -1}, expect: "negative"},
+		{name: "tls files without tls", conf: MongoDBConfig{Hosts: "h", TLSCAFile: "ca.pem"}, expect: "tls is disabled"},
+		{name: "key without cert", conf: MongoDBConfig{Hosts: "h", TLS: true, TLSKeyFile: "key.pem"}, expect: "tlsCertFile is empty"},
+		{name: "unknown compressor", conf: MongoDBConfig{Hosts: "h", Compressors: []string{"lz4"}}, expect: "unknown compressor 'lz4'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.conf.Validate()
+			switch {
+			case tt.expect == "" && err != nil:
+				t.Fatalf("unexpected error %v", err)
+
+			case tt.expect != "" && (err == nil || !strings.Contains(err.Error(), tt.expect)):
+				t.Fatalf("expecting error '%s', got %v", tt.expect, err)
+			}
+		})
+	}
+}
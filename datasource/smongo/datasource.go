@@ -0,0 +1,249 @@
+package smongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/soyart/satch"
+)
+
+// Query declares an input query of DataSource
+type Query struct {
+	Name       string      // Key in Inputs, defaults to Coll
+	Coll       string      // Collection to query
+	Filter     interface{} // Defaults to all documents
+	Projection interface{}
+	Sort       interface{}
+
+	// Decode is a value of the type each document is decoded into,
+	// e.g. Payout{}, so that Inputs[Name] is []Payout. Defaults to bson.M.
+	Decode interface{}
+}
+
+// Inputs maps query names to slices of decoded documents
+type Inputs map[string]interface{}
+
+// InputsOf returns the documents of query name as []T
+func InputsOf[T any](inputs Inputs, name string) ([]T, error) {
+	docs, ok := inputs[name]
+	if !ok {
+		return nil, fmt.Errorf("no inputs for query '%s'", name)
+	}
+
+	typed, ok := docs.([]T)
+	if !ok {
+		return nil, fmt.Errorf("unexpected inputs type for query '%s': %s", name, reflect.TypeOf(docs))
+	}
+
+	return typed, nil
+}
+
+// Planner is implemented by job outputs that build their own WritePlan
+type Planner interface {
+	Plan() WritePlan
+}
+
+type DataSourceConfig struct {
+	Queries []Query
+
+	// CollOrder is the order in which collections are written
+	// when committing a map of collection to writes.
+	// Collections not listed are written afterwards in lexical order.
+	CollOrder []string
+
+	// Locker is taken by LockRead and LockWrite, which are no-ops if it is nil
+	Locker satch.Locker
+
+	// Snapshot makes Inputs run all queries at a single point in time.
+	// The cluster time is recorded in the satch report as ReportKeyClusterTime.
+	Snapshot bool
+}
+
+// DataSource is a satch.DataSource driven by DataSourceConfig.
+//
+// Inputs runs the configured queries and returns Inputs.
+// Commit accepts Planner, WritePlan, or a map of collection name to []mongo.WriteModel
+// (including named map types), and writes it in one transaction.
+// If the outputs also implement Verifiable, their postconditions are verified after commit.
+type DataSource struct {
+	backend Backend
+	conf    DataSourceConfig
+}
+
+var (
+	_ satch.DataSource = &DataSource{}
+	_ satch.Unlocker   = &DataSource{}
+)
+
+func NewDataSource(backend Backend, conf DataSourceConfig) (*DataSource, error) {
+	if backend == nil {
+		return nil, errors.New("backend is nil")
+	}
+
+	names := make(map[string]bool)
+	for i := range conf.Queries {
+		q := &conf.Queries[i]
+		if q.Coll == "" {
+			return nil, fmt.Errorf("query %d has no collection", i)
+		}
+
+		if q.Name == "" {
+			q.Name = q.Coll
+		}
+
+		if names[q.Name] {
+			return nil, fmt.Errorf("duplicate query name '%s'", q.Name)
+		}
+
+		names[q.Name] = true
+	}
+
+	return &DataSource{
+		backend: backend,
+		conf:    conf,
+	}, nil
+}
+
+func (d *DataSource) LockRead(ctx context.Context) error {
+	if d.conf.Locker == nil {
+		return nil
+	}
+
+	return d.conf.Locker.Lock(ctx, "read")
+}
+
+func (d *DataSource) LockWrite(ctx context.Context) error {
+	if d.conf.Locker == nil {
+		return nil
+	}
+
+	return d.conf.Locker.Lock(ctx, "write")
+}
+
+func (d *DataSource) Unlock(ctx context.Context) error {
+	if d.conf.Locker == nil {
+		return nil
+	}
+
+	return d.conf.Locker.Unlock(ctx)
+}
+
+func (d *DataSource) Inputs(ctx context.Context) (interface{}, error) {
+	inputs := make(Inputs, len(d.conf.Queries))
+	queries := make([]SnapshotQuery, len(d.conf.Queries))
+
+	for i := range d.conf.Queries {
+		queries[i] = d.conf.Queries[i].snapshotQuery()
+	}
+
+	if d.conf.Snapshot {
+		clusterTime, err := d.backend.FindSnapshot(ctx, nil, queries...)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to run snapshot queries")
+		}
+
+		satch.Record(ctx, ReportKeyClusterTime, clusterTime)
+	}
+
+	for i := range d.conf.Queries {
+		q := &d.conf.Queries[i]
+		sq := &queries[i]
+
+		if !d.conf.Snapshot {
+			err := d.backend.Find(ctx, sq.Coll, sq.Filter, sq.Results, sq.Opts...)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to run query '%s'", q.Name)
+			}
+		}
+
+		inputs[q.Name] = reflect.ValueOf(sq.Results).Elem().Interface()
+	}
+
+	return inputs, nil
+}
+
+func (d *DataSource) Commit(ctx context.Context, data interface{}) error {
+	plan, err := d.plan(data)
+	if err != nil {
+		return err
+	}
+
+	return d.commit(ctx, plan, data)
+}
+
+// commit writes plan, and verifies the postconditions of data
+func (d *DataSource) commit(ctx context.Context, plan WritePlan, data interface{}) error {
+	_, err := d.backend.BulkWrite(ctx, plan)
+	if err != nil {
+		return err
+	}
+
+	verifiable, ok := data.(Verifiable)
+	if !ok {
+		return nil
+	}
+
+	_, err = Verify(ctx, d.backend, verifiable.Postconditions()...)
+	return err
+}
+
+// snapshotQuery converts q into SnapshotQuery with Results pointing to a new slice
+func (q *Query) snapshotQuery() SnapshotQuery {
+	typ := reflect.TypeOf(bson.M{})
+	if q.Decode != nil {
+		typ = reflect.TypeOf(q.Decode)
+	}
+
+	results := reflect.New(reflect.SliceOf(typ))
+	results.Elem().Set(reflect.MakeSlice(reflect.SliceOf(typ), 0, 0))
+
+	filter := q.Filter
+	if filter == nil {
+		filter = bson.M{}
+	}
+
+	opts := options.Find()
+	if q.Projection != nil {
+		opts.SetProjection(q.Projection)
+	}
+
+	if q.Sort != nil {
+		opts.SetSort(q.Sort)
+	}
+
+	return SnapshotQuery{
+		Coll:    q.Coll,
+		Filter:  filter,
+		Results: results.Interface(),
+		Opts:    []*options.FindOptions{opts},
+	}
+}
+
+func (d *DataSource) plan(data interface{}) (WritePlan, error) {
+	switch outputs := data.(type) {
+	case Planner:
+		return outputs.Plan(), nil
+
+	case WritePlan:
+		return outputs, nil
+
+	case map[string][]mongo.WriteModel:
+		return PlanFromCollsOrdered(outputs, d.conf.CollOrder), nil
+	}
+
+	// Named map types, e.g. `type Outputs map[string][]mongo.WriteModel`
+	typ := reflect.TypeOf(map[string][]mongo.WriteModel{})
+	v := reflect.ValueOf(data)
+	if data != nil && v.Type().ConvertibleTo(typ) {
+		collWrites := v.Convert(typ).Interface().(map[string][]mongo.WriteModel)
+		return PlanFromCollsOrdered(collWrites, d.conf.CollOrder), nil
+	}
+
+	return nil, fmt.Errorf("unexpected data type: '%s'", reflect.TypeOf(data))
+}
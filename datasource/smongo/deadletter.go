@@ -0,0 +1,136 @@
+package smongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/soyart/satch"
+)
+
+const DefaultDeadLetterColl = "satch_dead_letters"
+
+// DeadLetterColl is a satch.DeadLetterStore in a MongoDB collection.
+// Letters of several jobs can share a collection, each job with its own scope.
+type DeadLetterColl struct {
+	coll  *mongo.Collection
+	scope string
+}
+
+var _ satch.DeadLetterStore = &DeadLetterColl{}
+
+type deadLetterDoc struct {
+	ID     string        `bson:"_id"` // scope:key
+	Scope  string        `bson:"scope"`
+	Key    string        `bson:"key"`
+	JobID  string        `bson:"job_id"`
+	Reason string        `bson:"reason"`
+	Input  bson.RawValue `bson:"input"`
+	At     int64         `bson:"at"` // Unix milliseconds
+}
+
+func NewDeadLetterColl(coll *mongo.Collection, scope string) *DeadLetterColl {
+	return &DeadLetterColl{coll: coll, scope: scope}
+}
+
+func (s *DeadLetterColl) Put(ctx context.Context, letters ...satch.DeadLetter) error {
+	if len(letters) == 0 {
+		return nil
+	}
+
+	writes := make([]mongo.WriteModel, len(letters))
+	for i := range letters {
+		letter := &letters[i]
+		writes[i] = mongo.
+			NewReplaceOneModel().
+			SetFilter(bson.M{"_id": s.id(letter.Key)}).
+			SetReplacement(bson.M{
+				"scope":  s.scope,
+				"key":    letter.Key,
+				"job_id": letter.JobID,
+				"reason": letter.Reason,
+				"input":  letter.Input,
+				"at":     letter.At.UnixMilli(),
+			}).
+			SetUpsert(true)
+	}
+
+	_, err := s.coll.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return errors.Wrapf(err, "failed to put %d dead letters to collection '%s'", len(letters), s.coll.Name())
+	}
+
+	return nil
+}
+
+// List returns letters of the scope, oldest first.
+// Inputs are loaded as BSON values, so DecodeInput uses bson tags.
+func (s *DeadLetterColl) List(ctx context.Context) ([]satch.DeadLetter, error) {
+	cursor, err := s.coll.Find(
+		ctx,
+		bson.M{"scope": s.scope},
+		options.Find().SetSort(bson.D{{Key: "at", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find dead letters in collection '%s'", s.coll.Name())
+	}
+
+	var docs []deadLetterDoc
+	err = cursor.All(ctx, &docs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode dead letters")
+	}
+
+	letters := make([]satch.DeadLetter, len(docs))
+	for i := range docs {
+		doc := docs[i]
+		letter := satch.DeadLetter{
+			Key:    doc.Key,
+			JobID:  doc.JobID,
+			Reason: doc.Reason,
+			At:     time.UnixMilli(doc.At),
+		}
+
+		if doc.Input.Type == bson.TypeEmbeddedDocument {
+			var input bson.M
+			err = doc.Input.Unmarshal(&input)
+			letter.Input = input
+		} else {
+			err = doc.Input.Unmarshal(&letter.Input)
+		}
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode input of dead letter '%s'", doc.Key)
+		}
+
+		letters[i] = letter.WithInputDecoder(doc.Input.Unmarshal)
+	}
+
+	return letters, nil
+}
+
+func (s *DeadLetterColl) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	ids := make(bson.A, len(keys))
+	for i, key := range keys {
+		ids[i] = s.id(key)
+	}
+
+	_, err := s.coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete %d dead letters from collection '%s'", len(keys), s.coll.Name())
+	}
+
+	return nil
+}
+
+func (s *DeadLetterColl) id(key string) string {
+	return s.scope + ":" + key
+}
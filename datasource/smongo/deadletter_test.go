@@ -0,0 +1,72 @@
+package smongo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/soyart/satch"
+)
+
+func TestDeadLetterColl(t *testing.T) {
+	ctx := context.Background()
+	coll := testDB(t, false).Collection(DefaultDeadLetterColl)
+	payouts := NewDeadLetterColl(coll, "payout")
+	others := NewDeadLetterColl(coll, "other")
+
+	type input struct {
+		ID     string  `bson:"id"`
+		Amount float64 `bson:"amount"`
+	}
+
+	now := time.Now().Truncate(time.Millisecond)
+	err := payouts.Put(ctx,
+		satch.DeadLetter{Key: "p2", JobID: "run1", Reason: "bad", Input: input{ID: "p2", Amount: 2}, At: now.Add(time.Second)},
+		satch.DeadLetter{Key: "p1", JobID: "run1", Reason: "bad", Input: input{ID: "p1", Amount: 1}, At: now},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same key in another scope
+	err = others.Put(ctx, satch.DeadLetter{Key: "p1", JobID: "other", Input: "other", At: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaces the letter of p2
+	err = payouts.Put(ctx, satch.DeadLetter{Key: "p2", JobID: "run2", Reason: "still bad", Input: input{ID: "p2", Amount: 2}, At: now.Add(2 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	letters, err := payouts.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(letters) != 2 || letters[0].Key != "p1" || letters[1].Key != "p2" || letters[1].JobID != "run2" || !letters[0].At.Equal(now) {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+
+	var decoded input
+	err = letters[1].DecodeInput(&decoded)
+	if err != nil || decoded != (input{ID: "p2", Amount: 2}) {
+		t.Fatalf("unexpected input %+v, %v", decoded, err)
+	}
+
+	err = payouts.Delete(ctx, "p1", "p2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	letters, err = payouts.List(ctx)
+	if err != nil || len(letters) != 0 {
+		t.Fatalf("expecting no dead letters, got %+v, %v", letters, err)
+	}
+
+	letters, err = others.List(ctx)
+	if err != nil || len(letters) != 1 || letters[0].Input != "other" {
+		t.Fatalf("expecting letters of other scopes kept, got %+v, %v", letters, err)
+	}
+}
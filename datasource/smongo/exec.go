@@ -0,0 +1,139 @@
+package smongo
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// bulkFunc writes models to a collection
+type bulkFunc func(models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+
+// execPlan executes plan with the bulkFunc for each collection.
+// It is shared by MongoDB and in-memory backends.
+//
+// Steps that are versioned or have expectations are executed one model at a time,
+// so that each model's result can be checked. Expectation failures are collected
+// across all steps, and returned as *ExpectationError after the last step.
+func execPlan(
+	plan WritePlan,
+	opts []*options.BulkWriteOptions,
+	bulkFor func(coll string) bulkFunc,
+) (
+	*BulkWriteCollsResult,
+	error,
+) {
+	results := NewBulkWriteCollsResult()
+	failures := []ExpectationFailure{}
+
+	for i := range plan {
+		step := &plan[i]
+		if len(step.Writes) == 0 {
+			continue
+		}
+
+		result, err := execStep(step, opts, bulkFor(step.Coll), &failures)
+		results.Add(step.Coll, len(step.Writes), result)
+
+		if err != nil {
+			logrus.Errorf("bulkWrite: error bulk writing %d write models to collection '%s' (step %d): %s", len(step.Writes), step.Coll, i, err.Error())
+			return results, err
+		}
+	}
+
+	if len(failures) != 0 {
+		err := &ExpectationError{Failures: failures}
+		logrus.Errorf("bulkWrite: %s", err.Error())
+		return results, err
+	}
+
+	return results, nil
+}
+
+func execStep(
+	step *CollWrites,
+	planOpts []*options.BulkWriteOptions,
+	bulk bulkFunc,
+	failures *[]ExpectationFailure,
+) (
+	*mongo.BulkWriteResult,
+	error,
+) {
+	if step.Versions == nil && !hasExpectations(step.Writes) {
+		return bulk(step.Writes, step.options(planOpts)...)
+	}
+
+	// The driver may retry tx callbacks, so each run starts from the input versions
+	var versions *Versions
+	if step.Versions != nil {
+		versions = step.Versions.clone()
+	}
+
+	result := &mongo.BulkWriteResult{UpsertedIDs: make(map[int64]interface{})}
+	conflict := &ConflictError{Coll: step.Coll}
+
+	for i := range step.Writes {
+		original, expect := unwrapExpected(step.Writes[i])
+		model := original
+
+		var key interface{}
+		if versions != nil {
+			var err error
+			model, key, err = versions.Apply(model)
+			if err != nil {
+				return result, errors.Wrapf(err, "bad versioned write %d for collection '%s'", i, step.Coll)
+			}
+		}
+
+		resultWrite, err := bulk([]mongo.WriteModel{model}, step.options(planOpts)...)
+		if err != nil {
+			return result, errors.Wrapf(err, "write %d failed for collection '%s'", i, step.Coll)
+		}
+
+		addResult(result, resultWrite, int64(i))
+
+		affected := resultWrite.MatchedCount + resultWrite.UpsertedCount + resultWrite.InsertedCount + resultWrite.DeletedCount
+		if versions != nil {
+			if affected == 0 {
+				conflict.Keys = append(conflict.Keys, key)
+				continue
+			}
+
+			version, _ := versions.Get(key)
+			err = versions.Set(key, version+1)
+			if err != nil {
+				return result, err
+			}
+		}
+
+		if !expect.met(affected) {
+			*failures = append(*failures, ExpectationFailure{
+				Coll:     step.Coll,
+				Index:    i,
+				Model:    original,
+				Expect:   expect,
+				Affected: affected,
+			})
+		}
+	}
+
+	if len(conflict.Keys) != 0 {
+		return result, conflict
+	}
+
+	return result, nil
+}
+
+// addResult adds the counts of a single-model write at index to result
+func addResult(result, write *mongo.BulkWriteResult, index int64) {
+	result.InsertedCount += write.InsertedCount
+	result.MatchedCount += write.MatchedCount
+	result.ModifiedCount += write.ModifiedCount
+	result.DeletedCount += write.DeletedCount
+	result.UpsertedCount += write.UpsertedCount
+
+	for _, id := range write.UpsertedIDs {
+		result.UpsertedIDs[index] = id
+	}
+}
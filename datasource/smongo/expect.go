@@ -0,0 +1,118 @@
+package smongo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrExpectation is matched by *ExpectationError with errors.Is
+var ErrExpectation = errors.New("write expectation failed")
+
+// Expectation is the number of documents a write model must affect.
+// Affected documents are those matched, upserted, inserted or deleted.
+type Expectation int
+
+const (
+	ExpectAny Expectation = iota
+	ExpectExactlyOne
+	ExpectAtLeastOne
+)
+
+func (e Expectation) String() string {
+	switch e {
+	case ExpectExactlyOne:
+		return "exactly one"
+	case ExpectAtLeastOne:
+		return "at least one"
+	}
+
+	return "any"
+}
+
+func (e Expectation) met(affected int64) bool {
+	switch e {
+	case ExpectExactlyOne:
+		return affected == 1
+	case ExpectAtLeastOne:
+		return affected >= 1
+	}
+
+	return true
+}
+
+// ExpectedWrite is a write model with an expectation.
+// It can be used anywhere in WritePlan in place of the wrapped model.
+//
+// Steps with expectations are executed one model at a time,
+// and the transaction aborts with *ExpectationError if any expectation fails.
+type ExpectedWrite struct {
+	mongo.WriteModel
+	Expect Expectation
+}
+
+// Expect wraps model with expectation e
+func Expect(e Expectation, model mongo.WriteModel) *ExpectedWrite {
+	return &ExpectedWrite{WriteModel: model, Expect: e}
+}
+
+// ExpectAll wraps every model with expectation e
+func ExpectAll(e Expectation, models []mongo.WriteModel) []mongo.WriteModel {
+	wrapped := make([]mongo.WriteModel, len(models))
+	for i := range models {
+		wrapped[i] = Expect(e, models[i])
+	}
+
+	return wrapped
+}
+
+// ExpectationFailure describes a write model that did not meet its expectation
+type ExpectationFailure struct {
+	Coll     string
+	Index    int // Index of the model in its step
+	Model    mongo.WriteModel
+	Expect   Expectation
+	Affected int64
+}
+
+func (f ExpectationFailure) String() string {
+	return fmt.Sprintf("collection '%s' write %d affected %d documents, expected %s: %+v", f.Coll, f.Index, f.Affected, f.Expect, f.Model)
+}
+
+// ExpectationError lists all write models that did not meet their expectations
+type ExpectationError struct {
+	Failures []ExpectationFailure
+}
+
+func (e *ExpectationError) Error() string {
+	failures := make([]string, len(e.Failures))
+	for i := range e.Failures {
+		failures[i] = e.Failures[i].String()
+	}
+
+	return fmt.Sprintf("%s: %d writes: %s", ErrExpectation.Error(), len(failures), strings.Join(failures, "; "))
+}
+
+func (e *ExpectationError) Is(target error) bool {
+	return target == ErrExpectation
+}
+
+func unwrapExpected(model mongo.WriteModel) (mongo.WriteModel, Expectation) {
+	if expected, ok := model.(*ExpectedWrite); ok {
+		return expected.WriteModel, expected.Expect
+	}
+
+	return model, ExpectAny
+}
+
+func hasExpectations(models []mongo.WriteModel) bool {
+	for i := range models {
+		if _, ok := models[i].(*ExpectedWrite); ok {
+			return true
+		}
+	}
+
+	return false
+}
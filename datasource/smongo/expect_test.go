@@ -0,0 +1,77 @@
+package smongo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestExpectMemBackend(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemBackend()
+
+	err := mem.Insert("accounts",
+		bson.M{"_id": "a1", "balance": int32(10)},
+		bson.M{"_id": "a2", "balance": int32(20)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts := mem.Docs("accounts")
+
+	debit := func(id string) mongo.WriteModel {
+		return mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": id}).SetUpdate(bson.M{"$inc": bson.M{"balance": int32(-1)}})
+	}
+
+	plan := WritePlan{}.
+		Then("payouts", []mongo.WriteModel{
+			mongo.NewInsertOneModel().SetDocument(bson.M{"_id": "p1"}),
+		}).
+		Then("accounts", []mongo.WriteModel{
+			Expect(ExpectExactlyOne, debit("a1")),
+			Expect(ExpectExactlyOne, debit("a3")),
+		})
+
+	_, err = mem.BulkWrite(ctx, plan)
+	if !errors.Is(err, ErrExpectation) {
+		t.Fatalf("expecting ErrExpectation, got %v", err)
+	}
+
+	expectationErr := &ExpectationError{}
+	if !errors.As(err, &expectationErr) {
+		t.Fatalf("expecting *ExpectationError, got %v", err)
+	}
+
+	if n := len(expectationErr.Failures); n != 1 {
+		t.Fatalf("expecting 1 failure, got %d", n)
+	}
+
+	failure := expectationErr.Failures[0]
+	if failure.Coll != "accounts" || failure.Index != 1 || failure.Expect != ExpectExactlyOne || failure.Affected != 0 {
+		t.Fatalf("unexpected failure %s", failure)
+	}
+
+	// Earlier steps and writes are rolled back
+	if payouts := mem.Docs("payouts"); len(payouts) != 0 {
+		t.Fatalf("expecting payouts rolled back, got %v", payouts)
+	}
+
+	if actual := mem.Docs("accounts"); !reflect.DeepEqual(actual, accounts) {
+		t.Fatalf("expecting accounts rolled back, got %v", actual)
+	}
+
+	plan = WritePlan{}.Then("accounts", ExpectAll(ExpectAtLeastOne, []mongo.WriteModel{debit("a1"), debit("a2")}))
+	_, err = mem.BulkWrite(ctx, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := mem.Docs("accounts"); actual[0]["balance"] != int32(9) || actual[1]["balance"] != int32(19) {
+		t.Fatalf("unexpected accounts %v", actual)
+	}
+}
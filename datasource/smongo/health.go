@@ -0,0 +1,121 @@
+package smongo
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// ErrTxUnsupported is returned by CheckTx when the deployment
+// is not a replica set or a sharded cluster
+var ErrTxUnsupported = errors.New("mongodb deployment does not support transactions: smongo requires a replica set or a sharded cluster")
+
+// codeCommandNotFound is returned by servers older than MongoDB 4.4.2 for hello
+const codeCommandNotFound = 59
+
+// Topology of a MongoDB deployment, as reported by the hello command
+type Topology string
+
+const (
+	TopologyStandalone Topology = "standalone"
+	TopologyReplicaSet Topology = "replicaSet"
+	TopologySharded    Topology = "sharded"
+)
+
+// SupportsTx reports whether transactions can be used with the topology
+func (t Topology) SupportsTx() bool {
+	return t == TopologyReplicaSet || t == TopologySharded
+}
+
+// Ping checks that the primary is reachable
+func (m *MongoDB) Ping(ctx context.Context) error {
+	err := m.cli.Ping(ctx, readpref.Primary())
+	if err != nil {
+		return errors.Wrap(err, "failed to ping mongodb")
+	}
+
+	return nil
+}
+
+// Close disconnects the client, waiting for in-use connections
+// to be returned to the pool until ctx is done
+func (m *MongoDB) Close(ctx context.Context) error {
+	err := m.cli.Disconnect(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to disconnect from mongodb")
+	}
+
+	return nil
+}
+
+// helloReply is the part of hello and isMaster replies used to find the topology
+type helloReply struct {
+	SetName string `bson:"setName"`
+	Msg     string `bson:"msg"`
+}
+
+func (r helloReply) topology() Topology {
+	switch {
+	case r.Msg == "isdbgrid":
+		return TopologySharded
+
+	case r.SetName != "":
+		return TopologyReplicaSet
+	}
+
+	return TopologyStandalone
+}
+
+// Topology runs the hello command to find out the deployment topology,
+// falling back to isMaster on servers without hello
+func (m *MongoDB) Topology(ctx context.Context) (Topology, error) {
+	var reply helloReply
+
+	admin := m.cli.Database("admin")
+	err := admin.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&reply)
+	if isCommandNotFound(err) {
+		err = admin.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&reply)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to run isMaster command")
+		}
+	}
+
+	if err != nil {
+		return "", errors.Wrap(err, "failed to run hello command")
+	}
+
+	return reply.topology(), nil
+}
+
+func isCommandNotFound(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == codeCommandNotFound
+}
+
+// CheckTx returns ErrTxUnsupported if the deployment cannot run
+// the transactions used by smongo's Tx helpers
+func (m *MongoDB) CheckTx(ctx context.Context) error {
+	topology, err := m.Topology(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !topology.SupportsTx() {
+		return errors.Wrapf(ErrTxUnsupported, "topology %s", topology)
+	}
+
+	return nil
+}
+
+// Ready pings the deployment and checks that it supports transactions
+func (m *MongoDB) Ready(ctx context.Context) error {
+	err := m.Ping(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.CheckTx(ctx)
+}
@@ -0,0 +1,84 @@
+package smongo
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestHelloReplyTopology(t *testing.T) {
+	tests := []struct {
+		reply    helloReply
+		expect   Topology
+		supports bool
+	}{
+		{reply: helloReply{}, expect: TopologyStandalone},
+		{reply: helloReply{SetName: "rs0"}, expect: TopologyReplicaSet, supports: true},
+		{reply: helloReply{Msg: "isdbgrid"}, expect: TopologySharded, supports: true},
+	}
+
+	for _, tt := range tests {
+		topology := tt.reply.topology()
+		if topology != tt.expect || topology.SupportsTx() != tt.supports {
+			t.Fatalf("expecting %s for %+v, got %s", tt.expect, tt.reply, topology)
+		}
+	}
+}
+
+func TestIsCommandNotFound(t *testing.T) {
+	tests := []struct {
+		err    error
+		expect bool
+	}{
+		{err: nil},
+		{err: errors.New("no such command")},
+		{err: mongo.CommandError{Code: 13, Name: "Unauthorized"}},
+		{err: mongo.CommandError{Code: codeCommandNotFound, Name: "CommandNotFound"}, expect: true},
+	}
+
+	for _, tt := range tests {
+		if isCommandNotFound(tt.err) != tt.expect {
+			t.Fatalf("expecting %v for %v", tt.expect, tt.err)
+		}
+	}
+}
+
+func TestNewClientReady(t *testing.T) {
+	uri := os.Getenv(envTestURI)
+	if uri == "" {
+		t.Skipf("%s is not set", envTestURI)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mg, err := NewClient(ctx, MongoDBConfig{URI: uri, SkipReadyCheck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mg.Close(ctx)
+
+	topology, err := mg.Topology(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ready check fails on deployments without transactions
+	ready, err := NewClient(ctx, MongoDBConfig{URI: uri})
+	switch {
+	case topology.SupportsTx() && err != nil:
+		t.Fatalf("unexpected error for topology %s: %v", topology, err)
+
+	case !topology.SupportsTx() && !errors.Is(err, ErrTxUnsupported):
+		t.Fatalf("expecting ErrTxUnsupported for topology %s, got %v", topology, err)
+	}
+
+	if ready != nil {
+		ready.Close(ctx)
+	}
+}
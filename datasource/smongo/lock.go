@@ -0,0 +1,161 @@
+package smongo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/soyart/satch"
+)
+
+const DefaultLockTTL = 10 * time.Minute
+
+// CollLock is a lock stored as a document in a MongoDB collection.
+// A lock that is not released expires after its TTL, and can then be taken by others.
+type CollLock struct {
+	coll  *mongo.Collection
+	id    string
+	owner string
+	ttl   time.Duration
+}
+
+type collLockDoc struct {
+	ID        string `bson:"_id"`
+	Owner     string `bson:"owner"`
+	Mode      string `bson:"mode,omitempty"`
+	ExpiresAt int64  `bson:"expires_at"`
+}
+
+// NewCollLock returns a lock identified by id in coll, owned by this process
+func NewCollLock(coll *mongo.Collection, id string, ttl time.Duration) *CollLock {
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
+
+	hostname, _ := os.Hostname()
+
+	return &CollLock{
+		coll:  coll,
+		id:    id,
+		owner: fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		ttl:   ttl,
+	}
+}
+
+func (l *CollLock) Lock(ctx context.Context, mode string) error {
+	now := time.Now()
+	lock := collLockDoc{
+		ID:        l.id,
+		Owner:     l.owner,
+		Mode:      mode,
+		ExpiresAt: now.Add(l.ttl).Unix(),
+	}
+
+	_, err := l.coll.InsertOne(ctx, lock)
+	if err == nil {
+		return nil
+	}
+
+	if !mongo.IsDuplicateKeyError(err) {
+		return errors.Wrapf(err, "failed to take lock '%s'", l.id)
+	}
+
+	result, err := l.coll.ReplaceOne(
+		ctx,
+		bson.M{
+			"_id":        l.id,
+			"expires_at": bson.M{"$lt": now.Unix()},
+		},
+		lock,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to take over expired lock '%s'", l.id)
+	}
+
+	if result.MatchedCount == 0 {
+		return errors.Wrapf(satch.ErrLocked, "lock '%s'", l.id)
+	}
+
+	logrus.Warnf("lock: took over expired lock '%s'", l.id)
+	return nil
+}
+
+// Unlock releases the lock if it is still owned by l
+func (l *CollLock) Unlock(ctx context.Context) error {
+	_, err := l.coll.DeleteOne(ctx, bson.M{
+		"_id":   l.id,
+		"owner": l.owner,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to release lock '%s'", l.id)
+	}
+
+	return nil
+}
+
+// Renew extends the lock by its TTL from now.
+// It fails with satch.ErrLockLost if the lock is no longer owned by l.
+func (l *CollLock) Renew(ctx context.Context) error {
+	result, err := l.coll.UpdateOne(
+		ctx,
+		bson.M{
+			"_id":   l.id,
+			"owner": l.owner,
+		},
+		bson.M{"$set": bson.M{"expires_at": time.Now().Add(l.ttl).Unix()}},
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to renew lock '%s'", l.id)
+	}
+
+	if result.MatchedCount == 0 {
+		return errors.Wrapf(satch.ErrLockLost, "lock '%s'", l.id)
+	}
+
+	return nil
+}
+
+// KeepAlive renews the lock every third of its TTL until ctx is done or stop is called.
+// If renewing fails, lost is called with the error and renewing stops.
+func (l *CollLock) KeepAlive(ctx context.Context, lost func(err error)) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-ticker.C:
+			}
+
+			err := l.Renew(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				logrus.Errorf("lock: failed to renew lock '%s': %s", l.id, err.Error())
+				lost(err)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,824 @@
+package smongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MemBackend is an in-memory Backend for unit tests.
+//
+// It supports the filters and updates commonly used in batch jobs:
+// equality, $eq, $ne, $in, $nin, $gt, $gte, $lt, $lte, $exists, $and, $or and $nor filters,
+// and $set, $unset, $inc and $setOnInsert updates.
+// Update pipelines, projections and collations are not supported.
+// Aggregate supports the stages listed in memAggregate.
+//
+// BulkWrite and FindOneAndUpdate are atomic: a failing call leaves the documents unchanged.
+// WithTx runs one transaction at a time, and blocks other calls until it returns.
+// Insert and Docs must not be called inside transactions.
+//
+// FindSnapshot only supports the current time. Its timestamps
+// count the writes to the backend, and are not wall clock times.
+type MemBackend struct {
+	mut   sync.RWMutex
+	colls map[string][]bson.M
+	clock uint32 // Incremented on every change
+}
+
+// memTx holds the collections of a WithTx transaction,
+// which replace the backend's collections when the transaction succeeds
+type memTx struct {
+	backend *MemBackend
+	mut     sync.Mutex
+	colls   map[string][]bson.M
+	changed bool
+}
+
+type memTxKey struct{}
+
+func NewMemBackend() *MemBackend {
+	return &MemBackend{colls: make(map[string][]bson.M)}
+}
+
+// Insert adds docs, e.g. structs with bson tags, to coll.
+// Documents without _id get a new ObjectID.
+func (m *MemBackend) Insert(coll string, docs ...interface{}) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	for i := range docs {
+		doc, err := toDoc(docs[i])
+		if err != nil {
+			return errors.Wrapf(err, "bad document %d for collection '%s'", i, coll)
+		}
+
+		if _, ok := doc["_id"]; !ok {
+			doc["_id"] = primitive.NewObjectID()
+		}
+
+		m.colls[coll] = append(m.colls[coll], doc)
+	}
+
+	m.clock++
+	return nil
+}
+
+// Docs returns copies of all documents in coll, in insertion order
+func (m *MemBackend) Docs(coll string) []bson.M {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	return copyDocs(m.colls[coll])
+}
+
+func (m *MemBackend) Find(
+	ctx context.Context,
+	coll string,
+	filter interface{},
+	results interface{},
+	opts ...*options.FindOptions,
+) error {
+	return m.read(ctx, func(colls map[string][]bson.M) error {
+		return memFind(colls[coll], filter, results, opts...)
+	})
+}
+
+func (m *MemBackend) FindSnapshot(
+	ctx context.Context,
+	at *primitive.Timestamp,
+	queries ...SnapshotQuery,
+) (
+	primitive.Timestamp,
+	error,
+) {
+	var now primitive.Timestamp
+	err := m.read(ctx, func(colls map[string][]bson.M) error {
+		now = primitive.Timestamp{I: m.clock}
+		if at != nil && !at.Equal(now) {
+			return fmt.Errorf("mem: snapshot at %v is not the current time %v", *at, now)
+		}
+
+		for i := range queries {
+			q := &queries[i]
+
+			err := memFind(colls[q.Coll], q.Filter, q.Results, q.Opts...)
+			if err != nil {
+				return errors.Wrapf(err, "mem: snapshot find in collection '%s' failed", q.Coll)
+			}
+		}
+
+		return nil
+	})
+
+	return now, err
+}
+
+func (m *MemBackend) BulkWrite(
+	ctx context.Context,
+	plan WritePlan,
+	opts ...*options.BulkWriteOptions,
+) (
+	*BulkWriteCollsResult,
+	error,
+) {
+	var results *BulkWriteCollsResult
+	err := m.write(ctx, func(colls map[string][]bson.M) error {
+		// Writes go to copies of the collections, which replace the originals only on success
+		tx := make(map[string][]bson.M)
+
+		var err error
+		results, err = execPlan(plan, opts, func(coll string) bulkFunc {
+			return func(models []mongo.WriteModel, _ ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+				docs, ok := tx[coll]
+				if !ok {
+					docs = copyDocs(colls[coll])
+				}
+
+				result := &mongo.BulkWriteResult{UpsertedIDs: make(map[int64]interface{})}
+				for i := range models {
+					err := memWrite(&docs, models[i], int64(i), result)
+					if err != nil {
+						return result, errors.Wrapf(err, "mem: write %d to collection '%s' failed", i, coll)
+					}
+				}
+
+				tx[coll] = docs
+				return result, nil
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		for coll, docs := range tx {
+			colls[coll] = docs
+		}
+
+		return nil
+	})
+
+	return results, err
+}
+
+// FindOneAndUpdate supports the Sort, Upsert and ReturnDocument options
+func (m *MemBackend) FindOneAndUpdate(
+	ctx context.Context,
+	coll string,
+	filter interface{},
+	update interface{},
+	result interface{},
+	opts ...*options.FindOneAndUpdateOptions,
+) error {
+	opt := options.MergeFindOneAndUpdateOptions(opts...)
+	if opt.Projection != nil || opt.ArrayFilters != nil || opt.Collation != nil {
+		return errors.New("mem: projections, array filters and collations are not supported")
+	}
+
+	var found bson.M
+	err := m.write(ctx, func(colls map[string][]bson.M) error {
+		var err error
+		found, err = memFindOneAndUpdate(colls, coll, filter, update, opt)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if found == nil {
+		return mongo.ErrNoDocuments
+	}
+
+	return memDecode(found, result)
+}
+
+func (m *MemBackend) Aggregate(
+	ctx context.Context,
+	coll string,
+	pipeline interface{},
+	results interface{},
+	_ ...*options.AggregateOptions,
+) error {
+	return m.read(ctx, func(colls map[string][]bson.M) error {
+		docs, err := memAggregate(colls[coll], pipeline)
+		if err != nil {
+			return err
+		}
+
+		return memDecodeAll(docs, results)
+	})
+}
+
+// WithTx runs tx on copies of the collections, which replace
+// the originals only if tx succeeds. Calls with the context of tx
+// see its writes, while calls from other goroutines wait for tx.
+//
+// The context passed to tx has no MongoDB session.
+func (m *MemBackend) WithTx(ctx context.Context, tx TxFunc) (interface{}, error) {
+	if m.txFrom(ctx) != nil {
+		return tx(mongo.NewSessionContext(ctx, nil))
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	state := &memTx{backend: m, colls: make(map[string][]bson.M, len(m.colls))}
+	for coll, docs := range m.colls {
+		state.colls[coll] = copyDocs(docs)
+	}
+
+	result, err := tx(mongo.NewSessionContext(context.WithValue(ctx, memTxKey{}, state), nil))
+	if err != nil {
+		return result, errors.Wrap(err, "failed to perform tx")
+	}
+
+	state.mut.Lock()
+	defer state.mut.Unlock()
+
+	if state.changed {
+		m.colls = state.colls
+		m.clock++
+	}
+
+	return result, nil
+}
+
+func (m *MemBackend) txFrom(ctx context.Context) *memTx {
+	tx, ok := ctx.Value(memTxKey{}).(*memTx)
+	if !ok || tx.backend != m {
+		return nil
+	}
+
+	return tx
+}
+
+// read runs fn on the collections seen by ctx
+func (m *MemBackend) read(ctx context.Context, fn func(colls map[string][]bson.M) error) error {
+	if tx := m.txFrom(ctx); tx != nil {
+		tx.mut.Lock()
+		defer tx.mut.Unlock()
+
+		return fn(tx.colls)
+	}
+
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	return fn(m.colls)
+}
+
+// write runs fn on the collections seen by ctx, and records a change if fn succeeds.
+// fn must leave colls unchanged if it fails.
+func (m *MemBackend) write(ctx context.Context, fn func(colls map[string][]bson.M) error) error {
+	if tx := m.txFrom(ctx); tx != nil {
+		tx.mut.Lock()
+		defer tx.mut.Unlock()
+
+		err := fn(tx.colls)
+		if err == nil {
+			tx.changed = true
+		}
+
+		return err
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	err := fn(m.colls)
+	if err == nil {
+		m.clock++
+	}
+
+	return err
+}
+
+func memFind(
+	docs []bson.M,
+	filter interface{},
+	results interface{},
+	opts ...*options.FindOptions,
+) error {
+	f, err := toDoc(filter)
+	if err != nil {
+		return errors.Wrap(err, "bad filter")
+	}
+
+	matched := []bson.M{}
+	for _, doc := range docs {
+		ok, err := memMatch(doc, f)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			matched = append(matched, doc)
+		}
+	}
+
+	matched = copyDocs(matched)
+
+	opt := options.MergeFindOptions(opts...)
+	if opt.Sort != nil {
+		err := memSort(matched, opt.Sort)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opt.Skip != nil {
+		skip := int(*opt.Skip)
+		if skip > len(matched) {
+			skip = len(matched)
+		}
+
+		matched = matched[skip:]
+	}
+
+	if opt.Limit != nil && *opt.Limit > 0 && int(*opt.Limit) < len(matched) {
+		matched = matched[:*opt.Limit]
+	}
+
+	return memDecodeAll(matched, results)
+}
+
+// memFindOneAndUpdate updates the first match of filter in coll, in the order of opt.Sort.
+// It returns a copy of the document before or after the update, or nil.
+func memFindOneAndUpdate(
+	colls map[string][]bson.M,
+	coll string,
+	filter interface{},
+	update interface{},
+	opt *options.FindOneAndUpdateOptions,
+) (
+	bson.M,
+	error,
+) {
+	f, err := toDoc(filter)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad filter")
+	}
+
+	u, err := toDoc(update)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad update")
+	}
+
+	less := func(a, b bson.M) bool { return false }
+	if opt.Sort != nil {
+		less, err = memLess(opt.Sort)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	docs := colls[coll]
+	index := -1
+	for i, doc := range docs {
+		ok, err := memMatch(doc, f)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok && (index < 0 || less(doc, docs[index])) {
+			index = i
+		}
+	}
+
+	after := opt.ReturnDocument != nil && *opt.ReturnDocument == options.After
+
+	if index < 0 {
+		if opt.Upsert == nil || !*opt.Upsert {
+			return nil, nil
+		}
+
+		doc := memUpsertDoc(f)
+		err = memApplyUpdate(doc, u, true)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := doc["_id"]; !ok {
+			doc["_id"] = primitive.NewObjectID()
+		}
+
+		colls[coll] = append(docs, doc)
+		if !after {
+			return nil, nil
+		}
+
+		return copyDoc(doc), nil
+	}
+
+	before := docs[index]
+	updated := copyDoc(before)
+	err = memApplyUpdate(updated, u, false)
+	if err != nil {
+		return nil, err
+	}
+
+	docs[index] = updated
+	if after {
+		return copyDoc(updated), nil
+	}
+
+	return copyDoc(before), nil
+}
+
+// memDecode decodes doc into result, a pointer
+func memDecode(doc bson.M, result interface{}) error {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	return bson.Unmarshal(b, result)
+}
+
+// memDecodeAll decodes docs into results, a pointer to a slice
+func memDecodeAll(docs []bson.M, results interface{}) error {
+	values := make([]interface{}, len(docs))
+	for i := range docs {
+		values[i] = docs[i]
+	}
+
+	cursor, err := mongo.NewCursorFromDocuments(values, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create cursor")
+	}
+
+	return cursor.All(context.Background(), results)
+}
+
+// memWrite executes model on docs, adding the counts to result
+func memWrite(docs *[]bson.M, model mongo.WriteModel, index int64, result *mongo.BulkWriteResult) error {
+	switch m := model.(type) {
+	case *mongo.InsertOneModel:
+		doc, err := toDoc(m.Document)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := doc["_id"]; !ok {
+			doc["_id"] = primitive.NewObjectID()
+		}
+
+		*docs = append(*docs, doc)
+		result.InsertedCount++
+		return nil
+
+	case *mongo.UpdateOneModel:
+		return memUpdate(docs, m.Filter, m.Update, m.Upsert, false, index, result)
+
+	case *mongo.UpdateManyModel:
+		return memUpdate(docs, m.Filter, m.Update, m.Upsert, true, index, result)
+
+	case *mongo.ReplaceOneModel:
+		return memReplace(docs, m, index, result)
+
+	case *mongo.DeleteOneModel:
+		return memDelete(docs, m.Filter, false, result)
+
+	case *mongo.DeleteManyModel:
+		return memDelete(docs, m.Filter, true, result)
+	}
+
+	return fmt.Errorf("mem: unsupported write model %s", reflect.TypeOf(model))
+}
+
+func memUpdate(
+	docs *[]bson.M,
+	filter interface{},
+	update interface{},
+	upsert *bool,
+	many bool,
+	index int64,
+	result *mongo.BulkWriteResult,
+) error {
+	f, err := toDoc(filter)
+	if err != nil {
+		return errors.Wrap(err, "bad filter")
+	}
+
+	u, err := toDoc(update)
+	if err != nil {
+		return errors.Wrap(err, "bad update")
+	}
+
+	matched := false
+	for i, doc := range *docs {
+		ok, err := memMatch(doc, f)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		matched = true
+		updated := copyDoc(doc)
+		err = memApplyUpdate(updated, u, false)
+		if err != nil {
+			return err
+		}
+
+		result.MatchedCount++
+		if !reflect.DeepEqual(doc, updated) {
+			result.ModifiedCount++
+		}
+
+		(*docs)[i] = updated
+		if !many {
+			break
+		}
+	}
+
+	if matched || upsert == nil || !*upsert {
+		return nil
+	}
+
+	doc := memUpsertDoc(f)
+	err = memApplyUpdate(doc, u, true)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = primitive.NewObjectID()
+	}
+
+	*docs = append(*docs, doc)
+	result.UpsertedCount++
+	result.UpsertedIDs[index] = doc["_id"]
+
+	return nil
+}
+
+func memReplace(docs *[]bson.M, m *mongo.ReplaceOneModel, index int64, result *mongo.BulkWriteResult) error {
+	f, err := toDoc(m.Filter)
+	if err != nil {
+		return errors.Wrap(err, "bad filter")
+	}
+
+	replacement, err := toDoc(m.Replacement)
+	if err != nil {
+		return errors.Wrap(err, "bad replacement")
+	}
+
+	for i, doc := range *docs {
+		ok, err := memMatch(doc, f)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		replacement["_id"] = doc["_id"]
+		result.MatchedCount++
+		if !reflect.DeepEqual(doc, replacement) {
+			result.ModifiedCount++
+		}
+
+		(*docs)[i] = replacement
+		return nil
+	}
+
+	if m.Upsert == nil || !*m.Upsert {
+		return nil
+	}
+
+	if _, ok := replacement["_id"]; !ok {
+		replacement["_id"] = primitive.NewObjectID()
+	}
+
+	*docs = append(*docs, replacement)
+	result.UpsertedCount++
+	result.UpsertedIDs[index] = replacement["_id"]
+
+	return nil
+}
+
+func memDelete(docs *[]bson.M, filter interface{}, many bool, result *mongo.BulkWriteResult) error {
+	f, err := toDoc(filter)
+	if err != nil {
+		return errors.Wrap(err, "bad filter")
+	}
+
+	kept := make([]bson.M, 0, len(*docs))
+	deleted := false
+	for _, doc := range *docs {
+		if deleted && !many {
+			kept = append(kept, doc)
+			continue
+		}
+
+		ok, err := memMatch(doc, f)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			deleted = true
+			result.DeletedCount++
+			continue
+		}
+
+		kept = append(kept, doc)
+	}
+
+	*docs = kept
+	return nil
+}
+
+// memUpsertDoc builds the base document for upserts from equality conditions in filter
+func memUpsertDoc(filter bson.M) bson.M {
+	doc := bson.M{}
+	for key, cond := range filter {
+		if key == "$and" {
+			subs, ok := cond.(bson.A)
+			if !ok {
+				continue
+			}
+
+			for _, sub := range subs {
+				if subDoc, ok := sub.(bson.M); ok {
+					for k, v := range memUpsertDoc(subDoc) {
+						doc[k] = v
+					}
+				}
+			}
+
+			continue
+		}
+
+		if isOperator(key) || isOperatorDoc(cond) {
+			continue
+		}
+
+		memSetPath(doc, key, cond)
+	}
+
+	return doc
+}
+
+func memApplyUpdate(doc bson.M, update bson.M, inserting bool) error {
+	if len(update) == 0 {
+		return errors.New("mem: empty update")
+	}
+
+	for op, fields := range update {
+		f, ok := fields.(bson.M)
+		if !ok {
+			return fmt.Errorf("mem: bad %s value %v", op, fields)
+		}
+
+		switch op {
+		case "$set":
+			for path, v := range f {
+				memSetPath(doc, path, v)
+			}
+
+		case "$setOnInsert":
+			if !inserting {
+				continue
+			}
+
+			for path, v := range f {
+				memSetPath(doc, path, v)
+			}
+
+		case "$unset":
+			for path := range f {
+				memUnsetPath(doc, path)
+			}
+
+		case "$inc":
+			for path, delta := range f {
+				current, exists := memGetPath(doc, path)
+				if !exists || current == nil {
+					memSetPath(doc, path, delta)
+					continue
+				}
+
+				sum, err := memAdd(current, delta)
+				if err != nil {
+					return errors.Wrapf(err, "mem: cannot $inc field '%s'", path)
+				}
+
+				memSetPath(doc, path, sum)
+			}
+
+		default:
+			return fmt.Errorf("mem: unsupported update operator '%s'", op)
+		}
+	}
+
+	return nil
+}
+
+func memSort(docs []bson.M, sortSpec interface{}) error {
+	less, err := memLess(sortSpec)
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		return less(docs[i], docs[j])
+	})
+
+	return nil
+}
+
+// memLess returns the order of sortSpec, e.g. bson.D{{Key: "t", Value: -1}}
+func memLess(sortSpec interface{}) (func(a, b bson.M) bool, error) {
+	spec, err := toOrderedDoc(sortSpec)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad sort")
+	}
+
+	return func(a, b bson.M) bool {
+		for _, e := range spec {
+			x, _ := memGetPath(a, e.Key)
+			y, _ := memGetPath(b, e.Key)
+
+			c := memCompare(x, y)
+			if c == 0 {
+				continue
+			}
+
+			if n, ok := toFloat(e.Value); ok && n < 0 {
+				return c > 0
+			}
+
+			return c < 0
+		}
+
+		return false
+	}, nil
+}
+
+// toDoc normalizes v, e.g. a struct, bson.D or map, into bson.M
+// with the same value types as documents read from MongoDB
+func toDoc(v interface{}) (bson.M, error) {
+	if v == nil {
+		return bson.M{}, nil
+	}
+
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc bson.M
+	err = bson.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+func toOrderedDoc(v interface{}) (bson.D, error) {
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc bson.D
+	err = bson.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+func copyDoc(doc bson.M) bson.M {
+	copied, err := toDoc(doc)
+	if err != nil {
+		// Documents in MemBackend are always valid BSON
+		panic(err)
+	}
+
+	return copied
+}
+
+func copyDocs(docs []bson.M) []bson.M {
+	copied := make([]bson.M, len(docs))
+	for i := range docs {
+		copied[i] = copyDoc(docs[i])
+	}
+
+	return copied
+}
@@ -0,0 +1,399 @@
+package smongo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// memAggregate runs pipeline on copies of docs. It supports the stages
+// $match, $sort, $skip, $limit, $count, $project and $group, with
+// the accumulators $sum, $avg, $min, $max, $first, $last and $push.
+//
+// Expressions are field paths like "$amount", literals,
+// and documents or arrays of expressions. Operators like $add are not supported.
+func memAggregate(docs []bson.M, pipeline interface{}) ([]bson.M, error) {
+	wrapped, err := toOrderedDoc(bson.M{"pipeline": pipeline})
+	if err != nil {
+		return nil, errors.Wrap(err, "bad pipeline")
+	}
+
+	stages, ok := wrapped[0].Value.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("mem: pipeline must be an array, got %v", pipeline)
+	}
+
+	docs = copyDocs(docs)
+	for i, s := range stages {
+		stage, ok := s.(bson.D)
+		if !ok || len(stage) != 1 {
+			return nil, fmt.Errorf("mem: stage %d must be a document with a single field", i)
+		}
+
+		docs, err = memStage(docs, stage[0].Key, stage[0].Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "mem: stage %d (%s) failed", i, stage[0].Key)
+		}
+	}
+
+	return docs, nil
+}
+
+func memStage(docs []bson.M, name string, spec interface{}) ([]bson.M, error) {
+	switch name {
+	case "$match":
+		f, err := toDoc(spec)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad filter")
+		}
+
+		matched := []bson.M{}
+		for _, doc := range docs {
+			ok, err := memMatch(doc, f)
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				matched = append(matched, doc)
+			}
+		}
+
+		return matched, nil
+
+	case "$sort":
+		return docs, memSort(docs, spec)
+
+	case "$skip":
+		n, ok := toFloat(spec)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("bad skip %v", spec)
+		}
+
+		if int(n) > len(docs) {
+			return []bson.M{}, nil
+		}
+
+		return docs[int(n):], nil
+
+	case "$limit":
+		n, ok := toFloat(spec)
+		if !ok || n <= 0 {
+			return nil, fmt.Errorf("bad limit %v", spec)
+		}
+
+		if int(n) < len(docs) {
+			return docs[:int(n)], nil
+		}
+
+		return docs, nil
+
+	case "$count":
+		field, ok := spec.(string)
+		if !ok || field == "" {
+			return nil, fmt.Errorf("bad count field %v", spec)
+		}
+
+		// Like MongoDB, counting no documents outputs nothing
+		if len(docs) == 0 {
+			return []bson.M{}, nil
+		}
+
+		return []bson.M{{field: int32(len(docs))}}, nil
+
+	case "$project":
+		fields, ok := spec.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("bad projection %v", spec)
+		}
+
+		return memProject(docs, fields)
+
+	case "$group":
+		fields, ok := spec.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("bad group %v", spec)
+		}
+
+		return memGroup(docs, fields)
+	}
+
+	return nil, fmt.Errorf("mem: unsupported stage '%s'", name)
+}
+
+func memProject(docs []bson.M, spec bson.D) ([]bson.M, error) {
+	keepID := true
+	include, exclude := false, false
+	for _, e := range spec {
+		flag, isFlag := memFlag(e.Value)
+		switch {
+		case e.Key == "_id" && isFlag:
+			keepID = flag
+		case isFlag && !flag:
+			exclude = true
+		default:
+			include = true
+		}
+	}
+
+	if include && exclude {
+		return nil, errors.New("cannot mix inclusion and exclusion")
+	}
+
+	projected := make([]bson.M, len(docs))
+	for i, doc := range docs {
+		if !include {
+			out := doc
+			for _, e := range spec {
+				if e.Key != "_id" {
+					memUnsetPath(out, e.Key)
+				}
+			}
+
+			if !keepID {
+				delete(out, "_id")
+			}
+
+			projected[i] = out
+			continue
+		}
+
+		out := bson.M{}
+		if id, ok := doc["_id"]; ok && keepID {
+			out["_id"] = id
+		}
+
+		for _, e := range spec {
+			flag, isFlag := memFlag(e.Value)
+			if isFlag {
+				if e.Key == "_id" || !flag {
+					continue
+				}
+
+				if v, ok := memGetPath(doc, e.Key); ok {
+					memSetPath(out, e.Key, v)
+				}
+
+				continue
+			}
+
+			v, err := memEval(doc, e.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			memSetPath(out, e.Key, v)
+		}
+
+		projected[i] = out
+	}
+
+	return projected, nil
+}
+
+func memGroup(docs []bson.M, spec bson.D) ([]bson.M, error) {
+	var idExpr interface{}
+	hasID := false
+	for _, e := range spec {
+		if e.Key == "_id" {
+			idExpr, hasID = e.Value, true
+		}
+	}
+
+	if !hasID {
+		return nil, errors.New("group requires _id")
+	}
+
+	// Groups keep the order in which their first documents appear
+	var ids []interface{}
+	var members [][]bson.M
+
+	for _, doc := range docs {
+		id, err := memEval(doc, idExpr)
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for i := range ids {
+			if memEqValue(ids[i], id) {
+				members[i] = append(members[i], doc)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			ids = append(ids, id)
+			members = append(members, []bson.M{doc})
+		}
+	}
+
+	groups := make([]bson.M, len(ids))
+	for i := range ids {
+		group := bson.M{"_id": ids[i]}
+
+		for _, e := range spec {
+			if e.Key == "_id" {
+				continue
+			}
+
+			acc, ok := e.Value.(bson.D)
+			if !ok || len(acc) != 1 {
+				return nil, fmt.Errorf("field '%s' must be a single accumulator", e.Key)
+			}
+
+			v, err := memAccumulate(members[i], acc[0].Key, acc[0].Value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field '%s'", e.Key)
+			}
+
+			group[e.Key] = v
+		}
+
+		groups[i] = group
+	}
+
+	return groups, nil
+}
+
+// memAccumulate applies accumulator op to expr evaluated on docs.
+// Missing and null values are skipped, except by $first and $last.
+func memAccumulate(docs []bson.M, op string, expr interface{}) (interface{}, error) {
+	values := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		v, err := memEval(doc, expr)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = v
+	}
+
+	switch op {
+	case "$first":
+		return values[0], nil
+
+	case "$last":
+		return values[len(values)-1], nil
+
+	case "$sum", "$avg":
+		var sum interface{} = int32(0)
+		n := 0
+		for _, v := range values {
+			if _, ok := toFloat(v); !ok {
+				continue
+			}
+
+			var err error
+			sum, err = memAdd(sum, v)
+			if err != nil {
+				return nil, err
+			}
+
+			n++
+		}
+
+		if op == "$sum" {
+			return sum, nil
+		}
+
+		if n == 0 {
+			return nil, nil
+		}
+
+		total, _ := toFloat(sum)
+		return total / float64(n), nil
+
+	case "$min", "$max":
+		var result interface{}
+		for _, v := range values {
+			if v == nil {
+				continue
+			}
+
+			c := memCompare(v, result)
+			if result == nil || (op == "$min" && c < 0) || (op == "$max" && c > 0) {
+				result = v
+			}
+		}
+
+		return result, nil
+
+	case "$push":
+		pushed := bson.A{}
+		for _, v := range values {
+			if v != nil {
+				pushed = append(pushed, v)
+			}
+		}
+
+		return pushed, nil
+	}
+
+	return nil, fmt.Errorf("mem: unsupported accumulator '%s'", op)
+}
+
+// memEval evaluates expr on doc. Missing fields evaluate to nil.
+func memEval(doc bson.M, expr interface{}) (interface{}, error) {
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$$") {
+			return nil, fmt.Errorf("mem: unsupported variable '%s'", e)
+		}
+
+		if strings.HasPrefix(e, "$") {
+			v, _ := memGetPath(doc, e[1:])
+			return v, nil
+		}
+
+		return e, nil
+
+	case bson.D:
+		out := bson.M{}
+		for _, field := range e {
+			if isOperator(field.Key) {
+				return nil, fmt.Errorf("mem: unsupported expression operator '%s'", field.Key)
+			}
+
+			v, err := memEval(doc, field.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			out[field.Key] = v
+		}
+
+		return out, nil
+
+	case bson.A:
+		out := make(bson.A, len(e))
+		for i := range e {
+			v, err := memEval(doc, e[i])
+			if err != nil {
+				return nil, err
+			}
+
+			out[i] = v
+		}
+
+		return out, nil
+	}
+
+	return expr, nil
+}
+
+// memFlag reads projection values like 1, 0, true and false
+func memFlag(v interface{}) (bool, bool) {
+	if b, ok := v.(bool); ok {
+		return b, true
+	}
+
+	if n, ok := toFloat(v); ok {
+		return n != 0, true
+	}
+
+	return false, false
+}
@@ -0,0 +1,346 @@
+package smongo
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memMatch reports whether doc matches filter
+func memMatch(doc bson.M, filter bson.M) (bool, error) {
+	for key, cond := range filter {
+		var ok bool
+		var err error
+
+		switch key {
+		case "$and", "$or", "$nor":
+			ok, err = memMatchLogical(doc, key, cond)
+
+		default:
+			if isOperator(key) {
+				return false, fmt.Errorf("mem: unsupported top-level operator '%s'", key)
+			}
+
+			v, exists := memGetPath(doc, key)
+			ok, err = memMatchField(v, exists, cond)
+		}
+
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func memMatchLogical(doc bson.M, op string, cond interface{}) (bool, error) {
+	subs, ok := cond.(bson.A)
+	if !ok {
+		return false, fmt.Errorf("mem: %s requires an array", op)
+	}
+
+	for _, sub := range subs {
+		subFilter, ok := sub.(bson.M)
+		if !ok {
+			return false, fmt.Errorf("mem: %s requires an array of documents", op)
+		}
+
+		matched, err := memMatch(doc, subFilter)
+		if err != nil {
+			return false, err
+		}
+
+		switch {
+		case op == "$and" && !matched:
+			return false, nil
+
+		case op == "$or" && matched:
+			return true, nil
+
+		case op == "$nor" && matched:
+			return false, nil
+		}
+	}
+
+	return op != "$or", nil
+}
+
+func memMatchField(v interface{}, exists bool, cond interface{}) (bool, error) {
+	ops, ok := cond.(bson.M)
+	if !ok || !isOperatorDoc(ops) {
+		return memEq(v, exists, cond), nil
+	}
+
+	for op, arg := range ops {
+		var ok bool
+
+		switch op {
+		case "$eq":
+			ok = memEq(v, exists, arg)
+
+		case "$ne":
+			ok = !memEq(v, exists, arg)
+
+		case "$in", "$nin":
+			list, isList := arg.(bson.A)
+			if !isList {
+				return false, fmt.Errorf("mem: %s requires an array", op)
+			}
+
+			for _, item := range list {
+				if memEq(v, exists, item) {
+					ok = true
+					break
+				}
+			}
+
+			if op == "$nin" {
+				ok = !ok
+			}
+
+		case "$gt", "$gte", "$lt", "$lte":
+			if !exists || !memComparable(v, arg) {
+				return false, nil
+			}
+
+			c := memCompare(v, arg)
+			switch op {
+			case "$gt":
+				ok = c > 0
+			case "$gte":
+				ok = c >= 0
+			case "$lt":
+				ok = c < 0
+			case "$lte":
+				ok = c <= 0
+			}
+
+		case "$exists":
+			want, isBool := arg.(bool)
+			if !isBool {
+				return false, errors.New("mem: $exists requires a bool")
+			}
+
+			ok = exists == want
+
+		default:
+			return false, fmt.Errorf("mem: unsupported filter operator '%s'", op)
+		}
+
+		if !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// memEq matches like MongoDB equality: null matches missing fields,
+// and arrays match if any element is equal
+func memEq(v interface{}, exists bool, want interface{}) bool {
+	if want == nil {
+		return !exists || v == nil
+	}
+
+	if !exists {
+		return false
+	}
+
+	if memEqValue(v, want) {
+		return true
+	}
+
+	if arr, ok := v.(bson.A); ok {
+		for _, item := range arr {
+			if memEqValue(item, want) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func memEqValue(a, b interface{}) bool {
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+	if okA && okB {
+		return fa == fb
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+func memComparable(a, b interface{}) bool {
+	_, okA := toFloat(a)
+	_, okB := toFloat(b)
+	if okA && okB {
+		return true
+	}
+
+	_, okA = a.(string)
+	_, okB = b.(string)
+
+	return okA && okB
+}
+
+// memCompare orders a and b. Missing and null values sort first,
+// and values of different types are ordered by type name.
+func memCompare(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+	if okA && okB {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+
+		return 0
+	}
+
+	sa, okA := a.(string)
+	sb, okB := b.(string)
+	if okA && okB {
+		return strings.Compare(sa, sb)
+	}
+
+	ta, okA := a.(primitive.DateTime)
+	tb, okB := b.(primitive.DateTime)
+	if okA && okB {
+		return memCompare(int64(ta), int64(tb))
+	}
+
+	return strings.Compare(fmt.Sprintf("%T", a), fmt.Sprintf("%T", b))
+}
+
+func memAdd(a, b interface{}) (interface{}, error) {
+	switch x := a.(type) {
+	case int32:
+		if y, ok := b.(int32); ok {
+			return x + y, nil
+		}
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return x + y, nil
+		case int32:
+			return x + int64(y), nil
+		}
+	}
+
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+	if !okA || !okB {
+		return nil, fmt.Errorf("non-numeric values %v and %v", a, b)
+	}
+
+	if _, ok := a.(float64); !ok {
+		if _, ok := b.(float64); !ok {
+			return int64(fa + fb), nil
+		}
+	}
+
+	return fa + fb, nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+
+	return 0, false
+}
+
+func memGetPath(doc bson.M, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	var current interface{} = doc
+
+	for _, part := range parts {
+		m, ok := current.(bson.M)
+		if !ok {
+			return nil, false
+		}
+
+		current, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+func memSetPath(doc bson.M, path string, v interface{}) {
+	parts := strings.Split(path, ".")
+	current := doc
+
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(bson.M)
+		if !ok {
+			next = bson.M{}
+			current[part] = next
+		}
+
+		current = next
+	}
+
+	current[parts[len(parts)-1]] = v
+}
+
+func memUnsetPath(doc bson.M, path string) {
+	parts := strings.Split(path, ".")
+	current := doc
+
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(bson.M)
+		if !ok {
+			return
+		}
+
+		current = next
+	}
+
+	delete(current, parts[len(parts)-1])
+}
+
+func isOperator(key string) bool {
+	return strings.HasPrefix(key, "$")
+}
+
+// isOperatorDoc reports whether v is a document of operators, e.g. {"$in": [...]}
+func isOperatorDoc(v interface{}) bool {
+	m, ok := v.(bson.M)
+	if !ok || len(m) == 0 {
+		return false
+	}
+
+	for key := range m {
+		if !isOperator(key) {
+			return false
+		}
+	}
+
+	return true
+}
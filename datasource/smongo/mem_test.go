@@ -0,0 +1,585 @@
+package smongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMemMatch(t *testing.T) {
+	doc := bson.M{
+		"name":    "a1",
+		"balance": float64(100),
+		"count":   int32(3),
+		"total":   int64(7),
+		"nil":     nil,
+		"tags":    bson.A{"x", "y"},
+		"owner":   bson.M{"id": "c1", "banned": false},
+	}
+
+	tests := []struct {
+		name   string
+		filter bson.M
+		expect bool
+	}{
+		{name: "empty", filter: bson.M{}, expect: true},
+		{name: "equality", filter: bson.M{"name": "a1"}, expect: true},
+		{name: "equality mismatch", filter: bson.M{"name": "a2"}, expect: false},
+		{name: "equality across int32 and float64", filter: bson.M{"count": float64(3)}, expect: true},
+		{name: "equality across int64 and int32", filter: bson.M{"total": int32(7)}, expect: true},
+		{name: "nested path", filter: bson.M{"owner.id": "c1"}, expect: true},
+		{name: "array element", filter: bson.M{"tags": "y"}, expect: true},
+		{name: "whole array", filter: bson.M{"tags": bson.A{"x", "y"}}, expect: true},
+		{name: "null matches missing", filter: bson.M{"missing": nil}, expect: true},
+		{name: "null matches null", filter: bson.M{"nil": nil}, expect: true},
+		{name: "null does not match value", filter: bson.M{"name": nil}, expect: false},
+		{name: "$eq", filter: bson.M{"name": bson.M{"$eq": "a1"}}, expect: true},
+		{name: "$ne", filter: bson.M{"name": bson.M{"$ne": "a1"}}, expect: false},
+		{name: "$ne matches missing", filter: bson.M{"suspended": bson.M{"$ne": true}}, expect: true},
+		{name: "$ne array element", filter: bson.M{"tags": bson.M{"$ne": "x"}}, expect: false},
+		{name: "$in", filter: bson.M{"name": bson.M{"$in": bson.A{"a0", "a1"}}}, expect: true},
+		{name: "$in mismatch", filter: bson.M{"name": bson.M{"$in": bson.A{"a0"}}}, expect: false},
+		{name: "$in null matches missing", filter: bson.M{"missing": bson.M{"$in": bson.A{nil}}}, expect: true},
+		{name: "$nin", filter: bson.M{"name": bson.M{"$nin": bson.A{"a0", "a1"}}}, expect: false},
+		{name: "$nin matches missing", filter: bson.M{"missing": bson.M{"$nin": bson.A{"a1"}}}, expect: true},
+		{name: "$gt across types", filter: bson.M{"balance": bson.M{"$gt": int32(99)}}, expect: true},
+		{name: "$gte", filter: bson.M{"count": bson.M{"$gte": int64(3)}}, expect: true},
+		{name: "$lt", filter: bson.M{"total": bson.M{"$lt": float64(7)}}, expect: false},
+		{name: "$lte", filter: bson.M{"total": bson.M{"$lte": float64(7.5)}}, expect: true},
+		{name: "range", filter: bson.M{"balance": bson.M{"$gte": 99.99, "$lte": 100.01}}, expect: true},
+		{name: "string comparison", filter: bson.M{"name": bson.M{"$gt": "a0"}}, expect: true},
+		{name: "comparison does not match missing", filter: bson.M{"missing": bson.M{"$lt": 1}}, expect: false},
+		{name: "comparison does not match other types", filter: bson.M{"name": bson.M{"$gt": 1}}, expect: false},
+		{name: "$exists", filter: bson.M{"nil": bson.M{"$exists": true}}, expect: true},
+		{name: "$exists false", filter: bson.M{"missing": bson.M{"$exists": false}}, expect: true},
+		{name: "$and", filter: bson.M{"$and": bson.A{bson.M{"name": "a1"}, bson.M{"count": 4}}}, expect: false},
+		{name: "$or", filter: bson.M{"$or": bson.A{bson.M{"name": "a2"}, bson.M{"count": 3}}}, expect: true},
+		{name: "$or none", filter: bson.M{"$or": bson.A{bson.M{"name": "a2"}, bson.M{"count": 4}}}, expect: false},
+		{name: "$nor", filter: bson.M{"$nor": bson.A{bson.M{"name": "a2"}, bson.M{"count": 4}}}, expect: true},
+		{name: "embedded document equality", filter: bson.M{"owner": bson.M{"id": "c1", "banned": false}}, expect: true},
+	}
+
+	for i := range tests {
+		tc := &tests[i]
+
+		actual, err := memMatch(doc, tc.filter)
+		if err != nil {
+			t.Fatalf("[%s] unexpected error: %v", tc.name, err)
+		}
+
+		if actual != tc.expect {
+			t.Fatalf("[%s] expecting %v, got %v", tc.name, tc.expect, actual)
+		}
+	}
+}
+
+func TestMemMatchErrors(t *testing.T) {
+	filters := []bson.M{
+		{"$where": "true"},
+		{"name": bson.M{"$regex": "a"}},
+		{"name": bson.M{"$in": "a1"}},
+		{"name": bson.M{"$exists": 1}},
+		{"$or": bson.M{"name": "a1"}},
+	}
+
+	for _, filter := range filters {
+		_, err := memMatch(bson.M{"name": "a1"}, filter)
+		if err == nil {
+			t.Fatalf("expecting error for filter %v", filter)
+		}
+	}
+}
+
+func TestMemAdd(t *testing.T) {
+	tests := []struct {
+		a, b   interface{}
+		expect interface{}
+		err    bool
+	}{
+		{a: int32(1), b: int32(2), expect: int32(3)},
+		{a: int64(1), b: int32(2), expect: int64(3)},
+		{a: int32(1), b: int64(2), expect: int64(3)},
+		{a: int64(1), b: int64(2), expect: int64(3)},
+		{a: float64(1.5), b: int32(2), expect: float64(3.5)},
+		{a: int64(1), b: float64(0.5), expect: float64(1.5)},
+		{a: "1", b: int32(1), err: true},
+		{a: int32(1), b: true, err: true},
+	}
+
+	for _, tc := range tests {
+		actual, err := memAdd(tc.a, tc.b)
+		if tc.err {
+			if err == nil {
+				t.Fatalf("expecting error adding %v and %v", tc.a, tc.b)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual != tc.expect {
+			t.Fatalf("adding %v (%T) and %v (%T): expecting %v (%T), got %v (%T)", tc.a, tc.a, tc.b, tc.b, tc.expect, tc.expect, actual, actual)
+		}
+	}
+}
+
+func TestMemApplyUpdate(t *testing.T) {
+	tests := []struct {
+		name      string
+		doc       bson.M
+		update    bson.M
+		inserting bool
+		expect    bson.M
+		err       bool
+	}{
+		{
+			name:   "$set nested",
+			doc:    bson.M{"a": int32(1)},
+			update: bson.M{"$set": bson.M{"b.c": "x"}},
+			expect: bson.M{"a": int32(1), "b": bson.M{"c": "x"}},
+		},
+		{
+			name:   "$unset",
+			doc:    bson.M{"a": int32(1), "b": int32(2)},
+			update: bson.M{"$unset": bson.M{"b": ""}},
+			expect: bson.M{"a": int32(1)},
+		},
+		{
+			name:   "$inc",
+			doc:    bson.M{"balance": float64(10)},
+			update: bson.M{"$inc": bson.M{"balance": float64(-2.5)}},
+			expect: bson.M{"balance": float64(7.5)},
+		},
+		{
+			name:   "$inc missing field",
+			doc:    bson.M{},
+			update: bson.M{"$inc": bson.M{"attempts": int32(1)}},
+			expect: bson.M{"attempts": int32(1)},
+		},
+		{
+			name:   "$inc non-numeric field",
+			doc:    bson.M{"attempts": "1"},
+			update: bson.M{"$inc": bson.M{"attempts": int32(1)}},
+			err:    true,
+		},
+		{
+			name:   "$setOnInsert on update",
+			doc:    bson.M{"a": int32(1)},
+			update: bson.M{"$setOnInsert": bson.M{"created": true}},
+			expect: bson.M{"a": int32(1)},
+		},
+		{
+			name:      "$setOnInsert on insert",
+			doc:       bson.M{"a": int32(1)},
+			update:    bson.M{"$setOnInsert": bson.M{"created": true}},
+			inserting: true,
+			expect:    bson.M{"a": int32(1), "created": true},
+		},
+		{
+			name:   "empty update",
+			doc:    bson.M{},
+			update: bson.M{},
+			err:    true,
+		},
+		{
+			name:   "unsupported operator",
+			doc:    bson.M{"tags": bson.A{}},
+			update: bson.M{"$push": bson.M{"tags": "x"}},
+			err:    true,
+		},
+	}
+
+	for i := range tests {
+		tc := &tests[i]
+
+		err := memApplyUpdate(tc.doc, tc.update, tc.inserting)
+		if tc.err {
+			if err == nil {
+				t.Fatalf("[%s] expecting error", tc.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("[%s] unexpected error: %v", tc.name, err)
+		}
+
+		if !reflect.DeepEqual(tc.doc, tc.expect) {
+			t.Fatalf("[%s] expecting %v, got %v", tc.name, tc.expect, tc.doc)
+		}
+	}
+}
+
+func TestMemBackendBulkWrite(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemBackend()
+
+	err := mem.Insert("accounts",
+		bson.M{"_id": "a1", "balance": float64(10)},
+		bson.M{"_id": "a2", "balance": float64(20), "suspended": true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan := WritePlan{}.
+		Then("accounts", []mongo.WriteModel{
+			mongo.NewUpdateManyModel().
+				SetFilter(bson.M{"suspended": bson.M{"$ne": true}}).
+				SetUpdate(bson.M{"$inc": bson.M{"balance": float64(5)}}),
+			mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": "a3", "owner_id": "c3"}).
+				SetUpdate(bson.M{"$set": bson.M{"balance": float64(0)}, "$setOnInsert": bson.M{"created": true}}).
+				SetUpsert(true),
+			mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": "a2"}),
+		}).
+		Then("payouts", []mongo.WriteModel{
+			mongo.NewInsertOneModel().SetDocument(bson.M{"_id": "p1", "amount": float64(5)}),
+		})
+
+	result, err := mem.BulkWrite(ctx, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts := result.Colls["accounts"]
+	if accounts.MatchedCount != 1 || accounts.ModifiedCount != 1 || accounts.UpsertedCount != 1 || accounts.DeletedCount != 1 {
+		t.Fatalf("unexpected accounts result %+v", accounts)
+	}
+
+	if accounts.UpsertedIDs[1] != "a3" {
+		t.Fatalf("unexpected upserted ids %v", accounts.UpsertedIDs)
+	}
+
+	expect := []bson.M{
+		{"_id": "a1", "balance": float64(15)},
+		{"_id": "a3", "owner_id": "c3", "balance": float64(0), "created": true},
+	}
+
+	if actual := mem.Docs("accounts"); !reflect.DeepEqual(actual, expect) {
+		t.Fatalf("unexpected accounts\nexpect %v\nactual %v", expect, actual)
+	}
+
+	// A failing write rolls back the whole plan, including other collections
+	failing := WritePlan{}.
+		Then("payouts", []mongo.WriteModel{
+			mongo.NewInsertOneModel().SetDocument(bson.M{"_id": "p2"}),
+		}).
+		Then("accounts", []mongo.WriteModel{
+			mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": "a1"}).SetUpdate(bson.M{"$inc": bson.M{"balance": float64(1)}}),
+			mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": "a1"}).SetUpdate(bson.M{"$inc": bson.M{"_id": int32(1)}}),
+		})
+
+	_, err = mem.BulkWrite(ctx, failing)
+	if err == nil {
+		t.Fatal("expecting $inc on a non-numeric field to fail")
+	}
+
+	if actual := mem.Docs("accounts"); !reflect.DeepEqual(actual, expect) {
+		t.Fatalf("failed plan changed accounts: %v", actual)
+	}
+
+	if payouts := mem.Docs("payouts"); len(payouts) != 1 {
+		t.Fatalf("failed plan changed payouts: %v", payouts)
+	}
+}
+
+func TestMemBackendFind(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemBackend()
+
+	err := mem.Insert("payouts",
+		bson.M{"_id": "p1", "t": int64(3)},
+		bson.M{"_id": "p2", "t": int64(1)},
+		bson.M{"_id": "p3", "t": int64(2)},
+		bson.M{"_id": "p4"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results []bson.M
+	err = mem.Find(ctx, "payouts", bson.M{"t": bson.M{"$exists": true}}, &results, options.Find().SetSort(bson.D{{Key: "t", Value: -1}}).SetSkip(1).SetLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0]["_id"] != "p3" {
+		t.Fatalf("unexpected results %v", results)
+	}
+
+	before, err := mem.FindSnapshot(ctx, nil, SnapshotQuery{Coll: "payouts", Filter: bson.M{}, Results: &results})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 4 {
+		t.Fatalf("unexpected snapshot results %v", results)
+	}
+
+	_, err = mem.BulkWrite(ctx, WritePlan{}.Then("payouts", []mongo.WriteModel{mongo.NewDeleteManyModel().SetFilter(bson.M{})}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = mem.FindSnapshot(ctx, &before, SnapshotQuery{Coll: "payouts", Filter: bson.M{}, Results: &results})
+	if err == nil {
+		t.Fatal("expecting snapshot in the past to be rejected")
+	}
+}
+
+func TestMemBackendFindOneAndUpdate(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemBackend()
+
+	err := mem.Insert("units",
+		bson.M{"_id": "u1", "state": "pending", "priority": int32(1)},
+		bson.M{"_id": "u2", "state": "pending", "priority": int32(2)},
+		bson.M{"_id": "u3", "state": "done", "priority": int32(3)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claim := bson.M{"$set": bson.M{"state": "leased"}}
+
+	var claimed bson.M
+	err = mem.FindOneAndUpdate(ctx, "units", bson.M{"state": "pending"}, claim, &claimed,
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "priority", Value: -1}}).SetReturnDocument(options.After))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claimed["_id"] != "u2" || claimed["state"] != "leased" {
+		t.Fatalf("unexpected claimed unit %v", claimed)
+	}
+
+	// Returns the document before the update by default
+	var before bson.M
+	err = mem.FindOneAndUpdate(ctx, "units", bson.M{"state": "pending"}, claim, &before)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before["_id"] != "u1" || before["state"] != "pending" {
+		t.Fatalf("unexpected unit before update %v", before)
+	}
+
+	err = mem.FindOneAndUpdate(ctx, "units", bson.M{"state": "pending"}, claim, &before)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Fatalf("expecting ErrNoDocuments, got %v", err)
+	}
+
+	var upserted bson.M
+	err = mem.FindOneAndUpdate(ctx, "units", bson.M{"_id": "u4"}, claim, &upserted,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upserted["_id"] != "u4" || upserted["state"] != "leased" || len(mem.Docs("units")) != 4 {
+		t.Fatalf("unexpected upserted unit %v", upserted)
+	}
+
+	// A failing update changes nothing
+	err = mem.FindOneAndUpdate(ctx, "units", bson.M{"_id": "u3"}, bson.M{"$inc": bson.M{"state": int32(1)}}, &before)
+	if err == nil {
+		t.Fatal("expecting $inc on a non-numeric field to fail")
+	}
+
+	if docs := mem.Docs("units"); docs[2]["state"] != "done" {
+		t.Fatalf("failed update changed unit %v", docs[2])
+	}
+}
+
+func TestMemBackendAggregate(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemBackend()
+
+	err := mem.Insert("payouts",
+		bson.M{"_id": "p1", "owner": "c1", "state": "done", "amount": int32(10)},
+		bson.M{"_id": "p2", "owner": "c2", "state": "done", "amount": float64(2.5)},
+		bson.M{"_id": "p3", "owner": "c1", "state": "done", "amount": int32(5)},
+		bson.M{"_id": "p4", "owner": "c1", "state": "failed", "amount": int32(1)},
+		bson.M{"_id": "p5", "owner": "c3", "state": "done"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"state": "done"}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$owner"},
+			{Key: "count", Value: bson.M{"$sum": 1}},
+			{Key: "total", Value: bson.M{"$sum": "$amount"}},
+			{Key: "max", Value: bson.M{"$max": "$amount"}},
+			{Key: "ids", Value: bson.M{"$push": "$_id"}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$skip", Value: 1}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "owner": "$_id", "total": 1, "ids": 1}}},
+	}
+
+	type total struct {
+		Owner string   `bson:"owner"`
+		Total float64  `bson:"total"`
+		IDs   []string `bson:"ids"`
+	}
+
+	var totals []total
+	err = mem.Aggregate(ctx, "payouts", pipeline, &totals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []total{
+		{Owner: "c2", Total: 2.5, IDs: []string{"p2"}},
+		{Owner: "c3", Total: 0, IDs: []string{"p5"}},
+	}
+
+	if !reflect.DeepEqual(totals, expect) {
+		t.Fatalf("unexpected totals\nexpect %+v\nactual %+v", expect, totals)
+	}
+
+	var counts []bson.M
+	err = mem.Aggregate(ctx, "payouts", bson.A{bson.M{"$match": bson.M{"state": "failed"}}, bson.M{"$count": "n"}}, &counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(counts) != 1 || counts[0]["n"] != int32(1) {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+
+	err = mem.Aggregate(ctx, "payouts", bson.A{bson.M{"$lookup": bson.M{}}}, &counts)
+	if err == nil {
+		t.Fatal("expecting unsupported stage to fail")
+	}
+}
+
+func TestMemBackendVersionedWrites(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemBackend()
+
+	err := mem.Insert("accounts",
+		bson.M{"_id": "a1", "balance": int32(10), "version": int64(1)},
+		bson.M{"_id": "a2", "balance": int32(20)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := NewVersions("_id", "")
+	err = versions.Set("a1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a2 was read at version 1, but has no version yet
+	err = versions.Set("a2", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writes := []mongo.WriteModel{
+		mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": "a1"}).SetUpdate(bson.M{"$inc": bson.M{"balance": int32(1)}}),
+		mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": "a2"}).SetUpdate(bson.M{"$inc": bson.M{"balance": int32(1)}}),
+	}
+
+	_, err = mem.BulkWrite(ctx, WritePlan{}.ThenVersioned("accounts", versions, writes))
+
+	conflict := &ConflictError{}
+	if !errors.Is(err, ErrConflict) || !errors.As(err, &conflict) || !reflect.DeepEqual(conflict.Keys, []interface{}{"a2"}) {
+		t.Fatalf("expecting conflict on a2, got %v", err)
+	}
+
+	if docs := mem.Docs("accounts"); docs[0]["balance"] != int32(10) {
+		t.Fatalf("conflicting plan changed accounts: %v", docs)
+	}
+
+	result, err := mem.BulkWrite(ctx, WritePlan{}.ThenVersioned("accounts", versions, writes[:1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Coll("accounts").ModifiedCount != 1 {
+		t.Fatalf("unexpected result %+v", result.Coll("accounts"))
+	}
+
+	if docs := mem.Docs("accounts"); docs[0]["balance"] != int32(11) || docs[0]["version"] != int64(2) {
+		t.Fatalf("unexpected account %v", docs[0])
+	}
+}
+
+func TestMemBackendWithTx(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemBackend()
+
+	err := mem.Insert("accounts", bson.M{"_id": "a1", "balance": int32(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	debit := WritePlan{}.Then("accounts", []mongo.WriteModel{
+		mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": "a1"}).SetUpdate(bson.M{"$inc": bson.M{"balance": int32(-4)}}),
+	})
+
+	errAbort := errors.New("abort")
+	_, err = mem.WithTx(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		_, err := mem.BulkWrite(ctx, debit)
+		if err != nil {
+			return nil, err
+		}
+
+		// Writes of the transaction are visible inside it
+		var accounts []bson.M
+		err = mem.Find(ctx, "accounts", bson.M{"balance": int32(6)}, &accounts)
+		if err != nil || len(accounts) != 1 {
+			return nil, fmt.Errorf("expecting debited account, got %v, %v", accounts, err)
+		}
+
+		// Nested transactions join the outer one
+		return mem.WithTx(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+			return nil, errAbort
+		})
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("expecting abort, got %v", err)
+	}
+
+	if docs := mem.Docs("accounts"); docs[0]["balance"] != int32(10) {
+		t.Fatalf("aborted tx changed account %v", docs[0])
+	}
+
+	before, err := mem.FindSnapshot(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = mem.WithTx(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		return mem.BulkWrite(ctx, debit)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if docs := mem.Docs("accounts"); docs[0]["balance"] != int32(6) {
+		t.Fatalf("unexpected account %v", docs[0])
+	}
+
+	_, err = mem.FindSnapshot(ctx, &before)
+	if err == nil {
+		t.Fatal("expecting committed tx to advance the snapshot time")
+	}
+}
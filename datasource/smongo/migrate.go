@@ -0,0 +1,399 @@
+package smongo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/soyart/satch"
+)
+
+const (
+	DefaultMigrationsColl = "migrations"
+	DefaultMigrationLock  = 10 * time.Minute
+
+	migrationLockID = "lock"
+)
+
+// ErrMigrationLocked is returned when another migrator holds the lock
+var ErrMigrationLocked = errors.New("migrations are locked by another migrator")
+
+// MigrationFunc changes the database for one direction of a migration
+type MigrationFunc func(ctx context.Context, db *mongo.Database) error
+
+// Migration is a versioned database change.
+// Down may be nil for irreversible migrations.
+type Migration struct {
+	Version     int64
+	Description string
+	Up          MigrationFunc
+	Down        MigrationFunc
+}
+
+type MigrationStatus struct {
+	Version     int64
+	Description string
+	Applied     bool
+	AppliedAt   time.Time
+}
+
+// Migrator applies migrations to a database, recording applied versions
+// in a migrations collection. Only one migrator can run at a time.
+type Migrator struct {
+	db         *mongo.Database
+	coll       *mongo.Collection
+	migrations []Migration
+	lock       *CollLock
+}
+
+type migrationRecord struct {
+	Version     int64  `bson:"_id"`
+	Description string `bson:"description"`
+	AppliedAt   int64  `bson:"applied_at"`
+}
+
+// NewMigrator validates migrations and returns a Migrator using collection
+// DefaultMigrationsColl in db. Versions must be positive and unique.
+func NewMigrator(db *mongo.Database, migrations []Migration) (*Migrator, error) {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+
+	for i := range sorted {
+		m := &sorted[i]
+
+		switch {
+		case m.Version <= 0:
+			return nil, fmt.Errorf("migration version must be positive, got %d", m.Version)
+
+		case m.Up == nil:
+			return nil, fmt.Errorf("migration %d has no up function", m.Version)
+
+		case i > 0 && sorted[i-1].Version == m.Version:
+			return nil, fmt.Errorf("duplicate migration version %d", m.Version)
+		}
+	}
+
+	coll := db.Collection(DefaultMigrationsColl)
+
+	return &Migrator{
+		db:         db,
+		coll:       coll,
+		migrations: sorted,
+		lock:       NewCollLock(coll, migrationLockID, DefaultMigrationLock),
+	}, nil
+}
+
+// WithColl makes m record migrations in collection coll
+func (m *Migrator) WithColl(coll string) *Migrator {
+	m.coll = m.db.Collection(coll)
+	m.lock = NewCollLock(m.coll, migrationLockID, m.lock.ttl)
+	return m
+}
+
+// WithLockTTL sets how long a lock is held before other migrators can take it over.
+// The lock is renewed while migrations run, so ttl only bounds how long
+// a crashed migrator blocks others.
+func (m *Migrator) WithLockTTL(ttl time.Duration) *Migrator {
+	m.lock = NewCollLock(m.coll, migrationLockID, ttl)
+	return m
+}
+
+// Up applies pending migrations up to and including version target.
+// If target is 0, all pending migrations are applied.
+func (m *Migrator) Up(ctx context.Context, target int64) ([]int64, error) {
+	var done []int64
+
+	err := m.withLock(ctx, func(ctx context.Context, applied map[int64]migrationRecord) error {
+		for i := range m.migrations {
+			migration := &m.migrations[i]
+			if target > 0 && migration.Version > target {
+				break
+			}
+
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			logrus.Infof("migrate: up %d (%s)", migration.Version, migration.Description)
+
+			err := migration.Up(ctx, m.db)
+			if err != nil {
+				return errors.Wrapf(err, "migration %d up failed", migration.Version)
+			}
+
+			// Only the lock owner may record the migration
+			err = m.lock.Renew(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "migration %d applied but not recorded", migration.Version)
+			}
+
+			_, err = m.coll.InsertOne(ctx, migrationRecord{
+				Version:     migration.Version,
+				Description: migration.Description,
+				AppliedAt:   time.Now().Unix(),
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed to record migration %d", migration.Version)
+			}
+
+			done = append(done, migration.Version)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Down reverts applied migrations with versions greater than target, newest first.
+// It stops at the first migration without a down function.
+func (m *Migrator) Down(ctx context.Context, target int64) ([]int64, error) {
+	var done []int64
+
+	err := m.withLock(ctx, func(ctx context.Context, applied map[int64]migrationRecord) error {
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := &m.migrations[i]
+			if migration.Version <= target {
+				break
+			}
+
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+
+			if migration.Down == nil {
+				return fmt.Errorf("migration %d is irreversible", migration.Version)
+			}
+
+			logrus.Infof("migrate: down %d (%s)", migration.Version, migration.Description)
+
+			err := migration.Down(ctx, m.db)
+			if err != nil {
+				return errors.Wrapf(err, "migration %d down failed", migration.Version)
+			}
+
+			err = m.lock.Renew(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "migration %d reverted but not unrecorded", migration.Version)
+			}
+
+			_, err = m.coll.DeleteOne(ctx, bson.M{"_id": migration.Version})
+			if err != nil {
+				return errors.Wrapf(err, "failed to unrecord migration %d", migration.Version)
+			}
+
+			done = append(done, migration.Version)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Status reports every known migration and whether it is applied.
+// Applied versions unknown to m are reported too.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	known := make(map[int64]bool)
+
+	for i := range m.migrations {
+		migration := &m.migrations[i]
+		known[migration.Version] = true
+
+		status := MigrationStatus{
+			Version:     migration.Version,
+			Description: migration.Description,
+		}
+
+		if record, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = time.Unix(record.AppliedAt, 0)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	for version, record := range applied {
+		if known[version] {
+			continue
+		}
+
+		statuses = append(statuses, MigrationStatus{
+			Version:     version,
+			Description: record.Description,
+			Applied:     true,
+			AppliedAt:   time.Unix(record.AppliedAt, 0),
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+
+	return statuses, nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int64]migrationRecord, error) {
+	cursor, err := m.coll.Find(ctx, bson.M{"_id": bson.M{"$type": "number"}})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find applied migrations in collection '%s'", m.coll.Name())
+	}
+
+	var records []migrationRecord
+	err = cursor.All(ctx, &records)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode applied migrations")
+	}
+
+	applied := make(map[int64]migrationRecord, len(records))
+	for i := range records {
+		applied[records[i].Version] = records[i]
+	}
+
+	return applied, nil
+}
+
+// withLock runs f while holding the migration lock.
+// The lock is renewed while f runs, and ctx of f is canceled if the lock is lost.
+func (m *Migrator) withLock(ctx context.Context, f func(ctx context.Context, applied map[int64]migrationRecord) error) error {
+	err := m.lock.Lock(ctx, "migrate")
+	if err != nil {
+		if errors.Is(err, satch.ErrLocked) {
+			return ErrMigrationLocked
+		}
+
+		return err
+	}
+
+	defer func() {
+		errUnlock := m.lock.Unlock(context.Background())
+		if errUnlock != nil {
+			logrus.Errorf("migrate: failed to release lock: %s", errUnlock.Error())
+		}
+	}()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	stop := m.lock.KeepAlive(ctx, cancel)
+	defer stop()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = f(ctx, applied)
+	if cause := context.Cause(ctx); err != nil && errors.Is(cause, satch.ErrLockLost) {
+		return errors.Wrap(cause, "migration aborted")
+	}
+
+	return err
+}
+
+// Steps runs fns in order
+func Steps(fns ...MigrationFunc) MigrationFunc {
+	return func(ctx context.Context, db *mongo.Database) error {
+		for i := range fns {
+			err := fns[i](ctx, db)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// CreateIndexes creates indexes on coll. Use options.Index() to make
+// unique (SetUnique), TTL (SetExpireAfterSeconds) or named indexes,
+// and multiple keys in bson.D for compound indexes.
+func CreateIndexes(coll string, indexes ...mongo.IndexModel) MigrationFunc {
+	return func(ctx context.Context, db *mongo.Database) error {
+		_, err := db.Collection(coll).Indexes().CreateMany(ctx, indexes)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create %d indexes on collection '%s'", len(indexes), coll)
+		}
+
+		return nil
+	}
+}
+
+// DropIndexes drops indexes on coll by name
+func DropIndexes(coll string, names ...string) MigrationFunc {
+	return func(ctx context.Context, db *mongo.Database) error {
+		for _, name := range names {
+			_, err := db.Collection(coll).Indexes().DropOne(ctx, name)
+			if err != nil {
+				return errors.Wrapf(err, "failed to drop index '%s' on collection '%s'", name, coll)
+			}
+		}
+
+		return nil
+	}
+}
+
+// SetValidator sets a $jsonSchema validator on coll, creating coll if it does not exist.
+// A nil schema removes the validator.
+func SetValidator(coll string, schema bson.M) MigrationFunc {
+	return func(ctx context.Context, db *mongo.Database) error {
+		validator := bson.M{}
+		if schema != nil {
+			validator = bson.M{"$jsonSchema": schema}
+		}
+
+		names, err := db.ListCollectionNames(ctx, bson.M{"name": coll})
+		if err != nil {
+			return errors.Wrapf(err, "failed to list collection '%s'", coll)
+		}
+
+		if len(names) == 0 {
+			err = db.CreateCollection(ctx, coll, options.CreateCollection().SetValidator(validator))
+			if err != nil {
+				return errors.Wrapf(err, "failed to create collection '%s' with validator", coll)
+			}
+
+			return nil
+		}
+
+		err = db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: coll},
+			{Key: "validator", Value: validator},
+		}).Err()
+		if err != nil {
+			return errors.Wrapf(err, "failed to set validator on collection '%s'", coll)
+		}
+
+		return nil
+	}
+}
+
+// Transform updates all documents in coll matching filter.
+// update may be an update document or an aggregation pipeline.
+func Transform(coll string, filter interface{}, update interface{}) MigrationFunc {
+	return func(ctx context.Context, db *mongo.Database) error {
+		result, err := db.Collection(coll).UpdateMany(ctx, filter, update)
+		if err != nil {
+			return errors.Wrapf(err, "failed to transform documents in collection '%s'", coll)
+		}
+
+		logrus.Infof("migrate: transformed %d documents in collection '%s'", result.ModifiedCount, coll)
+		return nil
+	}
+}
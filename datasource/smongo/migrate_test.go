@@ -0,0 +1,115 @@
+package smongo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/soyart/satch"
+)
+
+func TestMigratorRenewsLock(t *testing.T) {
+	db := testDB(t, false)
+	ctx := context.Background()
+
+	started := make(chan struct{})
+	slow := Migration{
+		Version:     1,
+		Description: "outlives lock ttl",
+		Up: func(ctx context.Context, _ *mongo.Database) error {
+			close(started)
+
+			select {
+			case <-time.After(5 * time.Second):
+				return nil
+
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+
+	first, err := NewMigrator(db, []Migration{slow})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := first.WithLockTTL(3*time.Second).Up(ctx, 0)
+		done <- err
+	}()
+
+	<-started
+	time.Sleep(4 * time.Second)
+
+	second, err := NewMigrator(db, []Migration{slow})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = second.WithLockTTL(3*time.Second).Up(ctx, 0)
+	if !errors.Is(err, ErrMigrationLocked) {
+		t.Fatalf("expecting lock to be renewed past its ttl, got %v", err)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigratorLockLost(t *testing.T) {
+	db := testDB(t, false)
+	ctx := context.Background()
+
+	started := make(chan struct{})
+	migrator, err := NewMigrator(db, []Migration{{
+		Version: 1,
+		Up: func(ctx context.Context, _ *mongo.Database) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := migrator.WithLockTTL(3*time.Second).Up(ctx, 0)
+		done <- err
+	}()
+
+	<-started
+
+	// Another owner takes the lock over
+	_, err = db.Collection(DefaultMigrationsColl).UpdateOne(ctx, bson.M{"_id": migrationLockID}, bson.M{"$set": bson.M{"owner": "other"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-done:
+		if !errors.Is(err, satch.ErrLockLost) {
+			t.Fatalf("expecting satch.ErrLockLost, got %v", err)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("migration was not aborted after losing its lock")
+	}
+
+	n, err := db.Collection(DefaultMigrationsColl).CountDocuments(ctx, bson.M{"_id": int64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 0 {
+		t.Fatal("migration recorded without the lock")
+	}
+}
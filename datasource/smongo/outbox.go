@@ -0,0 +1,466 @@
+package smongo
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultOutboxColl        = "outbox"
+	DefaultOutboxBatchSize   = 100
+	DefaultOutboxInterval    = 5 * time.Second
+	DefaultOutboxMaxAttempts = 10
+)
+
+// OutboxEvent is an event written to the outbox in the same transaction as
+// the changes it describes. ID is the dedup ID: consumers should ignore
+// events with IDs they have already seen, as the relay delivers at least once.
+type OutboxEvent struct {
+	ID          string      `bson:"_id" json:"id"`
+	Topic       string      `bson:"topic" json:"topic"`
+	Payload     interface{} `bson:"payload" json:"payload"`
+	CreatedAt   int64       `bson:"created_at" json:"createdAt"`
+	PublishedAt int64       `bson:"published_at,omitempty" json:"publishedAt,omitempty"`
+	Attempts    int         `bson:"attempts,omitempty" json:"attempts,omitempty"`
+	ParkedAt    int64       `bson:"parked_at,omitempty" json:"parkedAt,omitempty"` // Set once Attempts reaches the relay's max attempts
+}
+
+// NewOutboxEvent creates an event. If id is empty, a random ID is used.
+//
+// Prefer deterministic IDs derived from the change, e.g. "payout.settled:<payout ID>",
+// so that a retried commit does not create a second event.
+func NewOutboxEvent(id, topic string, payload interface{}, now time.Time) OutboxEvent {
+	if id == "" {
+		id = randomID()
+	}
+
+	return OutboxEvent{
+		ID:        id,
+		Topic:     topic,
+		Payload:   payload,
+		CreatedAt: now.Unix(),
+	}
+}
+
+// OutboxWrites converts events into write models for the outbox collection,
+// to be committed with the other writes, e.g. as the last step of a WritePlan.
+//
+// Events are upserted by ID, so writing the same event twice is a no-op.
+func OutboxWrites(events []OutboxEvent) []mongo.WriteModel {
+	writes := make([]mongo.WriteModel, len(events))
+	for i := range events {
+		event := events[i]
+		writes[i] = mongo.
+			NewUpdateOneModel().
+			SetFilter(bson.M{"_id": event.ID}).
+			SetUpdate(bson.M{
+				"$setOnInsert": bson.M{
+					"topic":      event.Topic,
+					"payload":    event.Payload,
+					"created_at": event.CreatedAt,
+				},
+			}).
+			SetUpsert(true)
+	}
+
+	return writes
+}
+
+// Publisher publishes outbox events to other services.
+// Publish should only return nil if all events were delivered.
+type Publisher interface {
+	Publish(ctx context.Context, events []OutboxEvent) error
+}
+
+// PublisherFunc adapts a function to Publisher
+type PublisherFunc func(ctx context.Context, events []OutboxEvent) error
+
+func (f PublisherFunc) Publish(ctx context.Context, events []OutboxEvent) error {
+	return f(ctx, events)
+}
+
+// WriterPublisher writes events as JSON lines to an io.Writer
+type WriterPublisher struct {
+	mut sync.Mutex
+	w   io.Writer
+}
+
+func NewWriterPublisher(w io.Writer) *WriterPublisher {
+	return &WriterPublisher{w: w}
+}
+
+// NewStdoutPublisher returns a WriterPublisher writing to stdout
+func NewStdoutPublisher() *WriterPublisher {
+	return NewWriterPublisher(os.Stdout)
+}
+
+func (p *WriterPublisher) Publish(_ context.Context, events []OutboxEvent) error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	enc := json.NewEncoder(p.w)
+	for i := range events {
+		err := enc.Encode(events[i])
+		if err != nil {
+			return errors.Wrapf(err, "failed to write outbox event '%s'", events[i].ID)
+		}
+	}
+
+	return nil
+}
+
+// FilePublisher appends events as JSON lines to a file, syncing after each batch
+type FilePublisher struct {
+	mut  sync.Mutex
+	path string
+}
+
+func NewFilePublisher(path string) *FilePublisher {
+	return &FilePublisher{path: path}
+}
+
+func (p *FilePublisher) Publish(ctx context.Context, events []OutboxEvent) error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	f, err := os.OpenFile(p.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open outbox file '%s'", p.path)
+	}
+
+	defer f.Close()
+
+	err = NewWriterPublisher(f).Publish(ctx, events)
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// HTTPPublisher POSTs each event as JSON to a webhook URL,
+// with the event ID in header Idempotency-Key
+type HTTPPublisher struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client // http.DefaultClient if nil
+}
+
+func (p *HTTPPublisher) Publish(ctx context.Context, events []OutboxEvent) error {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	for i := range events {
+		event := &events[i]
+
+		body, err := json.Marshal(event)
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal outbox event '%s'", event.ID)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+		if err != nil {
+			return errors.Wrap(err, "failed to create webhook request")
+		}
+
+		for k, v := range p.Headers {
+			req.Header.Set(k, v)
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", event.ID)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return errors.Wrapf(err, "failed to post outbox event '%s'", event.ID)
+		}
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("webhook returned status %d for outbox event '%s'", resp.StatusCode, event.ID)
+		}
+	}
+
+	return nil
+}
+
+// Relay drains unpublished events from the outbox collection to a Publisher.
+// Events are marked published only after Publish succeeds,
+// so a crash between the two results in redelivery.
+//
+// If a batch fails, its events are published one by one, so that an event
+// that always fails does not hold back the others. Events that fail max attempts
+// times are parked, and are not relayed again until Unpark.
+type Relay struct {
+	backend     Backend
+	coll        string
+	pub         Publisher
+	batchSize   int64
+	interval    time.Duration
+	maxAttempts int
+}
+
+// NewRelay returns a Relay for outbox collection coll.
+// Marking events is transactional, so the deployment must support transactions.
+func NewRelay(coll *mongo.Collection, pub Publisher) *Relay {
+	return NewBackendRelay(NewMongoBackend(coll.Database()), coll.Name(), pub)
+}
+
+// NewBackendRelay returns a Relay for outbox collection coll in backend, e.g. MemBackend in tests
+func NewBackendRelay(backend Backend, coll string, pub Publisher) *Relay {
+	return &Relay{
+		backend:     backend,
+		coll:        coll,
+		pub:         pub,
+		batchSize:   DefaultOutboxBatchSize,
+		interval:    DefaultOutboxInterval,
+		maxAttempts: DefaultOutboxMaxAttempts,
+	}
+}
+
+// WithBatchSize sets the most events published at once.
+// Non-positive n means DefaultOutboxBatchSize.
+func (r *Relay) WithBatchSize(n int64) *Relay {
+	if n <= 0 {
+		n = DefaultOutboxBatchSize
+	}
+
+	r.batchSize = n
+	return r
+}
+
+// WithInterval sets how long Run waits after the outbox is drained.
+// Non-positive d means DefaultOutboxInterval.
+func (r *Relay) WithInterval(d time.Duration) *Relay {
+	if d <= 0 {
+		d = DefaultOutboxInterval
+	}
+
+	r.interval = d
+	return r
+}
+
+// WithMaxAttempts sets how many times an event may fail before it is parked.
+// Non-positive n means DefaultOutboxMaxAttempts.
+func (r *Relay) WithMaxAttempts(n int) *Relay {
+	if n <= 0 {
+		n = DefaultOutboxMaxAttempts
+	}
+
+	r.maxAttempts = n
+	return r
+}
+
+// Drain publishes one batch of unpublished events, oldest first,
+// and returns the number of events published.
+// Events that failed are counted, and parked once they reach max attempts.
+func (r *Relay) Drain(ctx context.Context) (int, error) {
+	var events []OutboxEvent
+	err := r.backend.Find(
+		ctx,
+		r.coll,
+		bson.M{
+			"published_at": bson.M{"$exists": false},
+			"parked_at":    bson.M{"$exists": false},
+		},
+		&events,
+		options.Find().
+			SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}).
+			SetLimit(r.batchSize),
+	)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to find outbox events in collection '%s'", r.coll)
+	}
+
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	published, failed, errPub := r.publish(ctx, events)
+
+	err = r.mark(ctx, published, failed)
+	if err != nil {
+		return 0, err
+	}
+
+	if errPub != nil {
+		return len(published), errors.Wrapf(errPub, "failed to publish %d of %d outbox events", len(failed), len(events))
+	}
+
+	return len(published), nil
+}
+
+// publish publishes events as a batch, or one by one if the batch fails.
+// It returns the first error of failed events.
+func (r *Relay) publish(ctx context.Context, events []OutboxEvent) ([]OutboxEvent, []OutboxEvent, error) {
+	err := r.pub.Publish(ctx, events)
+	if err == nil {
+		return events, nil, nil
+	}
+
+	if len(events) == 1 || ctx.Err() != nil {
+		return nil, events, err
+	}
+
+	logrus.Warnf("outbox: batch of %d events failed, publishing one by one: %s", len(events), err.Error())
+
+	var published, failed []OutboxEvent
+	var errFirst error
+	for i := range events {
+		err := r.pub.Publish(ctx, events[i:i+1])
+		if err == nil {
+			published = append(published, events[i])
+			continue
+		}
+
+		failed = append(failed, events[i])
+		if errFirst == nil {
+			errFirst = errors.Wrapf(err, "outbox event '%s'", events[i].ID)
+		}
+	}
+
+	return published, failed, errFirst
+}
+
+// mark marks published events, and counts attempts of failed events in one transaction
+func (r *Relay) mark(ctx context.Context, published, failed []OutboxEvent) error {
+	now := time.Now().Unix()
+	writes := []mongo.WriteModel{}
+
+	if len(published) > 0 {
+		writes = append(writes, mongo.
+			NewUpdateManyModel().
+			SetFilter(bson.M{"_id": bson.M{"$in": outboxIDs(published)}}).
+			SetUpdate(bson.M{"$set": bson.M{"published_at": now}}),
+		)
+	}
+
+	if len(failed) > 0 {
+		ids := outboxIDs(failed)
+		writes = append(
+			writes,
+			mongo.
+				NewUpdateManyModel().
+				SetFilter(bson.M{"_id": bson.M{"$in": ids}}).
+				SetUpdate(bson.M{"$inc": bson.M{"attempts": 1}}),
+			mongo.
+				NewUpdateManyModel().
+				SetFilter(bson.M{"_id": bson.M{"$in": ids}, "attempts": bson.M{"$gte": r.maxAttempts}}).
+				SetUpdate(bson.M{"$set": bson.M{"parked_at": now}}),
+		)
+
+		for i := range failed {
+			if failed[i].Attempts+1 >= r.maxAttempts {
+				logrus.Errorf("outbox: parking event '%s' after %d failed attempts", failed[i].ID, failed[i].Attempts+1)
+			}
+		}
+	}
+
+	_, err := r.backend.BulkWrite(ctx, WritePlan{}.Then(r.coll, writes))
+	if err != nil {
+		return errors.Wrapf(err, "failed to mark %d published and %d failed outbox events", len(published), len(failed))
+	}
+
+	return nil
+}
+
+// Parked returns parked events, oldest first
+func (r *Relay) Parked(ctx context.Context) ([]OutboxEvent, error) {
+	var events []OutboxEvent
+	err := r.backend.Find(
+		ctx,
+		r.coll,
+		bson.M{"parked_at": bson.M{"$exists": true}},
+		&events,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find parked outbox events in collection '%s'", r.coll)
+	}
+
+	return events, nil
+}
+
+// Unpark resets attempts of parked events with ids, so that they are relayed again
+func (r *Relay) Unpark(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	in := make(bson.A, len(ids))
+	for i := range ids {
+		in[i] = ids[i]
+	}
+
+	_, err := r.backend.BulkWrite(ctx, WritePlan{}.Then(r.coll, []mongo.WriteModel{
+		mongo.
+			NewUpdateManyModel().
+			SetFilter(bson.M{"_id": bson.M{"$in": in}, "parked_at": bson.M{"$exists": true}}).
+			SetUpdate(bson.M{"$unset": bson.M{"parked_at": "", "attempts": ""}}),
+	}))
+	if err != nil {
+		return errors.Wrapf(err, "failed to unpark %d outbox events", len(ids))
+	}
+
+	return nil
+}
+
+// Run drains the outbox until ctx is done. Publish errors are logged and retried.
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.Drain(ctx)
+		if err != nil {
+			logrus.Errorf("outbox: %s", err.Error())
+		}
+
+		// Keep draining without waiting while there are full batches
+		if err == nil && int64(n) == r.batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+func outboxIDs(events []OutboxEvent) bson.A {
+	ids := make(bson.A, len(events))
+	for i := range events {
+		ids[i] = events[i].ID
+	}
+
+	return ids
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,129 @@
+package smongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// failingPublisher records published event IDs, and fails batches with events in fail
+type failingPublisher struct {
+	fail      map[string]bool
+	published []string
+	calls     int
+}
+
+func (p *failingPublisher) Publish(_ context.Context, events []OutboxEvent) error {
+	p.calls++
+	for i := range events {
+		if p.fail[events[i].ID] {
+			return fmt.Errorf("cannot publish %s", events[i].ID)
+		}
+	}
+
+	for i := range events {
+		p.published = append(p.published, events[i].ID)
+	}
+
+	return nil
+}
+
+func TestRelayParksFailingEvents(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemBackend()
+
+	now := time.Unix(1000, 0)
+	events := []OutboxEvent{
+		NewOutboxEvent("e1", "topic", bson.M{"n": 1}, now),
+		NewOutboxEvent("e2", "topic", bson.M{"n": 2}, now.Add(time.Second)),
+		NewOutboxEvent("e3", "topic", bson.M{"n": 3}, now.Add(2*time.Second)),
+	}
+
+	_, err := mem.BulkWrite(ctx, WritePlan{}.Then(DefaultOutboxColl, OutboxWrites(events)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub := &failingPublisher{fail: map[string]bool{"e2": true}}
+	relay := NewBackendRelay(mem, DefaultOutboxColl, pub).WithBatchSize(0).WithMaxAttempts(2)
+
+	// The failing event does not hold back the others
+	n, err := relay.Drain(ctx)
+	if err == nil || n != 2 {
+		t.Fatalf("expecting 2 published and an error, got %d, %v", n, err)
+	}
+
+	if fmt.Sprint(pub.published) != "[e1 e3]" {
+		t.Fatalf("unexpected published events %v", pub.published)
+	}
+
+	// Parked after max attempts
+	n, err = relay.Drain(ctx)
+	if err == nil || n != 0 {
+		t.Fatalf("expecting failure, got %d, %v", n, err)
+	}
+
+	calls := pub.calls
+	n, err = relay.Drain(ctx)
+	if err != nil || n != 0 || pub.calls != calls {
+		t.Fatalf("expecting parked event to be skipped, got %d, %v, %d calls", n, err, pub.calls-calls)
+	}
+
+	parked, err := relay.Parked(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parked) != 1 || parked[0].ID != "e2" || parked[0].Attempts != 2 || parked[0].ParkedAt == 0 {
+		t.Fatalf("unexpected parked events %+v", parked)
+	}
+
+	// Unparked events are relayed again
+	pub.fail = nil
+	err = relay.Unpark(ctx, "e2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err = relay.Drain(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("expecting unparked event to be published, got %d, %v", n, err)
+	}
+
+	for _, doc := range mem.Docs(DefaultOutboxColl) {
+		if _, ok := doc["published_at"]; !ok {
+			t.Fatalf("event %v not published", doc["_id"])
+		}
+	}
+}
+
+func TestRelayRun(t *testing.T) {
+	mem := NewMemBackend()
+	_, err := mem.BulkWrite(context.Background(), WritePlan{}.Then(DefaultOutboxColl, OutboxWrites([]OutboxEvent{
+		NewOutboxEvent("e1", "topic", nil, time.Now()),
+		NewOutboxEvent("e2", "topic", nil, time.Now()),
+		NewOutboxEvent("e3", "topic", nil, time.Now()),
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub := &failingPublisher{}
+	relay := NewBackendRelay(mem, DefaultOutboxColl, pub).WithBatchSize(2).WithInterval(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = relay.Run(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if len(pub.published) != 3 {
+		t.Fatalf("expecting all events published, got %v", pub.published)
+	}
+}
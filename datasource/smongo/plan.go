@@ -0,0 +1,133 @@
+package smongo
+
+import (
+	"sort"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WritePlan is an ordered list of per-collection writes.
+// Unlike map[string][]mongo.WriteModel, the order in which
+// collections are written is defined by the caller.
+type WritePlan []CollWrites
+
+// CollWrites is a step in WritePlan
+type CollWrites struct {
+	Coll   string
+	Writes []mongo.WriteModel
+
+	// Unordered makes MongoDB continue with the remaining writes
+	// in this step after a write fails. Steps are ordered by default.
+	Unordered bool
+
+	// Opts are applied after the plan-wide options, and after Unordered
+	Opts []*options.BulkWriteOptions
+
+	// Versions, if set, makes this step's writes versioned.
+	// See TxVersionedBulkWrite. Versioned writes are sent one at a time,
+	// so Unordered has no effect, but Opts still apply to each write.
+	Versions *Versions
+}
+
+// PlanFromColls converts collWrites into WritePlan,
+// with collections sorted by name.
+func PlanFromColls(collWrites map[string][]mongo.WriteModel) WritePlan {
+	colls := make([]string, 0, len(collWrites))
+	for coll := range collWrites {
+		colls = append(colls, coll)
+	}
+
+	sort.Strings(colls)
+
+	plan := make(WritePlan, len(colls))
+	for i, coll := range colls {
+		plan[i] = CollWrites{
+			Coll:   coll,
+			Writes: collWrites[coll],
+		}
+	}
+
+	return plan
+}
+
+// PlanFromCollsOrdered converts collWrites into WritePlan, with collections
+// in order first, and the rest sorted by name
+func PlanFromCollsOrdered(collWrites map[string][]mongo.WriteModel, order []string) WritePlan {
+	plan := WritePlan{}
+	rest := make(map[string][]mongo.WriteModel, len(collWrites))
+	for coll, writes := range collWrites {
+		rest[coll] = writes
+	}
+
+	for _, coll := range order {
+		writes, ok := rest[coll]
+		if !ok {
+			continue
+		}
+
+		plan = plan.Then(coll, writes)
+		delete(rest, coll)
+	}
+
+	return append(plan, PlanFromColls(rest)...)
+}
+
+// Then appends a step for coll to the plan
+func (p WritePlan) Then(
+	coll string,
+	writes []mongo.WriteModel,
+	opts ...*options.BulkWriteOptions,
+) WritePlan {
+	return append(p, CollWrites{
+		Coll:   coll,
+		Writes: writes,
+		Opts:   opts,
+	})
+}
+
+// ThenUnordered appends an unordered step for coll to the plan
+func (p WritePlan) ThenUnordered(
+	coll string,
+	writes []mongo.WriteModel,
+	opts ...*options.BulkWriteOptions,
+) WritePlan {
+	return append(p, CollWrites{
+		Coll:      coll,
+		Writes:    writes,
+		Unordered: true,
+		Opts:      opts,
+	})
+}
+
+// ThenVersioned appends a versioned step for coll to the plan
+func (p WritePlan) ThenVersioned(
+	coll string,
+	versions *Versions,
+	writes []mongo.WriteModel,
+) WritePlan {
+	return append(p, CollWrites{
+		Coll:     coll,
+		Writes:   writes,
+		Versions: versions,
+	})
+}
+
+// Len returns the total number of write models in the plan
+func (p WritePlan) Len() int {
+	n := 0
+	for i := range p {
+		n += len(p[i].Writes)
+	}
+
+	return n
+}
+
+func (c *CollWrites) options(planOpts []*options.BulkWriteOptions) []*options.BulkWriteOptions {
+	opts := make([]*options.BulkWriteOptions, 0, len(planOpts)+len(c.Opts)+1)
+	opts = append(opts, planOpts...)
+	opts = append(opts, options.BulkWrite().SetOrdered(!c.Unordered))
+	opts = append(opts, c.Opts...)
+
+	return opts
+}
@@ -0,0 +1,693 @@
+package smongo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/soyart/satch"
+)
+
+const (
+	DefaultQueueColl     = "satch_queue"
+	DefaultLeaseTTL      = time.Minute
+	DefaultMaxAttempts   = 3
+	DefaultQueueInterval = time.Second
+)
+
+var (
+	// ErrLeaseLost is returned when a lease expired and was reclaimed by others
+	ErrLeaseLost = errors.New("lease lost")
+
+	// ErrRunIncomplete is returned by Finalize while a run has unfinished units
+	ErrRunIncomplete = errors.New("run incomplete")
+
+	// ErrRunFinalized is returned by Finalize if the run was already finalized
+	ErrRunFinalized = errors.New("run already finalized")
+)
+
+// UnitState is the state of a WorkUnit
+type UnitState string
+
+const (
+	UnitPending UnitState = "pending"
+	UnitLeased  UnitState = "leased"
+	UnitDone    UnitState = "done"
+	UnitFailed  UnitState = "failed" // Failed MaxAttempts times
+)
+
+// WorkUnit is a part of a job run, stored as a document in the queue collection.
+// Times are unix milliseconds.
+type WorkUnit struct {
+	ID         string        `bson:"_id"`
+	Run        string        `bson:"run"`
+	Seq        int           `bson:"seq"`
+	Payload    bson.RawValue `bson:"payload"`
+	State      UnitState     `bson:"state"`
+	Owner      string        `bson:"owner,omitempty"`
+	LeaseUntil int64         `bson:"lease_until,omitempty"`
+	Attempts   int           `bson:"attempts"`
+	Err        string        `bson:"err,omitempty"`
+	Result     interface{}   `bson:"result,omitempty"`
+	CreatedAt  int64         `bson:"created_at"`
+	UpdatedAt  int64         `bson:"updated_at"`
+}
+
+// DecodePayload decodes the payload of u into v
+func (u *WorkUnit) DecodePayload(v interface{}) error {
+	err := u.Payload.Unmarshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decode payload of unit '%s'", u.ID)
+	}
+
+	return nil
+}
+
+// RunStatus counts the units of a run by state
+type RunStatus struct {
+	Run     string
+	Pending int
+	Leased  int
+	Done    int
+	Failed  int
+}
+
+func (s RunStatus) Total() int {
+	return s.Pending + s.Leased + s.Done + s.Failed
+}
+
+// Complete reports whether every unit is done or failed
+func (s RunStatus) Complete() bool {
+	return s.Pending == 0 && s.Leased == 0
+}
+
+// Queue distributes the work units of job runs to workers in several processes.
+//
+// Workers claim units with leases via find-and-modify, and keep them alive with heartbeats.
+// Units whose leases expire are claimed again by other workers.
+// No transactions are used, so a standalone mongod works.
+type Queue struct {
+	coll        *mongo.Collection
+	owner       string
+	lease       time.Duration
+	maxAttempts int
+}
+
+func NewQueue(coll *mongo.Collection) *Queue {
+	hostname, _ := os.Hostname()
+
+	return &Queue{
+		coll:        coll,
+		owner:       fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		lease:       DefaultLeaseTTL,
+		maxAttempts: DefaultMaxAttempts,
+	}
+}
+
+// WithLeaseTTL sets how long a claimed unit is leased without heartbeats
+func (q *Queue) WithLeaseTTL(ttl time.Duration) *Queue {
+	q.lease = ttl
+	return q
+}
+
+// WithMaxAttempts sets how many times a unit is claimed before it is failed
+func (q *Queue) WithMaxAttempts(n int) *Queue {
+	q.maxAttempts = n
+	return q
+}
+
+// WithOwner sets the owner recorded in leases, which defaults to host, pid and start time
+func (q *Queue) WithOwner(owner string) *Queue {
+	q.owner = owner
+	return q
+}
+
+// Indexes returns the indexes used by Queue, e.g. for CreateIndexes in a Migration
+func (q *Queue) Indexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{Keys: bson.D{{Key: "run", Value: 1}, {Key: "state", Value: 1}, {Key: "seq", Value: 1}}},
+		{Keys: bson.D{{Key: "run", Value: 1}, {Key: "state", Value: 1}, {Key: "lease_until", Value: 1}}},
+	}
+}
+
+// Enqueue splits run into one unit per payload. Unit IDs are derived from run and
+// the payload index, so enqueueing the same run again does not add duplicates.
+func (q *Queue) Enqueue(ctx context.Context, run string, payloads ...interface{}) ([]string, error) {
+	if len(payloads) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now().UnixMilli()
+	ids := make([]string, len(payloads))
+	writes := make([]mongo.WriteModel, len(payloads))
+
+	for i, payload := range payloads {
+		ids[i] = fmt.Sprintf("%s:%d", run, i)
+		writes[i] = mongo.
+			NewUpdateOneModel().
+			SetFilter(bson.M{"_id": ids[i]}).
+			SetUpdate(bson.M{
+				"$setOnInsert": bson.M{
+					"run":        run,
+					"seq":        i,
+					"payload":    payload,
+					"state":      UnitPending,
+					"attempts":   0,
+					"created_at": now,
+					"updated_at": now,
+				},
+			}).
+			SetUpsert(true)
+	}
+
+	_, err := q.coll.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to enqueue %d units of run '%s'", len(payloads), run)
+	}
+
+	return ids, nil
+}
+
+// Claim leases the next pending or expired unit of run.
+// It returns nil if there is no unit to claim.
+func (q *Queue) Claim(ctx context.Context, run string) (*Lease, error) {
+	now := time.Now().UnixMilli()
+
+	var unit WorkUnit
+	err := q.coll.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"run":      run,
+			"attempts": bson.M{"$lt": q.maxAttempts},
+			"$or": bson.A{
+				bson.M{"state": UnitPending},
+				bson.M{"state": UnitLeased, "lease_until": bson.M{"$lt": now}},
+			},
+		},
+		bson.M{
+			"$set": bson.M{
+				"state":       UnitLeased,
+				"owner":       q.owner,
+				"lease_until": now + q.lease.Milliseconds(),
+				"updated_at":  now,
+			},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "seq", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&unit)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, errors.Wrapf(err, "failed to claim unit of run '%s'", run)
+	}
+
+	if unit.Attempts > 1 {
+		logrus.Warnf("queue: reclaimed unit '%s' on attempt %d", unit.ID, unit.Attempts)
+	}
+
+	return &Lease{q: q, Unit: unit}, nil
+}
+
+// Reclaim makes expired leases of run claimable again, and fails units
+// that expired on their last attempt. It returns the number of units changed.
+// Claim reclaims expired leases by itself, so Reclaim is only needed to keep
+// RunStatus accurate, e.g. by coordinators.
+func (q *Queue) Reclaim(ctx context.Context, run string) (int64, error) {
+	now := time.Now().UnixMilli()
+	expired := bson.M{"run": run, "state": UnitLeased, "lease_until": bson.M{"$lt": now}}
+
+	failed, err := q.coll.UpdateMany(
+		ctx,
+		bson.M{"$and": bson.A{expired, bson.M{"attempts": bson.M{"$gte": q.maxAttempts}}}},
+		bson.M{"$set": bson.M{"state": UnitFailed, "err": "lease expired on last attempt", "updated_at": now}},
+	)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to fail expired units of run '%s'", run)
+	}
+
+	pending, err := q.coll.UpdateMany(
+		ctx,
+		expired,
+		bson.M{
+			"$set":   bson.M{"state": UnitPending, "updated_at": now},
+			"$unset": bson.M{"owner": "", "lease_until": ""},
+		},
+	)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to reclaim expired units of run '%s'", run)
+	}
+
+	return failed.ModifiedCount + pending.ModifiedCount, nil
+}
+
+// Status counts the units of run by state
+func (q *Queue) Status(ctx context.Context, run string) (RunStatus, error) {
+	status := RunStatus{Run: run}
+
+	cursor, err := q.coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"run": run}}},
+		{{Key: "$group", Value: bson.M{"_id": "$state", "n": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return status, errors.Wrapf(err, "failed to count units of run '%s'", run)
+	}
+
+	var counts []struct {
+		State UnitState `bson:"_id"`
+		N     int       `bson:"n"`
+	}
+
+	err = cursor.All(ctx, &counts)
+	if err != nil {
+		return status, errors.Wrap(err, "failed to decode unit counts")
+	}
+
+	for _, c := range counts {
+		switch c.State {
+		case UnitPending:
+			status.Pending = c.N
+		case UnitLeased:
+			status.Leased = c.N
+		case UnitDone:
+			status.Done = c.N
+		case UnitFailed:
+			status.Failed = c.N
+		}
+	}
+
+	return status, nil
+}
+
+// Units returns the units of run in state, or all units if state is empty
+func (q *Queue) Units(ctx context.Context, run string, state UnitState) ([]WorkUnit, error) {
+	filter := bson.M{"run": run}
+	if state != "" {
+		filter["state"] = state
+	}
+
+	cursor, err := q.coll.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find units of run '%s'", run)
+	}
+
+	units := []WorkUnit{}
+	err = cursor.All(ctx, &units)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode units")
+	}
+
+	return units, nil
+}
+
+// Lease is a claimed unit. Its owner must Complete or Fail it before the lease expires,
+// calling Heartbeat or KeepAlive for long work.
+type Lease struct {
+	q    *Queue
+	Unit WorkUnit
+}
+
+type leaseKey struct{}
+
+// LeaseFrom returns the lease being worked on in ctx by Queue.Work
+func LeaseFrom(ctx context.Context) (*Lease, bool) {
+	lease, ok := ctx.Value(leaseKey{}).(*Lease)
+	return lease, ok
+}
+
+// Check fails with ErrLeaseLost if the lease was reclaimed or has expired
+func (l *Lease) Check(ctx context.Context) error {
+	filter := l.filter()
+	filter["lease_until"] = bson.M{"$gt": time.Now().UnixMilli()}
+
+	n, err := l.q.coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check lease of unit '%s'", l.Unit.ID)
+	}
+
+	if n == 0 {
+		return errors.Wrapf(ErrLeaseLost, "unit '%s'", l.Unit.ID)
+	}
+
+	return nil
+}
+
+// Fence returns a write to the queue collection that completes the unit only while it is
+// still leased by l. Written in the same transaction as the outputs of the unit, it fences
+// the commit: a lost lease aborts the transaction with ErrExpectation,
+// and committed units are never reclaimed. Complete still succeeds after a fenced commit.
+func (l *Lease) Fence() mongo.WriteModel {
+	return Expect(ExpectExactlyOne, mongo.
+		NewUpdateOneModel().
+		SetFilter(l.filter()).
+		SetUpdate(bson.M{
+			"$set":   bson.M{"state": UnitDone, "updated_at": time.Now().UnixMilli()},
+			"$unset": bson.M{"lease_until": "", "err": ""},
+		}),
+	)
+}
+
+// Heartbeat extends the lease, failing with ErrLeaseLost if it was reclaimed
+func (l *Lease) Heartbeat(ctx context.Context) error {
+	now := time.Now().UnixMilli()
+	until := now + l.q.lease.Milliseconds()
+
+	result, err := l.q.coll.UpdateOne(ctx, l.filter(), bson.M{"$set": bson.M{"lease_until": until, "updated_at": now}})
+	if err != nil {
+		return errors.Wrapf(err, "failed to extend lease of unit '%s'", l.Unit.ID)
+	}
+
+	if result.MatchedCount == 0 {
+		return errors.Wrapf(ErrLeaseLost, "unit '%s'", l.Unit.ID)
+	}
+
+	l.Unit.LeaseUntil = until
+	return nil
+}
+
+// KeepAlive heartbeats every third of the lease TTL until stop is called.
+// lost is closed if a heartbeat finds the lease lost.
+func (l *Lease) KeepAlive(ctx context.Context) (stop func(), lost <-chan struct{}) {
+	ctx, cancel := context.WithCancel(ctx)
+	lostCh := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(l.q.lease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			err := l.Heartbeat(ctx)
+			switch {
+			case err == nil, ctx.Err() != nil:
+				continue
+
+			case errors.Is(err, ErrLeaseLost):
+				logrus.Errorf("queue: %s", err.Error())
+				close(lostCh)
+
+				return
+			}
+
+			logrus.Warnf("queue: %s", err.Error())
+		}
+	}()
+
+	return func() { cancel(); <-done }, lostCh
+}
+
+// Complete marks the unit done, with an optional result for the coordinator
+func (l *Lease) Complete(ctx context.Context, result interface{}) error {
+	set := bson.M{"state": UnitDone, "updated_at": time.Now().UnixMilli()}
+	if result != nil {
+		set["result"] = result
+	}
+
+	// The unit may already be done by a commit with Fence
+	filter := l.filter()
+	filter["state"] = bson.M{"$in": bson.A{UnitLeased, UnitDone}}
+
+	return l.finish(ctx, filter, bson.M{"$set": set, "$unset": bson.M{"lease_until": "", "err": ""}})
+}
+
+// Fail releases the unit for another attempt,
+// or marks it failed if it has been attempted MaxAttempts times
+func (l *Lease) Fail(ctx context.Context, cause error) error {
+	state := UnitPending
+	if l.Unit.Attempts >= l.q.maxAttempts {
+		state = UnitFailed
+	}
+
+	msg := ""
+	if cause != nil {
+		msg = cause.Error()
+	}
+
+	return l.finish(ctx, l.filter(), bson.M{
+		"$set":   bson.M{"state": state, "err": msg, "updated_at": time.Now().UnixMilli()},
+		"$unset": bson.M{"lease_until": ""},
+	})
+}
+
+func (l *Lease) finish(ctx context.Context, filter bson.M, update bson.M) error {
+	result, err := l.q.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.Wrapf(err, "failed to update unit '%s'", l.Unit.ID)
+	}
+
+	if result.MatchedCount == 0 {
+		return errors.Wrapf(ErrLeaseLost, "unit '%s'", l.Unit.ID)
+	}
+
+	return nil
+}
+
+// filter matches the unit only while it is still leased by this lease
+func (l *Lease) filter() bson.M {
+	return bson.M{
+		"_id":      l.Unit.ID,
+		"state":    UnitLeased,
+		"owner":    l.q.owner,
+		"attempts": l.Unit.Attempts,
+	}
+}
+
+// WorkFunc processes a claimed unit, and returns its result
+type WorkFunc func(ctx context.Context, unit *WorkUnit) (result interface{}, err error)
+
+// Work claims and processes units of run until none is left to claim, and returns
+// the number of units processed. Unit failures are recorded in the queue, not returned.
+//
+// The context passed to fn is canceled if the lease is lost, and holds the lease for LeaseFrom.
+func (q *Queue) Work(ctx context.Context, run string, fn WorkFunc) (int, error) {
+	n := 0
+	for {
+		lease, err := q.Claim(ctx, run)
+		if err != nil {
+			return n, err
+		}
+
+		if lease == nil {
+			return n, nil
+		}
+
+		err = q.work(ctx, lease, fn)
+		if err != nil {
+			return n, err
+		}
+
+		n++
+	}
+}
+
+func (q *Queue) work(ctx context.Context, lease *Lease, fn WorkFunc) error {
+	workCtx, cancel := context.WithCancel(context.WithValue(ctx, leaseKey{}, lease))
+	defer cancel()
+
+	stop, lost := lease.KeepAlive(workCtx)
+	go func() {
+		select {
+		case <-lost:
+			cancel()
+		case <-workCtx.Done():
+		}
+	}()
+
+	result, err := fn(workCtx, &lease.Unit)
+	stop()
+
+	select {
+	case <-lost:
+		logrus.Errorf("queue: lost lease of unit '%s' while working", lease.Unit.ID)
+		return nil
+	default:
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err != nil {
+		logrus.Errorf("queue: unit '%s' failed on attempt %d: %s", lease.Unit.ID, lease.Unit.Attempts, err.Error())
+		err = lease.Fail(ctx, err)
+	} else {
+		err = lease.Complete(ctx, result)
+	}
+
+	if errors.Is(err, ErrLeaseLost) {
+		logrus.Errorf("queue: %s", err.Error())
+		return nil
+	}
+
+	return err
+}
+
+// JobWork returns a WorkFunc running job with ds via satch.Start,
+// with the unit as inputs. ds is used for locking and committing, while its Inputs is never called.
+//
+// Commits are fenced, so that a unit is not committed twice by workers whose leases were lost.
+// If ds is *DataSource, Lease.Fence is written in the transaction of the outputs,
+// so the queue collection must be in the database of ds. Otherwise, the lease is checked
+// before committing, and ds can fence its own writes with LeaseFrom.
+func JobWork(job satch.Job, ds satch.DataSource, conf satch.Config) WorkFunc {
+	return func(ctx context.Context, unit *WorkUnit) (interface{}, error) {
+		return nil, satch.Start(ctx, job, &unitDataSource{DataSource: ds, unit: unit}, conf)
+	}
+}
+
+// unitDataSource feeds a unit to satch.Start, and delegates the rest to the wrapped satch.DataSource
+type unitDataSource struct {
+	satch.DataSource
+	unit *WorkUnit
+}
+
+func (d *unitDataSource) Inputs(context.Context) (interface{}, error) {
+	return d.unit, nil
+}
+
+func (d *unitDataSource) Commit(ctx context.Context, outputs interface{}) error {
+	lease, ok := LeaseFrom(ctx)
+	if !ok {
+		return fmt.Errorf("no lease for unit '%s', JobWork must be run by Queue.Work", d.unit.ID)
+	}
+
+	err := lease.Check(ctx)
+	if err != nil {
+		return err
+	}
+
+	ds, ok := d.DataSource.(*DataSource)
+	if !ok {
+		return d.DataSource.Commit(ctx, outputs)
+	}
+
+	if backend, ok := ds.backend.(*MongoBackend); ok && backend.db.Name() != lease.q.coll.Database().Name() {
+		return fmt.Errorf("cannot fence unit '%s': queue is not in database '%s'", d.unit.ID, backend.db.Name())
+	}
+
+	plan, err := ds.plan(outputs)
+	if err != nil {
+		return err
+	}
+
+	return ds.commit(ctx, plan.Then(lease.q.coll.Name(), []mongo.WriteModel{lease.Fence()}), outputs)
+}
+
+// Coordinator tracks the completion of a run, and finalizes it once
+type Coordinator struct {
+	q        *Queue
+	run      string
+	interval time.Duration
+}
+
+func NewCoordinator(q *Queue, run string) *Coordinator {
+	return &Coordinator{q: q, run: run, interval: DefaultQueueInterval}
+}
+
+// WithInterval sets how often Wait polls the run status
+func (c *Coordinator) WithInterval(d time.Duration) *Coordinator {
+	c.interval = d
+	return c
+}
+
+// Wait reclaims expired leases and polls the run status until the run is complete
+func (c *Coordinator) Wait(ctx context.Context) (RunStatus, error) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		_, err := c.q.Reclaim(ctx, c.run)
+		if err != nil {
+			return RunStatus{Run: c.run}, err
+		}
+
+		status, err := c.q.Status(ctx, c.run)
+		if err != nil {
+			return status, err
+		}
+
+		if status.Complete() {
+			return status, nil
+		}
+
+		logrus.Infof(
+			"queue: run '%s' has %d pending, %d leased, %d done, %d failed units",
+			c.run, status.Pending, status.Leased, status.Done, status.Failed,
+		)
+
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Finalize calls fn with the units of a complete run, at most once per run
+// across all coordinators. If fn fails, the run can be finalized again.
+//
+// It fails with ErrRunIncomplete if the run has unfinished units,
+// and with ErrRunFinalized if the run was already finalized.
+func (c *Coordinator) Finalize(
+	ctx context.Context,
+	fn func(ctx context.Context, status RunStatus, units []WorkUnit) error,
+) error {
+	status, err := c.q.Status(ctx, c.run)
+	if err != nil {
+		return err
+	}
+
+	if !status.Complete() {
+		return errors.Wrapf(ErrRunIncomplete, "run '%s' has %d unfinished units", c.run, status.Pending+status.Leased)
+	}
+
+	// The run document has no state, so it is never claimed as a unit
+	id := "run:" + c.run
+	_, err = c.q.coll.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "finalized": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"finalized": true, "owner": c.q.owner, "updated_at": time.Now().UnixMilli()}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return errors.Wrapf(ErrRunFinalized, "run '%s'", c.run)
+		}
+
+		return errors.Wrapf(err, "failed to mark run '%s' finalized", c.run)
+	}
+
+	units, err := c.q.Units(ctx, c.run, "")
+	if err == nil {
+		err = fn(ctx, status, units)
+	}
+
+	if err != nil {
+		_, unmarkErr := c.q.coll.UpdateOne(context.WithoutCancel(ctx), bson.M{"_id": id}, bson.M{"$set": bson.M{"finalized": false}})
+		if unmarkErr != nil {
+			logrus.Errorf("queue: failed to unmark run '%s' finalized: %s", c.run, unmarkErr.Error())
+		}
+
+		return errors.Wrapf(err, "failed to finalize run '%s'", c.run)
+	}
+
+	return nil
+}
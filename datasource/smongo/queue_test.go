@@ -0,0 +1,371 @@
+package smongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/soyart/satch"
+)
+
+func testQueue(t *testing.T, db *mongo.Database, owner string) *Queue {
+	t.Helper()
+
+	return NewQueue(db.Collection(DefaultQueueColl)).WithOwner(owner).WithLeaseTTL(200 * time.Millisecond)
+}
+
+func enqueue(t *testing.T, q *Queue, run string, n int) {
+	t.Helper()
+
+	payloads := make([]interface{}, n)
+	for i := range payloads {
+		payloads[i] = bson.M{"n": i}
+	}
+
+	_, err := q.Enqueue(context.Background(), run, payloads...)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueClaim(t *testing.T) {
+	ctx := context.Background()
+	q := testQueue(t, testDB(t, false), "w1")
+
+	enqueue(t, q, "run", 2)
+	enqueue(t, q, "run", 2) // No duplicates
+
+	for seq := 0; seq < 2; seq++ {
+		lease, err := q.Claim(ctx, "run")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lease == nil || lease.Unit.Seq != seq || lease.Unit.Owner != "w1" || lease.Unit.Attempts != 1 {
+			t.Fatalf("unexpected lease of seq %d: %+v", seq, lease)
+		}
+
+		var payload struct{ N int }
+		err = lease.Unit.DecodePayload(&payload)
+		if err != nil || payload.N != seq {
+			t.Fatalf("unexpected payload %+v, %v", payload, err)
+		}
+	}
+
+	lease, err := q.Claim(ctx, "run")
+	if err != nil || lease != nil {
+		t.Fatalf("expecting nothing to claim, got %+v, %v", lease, err)
+	}
+
+	status, err := q.Status(ctx, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Leased != 2 || status.Total() != 2 || status.Complete() {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestQueueHeartbeat(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t, false)
+	q1 := testQueue(t, db, "w1")
+	q2 := testQueue(t, db, "w2")
+
+	enqueue(t, q1, "run", 1)
+
+	lease, err := q1.Claim(ctx, "run")
+	if err != nil || lease == nil {
+		t.Fatalf("failed to claim: %v", err)
+	}
+
+	// Heartbeats keep the unit from being claimed by others
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+
+		err = lease.Heartbeat(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		other, err := q2.Claim(ctx, "run")
+		if err != nil || other != nil {
+			t.Fatalf("expecting nothing to claim, got %+v, %v", other, err)
+		}
+	}
+
+	err = lease.Check(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired leases are claimed by others
+	time.Sleep(300 * time.Millisecond)
+
+	other, err := q2.Claim(ctx, "run")
+	if err != nil || other == nil {
+		t.Fatalf("failed to reclaim: %v", err)
+	}
+
+	if other.Unit.Owner != "w2" || other.Unit.Attempts != 2 {
+		t.Fatalf("unexpected reclaimed unit %+v", other.Unit)
+	}
+
+	for name, fn := range map[string]func(context.Context) error{
+		"check":     lease.Check,
+		"heartbeat": lease.Heartbeat,
+		"complete":  func(ctx context.Context) error { return lease.Complete(ctx, nil) },
+		"fail":      func(ctx context.Context) error { return lease.Fail(ctx, nil) },
+	} {
+		err = fn(ctx)
+		if !errors.Is(err, ErrLeaseLost) {
+			t.Fatalf("expecting %s of lost lease to fail with ErrLeaseLost, got %v", name, err)
+		}
+	}
+
+	err = other.Complete(ctx, bson.M{"ok": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	units, err := q2.Units(ctx, "run", UnitDone)
+	if err != nil || len(units) != 1 || units[0].Result == nil {
+		t.Fatalf("unexpected done units %+v, %v", units, err)
+	}
+}
+
+func TestQueueReclaim(t *testing.T) {
+	ctx := context.Background()
+	q := testQueue(t, testDB(t, false), "w1").WithMaxAttempts(2)
+
+	enqueue(t, q, "run", 1)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		lease, err := q.Claim(ctx, "run")
+		if err != nil || lease == nil {
+			t.Fatalf("failed to claim attempt %d: %v", attempt, err)
+		}
+
+		time.Sleep(300 * time.Millisecond)
+
+		n, err := q.Reclaim(ctx, "run")
+		if err != nil || n != 1 {
+			t.Fatalf("expecting 1 reclaimed unit, got %d, %v", n, err)
+		}
+	}
+
+	// Expired on the last attempt
+	status, err := q.Status(ctx, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Failed != 1 || !status.Complete() {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	lease, err := q.Claim(ctx, "run")
+	if err != nil || lease != nil {
+		t.Fatalf("expecting nothing to claim, got %+v, %v", lease, err)
+	}
+}
+
+func TestQueueFail(t *testing.T) {
+	ctx := context.Background()
+	q := testQueue(t, testDB(t, false), "w1").WithMaxAttempts(2)
+
+	enqueue(t, q, "run", 1)
+
+	for _, state := range []UnitState{UnitPending, UnitFailed} {
+		lease, err := q.Claim(ctx, "run")
+		if err != nil || lease == nil {
+			t.Fatalf("failed to claim: %v", err)
+		}
+
+		err = lease.Fail(ctx, errors.New("bad unit"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		units, err := q.Units(ctx, "run", state)
+		if err != nil || len(units) != 1 || units[0].Err != "bad unit" {
+			t.Fatalf("expecting a %s unit, got %+v, %v", state, units, err)
+		}
+	}
+}
+
+func TestCoordinatorFinalize(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t, false)
+	q := testQueue(t, db, "w1")
+	c1 := NewCoordinator(q, "run")
+	c2 := NewCoordinator(testQueue(t, db, "w2"), "run")
+
+	enqueue(t, q, "run", 2)
+
+	called := 0
+	finalize := func(_ context.Context, status RunStatus, units []WorkUnit) error {
+		called++
+		if status.Done != 2 || len(units) != 2 {
+			return fmt.Errorf("unexpected status %+v", status)
+		}
+
+		return nil
+	}
+
+	err := c1.Finalize(ctx, finalize)
+	if !errors.Is(err, ErrRunIncomplete) {
+		t.Fatalf("expecting ErrRunIncomplete, got %v", err)
+	}
+
+	n, err := q.Work(ctx, "run", func(context.Context, *WorkUnit) (interface{}, error) { return nil, nil })
+	if err != nil || n != 2 {
+		t.Fatalf("expecting 2 units worked, got %d, %v", n, err)
+	}
+
+	// A failed finalization can be retried
+	err = c1.Finalize(ctx, func(context.Context, RunStatus, []WorkUnit) error { return errors.New("unavailable") })
+	if err == nil {
+		t.Fatal("expecting finalize to fail")
+	}
+
+	err = c1.Finalize(ctx, finalize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c2.Finalize(ctx, finalize)
+	if !errors.Is(err, ErrRunFinalized) {
+		t.Fatalf("expecting ErrRunFinalized, got %v", err)
+	}
+
+	if called != 1 {
+		t.Fatalf("expecting 1 finalization, got %d", called)
+	}
+}
+
+// unitJob writes a document per unit
+type unitJob struct{}
+
+func (unitJob) ID() string { return "unit" }
+
+func (unitJob) Run(_ context.Context, inputs interface{}, _ time.Time) (interface{}, error) {
+	unit := inputs.(*WorkUnit)
+	return WritePlan{}.Then("outputs", []mongo.WriteModel{mongo.NewInsertOneModel().SetDocument(bson.M{"_id": unit.ID})}), nil
+}
+
+func TestJobWorkFenced(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t, true)
+	q1 := testQueue(t, db, "w1")
+	q2 := testQueue(t, db, "w2")
+
+	ds, err := NewDataSource(NewMongoBackend(db), DataSourceConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enqueue(t, q1, "run", 2)
+
+	// Commits complete units in the same transaction
+	n, err := q1.Work(ctx, "run", JobWork(unitJob{}, ds, satch.Config{}))
+	if err != nil || n != 2 {
+		t.Fatalf("expecting 2 units worked, got %d, %v", n, err)
+	}
+
+	status, err := q1.Status(ctx, "run")
+	if err != nil || status.Done != 2 {
+		t.Fatalf("unexpected status %+v, %v", status, err)
+	}
+
+	outputs, err := db.Collection("outputs").CountDocuments(ctx, bson.M{})
+	if err != nil || outputs != 2 {
+		t.Fatalf("expecting 2 outputs, got %d, %v", outputs, err)
+	}
+
+	// A lost lease cannot commit
+	enqueue(t, q1, "stale", 1)
+
+	stale, err := q1.Claim(ctx, "stale")
+	if err != nil || stale == nil {
+		t.Fatalf("failed to claim: %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	other, err := q2.Claim(ctx, "stale")
+	if err != nil || other == nil {
+		t.Fatalf("failed to reclaim: %v", err)
+	}
+
+	unitDS := &unitDataSource{DataSource: ds, unit: &stale.Unit}
+	err = unitDS.Commit(context.WithValue(ctx, leaseKey{}, stale), WritePlan{})
+	if !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("expecting ErrLeaseLost, got %v", err)
+	}
+
+	// The fence aborts commits whose leases are lost after the check
+	_, err = NewMongoBackend(db).BulkWrite(ctx, WritePlan{}.
+		Then("outputs", []mongo.WriteModel{mongo.NewInsertOneModel().SetDocument(bson.M{"_id": stale.Unit.ID})}).
+		Then(DefaultQueueColl, []mongo.WriteModel{stale.Fence()}),
+	)
+	if !errors.Is(err, ErrExpectation) {
+		t.Fatalf("expecting ErrExpectation, got %v", err)
+	}
+
+	outputs, err = db.Collection("outputs").CountDocuments(ctx, bson.M{"_id": stale.Unit.ID})
+	if err != nil || outputs != 0 {
+		t.Fatalf("expecting no outputs of stale lease, got %d, %v", outputs, err)
+	}
+}
+
+func TestLeaseFence(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemBackend()
+
+	err := mem.Insert(DefaultQueueColl, bson.M{"_id": "run:0", "run": "run", "state": UnitLeased, "owner": "w2", "attempts": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := NewQueue(nil).WithOwner("w1")
+	commit := func(lease *Lease) error {
+		_, err := mem.BulkWrite(ctx, WritePlan{}.
+			Then("outputs", []mongo.WriteModel{mongo.NewInsertOneModel().SetDocument(bson.M{"_id": lease.Unit.ID})}).
+			Then(DefaultQueueColl, []mongo.WriteModel{lease.Fence()}),
+		)
+
+		return err
+	}
+
+	// Reclaimed by w2 on attempt 2
+	for _, lease := range []*Lease{
+		{q: q, Unit: WorkUnit{ID: "run:0", Attempts: 2}},
+		{q: NewQueue(nil).WithOwner("w2"), Unit: WorkUnit{ID: "run:0", Attempts: 1}},
+	} {
+		err = commit(lease)
+		if !errors.Is(err, ErrExpectation) {
+			t.Fatalf("expecting ErrExpectation, got %v", err)
+		}
+	}
+
+	if outputs := mem.Docs("outputs"); len(outputs) != 0 {
+		t.Fatalf("expecting no outputs of stale leases, got %v", outputs)
+	}
+
+	err = commit(&Lease{q: NewQueue(nil).WithOwner("w2"), Unit: WorkUnit{ID: "run:0", Attempts: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	units := mem.Docs(DefaultQueueColl)
+	if len(units) != 1 || units[0]["state"] != string(UnitDone) || len(mem.Docs("outputs")) != 1 {
+		t.Fatalf("unexpected units %v, outputs %v", units, mem.Docs("outputs"))
+	}
+}
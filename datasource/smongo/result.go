@@ -0,0 +1,86 @@
+package smongo
+
+import (
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// BulkWriteCollsResult is the result of bulk writes across multiple collections.
+// Colls maps collection name to its own *mongo.BulkWriteResult,
+// while the count fields are totals across all collections.
+type BulkWriteCollsResult struct {
+	Colls map[string]*mongo.BulkWriteResult
+	Order []string // Collection names in the order they were written
+
+	MatchedCount  int64
+	ModifiedCount int64
+	UpsertedCount int64
+	InsertedCount int64
+	DeletedCount  int64
+
+	models map[string]int64 // Number of write models sent to each collection
+}
+
+func NewBulkWriteCollsResult() *BulkWriteCollsResult {
+	return &BulkWriteCollsResult{
+		Colls:  make(map[string]*mongo.BulkWriteResult),
+		models: make(map[string]int64),
+	}
+}
+
+// Add records result of models write models for coll, and adds its counts to the totals.
+// If coll was already written to, result is merged into its previous result.
+// Nil results are ignored.
+func (r *BulkWriteCollsResult) Add(coll string, models int, result *mongo.BulkWriteResult) {
+	if result == nil {
+		return
+	}
+
+	if r.models == nil {
+		r.models = make(map[string]int64)
+	}
+
+	prev, ok := r.Colls[coll]
+	if !ok {
+		r.Order = append(r.Order, coll)
+		r.Colls[coll] = result
+	} else {
+		r.Colls[coll] = mergeBulkWriteResults(prev, result, r.models[coll])
+	}
+
+	r.models[coll] += int64(models)
+
+	r.MatchedCount += result.MatchedCount
+	r.ModifiedCount += result.ModifiedCount
+	r.UpsertedCount += result.UpsertedCount
+	r.InsertedCount += result.InsertedCount
+	r.DeletedCount += result.DeletedCount
+}
+
+// mergeBulkWriteResults returns a new result with counts of a and b summed.
+// Upserted IDs of b are offset by models, the number of write models of a,
+// as if b's writes followed a's in one batch.
+func mergeBulkWriteResults(a, b *mongo.BulkWriteResult, models int64) *mongo.BulkWriteResult {
+	merged := &mongo.BulkWriteResult{
+		MatchedCount:  a.MatchedCount + b.MatchedCount,
+		ModifiedCount: a.ModifiedCount + b.ModifiedCount,
+		UpsertedCount: a.UpsertedCount + b.UpsertedCount,
+		InsertedCount: a.InsertedCount + b.InsertedCount,
+		DeletedCount:  a.DeletedCount + b.DeletedCount,
+		UpsertedIDs:   make(map[int64]interface{}, len(a.UpsertedIDs)+len(b.UpsertedIDs)),
+	}
+
+	for i, id := range a.UpsertedIDs {
+		merged.UpsertedIDs[i] = id
+	}
+
+	for i, id := range b.UpsertedIDs {
+		merged.UpsertedIDs[models+i] = id
+	}
+
+	return merged
+}
+
+// Coll returns the result for coll, or nil if coll was not written to
+func (r *BulkWriteCollsResult) Coll(coll string) *mongo.BulkWriteResult {
+	return r.Colls[coll]
+}
@@ -0,0 +1,47 @@
+package smongo
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestBulkWriteCollsResultAdd(t *testing.T) {
+	r := NewBulkWriteCollsResult()
+	r.Add("accounts", 2, &mongo.BulkWriteResult{MatchedCount: 2, ModifiedCount: 2, UpsertedIDs: map[int64]interface{}{1: "a"}, UpsertedCount: 1})
+	r.Add("payouts", 3, &mongo.BulkWriteResult{ModifiedCount: 3})
+	r.Add("accounts", 1, &mongo.BulkWriteResult{MatchedCount: 1, UpsertedIDs: map[int64]interface{}{0: "b"}, UpsertedCount: 1})
+	r.Add("payouts", 0, nil)
+
+	if len(r.Order) != 2 || r.Order[0] != "accounts" || r.Order[1] != "payouts" {
+		t.Fatalf("unexpected order %v", r.Order)
+	}
+
+	accounts := r.Coll("accounts")
+	if accounts.MatchedCount != 3 || accounts.ModifiedCount != 2 || accounts.UpsertedCount != 2 {
+		t.Fatalf("unexpected merged accounts result %+v", accounts)
+	}
+
+	if accounts.UpsertedIDs[1] != "a" || accounts.UpsertedIDs[2] != "b" {
+		t.Fatalf("unexpected merged upserted IDs %v", accounts.UpsertedIDs)
+	}
+
+	if r.MatchedCount != 3 || r.ModifiedCount != 5 || r.UpsertedCount != 2 {
+		t.Fatalf("unexpected totals %+v", r)
+	}
+}
+
+func TestBulkWriteCollsResultAddOffset(t *testing.T) {
+	r := NewBulkWriteCollsResult()
+
+	// The first step ends with 2 non-upserts
+	r.Add("accounts", 3, &mongo.BulkWriteResult{MatchedCount: 2, UpsertedIDs: map[int64]interface{}{0: "a"}, UpsertedCount: 1})
+	r.Add("accounts", 2, &mongo.BulkWriteResult{UpsertedIDs: map[int64]interface{}{1: "b"}, UpsertedCount: 1})
+	r.Add("accounts", 1, &mongo.BulkWriteResult{UpsertedIDs: map[int64]interface{}{0: "c"}, UpsertedCount: 1})
+
+	expected := map[int64]interface{}{0: "a", 4: "b", 5: "c"}
+	if !reflect.DeepEqual(r.Coll("accounts").UpsertedIDs, expected) {
+		t.Fatalf("unexpected merged upserted IDs %v", r.Coll("accounts").UpsertedIDs)
+	}
+}
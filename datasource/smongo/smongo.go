@@ -9,7 +9,6 @@ import (
 	"context"
 	"fmt"
 	"reflect"
-	"strings"
 
 	"github.com/pkg/errors"
 
@@ -19,17 +18,15 @@ import (
 
 type TxFunc func(ctx mongo.SessionContext) (interface{}, error)
 
-type MongoDBConfig struct {
-	Hosts    string `json:"hosts" yaml:"hosts"`
-	Admin    string `json:"admin" yaml:"admin"`
-	Username string `json:"username" yaml:"username"`
-	Password string `json:"password" yaml:"password"`
-}
-
 type MongoDB struct {
 	cli *mongo.Client
 }
 
+// NewClient validates conf and connects to MongoDB.
+// opts are applied after conf, and override it.
+//
+// Unless conf.SkipReadyCheck is set, the client is checked with Ready,
+// so that deployments without transactions fail here rather than on commit.
 func NewClient(
 	ctx context.Context,
 	conf MongoDBConfig,
@@ -38,22 +35,28 @@ func NewClient(
 	*MongoDB,
 	error,
 ) {
-	connOpts := options.
-		Client().
-		SetHosts(strings.Split(conf.Hosts, ",")).
-		SetAuth(options.Credential{
-			// TODO: auth login
-			// AuthSource: conf.Admin,
-			Username: conf.Username,
-			Password: conf.Password,
-		})
-
-	cli, err := mongo.Connect(ctx, append(opts, connOpts)...)
+	connOpts, err := conf.ClientOptions()
+	if err != nil {
+		return nil, errors.Wrap(err, "bad mongodb config")
+	}
+
+	cli, err := mongo.Connect(ctx, append([]*options.ClientOptions{connOpts}, opts...)...)
 	if err != nil {
 		return nil, err
 	}
 
-	return &MongoDB{cli: cli}, nil
+	mg := &MongoDB{cli: cli}
+	if conf.SkipReadyCheck {
+		return mg, nil
+	}
+
+	err = mg.Ready(ctx)
+	if err != nil {
+		mg.Close(context.WithoutCancel(ctx))
+		return nil, err
+	}
+
+	return mg, nil
 }
 
 func (m *MongoDB) Unwrap() *mongo.Client {
@@ -134,6 +137,8 @@ func WithTxColl(
 	return result, nil
 }
 
+// Find returns a cursor over documents in coll matching filter.
+// Backend.Find is the variant that also runs on MemBackend.
 func Find(
 	ctx context.Context,
 	coll *mongo.Collection,
@@ -186,7 +191,7 @@ func BulkWriteColls(
 	collWrites map[string][]mongo.WriteModel,
 	opts ...*options.BulkWriteOptions,
 ) (
-	*mongo.BulkWriteResult,
+	*BulkWriteCollsResult,
 	error,
 ) {
 	tx := TxBulkWriteColls(db, collWrites, opts...)
@@ -195,7 +200,7 @@ func BulkWriteColls(
 		return nil, err
 	}
 
-	result, ok := resultTx.(*mongo.BulkWriteResult)
+	result, ok := resultTx.(*BulkWriteCollsResult)
 	if !ok {
 		return nil, fmt.Errorf("unexpected result type: %s", reflect.TypeOf(resultTx).String())
 	}
@@ -203,6 +208,19 @@ func BulkWriteColls(
 	return result, nil
 }
 
+// BulkWritePlan executes plan in a DB-level transaction, like Backend.BulkWrite
+func BulkWritePlan(
+	ctx context.Context,
+	db *mongo.Database,
+	plan WritePlan,
+	opts ...*options.BulkWriteOptions,
+) (
+	*BulkWriteCollsResult,
+	error,
+) {
+	return NewMongoBackend(db).BulkWrite(ctx, plan, opts...)
+}
+
 func InsertMany(
 	ctx context.Context,
 	coll *mongo.Collection,
@@ -250,6 +268,106 @@ func Update(
 	return result, nil
 }
 
+func DeleteMany(
+	ctx context.Context,
+	coll *mongo.Collection,
+	filter interface{},
+	opts ...*options.DeleteOptions,
+) (
+	*mongo.DeleteResult,
+	error,
+) {
+	tx := TxDeleteMany(coll, filter, opts...)
+	resultTx, err := WithTxColl(ctx, coll, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, ok := resultTx.(*mongo.DeleteResult)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type: %s", reflect.TypeOf(resultTx).String())
+	}
+
+	return result, nil
+}
+
+func ReplaceOne(
+	ctx context.Context,
+	coll *mongo.Collection,
+	filter interface{},
+	replacement interface{},
+	opts ...*options.ReplaceOptions,
+) (
+	*mongo.UpdateResult,
+	error,
+) {
+	tx := TxReplaceOne(coll, filter, replacement, opts...)
+	resultTx, err := WithTxColl(ctx, coll, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, ok := resultTx.(*mongo.UpdateResult)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type: %s", reflect.TypeOf(resultTx).String())
+	}
+
+	return result, nil
+}
+
+// FindOneAndUpdate updates a single document and returns it.
+// Use options.FindOneAndUpdate().SetReturnDocument(options.After)
+// to get the document after the update.
+// Backend.FindOneAndUpdate is the variant that also runs on MemBackend.
+func FindOneAndUpdate(
+	ctx context.Context,
+	coll *mongo.Collection,
+	filter interface{},
+	update interface{},
+	opts ...*options.FindOneAndUpdateOptions,
+) (
+	*mongo.SingleResult,
+	error,
+) {
+	tx := TxFindOneAndUpdate(coll, filter, update, opts...)
+	resultTx, err := WithTxColl(ctx, coll, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, ok := resultTx.(*mongo.SingleResult)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type: %s", reflect.TypeOf(resultTx).String())
+	}
+
+	return result, nil
+}
+
+// Aggregate returns a cursor over the output of pipeline.
+// Backend.Aggregate is the variant that also runs on MemBackend.
+func Aggregate(
+	ctx context.Context,
+	coll *mongo.Collection,
+	pipeline interface{},
+	opts ...*options.AggregateOptions,
+) (
+	*mongo.Cursor,
+	error,
+) {
+	tx := TxAggregate(coll, pipeline, opts...)
+	resultTx, err := WithTxColl(ctx, coll, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, ok := resultTx.(*mongo.Cursor)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type: %s", reflect.TypeOf(resultTx).String())
+	}
+
+	return result, nil
+}
+
 type Collection struct {
 	coll *mongo.Collection
 }
@@ -311,3 +429,59 @@ func (c *Collection) Update(
 ) {
 	return Update(ctx, c.Unwrap(), filter, updates, opts...)
 }
+
+func (c *Collection) DeleteMany(
+	ctx context.Context,
+	filter interface{},
+	opts ...*options.DeleteOptions,
+) (
+	*mongo.DeleteResult,
+	error,
+) {
+	return DeleteMany(ctx, c.Unwrap(), filter, opts...)
+}
+
+func (c *Collection) ReplaceOne(
+	ctx context.Context,
+	filter interface{},
+	replacement interface{},
+	opts ...*options.ReplaceOptions,
+) (
+	*mongo.UpdateResult,
+	error,
+) {
+	return ReplaceOne(ctx, c.Unwrap(), filter, replacement, opts...)
+}
+
+// FindOneAndUpdate decodes the found document into result.
+// It returns mongo.ErrNoDocuments if filter matches nothing.
+func (c *Collection) FindOneAndUpdate(
+	ctx context.Context,
+	filter interface{},
+	update interface{},
+	result interface{},
+	opts ...*options.FindOneAndUpdateOptions,
+) error {
+	single, err := FindOneAndUpdate(ctx, c.coll, filter, update, opts...)
+	if err != nil {
+		return err
+	}
+
+	return single.Decode(result)
+}
+
+func (c *Collection) Aggregate(
+	ctx context.Context,
+	pipeline interface{},
+	results interface{},
+	opts ...*options.AggregateOptions,
+) error {
+	cursor, err := Aggregate(ctx, c.coll, pipeline, opts...)
+	if err != nil {
+		return err
+	}
+
+	defer cursor.Close(ctx)
+
+	return cursor.All(ctx, results)
+}
@@ -0,0 +1,59 @@
+package smongo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Environment variable with the URI of a MongoDB for tests, e.g. a local
+// single-node replica set at mongodb://localhost:27017/?replicaSet=rs0&directConnection=true.
+// Tests that need MongoDB are skipped if it is not set.
+const envTestURI = "SMONGO_TEST_URI"
+
+// testDB connects to the MongoDB at SMONGO_TEST_URI and returns a database
+// unique to the test, which is dropped when the test ends.
+// If replicaSet is true, the test is skipped on standalone deployments.
+func testDB(t *testing.T, replicaSet bool) *mongo.Database {
+	t.Helper()
+
+	uri := os.Getenv(envTestURI)
+	if uri == "" {
+		t.Skipf("%s is not set", envTestURI)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mg, err := NewClient(ctx, MongoDBConfig{URI: uri, SkipReadyCheck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		mg.Close(context.Background())
+	})
+
+	err = mg.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replicaSet {
+		err = mg.CheckTx(ctx)
+		if err != nil {
+			t.Skip(err.Error())
+		}
+	}
+
+	db := mg.Unwrap().Database(fmt.Sprintf("smongo_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+	})
+
+	return db
+}
@@ -0,0 +1,241 @@
+package smongo
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Report key for the cluster time of snapshot reads
+const ReportKeyClusterTime = "smongo.clusterTime"
+
+// SnapshotQuery is a query run by FindSnapshot
+type SnapshotQuery struct {
+	Coll    string
+	Filter  interface{}
+	Results interface{} // Pointer to a slice
+	Opts    []*options.FindOptions
+}
+
+// FindSnapshot runs queries with snapshot read concern at a single cluster time,
+// so that all queries see the data at the same point in time, even across collections.
+// If at is nil, the time of the first query is used. at is not modified.
+//
+// Queries are sent as find commands with an explicit atClusterTime, so FindOptions
+// that only make sense for tailable cursors are rejected.
+//
+// It returns the cluster time of the snapshot. Snapshot reads require MongoDB 5.0+.
+func FindSnapshot(
+	ctx context.Context,
+	db *mongo.Database,
+	at *primitive.Timestamp,
+	queries ...SnapshotQuery,
+) (
+	primitive.Timestamp,
+	error,
+) {
+	if len(queries) == 0 {
+		return primitive.Timestamp{}, errors.New("no snapshot queries")
+	}
+
+	var clusterTime primitive.Timestamp
+	if at != nil {
+		clusterTime = *at
+	}
+
+	for i := range queries {
+		q := &queries[i]
+
+		cmd, err := findCommand(q)
+		if err != nil {
+			return primitive.Timestamp{}, errors.Wrapf(err, "bad snapshot query for collection '%s'", q.Coll)
+		}
+
+		if clusterTime.IsZero() {
+			clusterTime, err = snapshotTime(ctx, db, q.Coll)
+			if err != nil {
+				return primitive.Timestamp{}, err
+			}
+		}
+
+		cmd = append(cmd, bson.E{Key: "readConcern", Value: bson.D{
+			{Key: "level", Value: "snapshot"},
+			{Key: "atClusterTime", Value: clusterTime},
+		}})
+
+		cursor, err := db.RunCommandCursor(ctx, cmd)
+		if err != nil {
+			return primitive.Timestamp{}, errors.Wrapf(err, "failed snapshot find in collection '%s'", q.Coll)
+		}
+
+		err = cursor.All(ctx, q.Results)
+		if err != nil {
+			return primitive.Timestamp{}, errors.Wrapf(err, "failed to decode snapshot results from collection '%s'", q.Coll)
+		}
+	}
+
+	return clusterTime, nil
+}
+
+// snapshotTime runs a single-document snapshot read on coll,
+// and returns the cluster time chosen by the server
+func snapshotTime(ctx context.Context, db *mongo.Database, coll string) (primitive.Timestamp, error) {
+	var resp struct {
+		Cursor struct {
+			AtClusterTime primitive.Timestamp `bson:"atClusterTime"`
+		} `bson:"cursor"`
+	}
+
+	err := db.RunCommand(ctx, bson.D{
+		{Key: "find", Value: coll},
+		{Key: "filter", Value: bson.D{}},
+		{Key: "projection", Value: bson.D{{Key: "_id", Value: 1}}},
+		{Key: "limit", Value: 1},
+		{Key: "singleBatch", Value: true},
+		{Key: "readConcern", Value: bson.D{{Key: "level", Value: "snapshot"}}},
+	}).Decode(&resp)
+	if err != nil {
+		return primitive.Timestamp{}, errors.Wrapf(err, "failed to start snapshot read in collection '%s'", coll)
+	}
+
+	if resp.Cursor.AtClusterTime.IsZero() {
+		return primitive.Timestamp{}, errors.New("server did not report snapshot time")
+	}
+
+	return resp.Cursor.AtClusterTime, nil
+}
+
+// findCommand converts q into a find command, without read concern
+func findCommand(q *SnapshotQuery) (bson.D, error) {
+	filter := q.Filter
+	if filter == nil {
+		filter = bson.D{}
+	}
+
+	cmd := bson.D{
+		{Key: "find", Value: q.Coll},
+		{Key: "filter", Value: filter},
+	}
+
+	// Later options override earlier ones, as with Collection.Find
+	fields := bson.D{}
+	set := func(key string, value interface{}) {
+		for i := range fields {
+			if fields[i].Key == key {
+				fields[i].Value = value
+				return
+			}
+		}
+
+		fields = append(fields, bson.E{Key: key, Value: value})
+	}
+
+	for _, opt := range q.Opts {
+		if opt == nil {
+			continue
+		}
+
+		if opt.CursorType != nil || opt.MaxAwaitTime != nil || opt.NoCursorTimeout != nil || opt.AllowPartialResults != nil || opt.OplogReplay != nil {
+			return nil, errors.New("tailable and cursor timeout options are not supported for snapshot reads")
+		}
+
+		if opt.Projection != nil {
+			set("projection", opt.Projection)
+		}
+
+		if opt.Sort != nil {
+			set("sort", opt.Sort)
+		}
+
+		if opt.Skip != nil {
+			set("skip", *opt.Skip)
+		}
+
+		if opt.Limit != nil {
+			// Negative limits mean a single batch, as with Collection.Find
+			if *opt.Limit < 0 {
+				set("limit", -*opt.Limit)
+				set("singleBatch", true)
+			} else {
+				set("limit", *opt.Limit)
+			}
+		}
+
+		if opt.BatchSize != nil {
+			set("batchSize", *opt.BatchSize)
+		}
+
+		if opt.Hint != nil {
+			set("hint", opt.Hint)
+		}
+
+		if opt.Collation != nil {
+			set("collation", collationDoc(opt.Collation))
+		}
+
+		if opt.Comment != nil {
+			set("comment", *opt.Comment)
+		}
+
+		if opt.MaxTime != nil {
+			set("maxTimeMS", opt.MaxTime.Milliseconds())
+		}
+
+		if opt.Max != nil {
+			set("max", opt.Max)
+		}
+
+		if opt.Min != nil {
+			set("min", opt.Min)
+		}
+
+		if opt.ReturnKey != nil {
+			set("returnKey", *opt.ReturnKey)
+		}
+
+		if opt.ShowRecordID != nil {
+			set("showRecordId", *opt.ShowRecordID)
+		}
+
+		if opt.AllowDiskUse != nil {
+			set("allowDiskUse", *opt.AllowDiskUse)
+		}
+
+		if opt.Let != nil {
+			set("let", opt.Let)
+		}
+	}
+
+	return append(cmd, fields...), nil
+}
+
+// collationDoc converts c to a command document with the server's field names
+func collationDoc(c *options.Collation) bson.D {
+	doc := bson.D{{Key: "locale", Value: c.Locale}}
+	fields := []struct {
+		key   string
+		value interface{}
+		set   bool
+	}{
+		{key: "caseLevel", value: c.CaseLevel, set: c.CaseLevel},
+		{key: "caseFirst", value: c.CaseFirst, set: c.CaseFirst != ""},
+		{key: "strength", value: c.Strength, set: c.Strength != 0},
+		{key: "numericOrdering", value: c.NumericOrdering, set: c.NumericOrdering},
+		{key: "alternate", value: c.Alternate, set: c.Alternate != ""},
+		{key: "maxVariable", value: c.MaxVariable, set: c.MaxVariable != ""},
+		{key: "normalization", value: c.Normalization, set: c.Normalization},
+		{key: "backwards", value: c.Backwards, set: c.Backwards},
+	}
+
+	for _, f := range fields {
+		if f.set {
+			doc = append(doc, bson.E{Key: f.key, Value: f.value})
+		}
+	}
+
+	return doc
+}
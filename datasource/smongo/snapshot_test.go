@@ -0,0 +1,121 @@
+package smongo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestFindCommand(t *testing.T) {
+	q := SnapshotQuery{
+		Coll:   "payouts",
+		Filter: bson.M{"settled": false},
+		Opts: []*options.FindOptions{
+			options.Find().SetSort(bson.D{{Key: "t", Value: 1}}).SetLimit(10),
+			options.Find().SetLimit(-5).SetMaxTime(2 * time.Second).SetCollation(&options.Collation{Locale: "en", Strength: 2}),
+		},
+	}
+
+	cmd, err := findCommand(&q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := bson.D{
+		{Key: "find", Value: "payouts"},
+		{Key: "filter", Value: bson.M{"settled": false}},
+		{Key: "sort", Value: bson.D{{Key: "t", Value: 1}}},
+		{Key: "limit", Value: int64(5)},
+		{Key: "singleBatch", Value: true},
+		{Key: "collation", Value: bson.D{{Key: "locale", Value: "en"}, {Key: "strength", Value: 2}}},
+		{Key: "maxTimeMS", Value: int64(2000)},
+	}
+
+	if !reflect.DeepEqual(cmd, expect) {
+		t.Fatalf("unexpected command\nexpect %v\nactual %v", expect, cmd)
+	}
+
+	_, err = findCommand(&SnapshotQuery{Coll: "payouts", Opts: []*options.FindOptions{options.Find().SetCursorType(options.Tailable)}})
+	if err == nil {
+		t.Fatal("expecting tailable cursor to be rejected")
+	}
+}
+
+func TestFindSnapshot(t *testing.T) {
+	db := testDB(t, true)
+	ctx := context.Background()
+
+	_, err := db.Collection("customers").InsertOne(ctx, bson.M{"id": "c1", "banned": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Collection("accounts").InsertOne(ctx, bson.M{"number": "a1", "owner_id": "c1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var customers, accounts []bson.M
+	at, err := FindSnapshot(
+		ctx,
+		db,
+		nil,
+		SnapshotQuery{Coll: "customers", Filter: bson.M{}, Results: &customers},
+		SnapshotQuery{Coll: "accounts", Filter: bson.M{}, Results: &accounts},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if at.IsZero() || len(customers) != 1 || len(accounts) != 1 {
+		t.Fatalf("unexpected snapshot at %v: %d customers, %d accounts", at, len(customers), len(accounts))
+	}
+
+	// Changes after the snapshot are not seen when reading at its time
+	_, err = db.Collection("customers").UpdateOne(ctx, bson.M{"id": "c1"}, bson.M{"$set": bson.M{"banned": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Collection("accounts").InsertOne(ctx, bson.M{"number": "a2", "owner_id": "c1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := at
+	customers, accounts = nil, nil
+	again, err := FindSnapshot(
+		ctx,
+		db,
+		&pinned,
+		SnapshotQuery{Coll: "customers", Filter: bson.M{}, Results: &customers},
+		SnapshotQuery{Coll: "accounts", Filter: bson.M{}, Results: &accounts},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again != at || pinned != at {
+		t.Fatalf("expecting snapshot at %v, got %v (pinned %v)", at, again, pinned)
+	}
+
+	if customers[0]["banned"] != false || len(accounts) != 1 {
+		t.Fatalf("snapshot saw later writes: %v, %d accounts", customers, len(accounts))
+	}
+
+	// A fresh snapshot sees them
+	var latest []bson.M
+	later, err := FindSnapshot(ctx, db, nil, SnapshotQuery{Coll: "accounts", Filter: bson.M{}, Results: &latest})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if primitive.CompareTimestamp(later, at) <= 0 || len(latest) != 2 {
+		t.Fatalf("unexpected fresh snapshot at %v with %d accounts", later, len(latest))
+	}
+}
@@ -1,6 +1,7 @@
 package smongo
 
 import (
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -41,25 +42,38 @@ func TxBulkWrite(
 
 // Wraps bulk writes across multiple collections inside a callback that can be sent to a MongoDB transaction.
 // The collWrites are represented as map of collection name to writes.
+//
+// Collections are written in lexical order of their names, so that runs are reproducible.
+// Use TxBulkWritePlan if the collections must be written in a specific order.
+//
+// The callback returns *BulkWriteCollsResult, even when it fails midway.
 func TxBulkWriteColls(
 	db *mongo.Database,
 	collWrites map[string][]mongo.WriteModel,
 	opts ...*options.BulkWriteOptions,
 ) TxFunc {
-	return func(ctx mongo.SessionContext) (interface{}, error) {
-		results := make(map[string]interface{})
+	return TxBulkWritePlan(db, PlanFromColls(collWrites), opts...)
+}
 
-		for coll, writes := range collWrites {
-			result, err := db.Collection(coll).BulkWrite(ctx, writes, opts...)
-			if err != nil {
-				logrus.Errorf("bulkWrite: error bulk writing %d write models to db '%s' for collection '%s': %s", len(writes), db.Name(), coll, err.Error())
-				return results, err
+// Wraps bulk writes across multiple collections inside a callback that can be sent to a MongoDB transaction.
+// The plan's steps are executed in order, and the first failing step aborts the rest.
+// Write models wrapped with Expect are checked, see ExpectedWrite.
+//
+// opts apply to every step, and are overridden by each step's own options.
+//
+// The callback returns *BulkWriteCollsResult, even when it fails midway.
+func TxBulkWritePlan(
+	db *mongo.Database,
+	plan WritePlan,
+	opts ...*options.BulkWriteOptions,
+) TxFunc {
+	return func(ctx mongo.SessionContext) (interface{}, error) {
+		return execPlan(plan, opts, func(coll string) bulkFunc {
+			c := db.Collection(coll)
+			return func(models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+				return c.BulkWrite(ctx, models, opts...)
 			}
-
-			results[coll] = result
-		}
-
-		return results, nil
+		})
 	}
 }
 
@@ -105,7 +119,62 @@ func TxDeleteMany(
 	return func(ctx mongo.SessionContext) (interface{}, error) {
 		result, err := coll.DeleteMany(ctx, filter, opts...)
 		if err != nil {
-			logrus.Errorf("update: error deleting documents '%s' from collection '%s': %s", err, coll.Name(), err.Error())
+			logrus.Errorf("deleteMany: error deleting documents with %v filter from collection '%s': %s", filter, coll.Name(), err.Error())
+		}
+
+		return result, err
+	}
+}
+
+// Wraps replaceOne inside a callback that can be sent to a MongoDB transaction
+func TxReplaceOne(
+	coll *mongo.Collection,
+	filter interface{},
+	replacement interface{},
+	opts ...*options.ReplaceOptions,
+) TxFunc {
+	return func(ctx mongo.SessionContext) (interface{}, error) {
+		result, err := coll.ReplaceOne(ctx, filter, replacement, opts...)
+		if err != nil {
+			logrus.Errorf("replaceOne: error replacing document with %v filter in collection '%s': %s", filter, coll.Name(), err.Error())
+		}
+
+		return result, err
+	}
+}
+
+// Wraps findOneAndUpdate inside a callback that can be sent to a MongoDB transaction.
+// A filter matching no documents is not an error for the transaction,
+// and is reported by the returned *mongo.SingleResult instead.
+func TxFindOneAndUpdate(
+	coll *mongo.Collection,
+	filter interface{},
+	update interface{},
+	opts ...*options.FindOneAndUpdateOptions,
+) TxFunc {
+	return func(ctx mongo.SessionContext) (interface{}, error) {
+		result := coll.FindOneAndUpdate(ctx, filter, update, opts...)
+
+		err := result.Err()
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			logrus.Errorf("findOneAndUpdate: error updating document with %v filter in collection '%s': %s", filter, coll.Name(), err.Error())
+			return result, err
+		}
+
+		return result, nil
+	}
+}
+
+// Wraps an aggregation pipeline inside a callback that can be sent to a MongoDB transaction
+func TxAggregate(
+	coll *mongo.Collection,
+	pipeline interface{},
+	opts ...*options.AggregateOptions,
+) TxFunc {
+	return func(ctx mongo.SessionContext) (interface{}, error) {
+		result, err := coll.Aggregate(ctx, pipeline, opts...)
+		if err != nil {
+			logrus.Errorf("aggregate: error aggregating with %v pipeline in collection '%s': %s", pipeline, coll.Name(), err.Error())
 		}
 
 		return result, err
@@ -0,0 +1,153 @@
+package smongo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/soyart/satch"
+)
+
+// Report key for *VerifyReport
+const ReportKeyVerify = "smongo.verify"
+
+// Postcondition is a check on documents after commit.
+// Filter selects the affected documents, and every selected document must match Expect.
+//
+// For example, settled payouts can be checked with Filter {"id": {"$in": ids}},
+// Expect {"settled": true} and Count len(ids).
+type Postcondition struct {
+	Name   string
+	Coll   string
+	Filter interface{}
+	Expect interface{}
+
+	// If positive, Filter must select exactly Count documents.
+	// This catches writes whose filters silently matched nothing.
+	Count int64
+}
+
+// Verifiable is implemented by job outputs that know their postconditions
+type Verifiable interface {
+	Postconditions() []Postcondition
+}
+
+type VerifyResult struct {
+	Name     string
+	Coll     string
+	Selected int64 // Documents selected by Filter
+	Matched  int64 // Selected documents that also match Expect
+	Expected int64 // Expected Selected, or 0 if not checked
+	OK       bool
+	Reason   string
+}
+
+type VerifyReport struct {
+	Results []VerifyResult
+}
+
+// OK reports whether all postconditions hold
+func (r *VerifyReport) OK() bool {
+	return len(r.Failures()) == 0
+}
+
+func (r *VerifyReport) Failures() []VerifyResult {
+	failures := []VerifyResult{}
+	for i := range r.Results {
+		if !r.Results[i].OK {
+			failures = append(failures, r.Results[i])
+		}
+	}
+
+	return failures
+}
+
+// VerifyError is returned by Verify when postconditions do not hold
+type VerifyError struct {
+	Report *VerifyReport
+}
+
+func (e *VerifyError) Error() string {
+	failures := e.Report.Failures()
+	reasons := make([]string, len(failures))
+	for i := range failures {
+		reasons[i] = fmt.Sprintf("%s (collection '%s'): %s", failures[i].Name, failures[i].Coll, failures[i].Reason)
+	}
+
+	return fmt.Sprintf("%d postconditions failed: %s", len(failures), strings.Join(reasons, "; "))
+}
+
+// Verify re-queries documents after commit and checks conds.
+// If any condition fails, it logs the failures and returns *VerifyError with the full report.
+// The report is also recorded in the satch report as ReportKeyVerify.
+func Verify(ctx context.Context, backend Backend, conds ...Postcondition) (*VerifyReport, error) {
+	report := &VerifyReport{Results: make([]VerifyResult, 0, len(conds))}
+
+	for i := range conds {
+		result, err := verify(ctx, backend, &conds[i])
+		if err != nil {
+			return report, errors.Wrapf(err, "failed to verify postcondition '%s'", conds[i].Name)
+		}
+
+		report.Results = append(report.Results, result)
+	}
+
+	satch.Record(ctx, ReportKeyVerify, report)
+
+	if !report.OK() {
+		err := &VerifyError{Report: report}
+		logrus.Errorf("verify: %s", err.Error())
+		return report, err
+	}
+
+	return report, nil
+}
+
+func verify(ctx context.Context, backend Backend, cond *Postcondition) (VerifyResult, error) {
+	result := VerifyResult{
+		Name:     cond.Name,
+		Coll:     cond.Coll,
+		Expected: cond.Count,
+	}
+
+	filter := cond.Filter
+	if filter == nil {
+		filter = bson.M{}
+	}
+
+	var selected []bson.M
+	err := backend.Find(ctx, cond.Coll, filter, &selected)
+	if err != nil {
+		return result, err
+	}
+
+	result.Selected = int64(len(selected))
+	result.Matched = result.Selected
+
+	if cond.Expect != nil {
+		var matched []bson.M
+		err = backend.Find(ctx, cond.Coll, bson.M{"$and": bson.A{filter, cond.Expect}}, &matched)
+		if err != nil {
+			return result, err
+		}
+
+		result.Matched = int64(len(matched))
+	}
+
+	switch {
+	case cond.Count > 0 && result.Selected != cond.Count:
+		result.Reason = fmt.Sprintf("expected %d documents, found %d", cond.Count, result.Selected)
+
+	case result.Matched != result.Selected:
+		result.Reason = fmt.Sprintf("%d of %d documents do not match %v", result.Selected-result.Matched, result.Selected, cond.Expect)
+
+	default:
+		result.OK = true
+	}
+
+	return result, nil
+}
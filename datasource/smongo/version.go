@@ -0,0 +1,379 @@
+package smongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Default name of the version field for NewVersions
+const DefaultVersionField = "version"
+
+// ErrConflict is matched by *ConflictError with errors.Is
+var ErrConflict = errors.New("version conflict")
+
+// ConflictError lists the keys of versioned writes that matched no documents,
+// i.e. documents that were changed or removed after their versions were read
+type ConflictError struct {
+	Coll string
+	Keys []interface{}
+}
+
+func (e *ConflictError) Error() string {
+	keys := make([]string, len(e.Keys))
+	for i := range e.Keys {
+		keys[i] = fmt.Sprint(e.Keys[i])
+	}
+
+	return fmt.Sprintf("%s: %d conflicting documents in collection '%s': %s", ErrConflict.Error(), len(keys), e.Coll, strings.Join(keys, ", "))
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Versions tracks versions of documents read at input time, keyed by KeyField.
+//
+// Versioned writes built from Versions only match documents whose VersionField
+// still has the tracked version, and increment it. A missing version field is version 0.
+type Versions struct {
+	KeyField     string
+	VersionField string
+
+	versions map[interface{}]int64
+}
+
+func NewVersions(keyField, versionField string) *Versions {
+	if versionField == "" {
+		versionField = DefaultVersionField
+	}
+
+	return &Versions{
+		KeyField:     keyField,
+		VersionField: versionField,
+		versions:     make(map[interface{}]int64),
+	}
+}
+
+// TrackVersions records versions of docs
+func TrackVersions[T any](
+	v *Versions,
+	docs []T,
+	key func(doc T) interface{},
+	version func(doc T) int64,
+) error {
+	for i := range docs {
+		err := v.Set(key(docs[i]), version(docs[i]))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Set records the version of the document with key.
+// Keys must be comparable, e.g. strings, numbers or primitive.ObjectID.
+func (v *Versions) Set(key interface{}, version int64) error {
+	k, err := versionKey(key)
+	if err != nil {
+		return err
+	}
+
+	v.versions[k] = version
+	return nil
+}
+
+// Get returns the recorded version of the document with key
+func (v *Versions) Get(key interface{}) (int64, bool) {
+	k, err := versionKey(key)
+	if err != nil {
+		return 0, false
+	}
+
+	version, ok := v.versions[k]
+	return version, ok
+}
+
+// Len returns the number of tracked documents
+func (v *Versions) Len() int {
+	return len(v.versions)
+}
+
+func (v *Versions) clone() *Versions {
+	cloned := NewVersions(v.KeyField, v.VersionField)
+	for key, version := range v.versions {
+		cloned.versions[key] = version
+	}
+
+	return cloned
+}
+
+// Filter returns the filter matching the document with key at its tracked version
+func (v *Versions) Filter(key interface{}) (bson.M, error) {
+	version, ok := v.Get(key)
+	if !ok {
+		return nil, fmt.Errorf("no version tracked for key %v", key)
+	}
+
+	return bson.M{
+		v.KeyField:     key,
+		v.VersionField: versionFilter(version),
+	}, nil
+}
+
+// Apply returns a copy of model with the tracked version added to its filter,
+// and the version field incremented for updates. Other fields of model, e.g. Collation
+// and Hint, are kept. It also returns the document key found in the model's filter.
+//
+// Supported models are *mongo.UpdateOneModel and *mongo.DeleteOneModel,
+// with bson.M or bson.D filters and updates. Upserts are rejected, because a versioned
+// filter that matches nothing would insert a duplicate instead of reporting a conflict.
+func (v *Versions) Apply(model mongo.WriteModel) (mongo.WriteModel, interface{}, error) {
+	switch m := model.(type) {
+	case *mongo.UpdateOneModel:
+		if m.Upsert != nil && *m.Upsert {
+			return nil, nil, errors.New("upserts cannot be versioned")
+		}
+
+		key, filter, err := v.versionedFilter(m.Filter)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		update, err := v.versionedUpdate(m.Update)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		versioned := *m
+		versioned.Filter = filter
+		versioned.Update = update
+
+		return &versioned, key, nil
+
+	case *mongo.DeleteOneModel:
+		key, filter, err := v.versionedFilter(m.Filter)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		versioned := *m
+		versioned.Filter = filter
+
+		return &versioned, key, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported write model for versioned writes: %s", reflect.TypeOf(model))
+}
+
+func (v *Versions) versionedFilter(filter interface{}) (interface{}, interface{}, error) {
+	var key interface{}
+	found := false
+
+	switch f := filter.(type) {
+	case bson.M:
+		key, found = f[v.KeyField]
+
+	case bson.D:
+		for i := range f {
+			if f[i].Key == v.KeyField {
+				key, found = f[i].Value, true
+				break
+			}
+		}
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported filter type for versioned writes: %s", reflect.TypeOf(filter))
+	}
+
+	if !found {
+		return nil, nil, fmt.Errorf("filter %v has no key field '%s'", filter, v.KeyField)
+	}
+
+	_, err := versionKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	version, ok := v.Get(key)
+	if !ok {
+		return nil, nil, fmt.Errorf("no version tracked for key %v", key)
+	}
+
+	// Wrap the original filter instead of modifying it
+	return key, bson.D{
+		{Key: "$and", Value: bson.A{
+			filter,
+			bson.M{v.VersionField: versionFilter(version)},
+		}},
+	}, nil
+}
+
+func (v *Versions) versionedUpdate(update interface{}) (interface{}, error) {
+	switch u := update.(type) {
+	case bson.M:
+		versioned := make(bson.M, len(u)+1)
+		for op, fields := range u {
+			versioned[op] = fields
+		}
+
+		inc, err := v.withInc(u["$inc"])
+		if err != nil {
+			return nil, err
+		}
+
+		versioned["$inc"] = inc
+		return versioned, nil
+
+	case bson.D:
+		versioned := make(bson.D, 0, len(u)+1)
+		var inc interface{}
+		for i := range u {
+			if u[i].Key == "$inc" {
+				inc = u[i].Value
+				continue
+			}
+
+			versioned = append(versioned, u[i])
+		}
+
+		incVersioned, err := v.withInc(inc)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(versioned, bson.E{Key: "$inc", Value: incVersioned}), nil
+	}
+
+	return nil, fmt.Errorf("unsupported update type for versioned writes: %s", reflect.TypeOf(update))
+}
+
+func (v *Versions) withInc(inc interface{}) (bson.M, error) {
+	versioned := bson.M{}
+
+	switch i := inc.(type) {
+	case nil:
+
+	case bson.M:
+		for field, n := range i {
+			versioned[field] = n
+		}
+
+	case bson.D:
+		for j := range i {
+			versioned[i[j].Key] = i[j].Value
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported $inc type for versioned writes: %s", reflect.TypeOf(inc))
+	}
+
+	if _, ok := versioned[v.VersionField]; ok {
+		return nil, fmt.Errorf("update must not change version field '%s'", v.VersionField)
+	}
+
+	versioned[v.VersionField] = 1
+	return versioned, nil
+}
+
+// Wraps versioned writes inside a callback that can be sent to a MongoDB transaction.
+// Each write is applied with Versions.Apply and executed one by one.
+// Writes that match no documents are collected into *ConflictError,
+// which is returned after all writes are attempted so that the transaction aborts.
+//
+// A document may be written to more than once, as the callback
+// tracks the versions it has incremented. The versions argument is not modified.
+//
+// The callback returns *mongo.BulkWriteResult.
+func TxVersionedBulkWrite(
+	coll *mongo.Collection,
+	versions *Versions,
+	writes []mongo.WriteModel,
+) TxFunc {
+	return func(ctx mongo.SessionContext) (interface{}, error) {
+		return versionedBulkWrite(ctx, coll, versions, writes)
+	}
+}
+
+// VersionedBulkWrite runs TxVersionedBulkWrite in a transaction.
+// With a Backend, e.g. MemBackend, plan the writes with WritePlan.ThenVersioned instead.
+func VersionedBulkWrite(
+	ctx context.Context,
+	coll *mongo.Collection,
+	versions *Versions,
+	writes []mongo.WriteModel,
+) (
+	*mongo.BulkWriteResult,
+	error,
+) {
+	tx := TxVersionedBulkWrite(coll, versions, writes)
+	resultTx, err := WithTxColl(ctx, coll, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, ok := resultTx.(*mongo.BulkWriteResult)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type: %s", reflect.TypeOf(resultTx).String())
+	}
+
+	return result, nil
+}
+
+func versionedBulkWrite(
+	ctx context.Context,
+	coll *mongo.Collection,
+	versions *Versions,
+	writes []mongo.WriteModel,
+) (
+	*mongo.BulkWriteResult,
+	error,
+) {
+	plan := WritePlan{}.ThenVersioned(coll.Name(), versions, writes)
+	results, err := execPlan(plan, nil, func(_ string) bulkFunc {
+		return func(models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+			return coll.BulkWrite(ctx, models, opts...)
+		}
+	})
+
+	result := results.Coll(coll.Name())
+	if result == nil {
+		result = &mongo.BulkWriteResult{}
+	}
+
+	return result, err
+}
+
+// versionFilter matches version, with missing version fields treated as 0
+func versionFilter(version int64) interface{} {
+	if version == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+
+	return version
+}
+
+// versionKey normalizes named string types, e.g. `type AccountNumber string`,
+// so that they match plain strings. Keys that cannot be map keys, e.g. bson.M, are rejected.
+func versionKey(key interface{}) (interface{}, error) {
+	v := reflect.ValueOf(key)
+	switch {
+	case !v.IsValid():
+		return nil, errors.New("version key is nil")
+
+	case v.Kind() == reflect.String:
+		return v.String(), nil
+
+	case !v.Comparable():
+		return nil, fmt.Errorf("unexpected version key type: '%s' is not comparable", reflect.TypeOf(key))
+	}
+
+	return key, nil
+}
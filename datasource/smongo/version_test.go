@@ -0,0 +1,142 @@
+package smongo
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type accountNumber string
+
+func TestVersionsApply(t *testing.T) {
+	versions := NewVersions("number", "")
+	err := versions.Set(accountNumber("a1"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hint := bson.M{"number": 1}
+	model := mongo.NewUpdateOneModel().
+		SetFilter(bson.M{"number": "a1"}).
+		SetUpdate(bson.M{"$inc": bson.M{"balance": 10}}).
+		SetHint(hint)
+
+	applied, key, err := versions.Apply(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key != "a1" {
+		t.Fatalf("unexpected key %v", key)
+	}
+
+	versioned := applied.(*mongo.UpdateOneModel)
+	if !reflect.DeepEqual(versioned.Hint, hint) {
+		t.Fatalf("expecting hint to be kept, got %v", versioned.Hint)
+	}
+
+	expectFilter := bson.D{{Key: "$and", Value: bson.A{bson.M{"number": "a1"}, bson.M{"version": int64(3)}}}}
+	if !reflect.DeepEqual(versioned.Filter, expectFilter) {
+		t.Fatalf("unexpected filter %v", versioned.Filter)
+	}
+
+	expectUpdate := bson.M{"$inc": bson.M{"balance": 10, "version": 1}}
+	if !reflect.DeepEqual(versioned.Update, expectUpdate) {
+		t.Fatalf("unexpected update %v", versioned.Update)
+	}
+
+	if !reflect.DeepEqual(model.Filter, bson.M{"number": "a1"}) {
+		t.Fatalf("original filter modified: %v", model.Filter)
+	}
+}
+
+func TestVersionsApplyErrors(t *testing.T) {
+	versions := NewVersions("number", "")
+	err := versions.Set("a1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		model mongo.WriteModel
+	}{
+		{
+			name:  "upsert",
+			model: mongo.NewUpdateOneModel().SetFilter(bson.M{"number": "a1"}).SetUpdate(bson.M{"$set": bson.M{"x": 1}}).SetUpsert(true),
+		},
+		{
+			name:  "unhashable key",
+			model: mongo.NewUpdateOneModel().SetFilter(bson.M{"number": bson.M{"$in": bson.A{"a1"}}}).SetUpdate(bson.M{"$set": bson.M{"x": 1}}),
+		},
+		{
+			name:  "untracked key",
+			model: mongo.NewDeleteOneModel().SetFilter(bson.M{"number": "a2"}),
+		},
+		{
+			name:  "no key field",
+			model: mongo.NewDeleteOneModel().SetFilter(bson.M{"id": "a1"}),
+		},
+		{
+			name:  "version field changed",
+			model: mongo.NewUpdateOneModel().SetFilter(bson.M{"number": "a1"}).SetUpdate(bson.M{"$inc": bson.M{"version": 2}}),
+		},
+		{
+			name:  "unsupported model",
+			model: mongo.NewInsertOneModel().SetDocument(bson.M{"number": "a1"}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := versions.Apply(tt.model)
+			if err == nil {
+				t.Fatal("expecting error")
+			}
+		})
+	}
+}
+
+func TestVersionsSetUnhashable(t *testing.T) {
+	versions := NewVersions("number", "")
+
+	err := versions.Set(bson.M{"a": 1}, 1)
+	if err == nil {
+		t.Fatal("expecting error for unhashable key")
+	}
+
+	err = versions.Set(nil, 1)
+	if err == nil {
+		t.Fatal("expecting error for nil key")
+	}
+
+	if _, ok := versions.Get(bson.A{1}); ok {
+		t.Fatal("unexpected version for unhashable key")
+	}
+
+	err = TrackVersions(versions, []bson.M{{"k": "x"}, {"k": bson.A{}}}, func(doc bson.M) interface{} { return doc["k"] }, func(bson.M) int64 { return 1 })
+	if err == nil {
+		t.Fatal("expecting TrackVersions to fail on unhashable key")
+	}
+}
+
+func TestVersionsApplyKeepsOpts(t *testing.T) {
+	versions := NewVersions("number", "")
+	err := versions.Set("a1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collation := &options.Collation{Locale: "en"}
+	applied, _, err := versions.Apply(mongo.NewDeleteOneModel().SetFilter(bson.D{{Key: "number", Value: "a1"}}).SetCollation(collation))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if applied.(*mongo.DeleteOneModel).Collation != collation {
+		t.Fatal("expecting collation to be kept")
+	}
+}
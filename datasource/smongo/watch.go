@@ -0,0 +1,297 @@
+package smongo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/soyart/satch"
+)
+
+const (
+	DefaultWatchBatchSize = 100
+	DefaultWatchWindow    = 5 * time.Second
+)
+
+// ChangeEvent is a change stream event.
+// FullDocument is only set for inserts and replaces,
+// or for updates if the change stream is opened with options.UpdateLookup.
+type ChangeEvent struct {
+	ID            bson.Raw            `bson:"_id"` // Resume token
+	OperationType string              `bson:"operationType"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+	Ns            struct {
+		DB   string `bson:"db"`
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey  bson.Raw `bson:"documentKey"`
+	FullDocument bson.Raw `bson:"fullDocument,omitempty"`
+}
+
+// ResumeTokenStore persists change stream resume tokens,
+// so that a restarted Watcher continues where it left off
+type ResumeTokenStore interface {
+	Load(ctx context.Context) (bson.Raw, error) // Returns nil if there's no token yet
+	Save(ctx context.Context, token bson.Raw) error
+}
+
+// WatchConfig configures Watcher.
+// A batch is processed when it has BatchSize events,
+// or when Window has passed since its first event.
+type WatchConfig struct {
+	Pipeline  mongo.Pipeline
+	BatchSize int
+	Window    time.Duration
+	Opts      []*options.ChangeStreamOptions
+
+	// Satch config for each batch
+	Satch satch.Config
+
+	// Inputs converts a batch into inputs for the job.
+	// If nil, the job gets the []ChangeEvent batch as inputs.
+	Inputs func(ctx context.Context, batch []ChangeEvent) (interface{}, error)
+}
+
+// Watcher runs a satch job with micro-batches of change stream events as inputs.
+//
+// The resume token of a batch is saved only after the job has committed it,
+// so events are delivered at least once.
+type Watcher struct {
+	coll   *mongo.Collection
+	job    satch.Job
+	ds     satch.DataSource
+	tokens ResumeTokenStore
+	conf   WatchConfig
+}
+
+// NewWatcher returns a Watcher that watches coll, and runs job for each batch.
+// ds is used for locking and committing, while its Inputs is never called.
+func NewWatcher(
+	coll *mongo.Collection,
+	job satch.Job,
+	ds satch.DataSource,
+	tokens ResumeTokenStore,
+	conf WatchConfig,
+) (
+	*Watcher,
+	error,
+) {
+	switch {
+	case coll == nil:
+		return nil, errors.New("coll is nil")
+
+	case job == nil:
+		return nil, errors.New("job is nil")
+
+	case ds == nil:
+		return nil, errors.New("ds is nil")
+
+	case tokens == nil:
+		return nil, errors.New("tokens is nil")
+
+	case conf.BatchSize < 0 || conf.Window < 0:
+		return nil, fmt.Errorf("bad batch size %d or window %s", conf.BatchSize, conf.Window)
+	}
+
+	if conf.BatchSize == 0 {
+		conf.BatchSize = DefaultWatchBatchSize
+	}
+
+	if conf.Window == 0 {
+		conf.Window = DefaultWatchWindow
+	}
+
+	if conf.Pipeline == nil {
+		conf.Pipeline = mongo.Pipeline{}
+	}
+
+	return &Watcher{
+		coll:   coll,
+		job:    job,
+		ds:     ds,
+		tokens: tokens,
+		conf:   conf,
+	}, nil
+}
+
+// Watch blocks, processing batches until ctx is done or a batch fails.
+// Events in a pending batch are discarded when ctx is done,
+// and will be redelivered by the next Watch.
+func (w *Watcher) Watch(ctx context.Context) error {
+	token, err := w.tokens.Load(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to load resume token")
+	}
+
+	// Wake up regularly to check if the pending batch is due
+	await := w.conf.Window
+	if await > time.Second {
+		await = time.Second
+	}
+
+	opts := options.ChangeStream().SetMaxAwaitTime(await)
+	if token != nil {
+		opts.SetStartAfter(token)
+	}
+
+	stream, err := w.coll.Watch(ctx, w.conf.Pipeline, append([]*options.ChangeStreamOptions{opts}, w.conf.Opts...)...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to watch collection '%s'", w.coll.Name())
+	}
+
+	defer stream.Close(context.Background())
+
+	batch := make([]ChangeEvent, 0, w.conf.BatchSize)
+	var first time.Time
+
+	for {
+		if stream.TryNext(ctx) {
+			var event ChangeEvent
+			err := stream.Decode(&event)
+			if err != nil {
+				return errors.Wrap(err, "failed to decode change event")
+			}
+
+			if len(batch) == 0 {
+				first = time.Now()
+			}
+
+			batch = append(batch, event)
+			if len(batch) < w.conf.BatchSize {
+				continue
+			}
+		}
+
+		err := stream.Err()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return errors.Wrapf(err, "change stream failed for collection '%s'", w.coll.Name())
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		full := len(batch) >= w.conf.BatchSize
+		due := len(batch) > 0 && time.Since(first) >= w.conf.Window
+		if !full && !due {
+			continue
+		}
+
+		err = w.process(ctx, batch)
+		if err != nil {
+			return err
+		}
+
+		batch = make([]ChangeEvent, 0, w.conf.BatchSize)
+	}
+}
+
+func (w *Watcher) process(ctx context.Context, batch []ChangeEvent) error {
+	logrus.Infof("watch: processing batch of %d events from collection '%s'", len(batch), w.coll.Name())
+
+	ds := &watchDataSource{
+		DataSource: w.ds,
+		batch:      batch,
+		inputs:     w.conf.Inputs,
+	}
+
+	err := satch.Start(ctx, w.job, ds, w.conf.Satch)
+	if err != nil {
+		return errors.Wrapf(err, "failed to process batch of %d events", len(batch))
+	}
+
+	token := batch[len(batch)-1].ID
+	err = w.tokens.Save(ctx, token)
+	if err != nil {
+		return errors.Wrap(err, "failed to save resume token")
+	}
+
+	return nil
+}
+
+// watchDataSource feeds a batch to satch.Start, and delegates the rest to the wrapped satch.DataSource
+type watchDataSource struct {
+	satch.DataSource
+
+	batch  []ChangeEvent
+	inputs func(ctx context.Context, batch []ChangeEvent) (interface{}, error)
+}
+
+func (d *watchDataSource) Inputs(ctx context.Context) (interface{}, error) {
+	if d.inputs == nil {
+		return d.batch, nil
+	}
+
+	return d.inputs(ctx, d.batch)
+}
+
+// CollTokenStore stores resume tokens in a MongoDB collection, one document per watcher ID
+type CollTokenStore struct {
+	coll *mongo.Collection
+	id   string
+}
+
+func NewCollTokenStore(coll *mongo.Collection, id string) *CollTokenStore {
+	return &CollTokenStore{coll: coll, id: id}
+}
+
+func (s *CollTokenStore) Load(ctx context.Context) (bson.Raw, error) {
+	var doc struct {
+		Token bson.Raw `bson:"token"`
+	}
+
+	err := s.coll.FindOne(ctx, bson.M{"_id": s.id}).Decode(&doc)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, errors.Wrapf(err, "failed to find resume token '%s' in collection '%s'", s.id, s.coll.Name())
+	}
+
+	return doc.Token, nil
+}
+
+func (s *CollTokenStore) Save(ctx context.Context, token bson.Raw) error {
+	_, err := s.coll.UpdateOne(
+		ctx,
+		bson.M{"_id": s.id},
+		bson.M{
+			"$set": bson.M{
+				"token":      token,
+				"updated_at": time.Now().Unix(),
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to save resume token '%s' in collection '%s'", s.id, s.coll.Name())
+	}
+
+	return nil
+}
+
+// MemTokenStore keeps the resume token in memory, for tests and one-off runs
+type MemTokenStore struct {
+	Token bson.Raw
+}
+
+func (s *MemTokenStore) Load(_ context.Context) (bson.Raw, error) {
+	return s.Token, nil
+}
+
+func (s *MemTokenStore) Save(_ context.Context, token bson.Raw) error {
+	s.Token = token
+	return nil
+}
@@ -0,0 +1,146 @@
+package smongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/soyart/satch"
+)
+
+// batchJob sends each batch of change events it runs on to batches,
+// and fails while fail is set
+type batchJob struct {
+	batches chan []ChangeEvent
+	fail    bool
+}
+
+func (j *batchJob) ID() string {
+	return "batch-job"
+}
+
+func (j *batchJob) Run(_ context.Context, inputs interface{}, _ time.Time) (interface{}, error) {
+	batch := inputs.([]ChangeEvent)
+	j.batches <- batch
+
+	if j.fail {
+		return nil, errors.New("job failed")
+	}
+
+	return nil, nil
+}
+
+// nopDataSource has no inputs of its own, and discards commits
+type nopDataSource struct{}
+
+func (nopDataSource) LockWrite(context.Context) error             { return nil }
+func (nopDataSource) LockRead(context.Context) error              { return nil }
+func (nopDataSource) Inputs(context.Context) (interface{}, error) { return nil, nil }
+func (nopDataSource) Commit(context.Context, interface{}) error   { return nil }
+
+var _ satch.DataSource = nopDataSource{}
+
+func TestWatcher(t *testing.T) {
+	db := testDB(t, true)
+	coll := db.Collection("payouts")
+
+	ctx := context.Background()
+	err := db.CreateCollection(ctx, coll.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := &MemTokenStore{}
+	job := &batchJob{batches: make(chan []ChangeEvent, 10)}
+
+	watch := func(ctx context.Context) chan error {
+		w, err := NewWatcher(coll, job, nopDataSource{}, tokens, WatchConfig{BatchSize: 2, Window: 200 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- w.Watch(ctx)
+		}()
+
+		// Give the change stream time to open before writing
+		time.Sleep(500 * time.Millisecond)
+		return done
+	}
+
+	insert := func(ids ...string) {
+		for _, id := range ids {
+			_, err := coll.InsertOne(ctx, bson.M{"id": id})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	receive := func() []string {
+		select {
+		case batch := <-job.batches:
+			ids := make([]string, len(batch))
+			for i := range batch {
+				ids[i] = batch[i].FullDocument.Lookup("id").StringValue()
+			}
+
+			return ids
+
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for batch")
+			return nil
+		}
+	}
+
+	// Full batch by count, then a partial batch by window
+	watchCtx, cancel := context.WithCancel(ctx)
+	done := watch(watchCtx)
+	insert("p1", "p2", "p3")
+
+	if batch := fmt.Sprint(receive()); batch != "[p1 p2]" {
+		t.Fatalf("unexpected first batch %s", batch)
+	}
+
+	if batch := fmt.Sprint(receive()); batch != "[p3]" {
+		t.Fatalf("unexpected second batch %s", batch)
+	}
+
+	cancel()
+	<-done
+
+	if tokens.Token == nil {
+		t.Fatal("expecting resume token to be saved")
+	}
+
+	// A failed batch is not acknowledged, and is redelivered after restart
+	job.fail = true
+	done = watch(ctx)
+	insert("p4")
+
+	if batch := fmt.Sprint(receive()); batch != "[p4]" {
+		t.Fatalf("unexpected batch %s", batch)
+	}
+
+	err = <-done
+	if err == nil {
+		t.Fatal("expecting watch to fail with the job")
+	}
+
+	job.fail = false
+	watchCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+
+	done = watch(watchCtx)
+	if batch := fmt.Sprint(receive()); batch != "[p4]" {
+		t.Fatalf("expecting p4 to be redelivered, got %s", batch)
+	}
+
+	cancel()
+	<-done
+}
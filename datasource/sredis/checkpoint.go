@@ -0,0 +1,126 @@
+package sredis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrStaleToken is returned when a fenced write is rejected,
+// because a newer lock owner has already written
+var ErrStaleToken = errors.New("stale fencing token")
+
+// Writes the checkpoint unless it was written with a newer fencing token
+var scriptSaveFenced = redis.NewScript(`
+local current = tonumber(redis.call('HGET', KEYS[1], 'token') or '0')
+if tonumber(ARGV[2]) < current then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'value', ARGV[1], 'token', ARGV[2], 'updated_at', ARGV[3])
+return 1
+`)
+
+// Checkpoint is the saved progress of a job
+type Checkpoint struct {
+	Value     []byte
+	Token     int64 // Newest fencing token used by SaveFenced, 0 if there is none
+	UpdatedAt time.Time
+}
+
+// Checkpoints stores job progress in Redis hashes,
+// so that a restarted job can continue where it left off
+type Checkpoints struct {
+	client redis.Cmdable
+	prefix string
+}
+
+// NewCheckpoints returns a store whose keys are prefixed with prefix,
+// or DefaultPrefix if prefix is empty
+func NewCheckpoints(client redis.Cmdable, prefix string) *Checkpoints {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+
+	return &Checkpoints{client: client, prefix: prefix}
+}
+
+// Load returns the checkpoint name, or nil if there is none
+func (c *Checkpoints) Load(ctx context.Context, name string) (*Checkpoint, error) {
+	fields, err := c.client.HGetAll(ctx, c.key(name)).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load checkpoint '%s'", name)
+	}
+
+	value, ok := fields["value"]
+	if !ok {
+		return nil, nil
+	}
+
+	checkpoint := &Checkpoint{Value: []byte(value)}
+
+	if token := fields["token"]; token != "" {
+		checkpoint.Token, err = strconv.ParseInt(token, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad token of checkpoint '%s'", name)
+		}
+	}
+
+	if updatedAt := fields["updated_at"]; updatedAt != "" {
+		ms, err := strconv.ParseInt(updatedAt, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad updated_at of checkpoint '%s'", name)
+		}
+
+		checkpoint.UpdatedAt = time.UnixMilli(ms)
+	}
+
+	return checkpoint, nil
+}
+
+// Save writes checkpoint name unconditionally.
+// It keeps the fencing token, so that stale SaveFenced calls are still rejected.
+func (c *Checkpoints) Save(ctx context.Context, name string, value []byte) error {
+	err := c.client.HSet(ctx, c.key(name), "value", value, "updated_at", time.Now().UnixMilli()).Err()
+	if err != nil {
+		return errors.Wrapf(err, "failed to save checkpoint '%s'", name)
+	}
+
+	return nil
+}
+
+// SaveFenced writes checkpoint name with the fencing token of a Lock.
+// It fails with ErrStaleToken if the checkpoint was saved with a newer token,
+// i.e. the lock was lost to another owner that has since made progress.
+func (c *Checkpoints) SaveFenced(ctx context.Context, name string, value []byte, token int64) error {
+	if token <= 0 {
+		return fmt.Errorf("bad fencing token %d for checkpoint '%s'", token, name)
+	}
+
+	n, err := scriptSaveFenced.Run(ctx, c.client, []string{c.key(name)}, value, token, time.Now().UnixMilli()).Int64()
+	if err != nil {
+		return errors.Wrapf(err, "failed to save checkpoint '%s'", name)
+	}
+
+	if n == 0 {
+		return errors.Wrapf(ErrStaleToken, "checkpoint '%s' with token %d", name, token)
+	}
+
+	return nil
+}
+
+func (c *Checkpoints) Delete(ctx context.Context, name string) error {
+	err := c.client.Del(ctx, c.key(name)).Err()
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete checkpoint '%s'", name)
+	}
+
+	return nil
+}
+
+func (c *Checkpoints) key(name string) string {
+	return c.prefix + "checkpoint:" + name
+}
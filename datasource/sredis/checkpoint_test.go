@@ -0,0 +1,74 @@
+package sredis
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	_, client := testRedis(t)
+	checkpoints := NewCheckpoints(client, "")
+
+	checkpoint, err := checkpoints.Load(ctx, "payout")
+	if err != nil || checkpoint != nil {
+		t.Fatalf("expecting no checkpoint, got %v, %v", checkpoint, err)
+	}
+
+	err = checkpoints.Save(ctx, "payout", []byte("page-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkpoints.SaveFenced(ctx, "payout", []byte("page-2"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writers with older tokens lost their lock to the writer of token 2
+	err = checkpoints.SaveFenced(ctx, "payout", []byte("page-0"), 1)
+	if !errors.Is(err, ErrStaleToken) {
+		t.Fatalf("expecting ErrStaleToken, got %v", err)
+	}
+
+	checkpoint, err = checkpoints.Load(ctx, "payout")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(checkpoint.Value) != "page-2" || checkpoint.Token != 2 || checkpoint.UpdatedAt.IsZero() {
+		t.Fatalf("unexpected checkpoint %+v", checkpoint)
+	}
+
+	// Unfenced saves keep the token, so stale writers are still rejected
+	err = checkpoints.Save(ctx, "payout", []byte("page-3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkpoints.SaveFenced(ctx, "payout", []byte("page-0"), 1)
+	if !errors.Is(err, ErrStaleToken) {
+		t.Fatalf("expecting ErrStaleToken after Save, got %v", err)
+	}
+
+	checkpoint, err = checkpoints.Load(ctx, "payout")
+	if err != nil || string(checkpoint.Value) != "page-3" || checkpoint.Token != 2 {
+		t.Fatalf("unexpected checkpoint %+v, %v", checkpoint, err)
+	}
+
+	err = checkpoints.SaveFenced(ctx, "payout", nil, 0)
+	if err == nil {
+		t.Fatal("expecting token 0 to be rejected")
+	}
+
+	err = checkpoints.Delete(ctx, "payout")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err = checkpoints.Load(ctx, "payout")
+	if err != nil || checkpoint != nil {
+		t.Fatalf("expecting deleted checkpoint, got %v, %v", checkpoint, err)
+	}
+}
@@ -0,0 +1,69 @@
+package sredis
+
+import (
+	"context"
+
+	"github.com/soyart/satch"
+)
+
+// DataSource wraps a satch.DataSource, replacing its locks with a Lock.
+//
+// The lock must be held on Commit, e.g. with satch.Config.LockWrite.
+type DataSource struct {
+	satch.DataSource
+	lock *Lock
+}
+
+var (
+	_ satch.DataSource = &DataSource{}
+	_ satch.Unlocker   = &DataSource{}
+)
+
+// WithLock returns ds locked by lock instead of its own LockRead and LockWrite
+func WithLock(ds satch.DataSource, lock *Lock) *DataSource {
+	return &DataSource{DataSource: ds, lock: lock}
+}
+
+func (d *DataSource) Lock() *Lock {
+	return d.lock
+}
+
+func (d *DataSource) LockRead(ctx context.Context) error {
+	return d.lock.Lock(ctx, "read")
+}
+
+func (d *DataSource) LockWrite(ctx context.Context) error {
+	return d.lock.Lock(ctx, "write")
+}
+
+func (d *DataSource) Unlock(ctx context.Context) error {
+	return d.lock.Unlock(ctx)
+}
+
+// Commit fails with satch.ErrLockLost if the lock is no longer held, and commits otherwise.
+//
+// The lock is renewed before commit, so that the commit has a whole TTL to finish.
+// The wrapped data source gets the fencing token via TokenFrom, to reject
+// its writes in stores that saw a newer token, e.g. with Checkpoints.SaveFenced.
+func (d *DataSource) Commit(ctx context.Context, data interface{}) error {
+	err := d.lock.Err()
+	if err != nil {
+		return err
+	}
+
+	token, err := d.lock.renewHeld(ctx)
+	if err != nil {
+		return err
+	}
+
+	return d.DataSource.Commit(context.WithValue(ctx, tokenKey{}, token), data)
+}
+
+type tokenKey struct{}
+
+// TokenFrom returns the fencing token of the Lock held by DataSource.Commit,
+// or false if ctx is not from DataSource.Commit
+func TokenFrom(ctx context.Context) (int64, bool) {
+	token, ok := ctx.Value(tokenKey{}).(int64)
+	return token, ok
+}
@@ -0,0 +1,101 @@
+package sredis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/soyart/satch"
+	"github.com/soyart/satch/datasource/smem"
+)
+
+type nopJob struct{}
+
+func (nopJob) ID() string { return "nop" }
+
+func (nopJob) Run(_ context.Context, inputs interface{}, _ time.Time) (interface{}, error) {
+	return inputs, nil
+}
+
+func TestDataSourceCommit(t *testing.T) {
+	ctx := context.Background()
+	mr, client := testRedis(t)
+
+	var tokens []int64
+	wrapped := smem.New(smem.Config{
+		Inputs: "outputs",
+		CommitFunc: func(ctx context.Context, _ interface{}) error {
+			token, ok := TokenFrom(ctx)
+			if !ok {
+				return errors.New("no fencing token")
+			}
+
+			tokens = append(tokens, token)
+			return nil
+		},
+	})
+
+	ds := WithLock(wrapped, NewLock(client, "payout", LockOptions{TTL: time.Second}))
+	for i := 0; i < 2; i++ {
+		err := satch.Start(ctx, nopJob{}, ds, satch.Config{LockWrite: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(tokens) != 2 || tokens[0] != 1 || tokens[1] != 2 {
+		t.Fatalf("unexpected tokens %v", tokens)
+	}
+
+	// Commit requires the lock
+	err := ds.Commit(ctx, "outputs")
+	if !errors.Is(err, satch.ErrLockLost) {
+		t.Fatalf("expecting ErrLockLost without the lock, got %v", err)
+	}
+
+	// A stale owner cannot commit
+	err = ds.LockWrite(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr.FastForward(2 * time.Second)
+
+	other := NewLock(client, "payout", LockOptions{TTL: time.Second})
+	err = other.Lock(ctx, "write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.Commit(ctx, "outputs")
+	if !errors.Is(err, satch.ErrLockLost) {
+		t.Fatalf("expecting ErrLockLost for stale owner, got %v", err)
+	}
+
+	if n := len(wrapped.Commits()); n != 2 {
+		t.Fatalf("expecting stale commits to be rejected, got %d commits", n)
+	}
+
+	// Commit renews the lock
+	err = other.Unlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds.Unlock(ctx)
+	err = ds.LockWrite(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr.FastForward(800 * time.Millisecond)
+	err = ds.Commit(ctx, "outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining := mr.TTL(ds.Lock().key); remaining <= 500*time.Millisecond {
+		t.Fatalf("expecting lock to be renewed on commit, %v left", remaining)
+	}
+}
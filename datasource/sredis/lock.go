@@ -0,0 +1,280 @@
+// sredis provides Redis-backed locks and checkpoints for satch jobs,
+// independent of where the jobs read and commit their data.
+//
+// Lock and Checkpoints work with any satch.DataSource, see WithLock.
+
+package sredis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+
+	"github.com/soyart/satch"
+)
+
+const (
+	DefaultLockTTL = 30 * time.Second
+	DefaultPrefix  = "satch:"
+)
+
+var (
+	// Takes the lock, and returns a new fencing token, or 0 if the lock is held
+	scriptAcquire = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return redis.call('INCR', KEYS[2])
+end
+return 0
+`)
+
+	// Extends the TTL of the lock if it is still owned by ARGV[1]
+	scriptRenew = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+	// Deletes the lock if it is still owned by ARGV[1]
+	scriptRelease = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+)
+
+type LockOptions struct {
+	TTL    time.Duration // Defaults to DefaultLockTTL
+	Prefix string        // Key prefix, defaults to DefaultPrefix
+
+	// AutoRenew renews the lock every TTL/3 until Unlock.
+	// If renewal fails for a whole TTL, the lock is considered lost, see Lock.Err.
+	AutoRenew bool
+}
+
+// Lock is a Redis lock taken with SET NX PX, and released with
+// a compare-and-delete script, so that an expired owner never deletes
+// a lock taken over by others.
+//
+// Every successful Lock returns a new, strictly increasing fencing token.
+// Writers should pass it to stores that can reject stale writers,
+// e.g. Checkpoints.SaveFenced.
+type Lock struct {
+	client   redis.Cmdable
+	name     string
+	key      string
+	fenceKey string
+	ttl      time.Duration
+	renew    bool
+
+	mut   sync.Mutex
+	value string // Owner and mode, set while held
+	token int64
+	lost  error
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewLock returns a lock named name.
+// Locks with the same name and prefix exclude each other.
+func NewLock(client redis.Cmdable, name string, opts LockOptions) *Lock {
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultLockTTL
+	}
+
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultPrefix
+	}
+
+	// The hash tags keep both keys in the same Redis Cluster slot,
+	// which scriptAcquire needs
+	return &Lock{
+		client:   client,
+		name:     name,
+		key:      fmt.Sprintf("%slock:{%s}", opts.Prefix, name),
+		fenceKey: fmt.Sprintf("%sfence:{%s}", opts.Prefix, name),
+		ttl:      opts.TTL,
+		renew:    opts.AutoRenew,
+	}
+}
+
+func (l *Lock) Name() string {
+	return l.name
+}
+
+// Token returns the fencing token of the current hold, or 0 if l is not held
+func (l *Lock) Token() int64 {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	return l.token
+}
+
+// Err returns satch.ErrLockLost if auto renewal lost the lock
+func (l *Lock) Err() error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	return l.lost
+}
+
+func (l *Lock) Lock(ctx context.Context, mode string) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.value != "" {
+		return errors.Wrapf(satch.ErrLocked, "redis lock '%s' is already held by this locker", l.name)
+	}
+
+	value := fmt.Sprintf("%s %s", owner(), mode)
+
+	token, err := scriptAcquire.Run(ctx, l.client, []string{l.key, l.fenceKey}, value, l.ttl.Milliseconds()).Int64()
+	if err != nil {
+		return errors.Wrapf(err, "failed to take redis lock '%s'", l.name)
+	}
+
+	if token == 0 {
+		return errors.Wrapf(satch.ErrLocked, "redis lock '%s'", l.name)
+	}
+
+	l.value = value
+	l.token = token
+	l.lost = nil
+
+	if l.renew {
+		l.stop = make(chan struct{})
+		l.done = make(chan struct{})
+
+		go l.autoRenew(l.value, l.stop, l.done)
+	}
+
+	logrus.Debugf("sredis: took lock '%s' with token %d", l.name, token)
+	return nil
+}
+
+// Renew extends the lock TTL, failing with satch.ErrLockLost if l no longer holds it
+func (l *Lock) Renew(ctx context.Context) error {
+	_, err := l.renewHeld(ctx)
+	return err
+}
+
+// renewHeld renews the lock, and returns the fencing token of the renewed hold
+func (l *Lock) renewHeld(ctx context.Context) (int64, error) {
+	l.mut.Lock()
+	value, token := l.value, l.token
+	l.mut.Unlock()
+
+	if value == "" {
+		return 0, errors.Wrapf(satch.ErrLockLost, "redis lock '%s' is not held", l.name)
+	}
+
+	err := l.renewValue(ctx, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return token, nil
+}
+
+// Unlock releases the lock if it is still owned by l.
+// It returns satch.ErrLockLost if the lock had expired or was taken by others.
+func (l *Lock) Unlock(ctx context.Context) error {
+	l.mut.Lock()
+	value, stop, done := l.value, l.stop, l.done
+	l.value, l.token, l.stop, l.done = "", 0, nil, nil
+	l.mut.Unlock()
+
+	if value == "" {
+		return nil
+	}
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	n, err := scriptRelease.Run(ctx, l.client, []string{l.key}, value).Int64()
+	if err != nil {
+		return errors.Wrapf(err, "failed to release redis lock '%s'", l.name)
+	}
+
+	if n == 0 {
+		return errors.Wrapf(satch.ErrLockLost, "redis lock '%s' expired before release", l.name)
+	}
+
+	return nil
+}
+
+func (l *Lock) renewValue(ctx context.Context, value string) error {
+	n, err := scriptRenew.Run(ctx, l.client, []string{l.key}, value, l.ttl.Milliseconds()).Int64()
+	if err != nil {
+		return errors.Wrapf(err, "failed to renew redis lock '%s'", l.name)
+	}
+
+	if n == 0 {
+		return errors.Wrapf(satch.ErrLockLost, "redis lock '%s'", l.name)
+	}
+
+	return nil
+}
+
+func (l *Lock) autoRenew(value string, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+		err := l.renewValue(ctx, value)
+		cancel()
+
+		switch {
+		case err == nil:
+			renewed = time.Now()
+			continue
+
+		case !errors.Is(err, satch.ErrLockLost) && time.Since(renewed) < l.ttl:
+			logrus.Warnf("sredis: %s", err.Error())
+			continue
+		}
+
+		logrus.Errorf("sredis: lost lock '%s': %s", l.name, err.Error())
+
+		l.mut.Lock()
+		l.lost = errors.Wrapf(satch.ErrLockLost, "redis lock '%s'", l.name)
+		l.mut.Unlock()
+
+		return
+	}
+}
+
+// owner returns a value unique to each lock acquisition
+func owner() string {
+	hostname, _ := os.Hostname()
+
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+	}
+
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(b))
+}
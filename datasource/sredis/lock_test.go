@@ -0,0 +1,149 @@
+package sredis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/soyart/satch"
+)
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	_, client := testRedis(t)
+
+	first := NewLock(client, "payout", LockOptions{})
+	second := NewLock(client, "payout", LockOptions{})
+
+	err := first.Lock(ctx, "write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Token() != 1 {
+		t.Fatalf("expecting token 1, got %d", first.Token())
+	}
+
+	err = second.Lock(ctx, "write")
+	if !errors.Is(err, satch.ErrLocked) {
+		t.Fatalf("expecting ErrLocked, got %v", err)
+	}
+
+	err = first.Lock(ctx, "write")
+	if !errors.Is(err, satch.ErrLocked) {
+		t.Fatalf("expecting ErrLocked when locking twice, got %v", err)
+	}
+
+	err = NewLock(client, "other", LockOptions{}).Lock(ctx, "write")
+	if err != nil {
+		t.Fatalf("expecting locks of other names to be independent, got %v", err)
+	}
+
+	err = first.Unlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Token() != 0 {
+		t.Fatal("expecting no token after unlock")
+	}
+
+	err = second.Lock(ctx, "read")
+	if err != nil {
+		t.Fatalf("expecting released lock to be taken, got %v", err)
+	}
+
+	if second.Token() != 2 {
+		t.Fatalf("expecting increasing token 2, got %d", second.Token())
+	}
+}
+
+func TestLockExpired(t *testing.T) {
+	ctx := context.Background()
+	mr, client := testRedis(t)
+
+	first := NewLock(client, "payout", LockOptions{TTL: time.Second})
+	second := NewLock(client, "payout", LockOptions{TTL: time.Second})
+
+	err := first.Lock(ctx, "write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = first.Renew(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr.FastForward(2 * time.Second)
+
+	err = second.Lock(ctx, "write")
+	if err != nil {
+		t.Fatalf("expecting expired lock to be taken, got %v", err)
+	}
+
+	err = first.Renew(ctx)
+	if !errors.Is(err, satch.ErrLockLost) {
+		t.Fatalf("expecting ErrLockLost on renew, got %v", err)
+	}
+
+	// The expired owner does not release the lock of the new owner
+	err = first.Unlock(ctx)
+	if !errors.Is(err, satch.ErrLockLost) {
+		t.Fatalf("expecting ErrLockLost on unlock, got %v", err)
+	}
+
+	value, err := mr.Get(second.key)
+	if err != nil || value != second.value {
+		t.Fatalf("expecting lock held by second, got %q, %v", value, err)
+	}
+
+	err = second.Unlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mr.Exists(second.key) {
+		t.Fatal("expecting lock key to be deleted")
+	}
+}
+
+func TestLockAutoRenew(t *testing.T) {
+	ctx := context.Background()
+	mr, client := testRedis(t)
+
+	ttl := 300 * time.Millisecond
+	lock := NewLock(client, "payout", LockOptions{TTL: ttl, AutoRenew: true})
+
+	err := lock.Lock(ctx, "write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lock.Unlock(ctx)
+
+	// miniredis only expires keys on FastForward, so the renewal shows in the TTL
+	mr.FastForward(250 * time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for mr.TTL(lock.key) <= ttl/2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if remaining := mr.TTL(lock.key); remaining <= ttl/2 {
+		t.Fatalf("expecting lock to be renewed, %v left", remaining)
+	}
+
+	// Another owner takes over
+	mr.Set(lock.key, "other")
+
+	deadline = time.Now().Add(2 * time.Second)
+	for lock.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !errors.Is(lock.Err(), satch.ErrLockLost) {
+		t.Fatalf("expecting ErrLockLost, got %v", lock.Err())
+	}
+}
@@ -0,0 +1,276 @@
+package ssql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+
+	"github.com/soyart/satch"
+)
+
+// Query declares an input query of DataSource
+type Query struct {
+	Name  string // Key in Inputs
+	Query string
+	Args  []interface{}
+
+	// Scan scans rows into a typed slice, e.g. ssql.ScanRows[Payout].
+	// If nil, rows are scanned into []map[string]interface{}.
+	Scan func(rows *sql.Rows) (interface{}, error)
+}
+
+// Inputs maps query names to scanned rows
+type Inputs map[string]interface{}
+
+// InputsOf returns the rows of query name as []T
+func InputsOf[T any](inputs Inputs, name string) ([]T, error) {
+	rows, ok := inputs[name]
+	if !ok {
+		return nil, fmt.Errorf("no inputs for query '%s'", name)
+	}
+
+	typed, ok := rows.([]T)
+	if !ok {
+		return nil, fmt.Errorf("unexpected inputs type for query '%s': %s", name, reflect.TypeOf(rows))
+	}
+
+	return typed, nil
+}
+
+// Scanner adapts ScanRows for Query.Scan
+func Scanner[T any]() func(rows *sql.Rows) (interface{}, error) {
+	return func(rows *sql.Rows) (interface{}, error) {
+		return ScanRows[T](rows)
+	}
+}
+
+type DataSourceConfig struct {
+	Dialect   Dialect
+	Isolation sql.IsolationLevel // For both Inputs and Commit
+	Queries   []Query
+
+	// Locker is taken by LockRead and LockWrite, which are no-ops if it is nil
+	Locker satch.Locker
+
+	// DryRun makes Prepare execute the statements of data in a transaction
+	// that is rolled back, so that e.g. constraint violations fail
+	// before any sink of a satch.Composite commits
+	DryRun bool
+
+	// Compensate returns the statements that undo a commit of data,
+	// e.g. deleting inserted rows. Compensate fails if it is nil.
+	Compensate func(data interface{}) ([]Stmt, error)
+}
+
+// DataSource is a satch.DataSource driven by DataSourceConfig.
+//
+// Inputs runs the configured queries in one transaction, and returns Inputs.
+// Commit accepts []Stmt, Insert or []Insert, and executes them in one transaction.
+//
+// As a sink of satch.Composite, it is atomic on its own, so it is best placed
+// last in satch.FanOutStopOnError, where it never needs compensating.
+type DataSource struct {
+	db   *sql.DB
+	conf DataSourceConfig
+}
+
+var (
+	_ satch.DataSource  = &DataSource{}
+	_ satch.Unlocker    = &DataSource{}
+	_ satch.Preparer    = &DataSource{}
+	_ satch.Compensator = &DataSource{}
+)
+
+func NewDataSource(db *sql.DB, conf DataSourceConfig) (*DataSource, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+
+	names := make(map[string]bool)
+	for i := range conf.Queries {
+		q := &conf.Queries[i]
+		switch {
+		case q.Name == "" || q.Query == "":
+			return nil, fmt.Errorf("query %d requires a name and a query", i)
+
+		case names[q.Name]:
+			return nil, fmt.Errorf("duplicate query name '%s'", q.Name)
+		}
+
+		names[q.Name] = true
+	}
+
+	return &DataSource{db: db, conf: conf}, nil
+}
+
+func (d *DataSource) LockRead(ctx context.Context) error {
+	if d.conf.Locker == nil {
+		return nil
+	}
+
+	return d.conf.Locker.Lock(ctx, "read")
+}
+
+func (d *DataSource) LockWrite(ctx context.Context) error {
+	if d.conf.Locker == nil {
+		return nil
+	}
+
+	return d.conf.Locker.Lock(ctx, "write")
+}
+
+func (d *DataSource) Unlock(ctx context.Context) error {
+	if d.conf.Locker == nil {
+		return nil
+	}
+
+	return d.conf.Locker.Unlock(ctx)
+}
+
+func (d *DataSource) Inputs(ctx context.Context) (interface{}, error) {
+	// Some SQLite drivers reject read-only transactions
+	readOnly := d.conf.Dialect == DialectPostgres
+
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{Isolation: d.conf.Isolation, ReadOnly: readOnly})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin input tx")
+	}
+
+	defer tx.Rollback()
+
+	inputs := make(Inputs, len(d.conf.Queries))
+	for i := range d.conf.Queries {
+		q := &d.conf.Queries[i]
+
+		rows, err := tx.QueryContext(ctx, q.Query, q.Args...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to run query '%s'", q.Name)
+		}
+
+		scan := q.Scan
+		if scan == nil {
+			scan = scanMaps
+		}
+
+		// Scan may return before closing rows, e.g. on errors
+		result, err := scan(rows)
+		rows.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to scan query '%s'", q.Name)
+		}
+
+		inputs[q.Name] = result
+	}
+
+	return inputs, nil
+}
+
+func (d *DataSource) Commit(ctx context.Context, data interface{}) error {
+	stmts, err := d.stmts(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = Exec(ctx, d.db, d.conf.Isolation, stmts...)
+	return err
+}
+
+// errDryRun rolls back the transaction of a successful dry run
+var errDryRun = errors.New("dry run")
+
+// Prepare checks that data converts to statements, and executes them if DryRun is set
+func (d *DataSource) Prepare(ctx context.Context, data interface{}) error {
+	stmts, err := d.stmts(data)
+	if err != nil || !d.conf.DryRun {
+		return err
+	}
+
+	_, err = WithTx(ctx, d.db, d.conf.Isolation, func(ctx context.Context, tx *sql.Tx) (interface{}, error) {
+		_, err := TxExec(stmts...)(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errDryRun
+	})
+	if errors.Is(err, errDryRun) {
+		return nil
+	}
+
+	return errors.Wrap(err, "dry run failed")
+}
+
+// Compensate executes the statements from DataSourceConfig.Compensate in one transaction
+func (d *DataSource) Compensate(ctx context.Context, data interface{}) error {
+	if d.conf.Compensate == nil {
+		return errors.New("ssql: no compensating statements configured")
+	}
+
+	stmts, err := d.conf.Compensate(data)
+	if err != nil {
+		return errors.Wrap(err, "failed to build compensating statements")
+	}
+
+	_, err = Exec(ctx, d.db, d.conf.Isolation, stmts...)
+	return err
+}
+
+func (d *DataSource) stmts(data interface{}) ([]Stmt, error) {
+	switch outputs := data.(type) {
+	case []Stmt:
+		return outputs, nil
+
+	case Insert:
+		return outputs.Stmts(d.conf.Dialect)
+
+	case []Insert:
+		stmts := []Stmt{}
+		for i := range outputs {
+			s, err := outputs[i].Stmts(d.conf.Dialect)
+			if err != nil {
+				return nil, err
+			}
+
+			stmts = append(stmts, s...)
+		}
+
+		return stmts, nil
+	}
+
+	return nil, fmt.Errorf("unexpected data type: '%s'", reflect.TypeOf(data))
+}
+
+func scanMaps(rows *sql.Rows) (interface{}, error) {
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		dests := make([]interface{}, len(cols))
+		for i := range values {
+			dests[i] = &values[i]
+		}
+
+		err := rows.Scan(dests...)
+		if err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(cols))
+		for i, col := range cols {
+			row[col] = values[i]
+		}
+
+		results = append(results, row)
+	}
+
+	return results, rows.Err()
+}
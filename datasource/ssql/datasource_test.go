@@ -0,0 +1,255 @@
+package ssql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soyart/satch"
+)
+
+// creditJob credits every account by 1
+type creditJob struct{}
+
+func (creditJob) ID() string { return "credit" }
+
+func (creditJob) Run(_ context.Context, inputs interface{}, _ time.Time) (interface{}, error) {
+	accounts, err := InputsOf[account](inputs.(Inputs), "accounts")
+	if err != nil {
+		return nil, err
+	}
+
+	ins := Insert{
+		Table:           "accounts",
+		Columns:         []string{"number", "owner_id", "balance"},
+		ConflictColumns: []string{"number"},
+	}
+
+	for _, acc := range accounts {
+		ins.Rows = append(ins.Rows, []interface{}{acc.Number, acc.Owner, acc.Balance + 1})
+	}
+
+	return []Insert{ins}, nil
+}
+
+func TestDataSource(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t,
+		TableLockDDL("locks"),
+		"CREATE TABLE accounts (number TEXT PRIMARY KEY, owner_id TEXT NOT NULL, balance REAL NOT NULL)",
+		"INSERT INTO accounts VALUES ('a1', 'c1', 10), ('a2', 'c2', 20)",
+	)
+
+	conf := DataSourceConfig{
+		Dialect: DialectSQLite,
+		Queries: []Query{{Name: "accounts", Query: "SELECT * FROM accounts ORDER BY number", Scan: Scanner[account]()}},
+		Locker:  NewTableLock(db, DialectSQLite, "locks", "credit", time.Minute),
+	}
+
+	ds, err := NewDataSource(db, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = satch.Start(ctx, creditJob{}, ds, satch.Config{LockWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err := QueryRows[account](ctx, db, "SELECT * FROM accounts ORDER BY number")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []account{{Number: "a1", Owner: "c1", Balance: 11}, {Number: "a2", Owner: "c2", Balance: 21}}
+	if !reflect.DeepEqual(accounts, expect) {
+		t.Fatalf("unexpected accounts %v", accounts)
+	}
+
+	// The lock was released by Start, and contends with other data sources
+	err = ds.LockWrite(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ds.Unlock(ctx)
+
+	conf.Locker = NewTableLock(db, DialectSQLite, "locks", "credit", time.Minute)
+	other, err := NewDataSource(db, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = satch.Start(ctx, creditJob{}, other, satch.Config{LockWrite: true})
+	if !errors.Is(err, satch.ErrLocked) {
+		t.Fatalf("expecting ErrLocked, got %v", err)
+	}
+
+	_, err = NewDataSource(db, DataSourceConfig{Queries: []Query{{Name: "a", Query: "SELECT 1"}, {Name: "a", Query: "SELECT 2"}}})
+	if err == nil {
+		t.Fatal("expecting duplicate query names to be rejected")
+	}
+}
+
+func TestDataSourceInputsScanError(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t, "CREATE TABLE items (id INTEGER PRIMARY KEY)", "INSERT INTO items VALUES (1), (2)")
+
+	errScan := errors.New("bad row")
+	var scanned *sql.Rows
+
+	ds, err := NewDataSource(db, DataSourceConfig{
+		Dialect: DialectSQLite,
+		Queries: []Query{{
+			Name:  "items",
+			Query: "SELECT id FROM items",
+			Scan: func(rows *sql.Rows) (interface{}, error) {
+				scanned = rows
+				return nil, errScan
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ds.Inputs(ctx)
+	if !errors.Is(err, errScan) {
+		t.Fatalf("expecting scan error, got %v", err)
+	}
+
+	if scanned.Next() {
+		t.Fatal("expecting rows to be closed")
+	}
+
+	if inUse := db.Stats().InUse; inUse != 0 {
+		t.Fatalf("expecting no connections in use, got %d", inUse)
+	}
+}
+
+// insertJob inserts ids into table t
+type insertJob struct {
+	ids []int
+}
+
+func (insertJob) ID() string { return "insert" }
+
+func (j insertJob) Run(context.Context, interface{}, time.Time) (interface{}, error) {
+	stmts := make([]Stmt, len(j.ids))
+	for i, id := range j.ids {
+		stmts[i] = Stmt{Query: "INSERT INTO t (id) VALUES (?)", Args: []interface{}{id}}
+	}
+
+	return stmts, nil
+}
+
+// testSink records commits, and fails them with err if set
+type testSink struct {
+	err       error
+	committed []interface{}
+}
+
+func (s *testSink) Commit(_ context.Context, data interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.committed = append(s.committed, data)
+	return nil
+}
+
+func TestDataSourceComposite(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t, "CREATE TABLE t (id INTEGER PRIMARY KEY)", "INSERT INTO t (id) VALUES (1)")
+
+	ds, err := NewDataSource(db, DataSourceConfig{
+		Dialect: DialectSQLite,
+		DryRun:  true,
+		Compensate: func(data interface{}) ([]Stmt, error) {
+			undo := []Stmt{}
+			for _, stmt := range data.([]Stmt) {
+				undo = append(undo, Stmt{Query: "DELETE FROM t WHERE id = ?", Args: stmt.Args})
+			}
+
+			return undo, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := func(job insertJob, sinks ...satch.NamedSink) (*satch.Composite, error) {
+		composite, err := satch.NewComposite(satch.CompositeConfig{Inputs: ds, Sinks: sinks, FanOut: satch.FanOutStopOnError})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return composite, satch.Start(ctx, job, composite, satch.Config{})
+	}
+
+	ids := func() []int64 {
+		ids, err := QueryRows[int64](ctx, db, "SELECT id FROM t ORDER BY id")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ids
+	}
+
+	// The insert is compensated when the next sink fails
+	composite, err := start(insertJob{ids: []int{2, 3}},
+		satch.NamedSink{Name: "sql", Sink: ds},
+		satch.NamedSink{Name: "fail", Sink: &testSink{err: errors.New("sink down")}},
+	)
+	if err == nil {
+		t.Fatal("expecting failing sink to fail the commit")
+	}
+
+	if result := composite.LastReport().Results[0]; !result.Committed || !result.Compensated {
+		t.Fatalf("unexpected result of sql %+v", result)
+	}
+
+	if actual := ids(); !reflect.DeepEqual(actual, []int64{1}) {
+		t.Fatalf("expecting insert compensated, got %v", actual)
+	}
+
+	// The dry run fails on the duplicate key before the first sink commits
+	first := &testSink{}
+	_, err = start(insertJob{ids: []int{4, 1}},
+		satch.NamedSink{Name: "first", Sink: first},
+		satch.NamedSink{Name: "sql", Sink: ds},
+	)
+	if err == nil {
+		t.Fatal("expecting dry run to fail")
+	}
+
+	if len(first.committed) != 0 {
+		t.Fatalf("expecting nothing committed, got %v", first.committed)
+	}
+
+	if actual := ids(); !reflect.DeepEqual(actual, []int64{1}) {
+		t.Fatalf("expecting dry run rolled back, got %v", actual)
+	}
+
+	_, err = start(insertJob{ids: []int{4}}, satch.NamedSink{Name: "first", Sink: first}, satch.NamedSink{Name: "sql", Sink: ds})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := ids(); !reflect.DeepEqual(actual, []int64{1, 4}) || len(first.committed) != 1 {
+		t.Fatalf("unexpected ids %v, commits %v", actual, first.committed)
+	}
+
+	noUndo, err := NewDataSource(db, DataSourceConfig{Dialect: DialectSQLite})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = noUndo.Compensate(ctx, []Stmt{})
+	if err == nil {
+		t.Fatal("expecting compensation without statements to fail")
+	}
+}
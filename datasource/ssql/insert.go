@@ -0,0 +1,155 @@
+package ssql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultBatchSize = 500
+
+// Insert describes batched inserts of rows into a table.
+// Each row has one value per column, in the order of Columns.
+// Table and column names are quoted with Quote.
+type Insert struct {
+	Table     string
+	Columns   []string
+	Rows      [][]interface{}
+	BatchSize int // Rows per statement, defaults to DefaultBatchSize
+
+	// ConflictColumns turns the insert into an upsert: rows conflicting
+	// on these columns update the other columns instead
+	ConflictColumns []string
+}
+
+// Stmts builds the batched INSERT statements
+func (ins Insert) Stmts(d Dialect) ([]Stmt, error) {
+	if ins.Table == "" || len(ins.Columns) == 0 {
+		return nil, errors.New("insert requires a table and columns")
+	}
+
+	batchSize := ins.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	stmts := []Stmt{}
+	for start := 0; start < len(ins.Rows); start += batchSize {
+		end := start + batchSize
+		if end > len(ins.Rows) {
+			end = len(ins.Rows)
+		}
+
+		stmt, err := ins.stmt(d, ins.Rows[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		stmts = append(stmts, stmt)
+	}
+
+	return stmts, nil
+}
+
+func (ins Insert) stmt(d Dialect, rows [][]interface{}) (Stmt, error) {
+	var b strings.Builder
+	args := make([]interface{}, 0, len(rows)*len(ins.Columns))
+
+	fmt.Fprintf(&b, "INSERT INTO %s (%s) VALUES ", Quote(ins.Table), quoteAll(ins.Columns))
+
+	for i, row := range rows {
+		if len(row) != len(ins.Columns) {
+			return Stmt{}, fmt.Errorf("row has %d values, expected %d columns", len(row), len(ins.Columns))
+		}
+
+		if i > 0 {
+			b.WriteString(", ")
+		}
+
+		b.WriteString("(")
+		for j := range row {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+
+			args = append(args, row[j])
+			b.WriteString(d.Placeholder(len(args)))
+		}
+
+		b.WriteString(")")
+	}
+
+	if len(ins.ConflictColumns) != 0 {
+		conflict := make(map[string]bool, len(ins.ConflictColumns))
+		for _, c := range ins.ConflictColumns {
+			conflict[c] = true
+		}
+
+		sets := []string{}
+		for _, c := range ins.Columns {
+			if !conflict[c] {
+				sets = append(sets, fmt.Sprintf("%s = excluded.%s", Quote(c), Quote(c)))
+			}
+		}
+
+		fmt.Fprintf(&b, " ON CONFLICT (%s)", quoteAll(ins.ConflictColumns))
+		if len(sets) == 0 {
+			b.WriteString(" DO NOTHING")
+		} else {
+			fmt.Fprintf(&b, " DO UPDATE SET %s", strings.Join(sets, ", "))
+		}
+	}
+
+	return Stmt{Query: b.String(), Args: args}, nil
+}
+
+func quoteAll(idents []string) string {
+	quoted := make([]string, len(idents))
+	for i := range idents {
+		quoted[i] = Quote(idents[i])
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+// Wraps batched inserts inside a callback that can be sent to WithTx.
+// The callback returns the total rows affected as int64.
+func TxInsert(d Dialect, ins Insert) TxFunc {
+	return func(ctx context.Context, tx *sql.Tx) (interface{}, error) {
+		stmts, err := ins.Stmts(d)
+		if err != nil {
+			logrus.Errorf("insert: bad insert into table '%s': %s", ins.Table, err.Error())
+			return int64(0), err
+		}
+
+		return TxExec(stmts...)(ctx, tx)
+	}
+}
+
+// InsertMany inserts (or upserts, if ins.ConflictColumns is set) rows in batches in one transaction
+func InsertMany(
+	ctx context.Context,
+	db *sql.DB,
+	d Dialect,
+	iso sql.IsolationLevel,
+	ins Insert,
+) (
+	int64,
+	error,
+) {
+	result, err := WithTx(ctx, db, iso, TxInsert(d, ins))
+	if err != nil {
+		return 0, err
+	}
+
+	affected, ok := result.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected result type: %T", result)
+	}
+
+	return affected, nil
+}
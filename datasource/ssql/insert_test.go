@@ -0,0 +1,122 @@
+package ssql
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+type account struct {
+	Number  string  `db:"number"`
+	Owner   string  `db:"owner_id"`
+	Balance float64 `db:"balance"`
+}
+
+func TestInsertStmts(t *testing.T) {
+	ins := Insert{
+		Table:           "accounts",
+		Columns:         []string{"number", "balance"},
+		Rows:            [][]interface{}{{"a1", 1}, {"a2", 2}, {"a3", 3}},
+		BatchSize:       2,
+		ConflictColumns: []string{"number"},
+	}
+
+	stmts, err := ins.Stmts(DialectPostgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []Stmt{
+		{
+			Query: `INSERT INTO "accounts" ("number", "balance") VALUES ($1, $2), ($3, $4) ON CONFLICT ("number") DO UPDATE SET "balance" = excluded."balance"`,
+			Args:  []interface{}{"a1", 1, "a2", 2},
+		},
+		{
+			Query: `INSERT INTO "accounts" ("number", "balance") VALUES ($1, $2) ON CONFLICT ("number") DO UPDATE SET "balance" = excluded."balance"`,
+			Args:  []interface{}{"a3", 3},
+		},
+	}
+
+	if !reflect.DeepEqual(stmts, expect) {
+		t.Fatalf("unexpected statements\nexpect %v\nactual %v", expect, stmts)
+	}
+
+	_, err = Insert{Table: "accounts", Columns: []string{"number"}, Rows: [][]interface{}{{"a1", 1}}}.Stmts(DialectSQLite)
+	if err == nil {
+		t.Fatal("expecting error for row with extra values")
+	}
+}
+
+func TestInsertManyUpsert(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t, "CREATE TABLE accounts (number TEXT PRIMARY KEY, owner_id TEXT NOT NULL, balance REAL NOT NULL)")
+
+	n, err := InsertMany(ctx, db, DialectSQLite, sql.LevelDefault, Insert{
+		Table:     "accounts",
+		Columns:   []string{"number", "owner_id", "balance"},
+		Rows:      [][]interface{}{{"a1", "c1", 10.0}, {"a2", "c1", 20.0}, {"a3", "c2", 30.0}},
+		BatchSize: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 {
+		t.Fatalf("expecting 3 rows inserted, got %d", n)
+	}
+
+	// Conflicting rows update the columns other than ConflictColumns
+	_, err = InsertMany(ctx, db, DialectSQLite, sql.LevelDefault, Insert{
+		Table:           "accounts",
+		Columns:         []string{"number", "owner_id", "balance"},
+		Rows:            [][]interface{}{{"a1", "c1", 15.0}, {"a4", "c3", 40.0}},
+		ConflictColumns: []string{"number"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err := QueryRows[account](ctx, db, "SELECT * FROM accounts ORDER BY number")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []account{
+		{Number: "a1", Owner: "c1", Balance: 15},
+		{Number: "a2", Owner: "c1", Balance: 20},
+		{Number: "a3", Owner: "c2", Balance: 30},
+		{Number: "a4", Owner: "c3", Balance: 40},
+	}
+
+	if !reflect.DeepEqual(accounts, expect) {
+		t.Fatalf("unexpected accounts\nexpect %v\nactual %v", expect, accounts)
+	}
+
+	// Conflicting rows are skipped if all columns are ConflictColumns
+	_, err = Exec(ctx, db, sql.LevelDefault, Stmt{Query: "CREATE TABLE owners (id TEXT PRIMARY KEY)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = InsertMany(ctx, db, DialectSQLite, sql.LevelDefault, Insert{
+			Table:           "owners",
+			Columns:         []string{"id"},
+			Rows:            [][]interface{}{{"c1"}, {"c2"}},
+			ConflictColumns: []string{"id"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	owners, err := QueryRows[string](ctx, db, "SELECT id FROM owners ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(owners, []string{"c1", "c2"}) {
+		t.Fatalf("unexpected owners %v", owners)
+	}
+}
@@ -0,0 +1,250 @@
+package ssql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/soyart/satch"
+)
+
+const DefaultLockTTL = 10 * time.Minute
+
+// AdvisoryLock is a PostgreSQL session-level advisory lock.
+// It holds a dedicated connection from Lock until Unlock.
+type AdvisoryLock struct {
+	db  *sql.DB
+	key int64
+
+	mut  sync.Mutex
+	conn *sql.Conn
+}
+
+func NewAdvisoryLock(db *sql.DB, key int64) *AdvisoryLock {
+	return &AdvisoryLock{db: db, key: key}
+}
+
+func (l *AdvisoryLock) Lock(ctx context.Context, _ string) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.conn != nil {
+		return errors.Wrapf(satch.ErrLocked, "advisory lock %d is already held by this locker", l.key)
+	}
+
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get connection for advisory lock")
+	}
+
+	var ok bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&ok)
+	if err != nil {
+		conn.Close()
+		return errors.Wrapf(err, "failed to take advisory lock %d", l.key)
+	}
+
+	if !ok {
+		conn.Close()
+		return errors.Wrapf(satch.ErrLocked, "advisory lock %d", l.key)
+	}
+
+	l.conn = conn
+	return nil
+}
+
+func (l *AdvisoryLock) Unlock(ctx context.Context) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.conn == nil {
+		return nil
+	}
+
+	defer func() {
+		l.conn.Close()
+		l.conn = nil
+	}()
+
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+	if err != nil {
+		return errors.Wrapf(err, "failed to release advisory lock %d", l.key)
+	}
+
+	return nil
+}
+
+// sqlStateLockNotAvailable is the PostgreSQL error code of NOWAIT failing on a locked row
+const sqlStateLockNotAvailable = "55P03"
+
+// RowLock locks a row with SELECT ... FOR UPDATE NOWAIT in a transaction
+// held open from Lock until Unlock. The row must exist. PostgreSQL only.
+//
+// Lock fails with satch.ErrLocked only if the row is locked by others,
+// which is detected with the SQLState method of errors from drivers such as pgx and lib/pq.
+type RowLock struct {
+	db    *sql.DB
+	query string
+	args  []interface{}
+
+	mut sync.Mutex
+	tx  *sql.Tx
+}
+
+// NewRowLock locks the row in table whose keyColumn is key
+func NewRowLock(db *sql.DB, d Dialect, table, keyColumn string, key interface{}) *RowLock {
+	return &RowLock{
+		db:    db,
+		query: fmt.Sprintf("SELECT 1 FROM %s WHERE %s = %s FOR UPDATE NOWAIT", Quote(table), Quote(keyColumn), d.Placeholder(1)),
+		args:  []interface{}{key},
+	}
+}
+
+func (l *RowLock) Lock(ctx context.Context, _ string) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.tx != nil {
+		return errors.Wrap(satch.ErrLocked, "row lock is already held by this locker")
+	}
+
+	// The lock must outlive ctx of the caller, and is released by Unlock
+	tx, err := l.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin tx for row lock")
+	}
+
+	var one int
+	err = tx.QueryRowContext(ctx, l.query, l.args...).Scan(&one)
+	if err != nil {
+		tx.Rollback()
+
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return errors.Wrapf(err, "no row to lock for %v", l.args)
+
+		// NOWAIT fails immediately if the row is locked by others
+		case isLockNotAvailable(err):
+			return errors.Wrapf(satch.ErrLocked, "row lock: %s", err.Error())
+		}
+
+		return errors.Wrap(err, "failed to take row lock")
+	}
+
+	l.tx = tx
+	return nil
+}
+
+func isLockNotAvailable(err error) bool {
+	var state interface{ SQLState() string }
+	if !errors.As(err, &state) {
+		return false
+	}
+
+	return state.SQLState() == sqlStateLockNotAvailable
+}
+
+func (l *RowLock) Unlock(_ context.Context) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.tx == nil {
+		return nil
+	}
+
+	err := l.tx.Rollback()
+	l.tx = nil
+	if err != nil {
+		return errors.Wrap(err, "failed to release row lock")
+	}
+
+	return nil
+}
+
+// TableLock is a lock stored as a row in a lock table, and works with any dialect.
+// A lock that is not released expires after its TTL, and can then be taken by others.
+//
+// The table must have columns id (primary key), owner, mode and expires_at (unix seconds),
+// see TableLockDDL.
+type TableLock struct {
+	db      *sql.DB
+	dialect Dialect
+	table   string
+	id      string
+	owner   string
+	ttl     time.Duration
+}
+
+// TableLockDDL returns the statement creating the lock table
+func TableLockDDL(table string) string {
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (id TEXT PRIMARY KEY, owner TEXT NOT NULL, mode TEXT, expires_at BIGINT NOT NULL)",
+		Quote(table),
+	)
+}
+
+func NewTableLock(db *sql.DB, d Dialect, table, id string, ttl time.Duration) *TableLock {
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
+
+	hostname, _ := os.Hostname()
+
+	return &TableLock{
+		db:      db,
+		dialect: d,
+		table:   table,
+		id:      id,
+		owner:   fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		ttl:     ttl,
+	}
+}
+
+func (l *TableLock) Lock(ctx context.Context, mode string) error {
+	now := time.Now()
+	p := l.dialect.Placeholder
+
+	// Insert the lock, or take it over if it has expired
+	query := fmt.Sprintf(
+		"INSERT INTO %s (id, owner, mode, expires_at) VALUES (%s, %s, %s, %s) "+
+			"ON CONFLICT (id) DO UPDATE SET owner = excluded.owner, mode = excluded.mode, expires_at = excluded.expires_at "+
+			"WHERE %s.expires_at < %s",
+		Quote(l.table), p(1), p(2), p(3), p(4), Quote(l.table), p(5),
+	)
+
+	result, err := l.db.ExecContext(ctx, query, l.id, l.owner, mode, now.Add(l.ttl).Unix(), now.Unix())
+	if err != nil {
+		return errors.Wrapf(err, "failed to take lock '%s'", l.id)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "failed to check lock '%s'", l.id)
+	}
+
+	if n == 0 {
+		return errors.Wrapf(satch.ErrLocked, "lock '%s'", l.id)
+	}
+
+	logrus.Debugf("ssql: took lock '%s' as %s", l.id, l.owner)
+	return nil
+}
+
+// Unlock releases the lock if it is still owned by l
+func (l *TableLock) Unlock(ctx context.Context) error {
+	p := l.dialect.Placeholder
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = %s AND owner = %s", Quote(l.table), p(1), p(2))
+
+	_, err := l.db.ExecContext(ctx, query, l.id, l.owner)
+	if err != nil {
+		return errors.Wrapf(err, "failed to release lock '%s'", l.id)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package ssql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/soyart/satch"
+)
+
+func TestTableLock(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t, TableLockDDL("locks"))
+
+	first := NewTableLock(db, DialectSQLite, "locks", "payout", time.Minute)
+	second := NewTableLock(db, DialectSQLite, "locks", "payout", time.Minute)
+	other := NewTableLock(db, DialectSQLite, "locks", "other", time.Minute)
+
+	err := first.Lock(ctx, "write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = second.Lock(ctx, "write")
+	if !errors.Is(err, satch.ErrLocked) {
+		t.Fatalf("expecting ErrLocked, got %v", err)
+	}
+
+	err = other.Lock(ctx, "write")
+	if err != nil {
+		t.Fatalf("expecting other lock ids to be independent, got %v", err)
+	}
+
+	// Unlock by non-owners leaves the lock held
+	err = second.Unlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = second.Lock(ctx, "write")
+	if !errors.Is(err, satch.ErrLocked) {
+		t.Fatalf("expecting ErrLocked after unlock by non-owner, got %v", err)
+	}
+
+	err = first.Unlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = second.Lock(ctx, "read")
+	if err != nil {
+		t.Fatalf("expecting released lock to be taken, got %v", err)
+	}
+
+	// Expired locks are taken over
+	_, err = db.ExecContext(ctx, "UPDATE locks SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Second).Unix(), "payout")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = first.Lock(ctx, "write")
+	if err != nil {
+		t.Fatalf("expecting expired lock to be taken over, got %v", err)
+	}
+
+	var owner string
+	err = db.QueryRowContext(ctx, "SELECT owner FROM locks WHERE id = ?", "payout").Scan(&owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if owner != first.owner {
+		t.Fatalf("expecting lock owned by %s, got %s", first.owner, owner)
+	}
+}
+
+// sqlStateError mimics errors of PostgreSQL drivers
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "pq: " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestRowLockErrors(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t, "CREATE TABLE jobs (id TEXT PRIMARY KEY)")
+
+	// SQLite has no FOR UPDATE, so the syntax error must not be taken as contention
+	err := NewRowLock(db, DialectSQLite, "jobs", "id", "payout").Lock(ctx, "write")
+	if err == nil || errors.Is(err, satch.ErrLocked) {
+		t.Fatalf("expecting non-contention error, got %v", err)
+	}
+
+	tests := []struct {
+		err    error
+		expect bool
+	}{
+		{err: sqlStateError(sqlStateLockNotAvailable), expect: true},
+		{err: fmt.Errorf("wrapped: %w", sqlStateError(sqlStateLockNotAvailable)), expect: true},
+		{err: sqlStateError("42601"), expect: false}, // syntax_error
+		{err: errors.New("connection refused"), expect: false},
+	}
+
+	for _, tc := range tests {
+		if actual := isLockNotAvailable(tc.err); actual != tc.expect {
+			t.Fatalf("%v: expecting %v, got %v", tc.err, tc.expect, actual)
+		}
+	}
+}
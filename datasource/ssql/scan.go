@@ -0,0 +1,159 @@
+package ssql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// QueryRows runs query and scans the rows into []T.
+// See ScanRows for how columns are mapped.
+func QueryRows[T any](ctx context.Context, q Querier, query string, args ...interface{}) ([]T, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query '%s'", query)
+	}
+
+	return ScanRows[T](rows)
+}
+
+// ScanRows scans rows into []T, and closes rows.
+//
+// If T is a struct, columns are mapped to fields by their `db` tags,
+// or by lower-cased field names if untagged. Fields tagged `db:"-"` are skipped,
+// and columns without fields are discarded. Fields of embedded structs are included,
+// and nil embedded struct pointers are allocated for them.
+// Otherwise, each row must have a single column, which is scanned into T.
+func ScanRows[T any](rows *sql.Rows) ([]T, error) {
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get columns")
+	}
+
+	var zero T
+	typ := reflect.TypeOf(zero)
+	isStruct := typ != nil && typ.Kind() == reflect.Struct
+
+	var fields map[string][]int
+	if isStruct {
+		fields = fieldIndexes(typ)
+	} else if len(cols) != 1 {
+		return nil, fmt.Errorf("cannot scan %d columns into non-struct %s", len(cols), typ)
+	}
+
+	results := []T{}
+	for rows.Next() {
+		var item T
+		dests := make([]interface{}, len(cols))
+
+		if isStruct {
+			v := reflect.ValueOf(&item).Elem()
+			for i, col := range cols {
+				index, ok := fields[strings.ToLower(col)]
+				if !ok {
+					dests[i] = new(interface{})
+					continue
+				}
+
+				dests[i] = fieldByIndex(v, index).Addr().Interface()
+			}
+		} else {
+			dests[0] = &item
+		}
+
+		err := rows.Scan(dests...)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+
+		results = append(results, item)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to iterate rows")
+	}
+
+	return results, nil
+}
+
+// fieldIndexes maps lower-cased column names to field indexes of struct typ.
+// Fields promoted through unexported embedded struct pointers are skipped,
+// as the pointers cannot be allocated.
+func fieldIndexes(typ reflect.Type) map[string][]int {
+	fields := make(map[string][]int)
+
+	for _, f := range reflect.VisibleFields(typ) {
+		if !f.IsExported() || isEmbeddedStruct(f) || !allocatable(typ, f.Index) {
+			continue
+		}
+
+		name := f.Tag.Get("db")
+		if name == "-" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fields[strings.ToLower(name)] = f.Index
+	}
+
+	return fields
+}
+
+func isEmbeddedStruct(f reflect.StructField) bool {
+	if !f.Anonymous {
+		return false
+	}
+
+	typ := f.Type
+	if typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	return typ.Kind() == reflect.Struct
+}
+
+// allocatable reports whether the embedded struct pointers on the path to index are exported
+func allocatable(typ reflect.Type, index []int) bool {
+	for _, i := range index[:len(index)-1] {
+		f := typ.Field(i)
+		typ = f.Type
+
+		if typ.Kind() == reflect.Pointer {
+			if !f.IsExported() {
+				return false
+			}
+
+			typ = typ.Elem()
+		}
+	}
+
+	return true
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex,
+// but allocates nil embedded struct pointers on the way
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+
+			v = v.Elem()
+		}
+
+		v = v.Field(x)
+	}
+
+	return v
+}
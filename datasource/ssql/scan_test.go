@@ -0,0 +1,49 @@
+package ssql
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+type Base struct {
+	ID int64 `db:"id"`
+}
+
+type audit struct {
+	Created string `db:"created"`
+}
+
+func TestScanRowsEmbedded(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t,
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT NOT NULL, created TEXT NOT NULL)",
+		"INSERT INTO items VALUES (1, 'a', 'today'), (2, 'b', 'yesterday')",
+	)
+
+	type item struct {
+		*Base
+		*audit        // Unexported, so created is discarded
+		Name   string `db:"name"`
+	}
+
+	items, err := QueryRows[item](ctx, db, "SELECT id, name, created FROM items ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 2 {
+		t.Fatalf("expecting 2 items, got %d", len(items))
+	}
+
+	for i, expect := range []item{{Base: &Base{ID: 1}, Name: "a"}, {Base: &Base{ID: 2}, Name: "b"}} {
+		if !reflect.DeepEqual(items[i], expect) {
+			t.Fatalf("unexpected item %d: %+v, %+v", i, items[i], items[i].Base)
+		}
+	}
+
+	// Each row gets its own embedded struct
+	if items[0].Base == items[1].Base {
+		t.Fatal("expecting rows to not share embedded structs")
+	}
+}
@@ -0,0 +1,159 @@
+// ssql provides building blocks for safe SQL transactions in batch jobs,
+// mirroring smongo for databases accessed via database/sql, e.g. PostgreSQL and SQLite.
+//
+// ssql does not import any SQL driver. Callers register and open their own.
+
+package ssql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type TxFunc func(ctx context.Context, tx *sql.Tx) (interface{}, error)
+
+// Querier is implemented by *sql.DB, *sql.Tx and *sql.Conn
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+var (
+	_ Querier = &sql.DB{}
+	_ Querier = &sql.Tx{}
+	_ Querier = &sql.Conn{}
+)
+
+// Dialect covers the SQL differences that ssql cares about
+type Dialect int
+
+const (
+	DialectPostgres Dialect = iota
+	DialectSQLite
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case DialectPostgres:
+		return "postgres"
+	case DialectSQLite:
+		return "sqlite"
+	}
+
+	return fmt.Sprintf("dialect(%d)", int(d))
+}
+
+// Placeholder returns the n-th (1-based) bind parameter
+func (d Dialect) Placeholder(n int) string {
+	if d == DialectPostgres {
+		return "$" + strconv.Itoa(n)
+	}
+
+	return "?"
+}
+
+// Quote quotes an identifier, e.g. a table or column name.
+// Dotted names, e.g. schema.table, are quoted by part.
+//
+// Quoted identifiers are case-sensitive, so they must be spelled
+// as they were created.
+func Quote(ident string) string {
+	parts := strings.Split(ident, ".")
+	for i := range parts {
+		parts[i] = `"` + strings.ReplaceAll(parts[i], `"`, `""`) + `"`
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// WithTx runs tx in a transaction with isolation level iso, e.g. sql.LevelSerializable.
+// The transaction is committed if tx succeeds, and rolled back otherwise.
+func WithTx(
+	ctx context.Context,
+	db *sql.DB,
+	iso sql.IsolationLevel,
+	tx TxFunc,
+) (
+	interface{},
+	error,
+) {
+	sqlTx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: iso})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to begin tx with isolation %s", iso)
+	}
+
+	result, err := tx(ctx, sqlTx)
+	if err != nil {
+		errRollback := sqlTx.Rollback()
+		if errRollback != nil {
+			logrus.Errorf("ssql: failed to rollback tx: %s", errRollback.Error())
+		}
+
+		return result, errors.Wrap(err, "failed to perform tx")
+	}
+
+	err = sqlTx.Commit()
+	if err != nil {
+		return result, errors.Wrap(err, "failed to commit tx")
+	}
+
+	return result, nil
+}
+
+// Stmt is a statement with its arguments
+type Stmt struct {
+	Query string
+	Args  []interface{}
+}
+
+// Wraps statements inside a callback that can be sent to WithTx.
+// The callback returns the total rows affected as int64.
+func TxExec(stmts ...Stmt) TxFunc {
+	return func(ctx context.Context, tx *sql.Tx) (interface{}, error) {
+		var affected int64
+
+		for i := range stmts {
+			result, err := tx.ExecContext(ctx, stmts[i].Query, stmts[i].Args...)
+			if err != nil {
+				logrus.Errorf("exec: error executing statement %d '%s': %s", i, stmts[i].Query, err.Error())
+				return affected, err
+			}
+
+			n, err := result.RowsAffected()
+			if err == nil {
+				affected += n
+			}
+		}
+
+		return affected, nil
+	}
+}
+
+func Exec(
+	ctx context.Context,
+	db *sql.DB,
+	iso sql.IsolationLevel,
+	stmts ...Stmt,
+) (
+	int64,
+	error,
+) {
+	result, err := WithTx(ctx, db, iso, TxExec(stmts...))
+	if err != nil {
+		return 0, err
+	}
+
+	affected, ok := result.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected result type: %T", result)
+	}
+
+	return affected, nil
+}
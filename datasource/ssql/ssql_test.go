@@ -0,0 +1,68 @@
+package ssql
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// testDB opens a new SQLite database file, so that connections share it
+func testDB(t *testing.T, ddl ...string) *sql.DB {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	for _, stmt := range ddl {
+		_, err := db.Exec(stmt)
+		if err != nil {
+			t.Fatalf("failed to run '%s': %v", stmt, err)
+		}
+	}
+
+	return db
+}
+
+func TestQuote(t *testing.T) {
+	tests := map[string]string{
+		"payouts":        `"payouts"`,
+		"public.payouts": `"public"."payouts"`,
+		`we"ird`:         `"we""ird"`,
+	}
+
+	for ident, expect := range tests {
+		if actual := Quote(ident); actual != expect {
+			t.Fatalf("quoting %s: expecting %s, got %s", ident, expect, actual)
+		}
+	}
+}
+
+func TestExecRollback(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t, "CREATE TABLE t (id INTEGER PRIMARY KEY)")
+
+	_, err := Exec(ctx, db, sql.LevelDefault,
+		Stmt{Query: "INSERT INTO t (id) VALUES (?)", Args: []interface{}{1}},
+		Stmt{Query: "INSERT INTO t (id) VALUES (?)", Args: []interface{}{1}},
+	)
+	if err == nil {
+		t.Fatal("expecting duplicate key error")
+	}
+
+	ids, err := QueryRows[int64](ctx, db, "SELECT id FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 0 {
+		t.Fatalf("expecting failed tx to be rolled back, got %v", ids)
+	}
+}
@@ -0,0 +1,329 @@
+package satch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const ReportKeyRecords = "satch.records"
+
+// ErrFailureRatio is matched by errors of runs that rejected too many records
+var ErrFailureRatio = errors.New("failure ratio exceeded")
+
+// DeadLetter is a record rejected by a job, with a snapshot of its input
+type DeadLetter struct {
+	Key    string      `json:"key"`   // Identifies the record, e.g. payout ID
+	JobID  string      `json:"jobID"` // Job run that rejected the record
+	Reason string      `json:"reason"`
+	Input  interface{} `json:"input"`
+	At     time.Time   `json:"at"`
+
+	decode func(v interface{}) error
+}
+
+// WithInputDecoder returns d whose DecodeInput uses decode.
+// It is used by stores whose Input is not in its original type after loading.
+func (d DeadLetter) WithInputDecoder(decode func(v interface{}) error) DeadLetter {
+	d.decode = decode
+	return d
+}
+
+// DecodeInput decodes the input snapshot into v, which must be a pointer
+func (d DeadLetter) DecodeInput(v interface{}) error {
+	if d.decode != nil {
+		return d.decode(v)
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("unexpected decode target: %s", reflect.TypeOf(v))
+	}
+
+	input := reflect.ValueOf(d.Input)
+	if input.IsValid() && input.Type().AssignableTo(rv.Elem().Type()) {
+		rv.Elem().Set(input)
+		return nil
+	}
+
+	b, err := json.Marshal(d.Input)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal input of dead letter '%s'", d.Key)
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// DeadLetterStore keeps rejected records for inspection and Reprocess.
+// A store is scoped to one job, and letters are unique by Key within it.
+type DeadLetterStore interface {
+	Put(ctx context.Context, letters ...DeadLetter) error // Replaces letters with the same keys
+	List(ctx context.Context) ([]DeadLetter, error)
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// RecordReport counts the records of a run, and lists rejected ones.
+// It is recorded in the satch report as ReportKeyRecords.
+type RecordReport struct {
+	Total    int // As reported with Processed
+	Rejected []DeadLetter
+
+	// DeadLetterErr is set if Rejected could not be written to Config.DeadLetters.
+	// Outputs are committed by then, so it does not fail the run.
+	DeadLetterErr error
+}
+
+// FailureRatio returns rejected records over total records.
+// If no total was reported, any rejection is a ratio of 1.
+func (r *RecordReport) FailureRatio() float64 {
+	switch {
+	case len(r.Rejected) == 0:
+		return 0
+
+	case r.Total <= 0:
+		return 1
+	}
+
+	return float64(len(r.Rejected)) / float64(r.Total)
+}
+
+// records collects rejections of a run from Reject and Processed
+type records struct {
+	mut      sync.Mutex
+	jobID    string
+	total    int
+	rejected []DeadLetter
+}
+
+type recordsKey struct{}
+
+func withRecords(ctx context.Context, jobID string) (context.Context, *records) {
+	r := &records{jobID: jobID}
+	return context.WithValue(ctx, recordsKey{}, r), r
+}
+
+// Reject records that the job failed to process a record, without failing the run.
+// The run still fails if the failure ratio exceeds Config.MaxFailureRatio.
+// Otherwise the outputs are committed, and the record is written to Config.DeadLetters.
+//
+// key identifies the record, and input is a snapshot of it for Reprocess.
+func Reject(ctx context.Context, key string, input interface{}, reason error) {
+	msg := "rejected"
+	if reason != nil {
+		msg = reason.Error()
+	}
+
+	r, ok := ctx.Value(recordsKey{}).(*records)
+	if !ok {
+		logrus.Warnf("record %s rejected outside of a satch run: %s", key, msg)
+		return
+	}
+
+	logrus.Warnf("job %s rejected record %s: %s", r.jobID, key, msg)
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.rejected = append(r.rejected, DeadLetter{
+		Key:    key,
+		JobID:  r.jobID,
+		Reason: msg,
+		Input:  input,
+		At:     time.Now(),
+	})
+}
+
+// Processed adds n to the number of records processed by the run, including rejected ones.
+// It is the denominator of the failure ratio.
+func Processed(ctx context.Context, n int) {
+	r, ok := ctx.Value(recordsKey{}).(*records)
+	if !ok {
+		return
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.total += n
+}
+
+func (r *records) report() *RecordReport {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	return &RecordReport{
+		Total:    r.total,
+		Rejected: append([]DeadLetter{}, r.rejected...),
+	}
+}
+
+// merge adds counts and rejections of other to r
+func (r *records) merge(other *records) {
+	report := other.report()
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.total += report.Total
+	r.rejected = append(r.rejected, report.Rejected...)
+}
+
+// check fails if the failure ratio of r exceeds conf.MaxFailureRatio
+func (r *records) check(conf Config) error {
+	report := r.report()
+
+	ratio := report.FailureRatio()
+	if ratio <= conf.MaxFailureRatio {
+		return nil
+	}
+
+	return errors.Wrapf(
+		ErrFailureRatio,
+		"%d of %d records rejected (%.4f > %.4f)",
+		len(report.Rejected), report.Total, ratio, conf.MaxFailureRatio,
+	)
+}
+
+// deadLetter writes rejections of r to conf.DeadLetters, and records the report.
+// Failures are logged, and recorded in the report as DeadLetterErr.
+func (r *records) deadLetter(ctx context.Context, conf Config) error {
+	report := r.report()
+	Record(ctx, ReportKeyRecords, report)
+
+	if len(report.Rejected) == 0 {
+		return nil
+	}
+
+	if conf.DeadLetters == nil {
+		logrus.Warnf("job %s rejected %d records, but there is no dead letter store", r.jobID, len(report.Rejected))
+		return nil
+	}
+
+	err := conf.DeadLetters.Put(ctx, report.Rejected...)
+	if err != nil {
+		report.DeadLetterErr = errors.Wrapf(err, "outputs committed, but failed to dead-letter %d records", len(report.Rejected))
+		logrus.Errorf("job %s: %s", r.jobID, report.DeadLetterErr.Error())
+
+		return report.DeadLetterErr
+	}
+
+	return nil
+}
+
+// ReprocessFilter narrows inputs to the records of letters, e.g. by DeadLetter.Key.
+// It also returns the letters whose records it found in inputs.
+type ReprocessFilter func(ctx context.Context, inputs interface{}, letters []DeadLetter) (filtered interface{}, found []DeadLetter, err error)
+
+// Reprocess runs job on dead-lettered records only. Inputs are read from ds as usual,
+// and narrowed by filter to the records of letters.
+// Letters of records that were found by filter and not rejected again are deleted
+// from conf.DeadLetters. Letters of records missing from the inputs are kept.
+//
+// conf.MaxFailureRatio applies to the dead-lettered records only, so it should be
+// high enough for records still failing not to hold back the rest.
+func Reprocess(
+	ctx context.Context,
+	job Job,
+	ds DataSource,
+	conf Config,
+	filter ReprocessFilter,
+) (
+	*Report,
+	error,
+) {
+	switch {
+	case conf.DeadLetters == nil:
+		return nil, errors.New("reprocess requires config.DeadLetters")
+
+	case filter == nil:
+		return nil, errors.New("filter is nil")
+	}
+
+	letters, err := conf.DeadLetters.List(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list dead letters")
+	}
+
+	if len(letters) == 0 {
+		logrus.Info("no dead letters to reprocess")
+		return nil, nil
+	}
+
+	reprocessDS := &reprocessDataSource{DataSource: ds, letters: letters, filter: filter}
+
+	report, err := StartReport(ctx, job, reprocessDS, conf)
+	if err != nil {
+		return report, err
+	}
+
+	found := make(map[string]bool)
+	for _, letter := range reprocessDS.found {
+		found[letter.Key] = true
+	}
+
+	rejected := make(map[string]bool)
+	if v, ok := report.Get(ReportKeyRecords); ok {
+		// Letters of records rejected again are kept, even if they could not be replaced
+		for _, letter := range v.(*RecordReport).Rejected {
+			rejected[letter.Key] = true
+		}
+	}
+
+	done := []string{}
+	for _, letter := range letters {
+		if found[letter.Key] && !rejected[letter.Key] {
+			done = append(done, letter.Key)
+		}
+	}
+
+	logrus.Infof(
+		"reprocessed %d of %d dead letters, %d rejected again",
+		len(found), len(letters), len(found)-len(done),
+	)
+
+	err = conf.DeadLetters.Delete(ctx, done...)
+	if err != nil {
+		return report, errors.Wrapf(err, "failed to delete %d reprocessed dead letters", len(done))
+	}
+
+	return report, nil
+}
+
+// reprocessDataSource narrows inputs of the wrapped DataSource to dead-lettered records
+type reprocessDataSource struct {
+	DataSource
+
+	letters []DeadLetter
+	filter  ReprocessFilter
+	found   []DeadLetter // Set by Inputs
+}
+
+func (d *reprocessDataSource) Inputs(ctx context.Context) (interface{}, error) {
+	inputs, err := d.DataSource.Inputs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered, found, err := d.filter(ctx, inputs, d.letters)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to filter dead-lettered records")
+	}
+
+	d.found = found
+	return filtered, nil
+}
+
+func (d *reprocessDataSource) Unlock(ctx context.Context) error {
+	unlocker, ok := d.DataSource.(Unlocker)
+	if !ok {
+		return nil
+	}
+
+	return unlocker.Unlock(ctx)
+}
@@ -0,0 +1,258 @@
+package satch
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDeadLetters is an in-memory DeadLetterStore, failing with err if set
+type testDeadLetters struct {
+	mut     sync.Mutex
+	err     error
+	letters map[string]DeadLetter
+}
+
+func (s *testDeadLetters) Put(ctx context.Context, letters ...DeadLetter) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.err != nil {
+		return s.err
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.letters == nil {
+		s.letters = make(map[string]DeadLetter)
+	}
+
+	for _, letter := range letters {
+		s.letters[letter.Key] = letter
+	}
+
+	return nil
+}
+
+func (s *testDeadLetters) List(context.Context) ([]DeadLetter, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	letters := []DeadLetter{}
+	for _, letter := range s.letters {
+		letters = append(letters, letter)
+	}
+
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Key < letters[j].Key })
+	return letters, nil
+}
+
+func (s *testDeadLetters) Delete(_ context.Context, keys ...string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, key := range keys {
+		delete(s.letters, key)
+	}
+
+	return nil
+}
+
+func (s *testDeadLetters) keys() []string {
+	letters, _ := s.List(context.Background())
+
+	keys := []string{}
+	for _, letter := range letters {
+		keys = append(keys, letter.Key)
+	}
+
+	return keys
+}
+
+// rejectJob rejects negative numbers, and fails on 99
+type rejectJob struct{}
+
+func (rejectJob) ID() string { return "reject" }
+
+func (rejectJob) Run(ctx context.Context, inputs interface{}, _ time.Time) (interface{}, error) {
+	outputs := []int{}
+	for _, n := range inputs.([]int) {
+		Processed(ctx, 1)
+
+		switch {
+		case n == 99:
+			return nil, errors.New("bad record 99")
+
+		case n < 0:
+			Reject(ctx, strconv.Itoa(n), n, errors.New("negative"))
+			continue
+		}
+
+		outputs = append(outputs, n)
+	}
+
+	return outputs, nil
+}
+
+// testDataSource has []int inputs, and records committed outputs
+type testDataSource struct {
+	inputs    []int
+	committed []interface{}
+}
+
+func (d *testDataSource) LockWrite(context.Context) error { return nil }
+func (d *testDataSource) LockRead(context.Context) error  { return nil }
+
+func (d *testDataSource) Inputs(context.Context) (interface{}, error) {
+	return d.inputs, nil
+}
+
+func (d *testDataSource) Commit(_ context.Context, outputs interface{}) error {
+	d.committed = append(d.committed, outputs)
+	return nil
+}
+
+// filterLetters narrows []int inputs to the keys of letters
+func filterLetters(_ context.Context, inputs interface{}, letters []DeadLetter) (interface{}, []DeadLetter, error) {
+	keys := make(map[string]DeadLetter)
+	for _, letter := range letters {
+		keys[letter.Key] = letter
+	}
+
+	filtered := []int{}
+	found := []DeadLetter{}
+	for _, n := range inputs.([]int) {
+		if letter, ok := keys[strconv.Itoa(n)]; ok {
+			filtered = append(filtered, n)
+			found = append(found, letter)
+		}
+	}
+
+	return filtered, found, nil
+}
+
+func TestStartDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	ds := &testDataSource{inputs: []int{1, -1, 2, -2}}
+	letters := &testDeadLetters{}
+
+	report, err := StartReport(ctx, rejectJob{}, ds, Config{MaxFailureRatio: 0.5, DeadLetters: letters})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ds.committed, []interface{}{[]int{1, 2}}) {
+		t.Fatalf("unexpected commits %v", ds.committed)
+	}
+
+	v, ok := report.Get(ReportKeyRecords)
+	if !ok {
+		t.Fatal("no records in report")
+	}
+
+	if records := v.(*RecordReport); records.Total != 4 || len(records.Rejected) != 2 || records.FailureRatio() != 0.5 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+
+	stored, _ := letters.List(ctx)
+	if len(stored) != 2 || stored[0].Key != "-1" || stored[0].JobID != "reject" || stored[0].Reason != "negative" {
+		t.Fatalf("unexpected dead letters %+v", stored)
+	}
+
+	var input int
+	err = stored[0].DecodeInput(&input)
+	if err != nil || input != -1 {
+		t.Fatalf("unexpected input %d, %v", input, err)
+	}
+}
+
+func TestStartFailureRatio(t *testing.T) {
+	ctx := context.Background()
+	ds := &testDataSource{inputs: []int{1, -1, -2}}
+	letters := &testDeadLetters{}
+
+	_, err := StartReport(ctx, rejectJob{}, ds, Config{MaxFailureRatio: 0.5, DeadLetters: letters})
+	if !errors.Is(err, ErrFailureRatio) {
+		t.Fatalf("expecting ErrFailureRatio, got %v", err)
+	}
+
+	if len(ds.committed) != 0 || len(letters.keys()) != 0 {
+		t.Fatalf("expecting nothing committed or dead-lettered, got %v, %v", ds.committed, letters.keys())
+	}
+}
+
+func TestStartDeadLetterErr(t *testing.T) {
+	ctx := context.Background()
+	ds := &testDataSource{inputs: []int{1, -1}}
+	errStore := errors.New("store unavailable")
+
+	// Outputs are committed, so the run must not fail
+	report, err := StartReport(ctx, rejectJob{}, ds, Config{MaxFailureRatio: 0.5, DeadLetters: &testDeadLetters{err: errStore}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ds.committed) != 1 {
+		t.Fatalf("unexpected commits %v", ds.committed)
+	}
+
+	v, ok := report.Get(ReportKeyRecords)
+	if !ok || !errors.Is(v.(*RecordReport).DeadLetterErr, errStore) {
+		t.Fatalf("expecting dead letter error in report, got %+v", v)
+	}
+}
+
+func TestReprocess(t *testing.T) {
+	ctx := context.Background()
+	ds := &testDataSource{inputs: []int{-1, 2, 3, -4}}
+	old := time.Now().Add(-time.Hour)
+
+	letters := &testDeadLetters{}
+	letters.Put(ctx,
+		DeadLetter{Key: "-1", JobID: "old", At: old},
+		DeadLetter{Key: "3", JobID: "old", At: old},
+		DeadLetter{Key: "7", JobID: "old", At: old},
+	)
+
+	// Too many records rejected again
+	_, err := Reprocess(ctx, rejectJob{}, ds, Config{DeadLetters: letters}, filterLetters)
+	if !errors.Is(err, ErrFailureRatio) {
+		t.Fatalf("expecting ErrFailureRatio, got %v", err)
+	}
+
+	if len(ds.committed) != 0 || !reflect.DeepEqual(letters.keys(), []string{"-1", "3", "7"}) {
+		t.Fatalf("expecting nothing committed or deleted, got %v, %v", ds.committed, letters.keys())
+	}
+
+	_, err = Reprocess(ctx, rejectJob{}, ds, Config{MaxFailureRatio: 1, DeadLetters: letters}, filterLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only dead-lettered records are run
+	if !reflect.DeepEqual(ds.committed, []interface{}{[]int{3}}) {
+		t.Fatalf("unexpected commits %v", ds.committed)
+	}
+
+	// The record rejected again is kept, and replaced by the new rejection.
+	// The letter of the record missing from the inputs is kept as is.
+	stored, _ := letters.List(ctx)
+	if len(stored) != 2 || stored[0].Key != "-1" || stored[0].JobID != "reject" || stored[1].Key != "7" || stored[1].JobID != "old" {
+		t.Fatalf("unexpected dead letters %+v", stored)
+	}
+
+	// Nothing to reprocess
+	ds.committed = nil
+	letters.Delete(ctx, "-1", "7")
+
+	report, err := Reprocess(ctx, rejectJob{}, ds, Config{MaxFailureRatio: 1, DeadLetters: letters}, filterLetters)
+	if err != nil || report != nil || len(ds.committed) != 0 {
+		t.Fatalf("expecting nothing reprocessed, got %+v, %v, %v", report, err, ds.committed)
+	}
+}
@@ -1,17 +1,35 @@
 package payout
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"sort"
+	"strings"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/soyart/satch"
+	"github.com/soyart/satch/datasource/smongo"
 )
 
 const (
 	CollectionPayouts   = "payouts"
 	CollectionAccounts  = "accounts"
 	CollectionCustomers = "customers"
+	CollectionOutbox    = smongo.DefaultOutboxColl
+)
+
+// transferTolerance absorbs float rounding when summing transfers and balances
+const transferTolerance = 1e-6
+
+// Outbox event topics
+const (
+	TopicCustomerBanned = "customer.banned"
+	TopicPayoutSettled  = "payout.settled"
 )
 
 type Change interface {
@@ -25,10 +43,22 @@ type Changes struct {
 	suspended Set[string]
 	canceled  Set[string]
 	settled   Set[string]
+	rejected  []RejectedPayout
 
 	List []Change // Exported for cmd/initdb
 }
 
+// RejectedPayout is a payout that could not be processed
+type RejectedPayout struct {
+	Payout Payout
+	Reason string
+}
+
+// Rejected returns payouts that could not be processed, and have no changes
+func (c *Changes) Rejected() []RejectedPayout {
+	return c.rejected
+}
+
 func (c *Changes) OutputsV2(now time.Time) OutputsV2 {
 	colls := make(map[string][]Change)
 	for i := range c.List {
@@ -42,8 +72,14 @@ func (c *Changes) OutputsV2(now time.Time) OutputsV2 {
 	// Other collections should have multiple UpdateOne
 	banned := sort.StringSlice(c.banned.Slice())
 	banned.Sort()
+
+	expectBanned := smongo.ExpectAny
+	if len(banned) > 0 {
+		expectBanned = smongo.ExpectAtLeastOne
+	}
+
 	outputsV2[CollectionCustomers] = []mongo.WriteModel{
-		mongo.
+		smongo.Expect(expectBanned, mongo.
 			NewUpdateManyModel().
 			SetFilter(bson.M{
 				"id": bson.M{
@@ -56,9 +92,10 @@ func (c *Changes) OutputsV2(now time.Time) OutputsV2 {
 					"banned_at":  now.Unix(),
 					"updated_at": now.Unix(),
 				},
-			}),
+			})),
 	}
 
+	// Every other change targets exactly one document by its key
 	for coll, changes := range colls {
 		if coll == CollectionCustomers {
 			continue
@@ -67,18 +104,51 @@ func (c *Changes) OutputsV2(now time.Time) OutputsV2 {
 		writes := make([]mongo.WriteModel, len(changes))
 		for i := range changes {
 			change := changes[i]
-			writes[i] = mongo.
+			writes[i] = smongo.Expect(smongo.ExpectExactlyOne, mongo.
 				NewUpdateOneModel().
 				SetFilter(change.Filter()).
-				SetUpdate(change.SetUpdate(now.Unix()))
+				SetUpdate(change.SetUpdate(now.Unix())))
 		}
 
 		outputsV2[coll] = writes
 	}
 
+	outputsV2[CollectionOutbox] = smongo.OutboxWrites(c.Events(now))
+
 	return outputsV2
 }
 
+// Events returns outbox events for banned customers and settled payouts.
+// Event IDs are derived from the entity IDs, so re-committing the same changes
+// does not publish the same event twice.
+func (c *Changes) Events(now time.Time) []smongo.OutboxEvent {
+	events := []smongo.OutboxEvent{}
+
+	for i := range c.List {
+		switch change := c.List[i].(type) {
+		case ChangeCustomerBan:
+			id := string(change)
+			events = append(events, smongo.NewOutboxEvent(
+				TopicCustomerBanned+":"+id,
+				TopicCustomerBanned,
+				bson.M{"id": id, "banned_at": now.Unix()},
+				now,
+			))
+
+		case ChangePayoutSettle:
+			id := string(change)
+			events = append(events, smongo.NewOutboxEvent(
+				TopicPayoutSettled+":"+id,
+				TopicPayoutSettled,
+				bson.M{"id": id, "settled_at": now.Unix()},
+				now,
+			))
+		}
+	}
+
+	return events
+}
+
 func (c *Changes) OutputsV1(now time.Time) OutputsV1 {
 	colls := make(map[string][]Change)
 	for i := range c.List {
@@ -134,6 +204,147 @@ func (c *Changes) OutputsV1(now time.Time) OutputsV1 {
 	}
 }
 
+// Postconditions returns checks that the changes were applied after commit:
+// payouts settled or canceled, accounts suspended, customers banned,
+// and account balances changed by the transferred amounts.
+// accounts are the accounts read as inputs.
+func (c *Changes) Postconditions(accounts []Account) []smongo.Postcondition {
+	var settled []string
+	deltas := make(map[string]float64)
+	for i := range c.List {
+		switch change := c.List[i].(type) {
+		case ChangePayoutSettle:
+			settled = append(settled, string(change))
+
+		case ChangeAccountTransfer:
+			deltas[change.Number] += change.Amount
+		}
+	}
+
+	conds := []smongo.Postcondition{}
+	keyed := []struct {
+		name   string
+		coll   string
+		key    string
+		ids    []string
+		expect bson.M
+	}{
+		{name: "payouts settled", coll: CollectionPayouts, key: "id", ids: settled, expect: bson.M{"settled": true}},
+		{name: "payouts canceled", coll: CollectionPayouts, key: "id", ids: c.canceled.Slice(), expect: bson.M{"canceled": true}},
+		{name: "accounts suspended", coll: CollectionAccounts, key: "number", ids: c.suspended.Slice(), expect: bson.M{"suspended": true}},
+		{name: "customers banned", coll: CollectionCustomers, key: "id", ids: c.banned.Slice(), expect: bson.M{"banned": true}},
+	}
+
+	for _, k := range keyed {
+		if len(k.ids) == 0 {
+			continue
+		}
+
+		sort.Strings(k.ids)
+		conds = append(conds, smongo.Postcondition{
+			Name:   k.name,
+			Coll:   k.coll,
+			Filter: bson.M{k.key: bson.M{"$in": k.ids}},
+			Expect: k.expect,
+			Count:  int64(len(k.ids)),
+		})
+	}
+
+	for i := range accounts {
+		acc := &accounts[i]
+		delta, ok := deltas[acc.Number]
+		if !ok {
+			continue
+		}
+
+		// $inc of floats may not add up to exactly the expected balance
+		balance := acc.Balance + delta
+		conds = append(conds, smongo.Postcondition{
+			Name:   "balance transferred for account " + acc.Number,
+			Coll:   CollectionAccounts,
+			Filter: bson.M{"number": acc.Number},
+			Expect: bson.M{"balance": bson.M{"$gte": balance - transferTolerance, "$lte": balance + transferTolerance}},
+			Count:  1,
+		})
+	}
+
+	return conds
+}
+
+// Invariants returns checks on the changes before commit:
+// transfers sum to zero, no suspended account is credited,
+// and at most maxBanned customers are banned in a run.
+// accounts are the accounts read as inputs, whose suspensions also count.
+func (c *Changes) Invariants(accounts []Account, maxBanned int) []satch.Invariant {
+	suspended := make(Set[string])
+	for i := range accounts {
+		if accounts[i].Suspended {
+			suspended.Add(accounts[i].Number)
+		}
+	}
+
+	var transfers []ChangeAccountTransfer
+	banned := 0
+	for i := range c.List {
+		switch change := c.List[i].(type) {
+		case ChangeAccountSuspend:
+			suspended.Add(string(change))
+
+		case ChangeCustomerBan:
+			banned++
+
+		case ChangeAccountTransfer:
+			transfers = append(transfers, change)
+		}
+	}
+
+	return []satch.Invariant{
+		{
+			Name: "transfers balanced",
+			Check: func(context.Context, interface{}) error {
+				sum := 0.0
+				for i := range transfers {
+					sum += transfers[i].Amount
+				}
+
+				if math.Abs(sum) > transferTolerance {
+					return fmt.Errorf("%d transfers sum to %f", len(transfers), sum)
+				}
+
+				return nil
+			},
+		},
+		{
+			Name: "no suspended account credited",
+			Check: func(context.Context, interface{}) error {
+				credited := []string{}
+				for i := range transfers {
+					if transfers[i].Amount > 0 && suspended.Contains(transfers[i].Number) {
+						credited = append(credited, transfers[i].Number)
+					}
+				}
+
+				if len(credited) > 0 {
+					sort.Strings(credited)
+					return fmt.Errorf("suspended accounts credited: %s", strings.Join(credited, ", "))
+				}
+
+				return nil
+			},
+		},
+		{
+			Name: "banned customers under threshold",
+			Check: func(context.Context, interface{}) error {
+				if banned > maxBanned {
+					return fmt.Errorf("%d customers banned, at most %d allowed", banned, maxBanned)
+				}
+
+				return nil
+			},
+		},
+	}
+}
+
 func (c *Changes) banCustomer(cust *Customer) {
 	cust.Banned = true
 
@@ -173,6 +384,11 @@ func (c *Changes) cancelPayout(p *Payout) {
 	c.List = append(c.List, ChangePayoutCancel(id))
 }
 
+func (c *Changes) reject(p *Payout, reason string) {
+	logrus.Infof("rejecting payout %s: %s", p.ID, reason)
+	c.rejected = append(c.rejected, RejectedPayout{Payout: *p, Reason: reason})
+}
+
 func (c *Changes) settlePayout(p *Payout, from, to *Account) {
 	if p.Canceled {
 		return
@@ -256,7 +472,7 @@ func (c ChangePayoutSettle) Collection() string {
 
 func (c ChangePayoutSettle) Filter() bson.M {
 	return bson.M{
-		"number": c,
+		"id": c,
 	}
 }
 
@@ -276,7 +492,7 @@ func (c ChangePayoutCancel) Collection() string {
 
 func (c ChangePayoutCancel) Filter() bson.M {
 	return bson.M{
-		"number": c,
+		"id": c,
 	}
 }
 
@@ -335,9 +551,10 @@ func (c ChangeAccountTransfer) Collection() string {
 }
 
 func (c ChangeAccountTransfer) Filter() bson.M {
+	// suspended is omitted from unsuspended accounts
 	return bson.M{
 		"number":    c.Number,
-		"suspended": false,
+		"suspended": bson.M{"$ne": true},
 	}
 }
 
@@ -14,35 +14,37 @@ func main() {
 	ctx := context.Background()
 
 	mg, err := smongo.NewClient(ctx, smongo.MongoDBConfig{
-		Hosts:    "localhost:47017",
-		Admin:    "admin",
-		Username: "test_user",
-		Password: "test_password",
+		Hosts:      "localhost:47017",
+		AuthSource: "admin",
+		Username:   "test_user",
+		Password:   "test_password",
 	})
 	if err != nil {
 		panic(err)
 	}
 
-	var customers []payout.Customer
-	var accounts []payout.Account
-	var payouts []payout.Payout
-
-	load("./example/payout/mock/customers.json", &customers)
-	load("./example/payout/mock/accounts.json", &accounts)
-	load("./example/payout/mock/payouts.json", &payouts)
+	defer mg.Close(ctx)
 
-	db := mg.Unwrap().Database(payout.DB)
-	_, err = smongo.InsertMany(ctx, db.Collection(payout.CollectionCustomers), sliceInf(customers))
+	migrator, err := smongo.NewMigrator(mg.Unwrap().Database(payout.DB), payout.Migrations)
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = smongo.InsertMany(ctx, db.Collection(payout.CollectionAccounts), sliceInf(accounts))
+	_, err = migrator.Up(ctx, 0)
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = smongo.InsertMany(ctx, db.Collection(payout.CollectionPayouts), sliceInf(payouts))
+	var customers []payout.Customer
+	var accounts []payout.Account
+	var payouts []payout.Payout
+
+	load("./example/payout/mock/customers.json", &customers)
+	load("./example/payout/mock/accounts.json", &accounts)
+	load("./example/payout/mock/payouts.json", &payouts)
+
+	backend := smongo.NewMongoBackend(mg.Unwrap().Database(payout.DB))
+	err = payout.Seed(ctx, backend, customers, accounts, payouts)
 	if err != nil {
 		panic(err)
 	}
@@ -61,12 +63,3 @@ func load(filename string, result interface{}) {
 		panic(err)
 	}
 }
-
-func sliceInf[T any](data []T) []interface{} {
-	result := make([]interface{}, len(data))
-	for i := range data {
-		result[i] = data[i]
-	}
-
-	return result
-}
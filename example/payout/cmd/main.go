@@ -11,17 +11,23 @@ import (
 func main() {
 	ctx := context.Background()
 	mg, err := smongo.NewClient(ctx, smongo.MongoDBConfig{
-		Hosts:    "localhost:47017",
-		Admin:    "lineman-admin",
-		Username: "test_user",
-		Password: "test_password",
+		Hosts:      "localhost:47017",
+		AuthSource: "admin",
+		Username:   "test_user",
+		Password:   "test_password",
 	})
 	if err != nil {
 		panic(err.Error())
 	}
 
+	defer mg.Close(ctx)
+
 	job := payout.New()
 	ds := payout.NewDS(mg)
 
-	satch.Start(ctx, job, ds, satch.Config{})
+	// Rejected payouts are dead-lettered, unless there are too many of them
+	satch.Start(ctx, job, ds, satch.Config{
+		MaxFailureRatio: 0.05,
+		DeadLetters:     payout.DeadLetters(mg),
+	})
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/soyart/satch/datasource/smongo"
+	"github.com/soyart/satch/example/payout"
+)
+
+// Usage: migrate up|down|status [version]
+//
+// up applies migrations up to version (default: all),
+// down reverts migrations newer than version (default: 0, i.e. all)
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: migrate up|down|status [version]")
+		os.Exit(2)
+	}
+
+	var version int64
+	if len(os.Args) > 2 {
+		v, err := strconv.ParseInt(os.Args[2], 10, 64)
+		if err != nil {
+			panic(err)
+		}
+
+		version = v
+	}
+
+	ctx := context.Background()
+	mg, err := smongo.NewClient(ctx, smongo.MongoDBConfig{
+		Hosts:    "localhost:47017",
+		Username: "test_user",
+		Password: "test_password",
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	defer mg.Close(ctx)
+
+	migrator, err := smongo.NewMigrator(mg.Unwrap().Database(payout.DB), payout.Migrations)
+	if err != nil {
+		panic(err)
+	}
+
+	switch cmd := os.Args[1]; cmd {
+	case "up":
+		applied, err := migrator.Up(ctx, version)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Println("applied:", applied)
+
+	case "down":
+		reverted, err := migrator.Down(ctx, version)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Println("reverted:", reverted)
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.Applied {
+				appliedAt = s.AppliedAt.String()
+			}
+
+			fmt.Printf("%d\t%s\t%s\n", s.Version, s.Description, appliedAt)
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n", cmd)
+		os.Exit(2)
+	}
+}
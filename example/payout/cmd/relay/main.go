@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+
+	"github.com/soyart/satch/datasource/smongo"
+	"github.com/soyart/satch/example/payout"
+)
+
+// Publishes payout outbox events to stdout
+func main() {
+	ctx := context.Background()
+	mg, err := smongo.NewClient(ctx, smongo.MongoDBConfig{
+		Hosts:    "localhost:47017",
+		Username: "test_user",
+		Password: "test_password",
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+
+	defer mg.Close(ctx)
+
+	coll := mg.Unwrap().Database(payout.DB).Collection(payout.CollectionOutbox)
+	relay := smongo.NewRelay(coll, smongo.NewStdoutPublisher())
+
+	err = relay.Run(ctx)
+	if err != nil {
+		panic(err.Error())
+	}
+}
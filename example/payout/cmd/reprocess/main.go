@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+
+	"github.com/soyart/satch"
+	"github.com/soyart/satch/datasource/smongo"
+	"github.com/soyart/satch/example/payout"
+)
+
+// Re-runs the payout job on dead-lettered payouts only
+func main() {
+	ctx := context.Background()
+	mg, err := smongo.NewClient(ctx, smongo.MongoDBConfig{
+		Hosts:      "localhost:47017",
+		AuthSource: "admin",
+		Username:   "test_user",
+		Password:   "test_password",
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+
+	defer mg.Close(ctx)
+
+	_, err = satch.Reprocess(
+		ctx,
+		payout.New(),
+		payout.NewDS(mg),
+		// Payouts rejected again stay dead-lettered without holding back the rest
+		satch.Config{MaxFailureRatio: 1, DeadLetters: payout.DeadLetters(mg)},
+		payout.ReprocessInputs,
+	)
+	if err != nil {
+		panic(err.Error())
+	}
+}
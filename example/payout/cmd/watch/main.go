@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/soyart/satch/datasource/smongo"
+	"github.com/soyart/satch/example/payout"
+)
+
+// Runs the payout job whenever new payouts are inserted
+func main() {
+	ctx := context.Background()
+	mg, err := smongo.NewClient(ctx, smongo.MongoDBConfig{
+		Hosts:    "localhost:47017",
+		Username: "test_user",
+		Password: "test_password",
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+
+	defer mg.Close(ctx)
+
+	db := mg.Unwrap().Database(payout.DB)
+	ds := payout.NewDS(mg)
+	tokens := smongo.NewCollTokenStore(db.Collection("watch_tokens"), "payout-inserts")
+
+	watcher, err := smongo.NewWatcher(
+		db.Collection(payout.CollectionPayouts),
+		payout.New(),
+		ds,
+		tokens,
+		smongo.WatchConfig{
+			Pipeline: mongo.Pipeline{
+				{{Key: "$match", Value: bson.M{"operationType": "insert"}}},
+			},
+			BatchSize: 50,
+			Window:    10 * time.Second,
+			Inputs: func(ctx context.Context, _ []smongo.ChangeEvent) (interface{}, error) {
+				// The events only trigger the job, which processes all payouts
+				return ds.Inputs(ctx)
+			},
+		},
+	)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	err = watcher.Watch(ctx)
+	if err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,71 @@
+package payout
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/soyart/satch/datasource/smongo"
+)
+
+// Migrations create the indexes used by payout writes,
+// which filter on payouts.id, accounts.number and customers.id
+var Migrations = []smongo.Migration{
+	{
+		Version:     1,
+		Description: "unique keys",
+		Up: smongo.Steps(
+			smongo.CreateIndexes(CollectionPayouts, mongo.IndexModel{
+				Keys:    bson.D{{Key: "id", Value: 1}},
+				Options: options.Index().SetName("id_unique").SetUnique(true),
+			}),
+			smongo.CreateIndexes(CollectionAccounts, mongo.IndexModel{
+				Keys:    bson.D{{Key: "number", Value: 1}},
+				Options: options.Index().SetName("number_unique").SetUnique(true),
+			}),
+			smongo.CreateIndexes(CollectionCustomers, mongo.IndexModel{
+				Keys:    bson.D{{Key: "id", Value: 1}},
+				Options: options.Index().SetName("id_unique").SetUnique(true),
+			}),
+		),
+		Down: smongo.Steps(
+			smongo.DropIndexes(CollectionPayouts, "id_unique"),
+			smongo.DropIndexes(CollectionAccounts, "number_unique"),
+			smongo.DropIndexes(CollectionCustomers, "id_unique"),
+		),
+	},
+	{
+		Version:     2,
+		Description: "lookup indexes",
+		Up: smongo.Steps(
+			smongo.CreateIndexes(CollectionAccounts, mongo.IndexModel{
+				Keys:    bson.D{{Key: "owner_id", Value: 1}},
+				Options: options.Index().SetName("owner_id"),
+			}),
+			smongo.CreateIndexes(CollectionPayouts, mongo.IndexModel{
+				Keys:    bson.D{{Key: "settled", Value: 1}, {Key: "t", Value: 1}},
+				Options: options.Index().SetName("settled_t"),
+			}),
+		),
+		Down: smongo.Steps(
+			smongo.DropIndexes(CollectionAccounts, "owner_id"),
+			smongo.DropIndexes(CollectionPayouts, "settled_t"),
+		),
+	},
+	{
+		Version:     3,
+		Description: "payout schema",
+		Up: smongo.SetValidator(CollectionPayouts, bson.M{
+			"bsonType": "object",
+			"required": bson.A{"id", "from", "to", "amount", "t"},
+			"properties": bson.M{
+				"id":     bson.M{"bsonType": "string"},
+				"from":   bson.M{"bsonType": "string"},
+				"to":     bson.M{"bsonType": "string"},
+				"amount": bson.M{"bsonType": bson.A{"double", "int", "long"}, "minimum": 0},
+				"t":      bson.M{"bsonType": bson.A{"int", "long"}},
+			},
+		}),
+		Down: smongo.SetValidator(CollectionPayouts, nil),
+	},
+}
@@ -29,6 +29,7 @@ type Account struct {
 	SuspendedAt int64   `bson:"suspended_at,omitempty" json:"suspendedAt,omitempty"`
 	Balance     float64 `bson:"balance" json:"balance"`
 	Suspended   bool    `bson:"suspended,omitempty" json:"suspended,omitempty"`
+	Version     int64   `bson:"version,omitempty" json:"version,omitempty"` // Incremented on every committed account write
 }
 
 type Customer struct {
@@ -90,16 +91,30 @@ func ProcessPayout(
 
 		logrus.Infof("start processing payout %s", p.ID)
 
+		// Payouts referring to missing accounts or customers are rejected,
+		// and left for reprocessing once the data is fixed
 		from, ok := accounts[p.From]
 		if !ok {
-			logrus.Infof("cancelPayout: no from")
-			changes.cancelPayout(p)
+			changes.reject(p, "no from account "+p.From)
+			continue
 		}
 
 		to, ok := accounts[p.To]
 		if !ok {
-			logrus.Infof("cancelPayout: no to")
-			changes.cancelPayout(p)
+			changes.reject(p, "no to account "+p.To)
+			continue
+		}
+
+		fromCust, ok := customers[from.OwnerID]
+		if !ok {
+			changes.reject(p, "no customer "+from.OwnerID+" of from account")
+			continue
+		}
+
+		toCust, ok := customers[to.OwnerID]
+		if !ok {
+			changes.reject(p, "no customer "+to.OwnerID+" of to account")
+			continue
 		}
 
 		if from.Suspended {
@@ -114,18 +129,6 @@ func ProcessPayout(
 
 		// Handle suspicious entities
 
-		fromCust, ok := customers[from.OwnerID]
-		if !ok {
-			logrus.Infof("cancelPayout: no cust from")
-			changes.cancelPayout(p)
-		}
-
-		toCust, ok := customers[to.OwnerID]
-		if !ok {
-			logrus.Infof("cancelPayout: no cust to")
-			changes.cancelPayout(p)
-		}
-
 		if fromCust.Banned {
 			logrus.Infof("cancelPayout + suspend from: banned from")
 			changes.cancelPayout(p)
@@ -19,16 +19,24 @@ import (
 const DB = "example-payout"
 
 type dataSource struct {
-	db *smongo.MongoDB
+	backend  smongo.Backend
+	versions *smongo.Versions // Account versions read by Inputs
 }
 
+// DefaultMaxBanned is the most customers a run may ban before its outputs are rejected
+const DefaultMaxBanned = 100
+
 type Job struct {
-	start time.Time
+	start     time.Time
+	maxBanned int
 }
 
 var (
 	_ satch.Job        = &Job{}
 	_ satch.DataSource = &dataSource{}
+
+	_ smongo.Verifiable = Outputs{}
+	_ satch.Validatable = Outputs{}
 )
 
 type Inputs struct {
@@ -38,23 +46,70 @@ type Inputs struct {
 	Accounts  []Account
 }
 
+// Outputs are the results of Job.Run to be committed
+type Outputs struct {
+	Writes OutputsV2
+	Checks []smongo.Postcondition // Verified after commit
+	Rules  []satch.Invariant      // Validated before commit
+}
+
+func (o Outputs) Postconditions() []smongo.Postcondition {
+	return o.Checks
+}
+
+func (o Outputs) Invariants() []satch.Invariant {
+	return o.Rules
+}
+
 // Maps collection name to writes
 // More iterable compared to OutputsV1
 type OutputsV2 map[string][]mongo.WriteModel
 
+// Plan returns the writes as smongo.WritePlan.
+// Customers are banned and accounts are suspended or credited
+// before payouts are marked settled or canceled.
+// Outbox events are written last, in the same transaction.
+//
+// Account writes are versioned with accounts,
+// so that accounts changed after Inputs are not written to.
+func (o OutputsV2) Plan(accounts *smongo.Versions) smongo.WritePlan {
+	return smongo.WritePlan{}.
+		Then(CollectionCustomers, o[CollectionCustomers]).
+		ThenVersioned(CollectionAccounts, accounts, o[CollectionAccounts]).
+		Then(CollectionPayouts, o[CollectionPayouts]).
+		Then(CollectionOutbox, o[CollectionOutbox])
+}
+
 type OutputsV1 struct {
 	Payouts   []mongo.WriteModel
 	Customers []mongo.WriteModel
 	Accounts  []mongo.WriteModel
 }
 
+// DeadLetters returns the store of rejected payouts
+func DeadLetters(mg *smongo.MongoDB) *smongo.DeadLetterColl {
+	return smongo.NewDeadLetterColl(mg.Collection(DB, smongo.DefaultDeadLetterColl).Unwrap(), "payout")
+}
+
 func New() *Job {
-	return &Job{start: time.Now()}
+	return &Job{start: time.Now(), maxBanned: DefaultMaxBanned}
+}
+
+// WithMaxBanned sets the most customers a run may ban
+func (j *Job) WithMaxBanned(n int) *Job {
+	j.maxBanned = n
+	return j
 }
 
 func NewDS(mg *smongo.MongoDB) *dataSource {
+	return NewDSBackend(smongo.NewMongoBackend(mg.Unwrap().Database(DB)))
+}
+
+// NewDSBackend returns a data source using backend,
+// e.g. smongo.MemBackend in tests
+func NewDSBackend(backend smongo.Backend) *dataSource {
 	return &dataSource{
-		db: mg,
+		backend: backend,
 	}
 }
 
@@ -77,23 +132,49 @@ func (j *Job) Run(ctx context.Context, inputs interface{}, now time.Time) (inter
 	logrus.Infof("changes: %+v", changes)
 	logrus.Infof("num changesList: %d", len(changes.List))
 
-	return changes.OutputsV2(j.start), err
-}
+	satch.Processed(ctx, len(inputsPayout.Payouts))
+	for _, rejected := range changes.Rejected() {
+		satch.Reject(ctx, rejected.Payout.ID, rejected.Payout, errors.New(rejected.Reason))
+	}
 
-func (d *dataSource) Unwrap() *mongo.Client {
-	return d.db.Unwrap()
+	return Outputs{
+		Writes: changes.OutputsV2(j.start),
+		Checks: changes.Postconditions(inputsPayout.Accounts),
+		Rules:  changes.Invariants(inputsPayout.Accounts, j.maxBanned),
+	}, nil
 }
 
-func (d *dataSource) UnwrapSatch() *smongo.MongoDB {
-	return d.db
-}
+// ReprocessInputs narrows inputs to dead-lettered payouts, for satch.Reprocess.
+// Payouts are taken from the fresh inputs rather than the dead letters,
+// so that fixes made since the rejection are picked up.
+// Letters of payouts no longer in the inputs are not returned as found.
+func ReprocessInputs(_ context.Context, inputs interface{}, letters []satch.DeadLetter) (interface{}, []satch.DeadLetter, error) {
+	inputsPayout, ok := inputs.(Inputs)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected inputs type: '%s'", reflect.TypeOf(inputs).String())
+	}
 
-func (d *dataSource) Collection(db, coll string) *mongo.Collection {
-	return d.db.Collection(db, coll).Unwrap()
+	byID := make(map[string]satch.DeadLetter)
+	for i := range letters {
+		byID[letters[i].Key] = letters[i]
+	}
+
+	payouts := []Payout{}
+	found := []satch.DeadLetter{}
+	for i := range inputsPayout.Payouts {
+		if letter, ok := byID[inputsPayout.Payouts[i].ID]; ok {
+			payouts = append(payouts, inputsPayout.Payouts[i])
+			found = append(found, letter)
+		}
+	}
+
+	inputsPayout.Payouts = payouts
+	return inputsPayout, found, nil
 }
 
-func (d *dataSource) CollectionSatch(db, coll string) *smongo.Collection {
-	return d.db.Collection(db, coll)
+// Backend returns the backend that inputs are read from and outputs are written to
+func (d *dataSource) Backend() smongo.Backend {
+	return d.backend
 }
 
 func (d *dataSource) LockRead(_ context.Context) error {
@@ -104,29 +185,36 @@ func (d *dataSource) LockWrite(_ context.Context) error {
 	return errors.New("should not lock writes for this job")
 }
 
+// Inputs reads customers, accounts and payouts at a single point in time,
+// and records that time in the satch report
 func (d *dataSource) Inputs(ctx context.Context) (interface{}, error) {
-	collPayouts := d.CollectionSatch(DB, "payouts")
-	collAccounts := d.CollectionSatch(DB, "accounts")
-	collCustomers := d.CollectionSatch(DB, "customers")
-
 	var customers []Customer
-	err := collCustomers.Find(ctx, bson.M{}, &customers)
-	if err != nil {
-		log.Println("failed to find input customers:", err.Error())
-		return nil, err
-	}
-
 	var accounts []Account
-	err = collAccounts.Find(ctx, bson.M{}, &accounts)
+	var payouts []Payout
+
+	clusterTime, err := d.backend.FindSnapshot(
+		ctx,
+		nil,
+		smongo.SnapshotQuery{Coll: CollectionCustomers, Filter: bson.M{}, Results: &customers},
+		smongo.SnapshotQuery{Coll: CollectionAccounts, Filter: bson.M{}, Results: &accounts},
+		smongo.SnapshotQuery{Coll: CollectionPayouts, Filter: bson.M{}, Results: &payouts},
+	)
 	if err != nil {
-		log.Println("failed to find input accounts:", err.Error())
+		log.Println("failed to find inputs:", err.Error())
 		return nil, err
 	}
 
-	var payouts []Payout
-	err = collPayouts.Find(ctx, bson.M{}, &payouts)
+	logrus.Infof("inputs read at cluster time %v", clusterTime)
+	satch.Record(ctx, smongo.ReportKeyClusterTime, clusterTime)
+
+	d.versions = smongo.NewVersions("number", smongo.DefaultVersionField)
+	err = smongo.TrackVersions(
+		d.versions,
+		accounts,
+		func(acc Account) interface{} { return acc.Number },
+		func(acc Account) int64 { return acc.Version },
+	)
 	if err != nil {
-		log.Println("failed to find input payouts:", err.Error())
 		return nil, err
 	}
 
@@ -138,33 +226,39 @@ func (d *dataSource) Inputs(ctx context.Context) (interface{}, error) {
 }
 
 func (d *dataSource) Commit(ctx context.Context, data interface{}) error {
-	outputs, ok := data.(OutputsV2)
+	outputs, ok := data.(Outputs)
 	if !ok {
 		return fmt.Errorf("unexpected data type: '%s'", reflect.TypeOf(data).String())
 	}
 
-	db := d.Unwrap().Database(DB)
-	tx := smongo.TxBulkWriteColls(db, outputs)
+	if d.versions == nil {
+		return errors.New("commit called before inputs: no account versions")
+	}
 
-	resultTx, err := smongo.WithTxDb(ctx, db, tx)
+	result, err := d.backend.BulkWrite(ctx, outputs.Writes.Plan(d.versions))
 	if err != nil {
-		return err
-	}
+		var conflict *smongo.ConflictError
+		if errors.As(err, &conflict) {
+			logrus.Errorf("accounts changed since inputs were read: %v", conflict.Keys)
+		}
 
-	resultColls, ok := resultTx.(map[string]interface{})
-	if !ok {
-		logrus.Errorf("unexpected type for tx result: '%s'", reflect.TypeOf(resultTx).String())
-		return nil // Ignoring this error
+		return err
 	}
 
-	for coll, result := range resultColls {
-		resultBulkWrite, ok := result.(*mongo.BulkWriteResult)
-		if !ok {
-			continue
-		}
-
-		logrus.Infof("%d documents modified for collection '%s'", resultBulkWrite.ModifiedCount, coll)
+	for _, coll := range result.Order {
+		logrus.Infof("%d documents modified for collection '%s'", result.Coll(coll).ModifiedCount, coll)
 	}
 
-	return nil
+	logrus.Infof(
+		"commit: %d matched, %d modified, %d upserted, %d inserted, %d deleted",
+		result.MatchedCount,
+		result.ModifiedCount,
+		result.UpsertedCount,
+		result.InsertedCount,
+		result.DeletedCount,
+	)
+
+	// Writes that silently matched nothing mean that money did not move
+	_, err = smongo.Verify(ctx, d.backend, outputs.Postconditions()...)
+	return err
 }
@@ -0,0 +1,207 @@
+package payout
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/soyart/satch"
+	"github.com/soyart/satch/datasource/sfile"
+	"github.com/soyart/satch/datasource/smongo"
+)
+
+func seedMem(t *testing.T) *smongo.MemBackend {
+	t.Helper()
+
+	now := time.Now()
+	mem := smongo.NewMemBackend()
+	err := Seed(
+		context.Background(),
+		mem,
+		[]Customer{
+			{ID: "c1", Name: "one"},
+			{ID: "c2", Name: "two"},
+			{ID: "c3", Name: "three", Banned: true},
+		},
+		[]Account{
+			{Number: "a1", OwnerID: "c1", Balance: 100},
+			{Number: "a2", OwnerID: "c2", Balance: 0},
+			{Number: "a3", OwnerID: "c3", Balance: 50},
+		},
+		[]Payout{
+			{ID: "p1", From: "a1", To: "a2", Amount: 40, T: now.Unix()},
+			{ID: "p2", From: "a1", To: "a9", Amount: 10, T: now.Unix()},
+			{ID: "p3", From: "a3", To: "a2", Amount: 10, T: now.Unix()},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mem
+}
+
+func findAll[T any](t *testing.T, mem *smongo.MemBackend, coll string, key func(T) string) map[string]T {
+	t.Helper()
+
+	var docs []T
+	err := mem.Find(context.Background(), coll, bson.M{}, &docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byKey := make(map[string]T)
+	for i := range docs {
+		byKey[key(docs[i])] = docs[i]
+	}
+
+	return byKey
+}
+
+func TestJobMem(t *testing.T) {
+	ctx := context.Background()
+	mem := seedMem(t)
+	deadLetters := sfile.NewDeadLetterFile(filepath.Join(t.TempDir(), "dead_letters.json"))
+
+	report, err := satch.StartReport(ctx, New(), NewDSBackend(mem), satch.Config{
+		MaxFailureRatio: 0.5,
+		DeadLetters:     deadLetters,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, ok := report.Get(satch.ReportKeyRecords)
+	if !ok {
+		t.Fatal("no records in report")
+	}
+
+	if r := records.(*satch.RecordReport); r.Total != 3 || len(r.Rejected) != 1 || r.Rejected[0].Key != "p2" {
+		t.Fatalf("unexpected records %+v", r)
+	}
+
+	accounts := findAll(t, mem, CollectionAccounts, func(acc Account) string { return acc.Number })
+	switch {
+	case accounts["a1"].Balance != 60 || accounts["a2"].Balance != 40:
+		t.Fatalf("unexpected balances after transfer: %+v", accounts)
+
+	case !accounts["a3"].Suspended || accounts["a3"].Balance != 50:
+		t.Fatalf("expecting account of banned customer to be suspended: %+v", accounts["a3"])
+	}
+
+	payouts := findAll(t, mem, CollectionPayouts, func(p Payout) string { return p.ID })
+	switch {
+	case !payouts["p1"].Settled:
+		t.Fatalf("expecting p1 settled: %+v", payouts["p1"])
+
+	case payouts["p2"].Settled || payouts["p2"].Canceled:
+		t.Fatalf("expecting rejected p2 unchanged: %+v", payouts["p2"])
+
+	case !payouts["p3"].Canceled:
+		t.Fatalf("expecting p3 canceled: %+v", payouts["p3"])
+	}
+
+	letters, err := deadLetters.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(letters) != 1 || letters[0].Key != "p2" {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+}
+
+func TestJobMemFloatBalances(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	mem := smongo.NewMemBackend()
+
+	// Credits applied one by one with $inc add up to 1,
+	// while 0.1 + (0.2 + 0.7) is 0.9999999999999999
+	err := Seed(
+		ctx,
+		mem,
+		[]Customer{{ID: "c1"}, {ID: "c2"}},
+		[]Account{
+			{Number: "a1", OwnerID: "c1", Balance: 0.1},
+			{Number: "a2", OwnerID: "c2", Balance: 10},
+		},
+		[]Payout{
+			{ID: "p1", From: "a2", To: "a1", Amount: 0.2, T: now},
+			{ID: "p2", From: "a2", To: "a1", Amount: 0.7, T: now},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = satch.Start(ctx, New(), NewDSBackend(mem), satch.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts := findAll(t, mem, CollectionAccounts, func(acc Account) string { return acc.Number })
+	if math.Abs(accounts["a1"].Balance-1) > transferTolerance {
+		t.Fatalf("unexpected balance %v", accounts["a1"].Balance)
+	}
+}
+
+func TestReprocessMem(t *testing.T) {
+	ctx := context.Background()
+	mem := seedMem(t)
+	conf := satch.Config{
+		MaxFailureRatio: 1,
+		DeadLetters:     sfile.NewDeadLetterFile(filepath.Join(t.TempDir(), "dead_letters.json")),
+	}
+
+	err := satch.Start(ctx, New(), NewDSBackend(mem), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// p2 is still rejected
+	_, err = satch.Reprocess(ctx, New(), NewDSBackend(mem), conf, ReprocessInputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	letters, err := conf.DeadLetters.List(ctx)
+	if err != nil || len(letters) != 1 || letters[0].Key != "p2" {
+		t.Fatalf("unexpected dead letters %+v, %v", letters, err)
+	}
+
+	// p2 is settled once its account exists
+	_, err = mem.BulkWrite(ctx, smongo.WritePlan{}.Then(CollectionAccounts, inserts([]Account{{Number: "a9", OwnerID: "c1"}})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := satch.Reprocess(ctx, New(), NewDSBackend(mem), conf, ReprocessInputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, ok := report.Get(satch.ReportKeyRecords)
+	if !ok || records.(*satch.RecordReport).Total != 1 {
+		t.Fatalf("expecting only p2 reprocessed, got %+v", records)
+	}
+
+	letters, err = conf.DeadLetters.List(ctx)
+	if err != nil || len(letters) != 0 {
+		t.Fatalf("expecting no dead letters, got %+v, %v", letters, err)
+	}
+
+	accounts := findAll(t, mem, CollectionAccounts, func(acc Account) string { return acc.Number })
+	payouts := findAll(t, mem, CollectionPayouts, func(p Payout) string { return p.ID })
+	switch {
+	case !payouts["p2"].Settled:
+		t.Fatalf("expecting p2 settled: %+v", payouts["p2"])
+
+	case accounts["a1"].Balance != 50 || accounts["a9"].Balance != 10:
+		t.Fatalf("unexpected balances after reprocess: %+v", accounts)
+	}
+}
@@ -0,0 +1,36 @@
+package payout
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/soyart/satch/datasource/smongo"
+)
+
+// Seed inserts customers, accounts and payouts in a single write plan,
+// e.g. to load mock data into a new database or smongo.MemBackend
+func Seed(
+	ctx context.Context,
+	backend smongo.Backend,
+	customers []Customer,
+	accounts []Account,
+	payouts []Payout,
+) error {
+	_, err := backend.BulkWrite(ctx, smongo.WritePlan{}.
+		ThenUnordered(CollectionCustomers, inserts(customers)).
+		ThenUnordered(CollectionAccounts, inserts(accounts)).
+		ThenUnordered(CollectionPayouts, inserts(payouts)),
+	)
+
+	return err
+}
+
+func inserts[T any](docs []T) []mongo.WriteModel {
+	writes := make([]mongo.WriteModel, len(docs))
+	for i := range docs {
+		writes[i] = mongo.NewInsertOneModel().SetDocument(docs[i])
+	}
+
+	return writes
+}
@@ -0,0 +1,24 @@
+package satch
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrLocked is returned by locks held by another owner
+	ErrLocked = errors.New("locked by another owner")
+
+	// ErrLockLost is returned when a held lock expired or was taken by another owner
+	ErrLockLost = errors.New("lock lost")
+)
+
+// Locker is a lock taking a mode, e.g. smongo.CollLock, ssql.RowLock or sredis.Lock.
+// Use LocksFrom to lock a Composite with it.
+type Locker interface {
+	// Lock takes the lock, failing with ErrLocked if it is held by others.
+	// mode is recorded for debugging only.
+	Lock(ctx context.Context, mode string) error
+	Unlock(ctx context.Context) error
+}
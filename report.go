@@ -0,0 +1,78 @@
+package satch
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Report describes a run of a satch job.
+// Data sources and jobs can record values in it with Record.
+type Report struct {
+	JobID string
+	Start time.Time
+	End   time.Time
+
+	mut    sync.Mutex
+	values map[string]interface{}
+}
+
+type reportKey struct{}
+
+func NewReport(jobID string) *Report {
+	return &Report{
+		JobID:  jobID,
+		Start:  time.Now(),
+		values: make(map[string]interface{}),
+	}
+}
+
+// WithReport returns ctx carrying report, for Record to record to
+func WithReport(ctx context.Context, report *Report) context.Context {
+	return context.WithValue(ctx, reportKey{}, report)
+}
+
+// ReportFrom returns the report in ctx, or nil if there is none
+func ReportFrom(ctx context.Context) *Report {
+	report, _ := ctx.Value(reportKey{}).(*Report)
+	return report
+}
+
+// Record sets key to value in the report carried by ctx.
+// It does nothing if ctx carries no report.
+func Record(ctx context.Context, key string, value interface{}) {
+	report := ReportFrom(ctx)
+	if report == nil {
+		return
+	}
+
+	report.Set(key, value)
+}
+
+func (r *Report) Set(key string, value interface{}) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.values[key] = value
+}
+
+func (r *Report) Get(key string) (interface{}, bool) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	value, ok := r.values[key]
+	return value, ok
+}
+
+// Values returns a copy of all recorded values
+func (r *Report) Values() map[string]interface{} {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	values := make(map[string]interface{}, len(r.values))
+	for k, v := range r.values {
+		values[k] = v
+	}
+
+	return values
+}
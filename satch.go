@@ -12,6 +12,17 @@ import (
 type Config struct {
 	LockWrite bool `json:"lockWrite"`
 	LockRead  bool `json:"lockRead"`
+
+	// MaxFailureRatio is the ratio of records a run may Reject and still commit.
+	// The default 0 fails the run on any rejection.
+	MaxFailureRatio float64 `json:"maxFailureRatio"`
+
+	// DeadLetters receives rejected records after a successful commit
+	DeadLetters DeadLetterStore `json:"-"`
+
+	// Invariants are checked on job outputs before commit.
+	// If any fails, nothing is committed. See also Validatable.
+	Invariants []Invariant `json:"-"`
 }
 
 type DataSource interface {
@@ -22,6 +33,12 @@ type DataSource interface {
 	Commit(ctx context.Context, data interface{}) error // Commit writes
 }
 
+// Unlocker is implemented by data sources whose locks should be released
+// when Start returns. Data sources without Unlocker must release locks themselves.
+type Unlocker interface {
+	Unlock(context.Context) error
+}
+
 type Job interface {
 	// Job ID for debugging only
 	ID() string
@@ -34,32 +51,41 @@ type Job interface {
 
 // Start starts a satch job. It aborts whenever an error surfaces.
 func Start(ctx context.Context, job Job, ds DataSource, conf Config) error {
+	_, err := StartReport(ctx, job, ds, conf)
+	return err
+}
+
+// StartReport is Start, but also returns the run report.
+// The report is returned even when the run fails, unless job or ds is nil.
+func StartReport(ctx context.Context, job Job, ds DataSource, conf Config) (*Report, error) {
 	switch {
 	case job == nil:
-		return errors.New("job is nil")
+		return nil, errors.New("job is nil")
 
 	case ds == nil:
-		return errors.New("ds is nil")
+		return nil, errors.New("ds is nil")
 	}
 
+	report := NewReport(job.ID())
+	ctx = WithReport(ctx, report)
+
+	err := run(ctx, job, ds, conf)
+	report.End = time.Now()
+
+	return report, err
+}
+
+func run(ctx context.Context, job Job, ds DataSource, conf Config) error {
 	id := job.ID()
 	logrus.Info("Starting job", id)
 
-	switch {
-	case conf.LockRead && conf.LockWrite:
-		return fmt.Errorf("unexpected config.LockRead and config.LockWrite for job %s", id)
-
-	case conf.LockRead:
-		err := ds.LockRead(ctx)
-		if err != nil {
-			return errors.Wrapf(err, "failed to lock write for job %s", id)
-		}
+	locked, err := lock(ctx, ds, conf, id)
+	if err != nil {
+		return err
+	}
 
-	case conf.LockWrite:
-		err := ds.LockWrite(ctx)
-		if err != nil {
-			return errors.Wrapf(err, "failed to lock write for job %s", id)
-		}
+	if locked {
+		defer unlock(ds, id)
 	}
 
 	start := time.Now()
@@ -69,15 +95,72 @@ func Start(ctx context.Context, job Job, ds DataSource, conf Config) error {
 		return errors.Wrapf(err, "failed to get inputs for job %s", job.ID())
 	}
 
+	ctx, recs := withRecords(ctx, id)
+
 	results, err := job.Run(ctx, inputs, start)
 	if err != nil {
 		return errors.Wrapf(err, "failed to run job %s", job.ID())
 	}
 
+	err = recs.check(conf)
+	if err != nil {
+		Record(ctx, ReportKeyRecords, recs.report())
+		return errors.Wrapf(err, "failed to run job %s", job.ID())
+	}
+
+	err = validate(ctx, conf, results)
+	if err != nil {
+		Record(ctx, ReportKeyRecords, recs.report())
+		return errors.Wrapf(err, "invalid results from job %s", job.ID())
+	}
+
 	err = ds.Commit(ctx, results)
 	if err != nil {
 		return errors.Wrapf(err, "failed to commit results from job %s", job.ID())
 	}
 
+	// Failures are recorded in the report, as the run has committed
+	recs.deadLetter(ctx, conf)
+
 	return nil
 }
+
+// lock locks ds as configured, and returns whether ds was locked
+func lock(ctx context.Context, ds DataSource, conf Config, id string) (bool, error) {
+	switch {
+	case conf.LockRead && conf.LockWrite:
+		return false, fmt.Errorf("unexpected config.LockRead and config.LockWrite for job %s", id)
+
+	case conf.LockRead:
+		err := ds.LockRead(ctx)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to lock read for job %s", id)
+		}
+
+		return true, nil
+
+	case conf.LockWrite:
+		err := ds.LockWrite(ctx)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to lock write for job %s", id)
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// unlock releases ds locks if ds is an Unlocker.
+// It uses a fresh context, so that locks are released even if the job's ctx is canceled.
+func unlock(ds DataSource, id string) {
+	unlocker, ok := ds.(Unlocker)
+	if !ok {
+		return
+	}
+
+	err := unlocker.Unlock(context.Background())
+	if err != nil {
+		logrus.Errorf("failed to unlock data source for job %s: %s", id, err.Error())
+	}
+}
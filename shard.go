@@ -0,0 +1,328 @@
+package satch
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const ReportKeyShards = "satch.shards"
+
+// ShardedDataSource is a DataSource whose inputs can be split into shards.
+// Each shard is run and committed separately, so Commit must accept
+// the outputs of a single shard. Use ShardFrom in Commit to tell shards apart.
+type ShardedDataSource interface {
+	DataSource
+
+	// Partition splits inputs into exactly shards partitions, e.g. with PartitionBy
+	Partition(ctx context.Context, inputs interface{}, shards int) ([]interface{}, error)
+}
+
+// ShardPolicy decides what happens to other shards when a shard fails
+type ShardPolicy int
+
+const (
+	// ShardContinue runs every shard regardless of failures
+	ShardContinue ShardPolicy = iota
+
+	// ShardAbort cancels running shards and skips pending ones after the first failure.
+	// Shards already committed stay committed.
+	ShardAbort
+)
+
+type ShardConfig struct {
+	Config // Locks are taken once for all shards
+
+	Shards  int // Number of partitions, must be positive
+	Workers int // Shards run concurrently, defaults to min(Shards, GOMAXPROCS)
+	Policy  ShardPolicy
+}
+
+// ShardResult is the outcome of a shard
+type ShardResult struct {
+	Shard     int
+	Committed bool
+	Skipped   bool   // Not run because of ShardAbort
+	Stage     string // "run", "validate" or "commit" if failed
+	Err       error
+	Start     time.Time
+	End       time.Time
+}
+
+// ShardReport is the outcome of a sharded run,
+// recorded in the satch report as ReportKeyShards
+type ShardReport struct {
+	Policy  ShardPolicy
+	Results []ShardResult
+}
+
+func (r *ShardReport) Failed() []ShardResult {
+	failed := []ShardResult{}
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+
+	return failed
+}
+
+func (r *ShardReport) Committed() int {
+	n := 0
+	for _, result := range r.Results {
+		if result.Committed {
+			n++
+		}
+	}
+
+	return n
+}
+
+// ShardError is returned by StartSharded when any shard fails
+type ShardError struct {
+	Report *ShardReport
+
+	// DeadLetterErr is set if rejections of committed shards could not be dead-lettered
+	DeadLetterErr error
+}
+
+func (e *ShardError) Error() string {
+	msgs := []string{}
+	for _, result := range e.Report.Failed() {
+		msgs = append(msgs, fmt.Sprintf("shard %d (%s): %s", result.Shard, result.Stage, result.Err.Error()))
+	}
+
+	msg := fmt.Sprintf("%d of %d shard(s) failed: %s", len(msgs), len(e.Report.Results), strings.Join(msgs, "; "))
+	if e.DeadLetterErr != nil {
+		msg += "; " + e.DeadLetterErr.Error()
+	}
+
+	return msg
+}
+
+func (e *ShardError) Unwrap() error {
+	return e.DeadLetterErr
+}
+
+type shardKey struct{}
+
+type shardInfo struct {
+	shard  int
+	shards int
+}
+
+// ShardFrom returns the shard being run or committed in ctx, and the number of shards.
+// ok is false outside of StartSharded.
+func ShardFrom(ctx context.Context) (shard int, shards int, ok bool) {
+	info, ok := ctx.Value(shardKey{}).(shardInfo)
+	return info.shard, info.shards, ok
+}
+
+// StartSharded is StartReport, but runs and commits each shard of the inputs separately.
+// Inputs are read once, partitioned with ds.Partition, and the shards are run
+// by a bounded worker pool. Each shard's outputs are committed as soon as it finishes.
+// Config.MaxFailureRatio and Config.Invariants apply to each shard, and rejected records of committed shards
+// are dead-lettered once all shards are done.
+//
+// It returns ShardError if any shard fails. The report is returned even when the run fails,
+// unless job or ds is nil.
+func StartSharded(ctx context.Context, job Job, ds ShardedDataSource, conf ShardConfig) (*Report, error) {
+	switch {
+	case job == nil:
+		return nil, errors.New("job is nil")
+
+	case ds == nil:
+		return nil, errors.New("ds is nil")
+	}
+
+	report := NewReport(job.ID())
+	ctx = WithReport(ctx, report)
+
+	err := runSharded(ctx, job, ds, conf)
+	report.End = time.Now()
+
+	return report, err
+}
+
+func runSharded(ctx context.Context, job Job, ds ShardedDataSource, conf ShardConfig) error {
+	id := job.ID()
+	logrus.Infof("Starting job %s with %d shards", id, conf.Shards)
+
+	if conf.Shards <= 0 {
+		return fmt.Errorf("unexpected config.Shards %d for job %s", conf.Shards, id)
+	}
+
+	workers := conf.Workers
+	if workers <= 0 {
+		workers = min(conf.Shards, runtime.GOMAXPROCS(0))
+	}
+
+	locked, err := lock(ctx, ds, conf.Config, id)
+	if err != nil {
+		return err
+	}
+
+	if locked {
+		defer unlock(ds, id)
+	}
+
+	start := time.Now()
+
+	inputs, err := ds.Inputs(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get inputs for job %s", id)
+	}
+
+	partitions, err := ds.Partition(ctx, inputs, conf.Shards)
+	if err != nil {
+		return errors.Wrapf(err, "failed to partition inputs for job %s", id)
+	}
+
+	if len(partitions) != conf.Shards {
+		return fmt.Errorf("expecting %d partitions for job %s, got %d", conf.Shards, id, len(partitions))
+	}
+
+	report := &ShardReport{Policy: conf.Policy, Results: make([]ShardResult, conf.Shards)}
+
+	// ctx is cancelled on the first failure with ShardAbort
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Rejections of committed shards
+	ctx, recs := withRecords(ctx, id)
+
+	shards := make(chan int)
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for shard := range shards {
+				result := &report.Results[shard]
+				result.Shard = shard
+
+				if ctx.Err() != nil {
+					result.Skipped = true
+					continue
+				}
+
+				runShard(ctx, job, ds, conf.Config, partitions[shard], start, shard, conf.Shards, recs, result)
+
+				if result.Err != nil && conf.Policy == ShardAbort {
+					cancel()
+				}
+			}
+		}()
+	}
+
+	for shard := 0; shard < conf.Shards; shard++ {
+		shards <- shard
+	}
+
+	close(shards)
+	wg.Wait()
+
+	Record(ctx, ReportKeyShards, report)
+
+	// Committed shards must be dead-lettered even if the run was aborted.
+	// Failures are recorded in the report, and only returned if the run failed anyway.
+	err = recs.deadLetter(context.WithoutCancel(parent), conf.Config)
+
+	if len(report.Failed()) > 0 {
+		return &ShardError{Report: report, DeadLetterErr: err}
+	}
+
+	return nil
+}
+
+func runShard(
+	ctx context.Context,
+	job Job,
+	ds DataSource,
+	conf Config,
+	inputs interface{},
+	now time.Time,
+	shard int,
+	shards int,
+	recs *records,
+	result *ShardResult,
+) {
+	ctx = context.WithValue(ctx, shardKey{}, shardInfo{shard: shard, shards: shards})
+
+	// The failure ratio applies to each shard, as shards commit separately
+	ctx, shardRecs := withRecords(ctx, job.ID())
+	result.Start = time.Now()
+
+	defer func() {
+		result.End = time.Now()
+
+		if result.Err != nil {
+			logrus.Errorf("shard %d of job %s failed to %s: %s", shard, job.ID(), result.Stage, result.Err.Error())
+		}
+	}()
+
+	outputs, err := job.Run(ctx, inputs, now)
+	if err == nil {
+		err = shardRecs.check(conf)
+	}
+
+	if err != nil {
+		result.Stage, result.Err = "run", err
+		return
+	}
+
+	err = validate(ctx, conf, outputs)
+	if err != nil {
+		result.Stage, result.Err = "validate", err
+		return
+	}
+
+	err = ds.Commit(ctx, outputs)
+	if err != nil {
+		result.Stage, result.Err = "commit", err
+		return
+	}
+
+	result.Committed = true
+	recs.merge(shardRecs)
+}
+
+// ShardOf returns the shard of key, in [0, shards)
+func ShardOf(key string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return int(h.Sum32() % uint32(shards))
+}
+
+// PartitionBy splits items into shards partitions by ShardOf(key(item)).
+// Each partition is a []T, so that PartitionBy can be returned from Partition directly.
+func PartitionBy[T any](items []T, shards int, key func(T) string) []interface{} {
+	parts := make([][]T, shards)
+	for i := range items {
+		shard := ShardOf(key(items[i]), shards)
+		parts[shard] = append(parts[shard], items[i])
+	}
+
+	partitions := make([]interface{}, shards)
+	for i := range parts {
+		if parts[i] == nil {
+			parts[i] = []T{}
+		}
+
+		partitions[i] = parts[i]
+	}
+
+	return partitions
+}
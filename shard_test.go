@@ -0,0 +1,215 @@
+package satch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// shardedDataSource has [][]int inputs, one slice per shard,
+// and records committed outputs by shard
+type shardedDataSource struct {
+	inputs [][]int
+
+	mut       sync.Mutex
+	committed map[int][]int
+}
+
+func (d *shardedDataSource) LockWrite(context.Context) error { return nil }
+func (d *shardedDataSource) LockRead(context.Context) error  { return nil }
+
+func (d *shardedDataSource) Inputs(context.Context) (interface{}, error) {
+	return d.inputs, nil
+}
+
+func (d *shardedDataSource) Partition(_ context.Context, inputs interface{}, shards int) ([]interface{}, error) {
+	partitions := []interface{}{}
+	for _, part := range inputs.([][]int) {
+		partitions = append(partitions, part)
+	}
+
+	return partitions, nil
+}
+
+func (d *shardedDataSource) Commit(ctx context.Context, outputs interface{}) error {
+	shard, _, ok := ShardFrom(ctx)
+	if !ok {
+		return errors.New("commit outside of a shard")
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if d.committed == nil {
+		d.committed = make(map[int][]int)
+	}
+
+	d.committed[shard] = outputs.([]int)
+	return nil
+}
+
+func shardResults(report *Report) string {
+	v, ok := report.Get(ReportKeyShards)
+	if !ok {
+		return "no shard report"
+	}
+
+	results := ""
+	for _, r := range v.(*ShardReport).Results {
+		results += fmt.Sprintf("%d:committed=%v,skipped=%v,stage=%s ", r.Shard, r.Committed, r.Skipped, r.Stage)
+	}
+
+	return results
+}
+
+func TestStartShardedContinue(t *testing.T) {
+	ctx := context.Background()
+	ds := &shardedDataSource{inputs: [][]int{{1, -1}, {2, 99}, {3, -3}}}
+	letters := &testDeadLetters{}
+
+	report, err := StartSharded(ctx, rejectJob{}, ds, ShardConfig{
+		Config: Config{MaxFailureRatio: 0.5, DeadLetters: letters},
+		Shards: 3,
+		Policy: ShardContinue,
+	})
+
+	shardErr := &ShardError{}
+	if !errors.As(err, &shardErr) {
+		t.Fatalf("expecting ShardError, got %v", err)
+	}
+	if shardErr.DeadLetterErr != nil {
+		t.Fatalf("unexpected dead letter error %v", shardErr.DeadLetterErr)
+	}
+
+	expected := "0:committed=true,skipped=false,stage= 1:committed=false,skipped=false,stage=run 2:committed=true,skipped=false,stage= "
+	if results := shardResults(report); results != expected {
+		t.Fatalf("unexpected shard results %s", results)
+	}
+
+	if !reflect.DeepEqual(ds.committed, map[int][]int{0: {1}, 2: {3}}) {
+		t.Fatalf("unexpected commits %v", ds.committed)
+	}
+
+	// Rejections of the failed shard are not dead-lettered
+	if keys := letters.keys(); !reflect.DeepEqual(keys, []string{"-1", "-3"}) {
+		t.Fatalf("unexpected dead letters %v", keys)
+	}
+}
+
+func TestStartShardedAbort(t *testing.T) {
+	ctx := context.Background()
+	ds := &shardedDataSource{inputs: [][]int{{1, -1}, {2, 99}, {3, -3}}}
+	letters := &testDeadLetters{}
+
+	report, err := StartSharded(ctx, rejectJob{}, ds, ShardConfig{
+		Config:  Config{MaxFailureRatio: 0.5, DeadLetters: letters},
+		Shards:  3,
+		Workers: 1,
+		Policy:  ShardAbort,
+	})
+
+	shardErr := &ShardError{}
+	if !errors.As(err, &shardErr) {
+		t.Fatalf("expecting ShardError, got %v", err)
+	}
+	if shardErr.DeadLetterErr != nil {
+		t.Fatalf("unexpected dead letter error %v", shardErr.DeadLetterErr)
+	}
+
+	expected := "0:committed=true,skipped=false,stage= 1:committed=false,skipped=false,stage=run 2:committed=false,skipped=true,stage= "
+	if results := shardResults(report); results != expected {
+		t.Fatalf("unexpected shard results %s", results)
+	}
+
+	if !reflect.DeepEqual(ds.committed, map[int][]int{0: {1}}) {
+		t.Fatalf("unexpected commits %v", ds.committed)
+	}
+
+	// The committed shard is dead-lettered although the run was aborted
+	if keys := letters.keys(); !reflect.DeepEqual(keys, []string{"-1"}) {
+		t.Fatalf("unexpected dead letters %v", keys)
+	}
+}
+
+func TestStartShardedDeadLetterErr(t *testing.T) {
+	ctx := context.Background()
+	errStore := errors.New("store unavailable")
+
+	t.Run("failed shards", func(t *testing.T) {
+		ds := &shardedDataSource{inputs: [][]int{{1, -1}, {99}}}
+
+		_, err := StartSharded(ctx, rejectJob{}, ds, ShardConfig{
+			Config:  Config{MaxFailureRatio: 0.5, DeadLetters: &testDeadLetters{err: errStore}},
+			Shards:  2,
+			Workers: 1,
+			Policy:  ShardAbort,
+		})
+
+		shardErr := &ShardError{}
+		if !errors.As(err, &shardErr) {
+			t.Fatalf("expecting ShardError, got %v", err)
+		}
+		if !errors.Is(err, errStore) {
+			t.Fatalf("expecting dead letter error, got %v", err)
+		}
+	})
+
+	// The run has committed, so the error is only recorded
+	t.Run("committed shards", func(t *testing.T) {
+		ds := &shardedDataSource{inputs: [][]int{{1, -1}, {2}}}
+
+		report, err := StartSharded(ctx, rejectJob{}, ds, ShardConfig{
+			Config: Config{MaxFailureRatio: 0.5, DeadLetters: &testDeadLetters{err: errStore}},
+			Shards: 2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records, ok := report.Get(ReportKeyRecords)
+		if !ok || !errors.Is(records.(*RecordReport).DeadLetterErr, errStore) {
+			t.Fatalf("expecting dead letter error in report, got %+v", records)
+		}
+	})
+}
+
+func TestPartitionBy(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "a"}
+	shards := 3
+
+	partitions := PartitionBy(keys, shards, func(key string) string { return key })
+	if len(partitions) != shards {
+		t.Fatalf("expecting %d partitions, got %d", shards, len(partitions))
+	}
+
+	n := 0
+	for shard, partition := range partitions {
+		part, ok := partition.([]string)
+		if !ok || part == nil {
+			t.Fatalf("unexpected partition %d: %#v", shard, partition)
+		}
+
+		for _, key := range part {
+			if ShardOf(key, shards) != shard {
+				t.Fatalf("key %s in shard %d, expecting %d", key, shard, ShardOf(key, shards))
+			}
+		}
+
+		n += len(part)
+	}
+
+	if n != len(keys) {
+		t.Fatalf("expecting %d items, got %d", len(keys), n)
+	}
+
+	// Empty partitions are empty slices, not nil
+	partitions = PartitionBy([]string{}, 2, func(key string) string { return key })
+	for shard, partition := range partitions {
+		if part := partition.([]string); part == nil || len(part) != 0 {
+			t.Fatalf("unexpected partition %d: %#v", shard, partition)
+		}
+	}
+}
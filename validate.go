@@ -0,0 +1,146 @@
+package satch
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const ReportKeyValidation = "satch.validation"
+
+// Invariant is a check on job outputs before they are committed.
+// Check returns a non-nil error describing the violation if the invariant does not hold.
+type Invariant struct {
+	Name  string
+	Check func(ctx context.Context, outputs interface{}) error
+}
+
+// InvariantOf returns an Invariant whose check receives outputs as T.
+// Outputs of other types violate the invariant.
+func InvariantOf[T any](name string, check func(ctx context.Context, outputs T) error) Invariant {
+	return Invariant{
+		Name: name,
+		Check: func(ctx context.Context, outputs interface{}) error {
+			t, ok := outputs.(T)
+			if !ok {
+				return fmt.Errorf("unexpected outputs type: '%s'", reflect.TypeOf(outputs))
+			}
+
+			return check(ctx, t)
+		},
+	}
+}
+
+// Validatable is implemented by job outputs that know their invariants.
+// They are checked after Config.Invariants.
+type Validatable interface {
+	Invariants() []Invariant
+}
+
+type ValidationResult struct {
+	Name   string
+	OK     bool
+	Reason string
+}
+
+// ValidationReport is the outcome of Validate,
+// recorded in the satch report as ReportKeyValidation
+type ValidationReport struct {
+	Results []ValidationResult
+}
+
+// OK reports whether all invariants hold
+func (r *ValidationReport) OK() bool {
+	return len(r.Failures()) == 0
+}
+
+func (r *ValidationReport) Failures() []ValidationResult {
+	failures := []ValidationResult{}
+	for i := range r.Results {
+		if !r.Results[i].OK {
+			failures = append(failures, r.Results[i])
+		}
+	}
+
+	return failures
+}
+
+// ValidationError is returned by Validate when invariants do not hold
+type ValidationError struct {
+	Report *ValidationReport
+}
+
+func (e *ValidationError) Error() string {
+	failures := e.Report.Failures()
+	reasons := make([]string, len(failures))
+	for i := range failures {
+		reasons[i] = fmt.Sprintf("%s: %s", failures[i].Name, failures[i].Reason)
+	}
+
+	return fmt.Sprintf("%d of %d invariants failed: %s", len(failures), len(e.Report.Results), strings.Join(reasons, "; "))
+}
+
+// Validate checks every invariant on outputs, without stopping at the first failure.
+// If any invariant fails, it logs the failures and returns *ValidationError with the full report.
+// The report is also recorded in the satch report as ReportKeyValidation.
+func Validate(ctx context.Context, outputs interface{}, invariants ...Invariant) (*ValidationReport, error) {
+	report := &ValidationReport{Results: make([]ValidationResult, len(invariants))}
+	for i := range invariants {
+		report.Results[i] = check(ctx, outputs, &invariants[i])
+	}
+
+	Record(ctx, ReportKeyValidation, report)
+
+	if !report.OK() {
+		err := &ValidationError{Report: report}
+		logrus.Errorf("validate: %s", err.Error())
+		return report, err
+	}
+
+	return report, nil
+}
+
+// check runs inv on outputs. Panics in checks are failures, so that outputs are never committed unchecked.
+func check(ctx context.Context, outputs interface{}, inv *Invariant) (result ValidationResult) {
+	result.Name = inv.Name
+
+	if inv.Check == nil {
+		result.Reason = "check is nil"
+		return result
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			result.OK = false
+			result.Reason = fmt.Sprintf("panic: %v", r)
+		}
+	}()
+
+	err := inv.Check(ctx, outputs)
+	if err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+
+	result.OK = true
+	return result
+}
+
+// validate checks conf.Invariants and invariants of Validatable outputs.
+// It does nothing if there are no invariants.
+func validate(ctx context.Context, conf Config, outputs interface{}) error {
+	invariants := append([]Invariant{}, conf.Invariants...)
+	if validatable, ok := outputs.(Validatable); ok {
+		invariants = append(invariants, validatable.Invariants()...)
+	}
+
+	if len(invariants) == 0 {
+		return nil
+	}
+
+	_, err := Validate(ctx, outputs, invariants...)
+	return err
+}
@@ -0,0 +1,167 @@
+package satch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// boundedInts are outputs checking that no value exceeds max
+type boundedInts struct {
+	values []int
+	max    int
+}
+
+func (b boundedInts) Invariants() []Invariant {
+	return []Invariant{
+		InvariantOf("bounded", func(_ context.Context, outputs boundedInts) error {
+			for _, n := range outputs.values {
+				if n > outputs.max {
+					return fmt.Errorf("%d exceeds %d", n, outputs.max)
+				}
+			}
+
+			return nil
+		}),
+	}
+}
+
+// boundedJob outputs its []int inputs as boundedInts
+type boundedJob struct{ max int }
+
+func (boundedJob) ID() string { return "bounded" }
+
+func (j boundedJob) Run(_ context.Context, inputs interface{}, _ time.Time) (interface{}, error) {
+	return boundedInts{values: inputs.([]int), max: j.max}, nil
+}
+
+// validationResults returns the validation results recorded in report
+func validationResults(t *testing.T, report *Report) []ValidationResult {
+	t.Helper()
+
+	v, ok := report.Get(ReportKeyValidation)
+	if !ok {
+		t.Fatal("no validation report")
+	}
+
+	return v.(*ValidationReport).Results
+}
+
+func TestStartInvariant(t *testing.T) {
+	ctx := context.Background()
+	atMostTwo := InvariantOf("at most 2 outputs", func(_ context.Context, outputs []int) error {
+		if len(outputs) > 2 {
+			return fmt.Errorf("got %d outputs", len(outputs))
+		}
+
+		return nil
+	})
+
+	ds := &testDataSource{inputs: []int{1, 2, 3}}
+	report, err := StartReport(ctx, rejectJob{}, ds, Config{Invariants: []Invariant{atMostTwo}})
+
+	validationErr := &ValidationError{}
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expecting ValidationError, got %v", err)
+	}
+
+	if len(ds.committed) != 0 {
+		t.Fatalf("expecting nothing committed, got %v", ds.committed)
+	}
+
+	results := validationResults(t, report)
+	if len(results) != 1 || results[0].OK || results[0].Reason != "got 3 outputs" {
+		t.Fatalf("unexpected validation results %+v", results)
+	}
+
+	// Rejected records do not count as outputs
+	ds = &testDataSource{inputs: []int{1, -2, 3}}
+	err = Start(ctx, rejectJob{}, ds, Config{MaxFailureRatio: 0.5, Invariants: []Invariant{atMostTwo}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ds.committed, []interface{}{[]int{1, 3}}) {
+		t.Fatalf("unexpected commits %v", ds.committed)
+	}
+}
+
+func TestStartValidatable(t *testing.T) {
+	ctx := context.Background()
+	ds := &testDataSource{inputs: []int{1, 5, 2}}
+	nonEmpty := InvariantOf("non-empty", func(_ context.Context, outputs boundedInts) error {
+		if len(outputs.values) == 0 {
+			return errors.New("no outputs")
+		}
+
+		return nil
+	})
+
+	report, err := StartReport(ctx, boundedJob{max: 3}, ds, Config{Invariants: []Invariant{nonEmpty}})
+
+	validationErr := &ValidationError{}
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expecting ValidationError, got %v", err)
+	}
+
+	if len(ds.committed) != 0 {
+		t.Fatalf("expecting nothing committed, got %v", ds.committed)
+	}
+
+	// Invariants of outputs are checked after Config.Invariants
+	expected := []ValidationResult{
+		{Name: "non-empty", OK: true},
+		{Name: "bounded", Reason: "5 exceeds 3"},
+	}
+	if results := validationResults(t, report); !reflect.DeepEqual(results, expected) {
+		t.Fatalf("unexpected validation results %+v", results)
+	}
+
+	err = Start(ctx, boundedJob{max: 5}, ds, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ds.committed) != 1 {
+		t.Fatalf("unexpected commits %v", ds.committed)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	report, err := Validate(ctx, "not ints",
+		InvariantOf("ints", func(context.Context, []int) error { return nil }),
+		Invariant{Name: "panics", Check: func(context.Context, interface{}) error { panic("boom") }},
+		Invariant{Name: "nil"},
+		Invariant{Name: "holds", Check: func(context.Context, interface{}) error { return nil }},
+	)
+
+	validationErr := &ValidationError{}
+	if !errors.As(err, &validationErr) || validationErr.Report != report {
+		t.Fatalf("expecting ValidationError with the report, got %v", err)
+	}
+
+	// Every invariant is checked despite earlier failures
+	expected := []ValidationResult{
+		{Name: "ints", Reason: "unexpected outputs type: 'string'"},
+		{Name: "panics", Reason: "panic: boom"},
+		{Name: "nil", Reason: "check is nil"},
+		{Name: "holds", OK: true},
+	}
+	if !reflect.DeepEqual(report.Results, expected) {
+		t.Fatalf("unexpected validation results %+v", report.Results)
+	}
+
+	if msg := err.Error(); !strings.HasPrefix(msg, "3 of 4 invariants failed") {
+		t.Fatalf("unexpected error message %s", msg)
+	}
+
+	report, err = Validate(ctx, []int{1}, InvariantOf("ints", func(context.Context, []int) error { return nil }))
+	if err != nil || !report.OK() {
+		t.Fatalf("expecting invariants to hold, got %+v, %v", report, err)
+	}
+}